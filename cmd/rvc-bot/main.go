@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"rvc/internal/bots"
+	"rvc/pkg/rvcclient"
+	"sort"
+	"strings"
+)
+
+// conversation is the current match of the bot, as seen through its events.
+type conversation struct {
+	client *rvcclient.Client
+	peerID string
+	// peer id -> username
+	peers map[string]string
+}
+
+func (c *conversation) Send(text string) error {
+	return c.client.SendMessage(text)
+}
+
+func (c *conversation) Peers() []string {
+	peers := make([]string, 0, len(c.peers))
+	for _, username := range c.peers {
+		peers = append(peers, username)
+	}
+
+	sort.Strings(peers)
+
+	return peers
+}
+
+func main() {
+	baseURL := flag.String("url", "http://localhost:8080", "user service url")
+	name := flag.String("bot", "greeter", "bot to run, one of "+strings.Join(bots.Names(), ", "))
+	key := flag.String("key", os.Getenv("BOT_API_KEY"), "bot api key of the service, BOT_API_KEY by default")
+	flag.Parse()
+
+	handler, ok := bots.New(*name)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "unknown bot "+*name)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	client := rvcclient.New(rvcclient.Config{
+		BaseURL:   strings.TrimSuffix(*baseURL, "/"),
+		Username:  handler.Name(),
+		Mode:      rvcclient.ModeText,
+		BotKey:    *key,
+		Reconnect: true,
+	})
+
+	if err := client.Connect(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "unable to connect:", err)
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	fmt.Println("connected " + handler.Name() + ", waiting to be summoned")
+
+	conv := &conversation{client: client, peers: map[string]string{}}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case event, ok := <-client.Events():
+			if !ok {
+				fmt.Println("disconnected")
+				return
+			}
+
+			switch event.Event {
+			case rvcclient.EventExchange:
+				exchange, err := event.Exchange()
+				if err != nil {
+					continue
+				}
+
+				// the bot gets a new peer id with every match
+				joined := exchange.PeerID != conv.peerID && len(exchange.Peers) > 0
+				conv.peerID = exchange.PeerID
+
+				conv.peers = map[string]string{}
+				for _, peer := range exchange.Peers {
+					conv.peers[peer.PeerID] = peer.Username
+				}
+
+				if joined {
+					fmt.Println("matched with " + strings.Join(conv.Peers(), ", "))
+					handler.Join(conv)
+				}
+
+			case rvcclient.EventRematch:
+				delete(conv.peers, event.From)
+
+			case rvcclient.EventMessage:
+				from, ok := conv.peers[event.From]
+				if !ok {
+					continue
+				}
+
+				message, err := event.Message()
+				if err != nil {
+					continue
+				}
+
+				handler.Message(conv, from, message)
+			}
+		}
+	}
+}
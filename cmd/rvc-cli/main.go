@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"rvc/pkg/rvcclient"
+	"strconv"
+	"strings"
+)
+
+const help = `commands:
+  /next              leave the partner and find a new one
+  /report <reason>   report the partner and find a new one
+  /rate <1-5> [tags] rate the last partner, tags are comma separated:
+                     great, funny, rude, inappropriate, no video, no audio, bad connection
+  /quit              leave`
+
+func main() {
+	baseURL := flag.String("url", "http://localhost:8080", "user service url")
+	username := flag.String("username", "", "username to chat as")
+	reach := flag.String("reach", rvcclient.ReachNearby, "how far away partners may be: nearby, country or anywhere")
+	flag.Parse()
+
+	if *username == "" {
+		fmt.Print("username: ")
+
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			os.Exit(1)
+		}
+
+		*username = strings.TrimSpace(line)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	client := rvcclient.New(rvcclient.Config{
+		BaseURL:  strings.TrimSuffix(*baseURL, "/"),
+		Username: *username,
+		Mode:     rvcclient.ModeText,
+		Reach:    *reach,
+	})
+
+	if err := client.Connect(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "unable to connect:", err)
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	fmt.Println("connected as " + *username + ", type /help for commands")
+
+	next(ctx, client)
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	// peer id -> username
+	partners := map[string]string{}
+	// /rate rates the last match that ended, or the current one
+	var match, lastMatch string
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+
+			line = strings.TrimSpace(line)
+
+			switch {
+			case line == "":
+			case line == "/quit":
+				return
+
+			case line == "/help":
+				fmt.Println(help)
+
+			case line == "/next":
+				if len(partners) > 0 {
+					lastMatch = match
+					fmt.Println("* how was it? /rate <1-5> [tags]")
+				}
+
+				partners = map[string]string{}
+				next(ctx, client)
+
+			case strings.HasPrefix(line, "/report"):
+				reason := strings.TrimSpace(strings.TrimPrefix(line, "/report"))
+				if reason == "" {
+					fmt.Println("usage: /report <reason>")
+					continue
+				}
+
+				if err := client.Report(ctx, "", reason); err != nil {
+					fmt.Fprintln(os.Stderr, "unable to report:", err)
+					continue
+				}
+
+				fmt.Println("* reported, finding a new partner")
+				partners = map[string]string{}
+				next(ctx, client)
+
+			case strings.HasPrefix(line, "/rate"):
+				args := strings.Fields(strings.TrimPrefix(line, "/rate"))
+
+				rating, err := 0, error(nil)
+				if len(args) > 0 {
+					rating, err = strconv.Atoi(args[0])
+				}
+
+				rated := lastMatch
+				if rated == "" {
+					rated = match
+				}
+
+				if err != nil || rating < 1 || rating > 5 || rated == "" {
+					fmt.Println("usage: /rate <1-5> [tags] once you chatted with someone")
+					continue
+				}
+
+				var tags []string
+				if len(args) > 1 {
+					for _, tag := range strings.Split(strings.Join(args[1:], " "), ",") {
+						tags = append(tags, strings.TrimSpace(tag))
+					}
+				}
+
+				if err := client.Feedback(ctx, rated, "", rating, tags...); err != nil {
+					fmt.Fprintln(os.Stderr, "unable to rate:", err)
+					continue
+				}
+
+				fmt.Println("* thanks for the feedback")
+
+			case strings.HasPrefix(line, "/"):
+				fmt.Println(help)
+
+			default:
+				if len(partners) == 0 {
+					fmt.Println("* nobody is here yet")
+					continue
+				}
+
+				if err := client.SendMessage(line); err != nil {
+					fmt.Fprintln(os.Stderr, "unable to send:", err)
+				}
+			}
+
+		case event, ok := <-client.Events():
+			if !ok {
+				fmt.Println("* disconnected")
+				return
+			}
+
+			switch event.Event {
+			case rvcclient.EventExchange:
+				exchange, err := event.Exchange()
+				if err != nil {
+					continue
+				}
+
+				present := map[string]string{}
+				for _, peer := range exchange.Peers {
+					present[peer.PeerID] = peer.Username
+
+					if _, ok := partners[peer.PeerID]; !ok && peer.Bot {
+						fmt.Println("* " + peer.Username + " joined, they are a bot")
+					} else if !ok && peer.Region != "" {
+						fmt.Println("* " + peer.Username + " joined from " + peer.Region)
+					} else if !ok {
+						fmt.Println("* " + peer.Username + " joined")
+					}
+				}
+
+				for peerID, name := range partners {
+					if _, ok := present[peerID]; !ok {
+						fmt.Println("* " + name + " left")
+					}
+				}
+
+				partners = present
+
+				if len(present) > 0 {
+					match = exchange.MatchID
+				}
+
+			case rvcclient.EventMessage:
+				message, err := event.Message()
+				if err != nil {
+					continue
+				}
+
+				name, ok := partners[event.From]
+				if !ok {
+					name = "?"
+				}
+
+				fmt.Println(name + ": " + message)
+
+			case rvcclient.EventQueueStatus:
+				status, err := event.QueueStatus()
+				if err != nil {
+					continue
+				}
+
+				line := fmt.Sprintf("* %d of %d waiting", status.Position, status.Waiting)
+				if status.EstimatedWait > 0 {
+					line += fmt.Sprintf(", about %ds", status.EstimatedWait)
+				}
+				fmt.Println(line)
+
+			case rvcclient.EventNoMatch:
+				noMatch, err := event.NoMatch()
+				if err != nil {
+					continue
+				}
+
+				fmt.Println("* no partner found (" + noMatch.Reason + "), /next to try again")
+
+			case rvcclient.EventThrottled:
+				throttled, err := event.Throttled()
+				if err != nil {
+					continue
+				}
+
+				fmt.Printf("* slow down, %s is allowed again in %ds\n", throttled.Action, throttled.RetryAfter)
+
+			case rvcclient.EventRematch:
+				if name, ok := partners[event.From]; ok {
+					fmt.Println("* " + name + " left, how was it? /rate <1-5> [tags]")
+					delete(partners, event.From)
+					lastMatch = match
+				}
+
+				if len(partners) == 0 {
+					next(ctx, client)
+				}
+			}
+		}
+	}
+}
+
+// next leaves the current partner and asks for a new one, the partner
+// arrives later as an exchange event.
+func next(ctx context.Context, client *rvcclient.Client) {
+	fmt.Println("* looking for a partner")
+
+	if _, err := client.Match(ctx, 2); err != nil && ctx.Err() == nil {
+		fmt.Fprintln(os.Stderr, "unable to find a partner:", err)
+	}
+}
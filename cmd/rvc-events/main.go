@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"rvc/internal/common"
+	"rvc/internal/events"
+)
+
+// Exports the analytics event stream as NDJSON, for loading into whatever
+// the analytics team queries.
+func main() {
+	redisURI := flag.String("redis", os.Getenv("REDIS_URI"), "redis url, REDIS_URI by default")
+	stream := flag.String("stream", "events", "stream the services write to, their EVENTS_STREAM")
+	from := flag.String("from", "0", "export entries after this stream id, 0 for all")
+	follow := flag.Bool("follow", false, "keep exporting new entries")
+	out := flag.String("out", "-", "NDJSON file to append to, - for stdout")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	redisConn, err := common.NewRedisStore(*redisURI)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unable to connect to redis:", err)
+		os.Exit(1)
+	}
+
+	exporter := events.NewNDJSONExporter(os.Stdout)
+	if *out != "-" {
+		exporter, err = events.OpenNDJSONFile(*out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "unable to open output:", err)
+			os.Exit(1)
+		}
+	}
+	defer exporter.Close()
+
+	lastID := *from
+
+	err = events.ReadStream(ctx, redisConn, *stream, *from, *follow, func(id string, event *events.Event) error {
+		lastID = id
+		return exporter.Export(ctx, event)
+	})
+	if err != nil && ctx.Err() == nil {
+		fmt.Fprintln(os.Stderr, "unable to export events:", err)
+		os.Exit(1)
+	}
+
+	// resume from here with -from
+	fmt.Fprintln(os.Stderr, "last id:", lastID)
+}
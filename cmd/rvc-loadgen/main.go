@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"rvc/internal/common"
+	"rvc/pkg/rvcclient"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type stats struct {
+	connected atomic.Int64
+	matches   atomic.Int64
+	sent      atomic.Int64
+	received  atomic.Int64
+	errors    atomic.Int64
+}
+
+func main() {
+	baseURL := flag.String("url", "http://localhost:8080", "user service url")
+	users := flag.Int("users", 10, "number of simulated users")
+	size := flag.Int("size", 2, "match size, 2 for 1:1 and up to 8 for group rooms")
+	duration := flag.Duration("duration", time.Minute, "how long to run")
+	interval := flag.Duration("interval", 10*time.Second, "time spent in a match before the next one")
+	rampUp := flag.Duration("ramp-up", 5*time.Second, "time over which users are connected")
+	mode := flag.String("mode", rvcclient.ModeText, "chat mode of the simulated users")
+	flag.Parse()
+
+	logger := common.NewLogger()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(ctx, *duration)
+	defer cancel()
+
+	var s stats
+	var wg sync.WaitGroup
+
+	for i := 0; i < *users; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(*rampUp * time.Duration(i) / time.Duration(*users)):
+			}
+
+			if err := simulate(ctx, *baseURL, fmt.Sprintf("loadgen-%d", i), *mode, *size, *interval, &s); err != nil {
+				s.errors.Add(1)
+				logger.Err(err).Msg("simulated user failed")
+			}
+		}(i)
+	}
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	report := func() {
+		logger.Info().
+			Int64("connected", s.connected.Load()).
+			Int64("matches", s.matches.Load()).
+			Int64("sent", s.sent.Load()).
+			Int64("received", s.received.Load()).
+			Int64("errors", s.errors.Load()).
+			Msg("load")
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				report()
+			}
+		}
+	}()
+
+	wg.Wait()
+	report()
+}
+
+// simulate registers a user that keeps matching, greeting every peer it is
+// matched with, until ctx is done.
+func simulate(ctx context.Context, baseURL string, username string, mode string, size int,
+	interval time.Duration, s *stats) error {
+	client := rvcclient.New(rvcclient.Config{
+		BaseURL:   baseURL,
+		Username:  username,
+		Mode:      mode,
+		Reconnect: true,
+	})
+
+	if err := client.Connect(ctx); err != nil {
+		return err
+	}
+	defer client.Close()
+
+	s.connected.Add(1)
+	defer s.connected.Add(-1)
+
+	if _, err := client.Match(ctx, size); err != nil {
+		return err
+	}
+
+	next := time.NewTimer(interval)
+	defer next.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-next.C:
+			if _, err := client.Match(ctx, size); err != nil && ctx.Err() == nil {
+				s.errors.Add(1)
+			}
+			next.Reset(interval)
+
+		case event, ok := <-client.Events():
+			if !ok {
+				return rvcclient.ErrNotConnected
+			}
+
+			switch event.Event {
+			case rvcclient.EventExchange:
+				exchange, err := event.Exchange()
+				if err != nil || len(exchange.Peers) == 0 {
+					continue
+				}
+
+				s.matches.Add(1)
+
+				if err := client.SendMessage("hello from " + username); err != nil {
+					s.errors.Add(1)
+					continue
+				}
+				s.sent.Add(1)
+
+			case rvcclient.EventMessage:
+				s.received.Add(1)
+
+			case rvcclient.EventReconnected:
+				if _, err := client.Match(ctx, size); err != nil && ctx.Err() == nil {
+					s.errors.Add(1)
+				}
+			}
+		}
+	}
+}
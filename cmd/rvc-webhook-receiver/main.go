@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"rvc/internal/webhooks"
+	"time"
+)
+
+// A stand-in receiver for developing against the webhooks, it checks the
+// signature of every delivery and prints the events.
+func main() {
+	addr := flag.String("addr", ":9090", "address to listen on")
+	secret := flag.String("secret", os.Getenv("WEBHOOK_SECRET"), "shared secret, WEBHOOK_SECRET by default")
+	failRate := flag.Float64("fail", 0, "fraction of deliveries to answer with 500, to exercise retries")
+	flag.Parse()
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if *secret != "" {
+			if err := webhooks.Verify(*secret, r.Header.Get(webhooks.SignatureHeader), body, 5*time.Minute); err != nil {
+				fmt.Println("rejected delivery:", err)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+
+		if rand.Float64() < *failRate {
+			fmt.Println("failing delivery " + r.Header.Get("X-Webhook-ID"))
+			http.Error(w, "failing on purpose", http.StatusInternalServerError)
+			return
+		}
+
+		var event webhooks.Event
+
+		if err := json.Unmarshal(body, &event); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fmt.Printf("%s %s %s %s\n", event.CreatedAt.Format(time.RFC3339), event.Type, event.ID, event.Data)
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	fmt.Println("receiving webhooks on " + *addr)
+
+	if err := http.ListenAndServe(*addr, nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -6,8 +6,14 @@ import (
 	"os"
 	"os/signal"
 	"rvc/internal/common"
+	"rvc/internal/events"
+	"rvc/internal/filter"
 	"rvc/internal/services/session"
+	"rvc/internal/webhooks"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 func main() {
@@ -40,16 +46,148 @@ func main() {
 		RedisClient: redisConn,
 	}
 
+	// analytics events
+	var exporters []events.Exporter
+
+	if stream := os.Getenv("EVENTS_STREAM"); stream != "" {
+		maxLen, _ := strconv.ParseInt(os.Getenv("EVENTS_MAXLEN"), 10, 64)
+
+		exporters = append(exporters, &events.StreamExporter{
+			RedisClient: redisConn,
+			Stream:      stream,
+			MaxLen:      maxLen,
+		})
+	}
+
+	if path := os.Getenv("EVENTS_NDJSON"); path != "" {
+		exporter, err := events.OpenNDJSONFile(path)
+		if err != nil {
+			loggerInstance.Err(err).Msg("unable to open events file")
+			os.Exit(1)
+		}
+
+		exporters = append(exporters, exporter)
+	}
+
+	eventLog := events.NewLog(loggerInstance, exporters...)
+	defer eventLog.Close()
+
+	// webhooks
+	var webhookURLs []string
+	if urls := os.Getenv("WEBHOOK_URLS"); urls != "" {
+		webhookURLs = strings.Split(urls, ",")
+	}
+
+	maxAttempts, _ := strconv.Atoi(os.Getenv("WEBHOOK_MAX_ATTEMPTS"))
+	webhookWorkers, _ := strconv.Atoi(os.Getenv("WEBHOOK_WORKERS"))
+
+	dispatcher := webhooks.NewDispatcher(redisConn, webhooks.Config{
+		Endpoints:   webhookURLs,
+		Secret:      os.Getenv("WEBHOOK_SECRET"),
+		MaxAttempts: maxAttempts,
+		Workers:     webhookWorkers,
+	}, loggerInstance)
+
 	handle := &session.ServerHandle{
 		Store:      storage,
 		Logger:     loggerInstance,
 		Goroutines: goroutines,
+		Webhooks:   dispatcher,
+		Events:     eventLog,
+	}
+
+	// text chat filters, FILTERS=0 relays messages untouched
+	if os.Getenv("FILTERS") != "0" {
+		action := func(name string, fallback string) string {
+			value := os.Getenv("FILTER_" + name)
+			if value == "" {
+				return fallback
+			}
+
+			if !filter.ValidAction(value) {
+				loggerInstance.Error().Msg("unknown action " + value + " of FILTER_" + name + ", available: pass, mask, drop, flag")
+				os.Exit(1)
+			}
+
+			return value
+		}
+
+		pipeline := &filter.Pipeline{}
+
+		if dir := os.Getenv("FILTER_WORDLISTS"); dir != "" {
+			lists, err := filter.LoadWordlists(dir)
+			if err != nil {
+				loggerInstance.Err(err).Msg("unable to load wordlists")
+				os.Exit(1)
+			}
+
+			pipeline.Filters = append(pipeline.Filters, filter.NewWordlist(lists, action("PROFANITY", filter.Mask)))
+		}
+
+		var allow []string
+		if hosts := os.Getenv("FILTER_LINKS_ALLOW"); hosts != "" {
+			allow = strings.Split(hosts, ",")
+		}
+
+		repeats, err := strconv.Atoi(os.Getenv("FILTER_SPAM_REPEATS"))
+		if err != nil {
+			repeats = 3
+		}
+
+		window, err := time.ParseDuration(os.Getenv("FILTER_SPAM_WINDOW"))
+		if err != nil {
+			window = 30 * time.Second
+		}
+
+		maxLength, err := strconv.Atoi(os.Getenv("FILTER_MAX_LENGTH"))
+		if err != nil {
+			maxLength = 1000
+		}
+
+		pipeline.Filters = append(pipeline.Filters,
+			&filter.Links{Action: action("LINKS", filter.Mask), Allow: allow},
+			filter.NewRepeats(repeats, window, action("SPAM", filter.Drop)),
+			&filter.MaxLength{Action: action("LENGTH", filter.Drop), Max: maxLength},
+		)
+
+		handle.Filter = pipeline
+		handle.FilterMetrics = session.NewFilterMetrics()
+	}
+
+	if os.Getenv("SESSION_MEDIA_MODE") == "sfu" {
+		portMin, _ := strconv.ParseUint(os.Getenv("SFU_PORT_MIN"), 10, 16)
+		portMax, _ := strconv.ParseUint(os.Getenv("SFU_PORT_MAX"), 10, 16)
+
+		var iceServers []string
+		if urls := os.Getenv("SFU_ICE_URLS"); urls != "" {
+			iceServers = strings.Split(urls, ",")
+		}
+
+		handle.SFU, err = session.NewSFU(session.SFUConfig{
+			PublicIP:   os.Getenv("SFU_PUBLIC_IP"),
+			PortMin:    uint16(portMin),
+			PortMax:    uint16(portMax),
+			ICEServers: iceServers,
+		})
+		if err != nil {
+			loggerInstance.Err(err).Msg("unable to configure sfu")
+			os.Exit(1)
+		}
+
+		loggerInstance.Info().Msg("relaying media through the sfu")
 	}
 
 	server := session.NewServer(":"+os.Getenv("SESSION_SERVICE_PORT"), handle)
 
 	var wg sync.WaitGroup
 
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		dispatcher.Run(ctx)
+	}()
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -8,8 +8,21 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 	"os"
 	"os/signal"
+	"rvc/internal/accounts"
+	"rvc/internal/bots"
+	"rvc/internal/challenge"
 	"rvc/internal/common"
+	"rvc/internal/events"
+	"rvc/internal/filter"
+	"rvc/internal/geo"
+	"rvc/internal/models"
 	"rvc/internal/services/user"
+	"rvc/internal/turn"
+	"rvc/internal/usernames"
+	"rvc/internal/webhooks"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -52,25 +65,337 @@ func main() {
 		loggerInstance.Err(err).Msg("unable to load templates")
 	}
 
+	var topicRooms []models.TopicRoom
+
+	if roomsFile := os.Getenv("TOPIC_ROOMS_FILE"); roomsFile != "" {
+		topicRooms, err = user.LoadTopicRooms(roomsFile)
+		if err != nil {
+			loggerInstance.Err(err).Msg("unable to load topic rooms")
+			os.Exit(1)
+		}
+	}
+
+	inviteTTL := 15 * time.Minute
+	if ttl, err := strconv.Atoi(os.Getenv("INVITE_TTL")); err == nil && ttl > 0 {
+		inviteTTL = time.Duration(ttl) * time.Second
+	}
+
+	// analytics events
+	var exporters []events.Exporter
+
+	if stream := os.Getenv("EVENTS_STREAM"); stream != "" {
+		maxLen, _ := strconv.ParseInt(os.Getenv("EVENTS_MAXLEN"), 10, 64)
+
+		exporters = append(exporters, &events.StreamExporter{
+			RedisClient: redisConn,
+			Stream:      stream,
+			MaxLen:      maxLen,
+		})
+	}
+
+	if path := os.Getenv("EVENTS_NDJSON"); path != "" {
+		exporter, err := events.OpenNDJSONFile(path)
+		if err != nil {
+			loggerInstance.Err(err).Msg("unable to open events file")
+			os.Exit(1)
+		}
+
+		exporters = append(exporters, exporter)
+	}
+
+	eventLog := events.NewLog(loggerInstance, exporters...)
+	defer eventLog.Close()
+
+	var webhookURLs []string
+	if urls := os.Getenv("WEBHOOK_URLS"); urls != "" {
+		webhookURLs = strings.Split(urls, ",")
+	}
+
+	maxAttempts, _ := strconv.Atoi(os.Getenv("WEBHOOK_MAX_ATTEMPTS"))
+	webhookWorkers, _ := strconv.Atoi(os.Getenv("WEBHOOK_WORKERS"))
+
+	dispatcher := webhooks.NewDispatcher(redisConn, webhooks.Config{
+		Endpoints:   webhookURLs,
+		Secret:      os.Getenv("WEBHOOK_SECRET"),
+		MaxAttempts: maxAttempts,
+		Workers:     webhookWorkers,
+	}, loggerInstance)
+
+	// the service waits for workers, bots and webhook deliveries on shutdown
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		dispatcher.Run(ctx)
+	}()
+
+	var relaxModesAfter time.Duration
+	if after, err := strconv.Atoi(os.Getenv("MATCH_RELAX_MODES_AFTER")); err == nil && after >= 0 {
+		relaxModesAfter = time.Duration(after) * time.Second
+	}
+
+	matchShards := 1
+	if shards, err := strconv.Atoi(os.Getenv("MATCH_SHARDS")); err == nil && shards > 0 {
+		matchShards = shards
+	}
+
+	matchWorkers := 1
+	if workers, err := strconv.Atoi(os.Getenv("MATCH_WORKERS")); err == nil && workers > 0 {
+		matchWorkers = workers
+	}
+
+	// replicas can split the partitions between them, all by default
+	matchPartitions := user.MatchPartitions(matchShards)
+	if partitions := os.Getenv("MATCH_PARTITIONS"); partitions != "" {
+		matchPartitions = nil
+
+		for _, partition := range strings.Split(partitions, ",") {
+			if partition = strings.TrimSpace(partition); partition != "" {
+				matchPartitions = append(matchPartitions, partition)
+			}
+		}
+	}
+
+	// without a database users have no location and any distance goes
+	var resolver geo.Resolver
+
+	if path := os.Getenv("GEOIP_DB"); path != "" {
+		db, err := geo.OpenMaxMind(path)
+		if err != nil {
+			loggerInstance.Err(err).Msg("unable to open geoip database")
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		resolver = db
+	}
+
+	// budgets are shared by the replicas through redis, RATE_LIMITS=0 turns
+	// them off when a proxy in front limits requests
+	rateLimits := user.DefaultRateLimits()
+
+	for action := range rateLimits {
+		value := os.Getenv("RATE_LIMIT_" + strings.ToUpper(action))
+		if value == "" {
+			continue
+		}
+
+		limit, err := user.ParseLimit(value)
+		if err != nil {
+			loggerInstance.Err(err).Msg("unable to parse rate limit of " + action)
+			os.Exit(1)
+		}
+
+		rateLimits[action] = limit
+	}
+
+	if os.Getenv("RATE_LIMITS") == "0" {
+		rateLimits = nil
+	}
+
+	// clients prove some work before registering unless told otherwise
+	var challenger challenge.Challenger
+
+	switch kind := os.Getenv("REGISTRATION_CHALLENGE"); kind {
+	case "", challenge.KindProofOfWork:
+		challenger = challenge.ProofOfWork{}
+	case challenge.KindCaptcha:
+		verifier, err := challenge.NewSiteVerify(os.Getenv("CAPTCHA_PROVIDER"), os.Getenv("CAPTCHA_SECRET"))
+		if err != nil {
+			loggerInstance.Err(err).Msg("unable to set up captcha")
+			os.Exit(1)
+		}
+
+		challenger = &challenge.Captcha{
+			Provider: os.Getenv("CAPTCHA_PROVIDER"),
+			SiteKey:  os.Getenv("CAPTCHA_SITE_KEY"),
+			Verifier: verifier,
+		}
+	case "none":
+	default:
+		loggerInstance.Error().Msg("unknown registration challenge " + kind + ", available: pow, captcha, none")
+		os.Exit(1)
+	}
+
+	challengeScale := user.DefaultChallengeScale
+	if difficulty, err := strconv.Atoi(os.Getenv("CHALLENGE_DIFFICULTY")); err == nil && difficulty >= 0 {
+		challengeScale.Base = difficulty
+		challengeScale.Max = max(challengeScale.Max, difficulty)
+	}
+	if difficulty, err := strconv.Atoi(os.Getenv("CHALLENGE_MAX_DIFFICULTY")); err == nil && difficulty >= challengeScale.Base {
+		challengeScale.Max = difficulty
+	}
+
+	botWait := 15 * time.Second
+	if wait, err := strconv.Atoi(os.Getenv("BOT_WAIT")); err == nil && wait > 0 {
+		botWait = time.Duration(wait) * time.Second
+	}
+
+	var botHandlers []bots.Handler
+
+	for _, name := range strings.Split(os.Getenv("BOTS"), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+
+		handler, ok := bots.New(name)
+		if !ok {
+			loggerInstance.Error().Msg("unknown bot " + name + ", available: " + strings.Join(bots.Names(), ", "))
+			os.Exit(1)
+		}
+
+		botHandlers = append(botHandlers, handler)
+	}
+
+	// people may not pass for staff or the bots, nor use the words the chat
+	// filters mask
+	usernamePolicy := usernames.DefaultPolicy()
+
+	for _, name := range bots.Names() {
+		if handler, ok := bots.New(name); ok {
+			usernamePolicy.Bots = append(usernamePolicy.Bots, handler.Name())
+		}
+	}
+
+	if reserved := os.Getenv("USERNAME_RESERVED"); reserved != "" {
+		usernamePolicy.Reserved = append(usernamePolicy.Reserved, strings.Split(reserved, ",")...)
+	}
+
+	if dir := os.Getenv("FILTER_WORDLISTS"); dir != "" {
+		lists, err := filter.LoadWordlists(dir)
+		if err != nil {
+			loggerInstance.Err(err).Msg("unable to load wordlists")
+			os.Exit(1)
+		}
+
+		for _, words := range lists {
+			usernamePolicy.Profanity = append(usernamePolicy.Profanity, words...)
+		}
+	}
+
 	httpHandle := &user.HttpServerHandle{
 		SessionStore: sessions.NewCookieStore([]byte(os.Getenv("SESSION_KEY"))),
 		Logger:       loggerInstance,
 		Ctx:          ctx,
+		TopicRooms:   topicRooms,
+		InviteTTL:    inviteTTL,
+
+		CrossModeMatching:  os.Getenv("MATCH_CROSS_MODE") == "1",
+		ReputationMatching: os.Getenv("MATCH_REPUTATION") == "1",
+		RelaxModesAfter:    relaxModesAfter,
+		MatchShards:        matchShards,
+		Geo:                resolver,
+		RateLimits:         rateLimits,
+		Challenger:         challenger,
+		ChallengeScale:     challengeScale,
+		Usernames:          usernamePolicy,
+		Bots:               botHandlers,
+		BotAPIKey:          os.Getenv("BOT_API_KEY"),
+		BotWait:            botWait,
+		Webhooks:           dispatcher,
+		Events:             eventLog,
 		Store: &user.HttpStorage{
 			RedisClient: redisConn,
 		},
 	}
 
 	eventHandle := &user.EventServerHandle{
-		Logger: loggerInstance,
+		Logger:     loggerInstance,
+		Webhooks:   dispatcher,
+		Events:     eventLog,
+		Partitions: matchPartitions,
+		Workers:    matchWorkers,
+		Metrics:    user.NewMatchMetrics(),
 		Store: &user.EventStorage{
 			RedisClient: redisConn,
 		},
 	}
 
+	if os.Getenv("ACCOUNTS_ENABLED") == "1" {
+		httpHandle.Accounts = &accounts.Storage{
+			RedisClient: redisConn,
+			Usernames:   usernamePolicy,
+		}
+		httpHandle.IdentityProviders = map[string]accounts.IdentityProvider{}
+
+		if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+			provider := accounts.NewOIDCProvider(accounts.OIDCConfig{
+				Name:         os.Getenv("OIDC_NAME"),
+				Issuer:       issuer,
+				ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+				ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+				RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+			})
+
+			httpHandle.IdentityProviders[provider.Name()] = provider
+		}
+	}
+
+	if os.Getenv("TURN_EMBEDDED") == "1" {
+		relayPortMin, err := strconv.ParseUint(os.Getenv("TURN_RELAY_PORT_MIN"), 10, 16)
+		if err != nil {
+			loggerInstance.Err(err).Msg("invalid TURN_RELAY_PORT_MIN")
+			os.Exit(1)
+		}
+
+		relayPortMax, err := strconv.ParseUint(os.Getenv("TURN_RELAY_PORT_MAX"), 10, 16)
+		if err != nil {
+			loggerInstance.Err(err).Msg("invalid TURN_RELAY_PORT_MAX")
+			os.Exit(1)
+		}
+
+		// the limits are off when unset
+		var bandwidthLimit, maxAllocations int
+
+		for name, limit := range map[string]*int{
+			"TURN_BANDWIDTH_LIMIT": &bandwidthLimit,
+			"TURN_MAX_ALLOCATIONS": &maxAllocations,
+		} {
+			value := os.Getenv(name)
+			if value == "" {
+				continue
+			}
+
+			if *limit, err = strconv.Atoi(value); err != nil || *limit < 0 {
+				loggerInstance.Error().Msg("invalid " + name + ": " + value)
+				os.Exit(1)
+			}
+		}
+
+		turnServer, err := turn.NewServer(turn.Config{
+			ListenAddr:     os.Getenv("TURN_LISTEN_ADDR"),
+			PublicIP:       os.Getenv("TURN_PUBLIC_IP"),
+			Realm:          os.Getenv("TURN_REALM"),
+			Secret:         os.Getenv("TURN_SECRET"),
+			RelayPortMin:   uint16(relayPortMin),
+			RelayPortMax:   uint16(relayPortMax),
+			BandwidthLimit: bandwidthLimit,
+			MaxAllocations: maxAllocations,
+			Authorize: func(userID string) bool {
+				return redisConn.Exists(context.Background(), "user_entry:"+userID).Val() == 1
+			},
+		}, loggerInstance)
+		if err != nil {
+			loggerInstance.Err(err).Msg("unable to configure embedded turn server")
+			os.Exit(1)
+		}
+
+		go func() {
+			if err := turnServer.Run(ctx); err != nil {
+				loggerInstance.Err(err).Msg("failed to start the embedded turn server")
+				os.Exit(1)
+			}
+		}()
+	}
+
 	server := user.NewServer(":"+os.Getenv("USER_SERVICE_PORT"), serverInstance, httpHandle, eventHandle)
 
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
+
 		if err := server.Run(ctx); err != nil {
 			loggerInstance.Err(err).Msg("failed to start the server")
 			os.Exit(1)
@@ -86,4 +411,19 @@ func main() {
 		loggerInstance.Err(err).Msg("failed to gracefully shutdown the server")
 		os.Exit(1)
 	}
+
+	stopped := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+
+	// bots leave their matches and pools before the service exits
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		loggerInstance.Error().Msg("timed out waiting for workers and bots to stop")
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,210 @@
+// Package oidctest is a minimal OpenID Connect provider for tests, it logs
+// in whoever names a username without a password.
+package oidctest
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const codeTTL = time.Minute
+
+type Server struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+
+	mu     sync.Mutex
+	codes  map[string]*grant
+	tokens map[string]string
+	mux    *http.ServeMux
+}
+
+type grant struct {
+	username    string
+	redirectURI string
+	expiresAt   time.Time
+}
+
+func NewServer(issuer string, clientID string, clientSecret string) *Server {
+	s := &Server{
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		codes:        make(map[string]*grant),
+		tokens:       make(map[string]string),
+		mux:          http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("/.well-known/openid-configuration", s.discovery)
+	s.mux.HandleFunc("/authorize", s.authorize)
+	s.mux.HandleFunc("/token", s.token)
+	s.mux.HandleFunc("/userinfo", s.userinfo)
+
+	return s
+}
+
+// Start serves a provider on a local address, which is its issuer. Callers
+// close the server when done.
+func Start(clientID string, clientSecret string) *httptest.Server {
+	server := httptest.NewUnstartedServer(nil)
+	server.Start()
+
+	server.Config.Handler = NewServer(server.URL, clientID, clientSecret)
+
+	return server
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                   s.issuer,
+		"authorization_endpoint":   s.issuer + "/authorize",
+		"token_endpoint":           s.issuer + "/token",
+		"userinfo_endpoint":        s.issuer + "/userinfo",
+		"response_types_supported": []string{"code"},
+		"subject_types_supported":  []string{"public"},
+	})
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="UTF-8"><title>Test OIDC login</title></head>
+<body>
+    <form method="post">
+        <input type="hidden" name="client_id" value="{{ .ClientID }}">
+        <input type="hidden" name="redirect_uri" value="{{ .RedirectURI }}">
+        <input type="hidden" name="state" value="{{ .State }}">
+        <input type="text" name="login_hint" placeholder="Username" required>
+        <button type="submit">Log in</button>
+    </form>
+</body>
+</html>`))
+
+// authorize asks for a username, or logs in the login_hint right away.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Form.Get("client_id") != s.clientID {
+		http.Error(w, "unknown client", http.StatusBadRequest)
+		return
+	}
+
+	redirectURI, err := url.Parse(r.Form.Get("redirect_uri"))
+	if err != nil || redirectURI.Scheme == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	username := strings.TrimSpace(r.Form.Get("login_hint"))
+	if username == "" {
+		_ = loginPage.Execute(w, map[string]string{
+			"ClientID":    s.clientID,
+			"RedirectURI": redirectURI.String(),
+			"State":       r.Form.Get("state"),
+		})
+		return
+	}
+
+	code := uuid.New().String()
+
+	s.mu.Lock()
+	s.codes[code] = &grant{
+		username:    username,
+		redirectURI: redirectURI.String(),
+		expiresAt:   time.Now().Add(codeTTL),
+	}
+	s.mu.Unlock()
+
+	query := redirectURI.Query()
+	query.Set("code", code)
+	query.Set("state", r.Form.Get("state"))
+	redirectURI.RawQuery = query.Encode()
+
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+
+	clientID, _ = url.QueryUnescape(clientID)
+	clientSecret, _ = url.QueryUnescape(clientSecret)
+
+	if clientID != s.clientID || clientSecret != s.clientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	code := r.PostFormValue("code")
+
+	s.mu.Lock()
+	grant, ok := s.codes[code]
+	delete(s.codes, code)
+	s.mu.Unlock()
+
+	if !ok || time.Now().After(grant.expiresAt) || grant.redirectURI != r.PostFormValue("redirect_uri") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	accessToken := strings.ReplaceAll(uuid.New().String(), "-", "")
+
+	s.mu.Lock()
+	s.tokens[accessToken] = grant.username
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+	})
+}
+
+func (s *Server) userinfo(w http.ResponseWriter, r *http.Request) {
+	accessToken, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	s.mu.Lock()
+	username, known := s.tokens[accessToken]
+	s.mu.Unlock()
+
+	if !ok || !known {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	// the username doubles as the subject, the same name is the same user
+	writeJSON(w, http.StatusOK, map[string]string{
+		"sub":                "mock|" + strings.ToLower(username),
+		"preferred_username": username,
+		"email":              strings.ToLower(username) + "@mock.local",
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,19 @@
+package accounts
+
+import "golang.org/x/crypto/bcrypt"
+
+// dummyHash is compared against when the account does not exist.
+var dummyHash, _ = HashPassword("random-video-chat")
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+func CheckPassword(hash string, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
@@ -0,0 +1,207 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Claims is what an identity provider asserts about a user.
+type Claims struct {
+	Subject  string
+	Username string
+	Email    string
+}
+
+// IdentityProvider logs users in through an external authorization server.
+type IdentityProvider interface {
+	Name() string
+	// AuthCodeURL is where the user is sent to log in, state comes back
+	// unchanged on the callback.
+	AuthCodeURL(ctx context.Context, state string) (string, error)
+	// Exchange trades the code the callback received for the user's claims.
+	Exchange(ctx context.Context, code string) (*Claims, error)
+}
+
+type OIDCConfig struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+// OIDCProvider implements the OpenID Connect authorization code flow, claims
+// are read from the userinfo endpoint over the back channel.
+type OIDCProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+func NewOIDCProvider(config OIDCConfig) *OIDCProvider {
+	if config.Name == "" {
+		config.Name = "oidc"
+	}
+
+	return &OIDCProvider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *OIDCProvider) Name() string {
+	return p.config.Name
+}
+
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, state string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.config.ClientID},
+		"redirect_uri":  {p.config.RedirectURL},
+		"scope":         {"openid profile email"},
+		"state":         {state},
+	}
+
+	return discovery.AuthorizationEndpoint + "?" + query.Encode(), nil
+}
+
+func (p *OIDCProvider) Exchange(ctx context.Context, code string) (*Claims, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {p.config.RedirectURL},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+	}
+
+	if err := p.do(req, &token); err != nil {
+		return nil, err
+	}
+
+	if token.AccessToken == "" {
+		return nil, errors.New("token response carries no access token")
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, discovery.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	var userinfo struct {
+		Subject           string `json:"sub"`
+		PreferredUsername string `json:"preferred_username"`
+		Name              string `json:"name"`
+		Email             string `json:"email"`
+	}
+
+	if err := p.do(req, &userinfo); err != nil {
+		return nil, err
+	}
+
+	if userinfo.Subject == "" {
+		return nil, errors.New("userinfo response carries no subject")
+	}
+
+	claims := &Claims{
+		Subject:  userinfo.Subject,
+		Username: userinfo.PreferredUsername,
+		Email:    userinfo.Email,
+	}
+
+	if claims.Username == "" {
+		claims.Username = userinfo.Name
+	}
+
+	if claims.Username == "" {
+		claims.Username, _, _ = strings.Cut(userinfo.Email, "@")
+	}
+
+	return claims, nil
+}
+
+// discover fetches the provider's metadata on first use, so the provider may
+// come up after the user service.
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		strings.TrimSuffix(p.config.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var discovery oidcDiscovery
+
+	if err := p.do(req, &discovery); err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSuffix(discovery.Issuer, "/") != strings.TrimSuffix(p.config.Issuer, "/") {
+		return nil, fmt.Errorf("issuer mismatch: %s", discovery.Issuer)
+	}
+
+	p.discovery = &discovery
+
+	return p.discovery, nil
+}
+
+func (p *OIDCProvider) do(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,100 @@
+package accounts
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"rvc/internal/accounts/oidctest"
+)
+
+const testRedirectURL = "http://rvc.test/login/oidc/callback"
+
+// authorize logs the username in at the provider and returns the code the
+// callback would receive.
+func authorize(t *testing.T, provider *OIDCProvider, username string) string {
+	t.Helper()
+
+	authURL, err := provider.AuthCodeURL(context.Background(), "state-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	resp, err := client.Get(authURL + "&login_hint=" + url.QueryEscape(username))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	location, err := resp.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if location.Query().Get("state") != "state-1" {
+		t.Errorf("state = %q, want state-1", location.Query().Get("state"))
+	}
+
+	return location.Query().Get("code")
+}
+
+func TestOIDCProviderExchange(t *testing.T) {
+	server := oidctest.Start("rvc", "secret")
+	defer server.Close()
+
+	provider := NewOIDCProvider(OIDCConfig{
+		Issuer:       server.URL,
+		ClientID:     "rvc",
+		ClientSecret: "secret",
+		RedirectURL:  testRedirectURL,
+	})
+
+	code := authorize(t, provider, "Alice")
+
+	claims, err := provider.Exchange(context.Background(), code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Subject != "mock|alice" || claims.Username != "Alice" || claims.Email != "alice@mock.local" {
+		t.Errorf("claims = %+v", claims)
+	}
+
+	// codes are single-use
+	if _, err := provider.Exchange(context.Background(), code); err == nil {
+		t.Error("exchanged a code twice")
+	}
+}
+
+func TestOIDCProviderRejectsWrongSecret(t *testing.T) {
+	server := oidctest.Start("rvc", "secret")
+	defer server.Close()
+
+	provider := NewOIDCProvider(OIDCConfig{
+		Issuer:       server.URL,
+		ClientID:     "rvc",
+		ClientSecret: "wrong",
+		RedirectURL:  testRedirectURL,
+	})
+
+	if _, err := provider.Exchange(context.Background(), authorize(t, provider, "Alice")); err == nil {
+		t.Error("exchanged a code with the wrong client secret")
+	}
+}
+
+func TestOIDCProviderRejectsIssuerMismatch(t *testing.T) {
+	server := httptest.NewServer(oidctest.NewServer("https://elsewhere.test", "rvc", "secret"))
+	defer server.Close()
+
+	provider := NewOIDCProvider(OIDCConfig{Issuer: server.URL, ClientID: "rvc", RedirectURL: testRedirectURL})
+
+	if _, err := provider.AuthCodeURL(context.Background(), "state-1"); err == nil {
+		t.Error("trusted the metadata of another issuer")
+	}
+}
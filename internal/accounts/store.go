@@ -0,0 +1,205 @@
+package accounts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"math/rand"
+	"rvc/internal/models"
+	"rvc/internal/usernames"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUsernameTaken      = errors.New("username is taken")
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrWeakPassword       = errors.New("password must be 8 to 72 characters")
+	ErrInvalidUsername    = errors.New("invalid username")
+)
+
+type Store interface {
+	// Accounts: Accounts outlive the users they register as
+
+	Signup(context.Context, string, string) (*models.Account, error)
+	Login(context.Context, string, string) (*models.Account, error)
+	GetAccount(context.Context, string) (*models.Account, error)
+
+	// LoginExternal finds or creates the account linked to an identity
+	// provider's subject.
+	LoginExternal(context.Context, string, *Claims) (*models.Account, error)
+}
+
+type Storage struct {
+	RedisClient *redis.Client
+	// Usernames is the policy account names are held to, the default one
+	// when nil
+	Usernames *usernames.Policy
+}
+
+func (s *Storage) Signup(ctx context.Context, username string, password string) (*models.Account, error) {
+	// bcrypt ignores everything past 72 bytes
+	if len(password) < 8 || len(password) > 72 {
+		return nil, ErrWeakPassword
+	}
+
+	passwordHash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.createAccount(ctx, username, passwordHash)
+}
+
+func (s *Storage) Login(ctx context.Context, username string, password string) (*models.Account, error) {
+	accountID, err := s.RedisClient.Get(ctx, usernameKey(username)).Result()
+	if errors.Is(err, redis.Nil) {
+		// hash anyway so unknown usernames take as long as wrong passwords
+		_ = CheckPassword(dummyHash, password)
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := s.GetAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	if account.PasswordHash == "" || !CheckPassword(account.PasswordHash, password) {
+		return nil, ErrInvalidCredentials
+	}
+
+	return account, nil
+}
+
+func (s *Storage) GetAccount(ctx context.Context, accountID string) (*models.Account, error) {
+	entry, err := s.RedisClient.HGetAll(ctx, fmt.Sprintf("account:%s", accountID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entry) == 0 {
+		return nil, redis.Nil
+	}
+
+	createdAt, err := time.Parse(time.RFC3339, entry["created_at"])
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.Account{
+		AccountID:    accountID,
+		Username:     entry["username"],
+		PasswordHash: entry["password_hash"],
+		CreatedAt:    createdAt,
+	}, nil
+}
+
+func (s *Storage) LoginExternal(ctx context.Context, provider string, claims *Claims) (*models.Account, error) {
+	identityKey := fmt.Sprintf("account_identity:%s:%s", provider, claims.Subject)
+
+	accountID, err := s.RedisClient.Get(ctx, identityKey).Result()
+	if err == nil {
+		return s.GetAccount(ctx, accountID)
+	}
+	if !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	// the provider's username may already be taken locally, fall back to a
+	// suffixed one
+	username := s.Usernames.Sanitize(claims.Username, "user")
+	var account *models.Account
+
+	for attempt := 0; attempt < 5; attempt++ {
+		account, err = s.createAccount(ctx, username, "")
+		if errors.Is(err, ErrUsernameTaken) || errors.Is(err, ErrInvalidUsername) {
+			username = s.suffixedUsername(claims.Username)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		break
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	linked, err := s.RedisClient.SetNX(ctx, identityKey, account.AccountID, 0).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if !linked {
+		// a concurrent login linked the subject first
+		s.removeAccount(ctx, account)
+		return s.LoginExternal(ctx, provider, claims)
+	}
+
+	return account, nil
+}
+
+// suffixedUsername makes a name the policy accepts out of the provider's
+// username and a random number. Digits are shared by every script, so the
+// suffix does not mix scripts into the name.
+func (s *Storage) suffixedUsername(username string) string {
+	maxLength := usernames.DefaultPolicy().MaxLength
+	if s.Usernames != nil {
+		maxLength = s.Usernames.MaxLength
+	}
+
+	suffix := fmt.Sprintf("-%06d", rand.Intn(1000000))
+
+	name := []rune(s.Usernames.Sanitize(username, "user"))
+	if room := maxLength - len(suffix); len(name) > room {
+		name = name[:room]
+	}
+
+	return strings.TrimSpace(string(name)) + suffix
+}
+
+func (s *Storage) createAccount(ctx context.Context, username string, passwordHash string) (*models.Account, error) {
+	username, err := s.Usernames.Normalize(username, false)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidUsername, err)
+	}
+
+	account := &models.Account{
+		AccountID:    strings.ReplaceAll(uuid.New().String(), "-", ""),
+		Username:     username,
+		PasswordHash: passwordHash,
+		CreatedAt:    time.Now().UTC().Truncate(time.Second),
+	}
+
+	claimed, err := s.RedisClient.SetNX(ctx, usernameKey(username), account.AccountID, 0).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if !claimed {
+		return nil, ErrUsernameTaken
+	}
+
+	if err := s.RedisClient.HSet(ctx, fmt.Sprintf("account:%s", account.AccountID),
+		"username", account.Username, "password_hash", account.PasswordHash,
+		"created_at", account.CreatedAt.Format(time.RFC3339)).Err(); err != nil {
+		return nil, err
+	}
+
+	return account, nil
+}
+
+func (s *Storage) removeAccount(ctx context.Context, account *models.Account) {
+	s.RedisClient.Del(ctx, fmt.Sprintf("account:%s", account.AccountID), usernameKey(account.Username))
+}
+
+// usernameKey indexes accounts by username, case-insensitively.
+func usernameKey(username string) string {
+	return fmt.Sprintf("account_username:%s", strings.ToLower(username))
+}
@@ -0,0 +1,95 @@
+package accounts
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"rvc/internal/usernames"
+)
+
+func newTestStorage(t *testing.T) *Storage {
+	return &Storage{RedisClient: redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})}
+}
+
+func TestSignupCountsCharacters(t *testing.T) {
+	s := newTestStorage(t)
+
+	// 20 letters but 40 bytes
+	name := strings.Repeat("д", 20)
+
+	account, err := s.Signup(context.Background(), name, "password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if account.Username != name {
+		t.Errorf("username = %q, want %q", account.Username, name)
+	}
+
+	if _, err := s.Signup(context.Background(), strings.Repeat("д", 33), "password123"); !errors.Is(err, ErrInvalidUsername) {
+		t.Errorf("33 letter username: err = %v, want ErrInvalidUsername", err)
+	}
+
+	if _, err := s.Signup(context.Background(), "аdmin", "password123"); !errors.Is(err, usernames.ErrScripts) {
+		t.Errorf("mixed script username: err = %v, want ErrScripts", err)
+	}
+}
+
+func TestLoginExternalSuffixesTakenNames(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+
+	// a long name whose cut would fall inside a character counted in bytes
+	name := strings.Repeat("Ж", 32)
+
+	first, err := s.LoginExternal(ctx, "oidc", &Claims{Subject: "1", Username: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := s.LoginExternal(ctx, "oidc", &Claims{Subject: "2", Username: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.AccountID == second.AccountID {
+		t.Fatal("two subjects share an account")
+	}
+
+	for _, account := range []string{first.Username, second.Username} {
+		if !utf8.ValidString(account) || utf8.RuneCountInString(account) > 32 {
+			t.Errorf("username %q is not a valid name of at most 32 characters", account)
+		}
+	}
+
+	if !strings.HasPrefix(second.Username, strings.Repeat("Ж", 25)+"-") {
+		t.Errorf("taken name fell back to %q", second.Username)
+	}
+
+	again, err := s.LoginExternal(ctx, "oidc", &Claims{Subject: "2", Username: "renamed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again.AccountID != second.AccountID {
+		t.Error("logging in again created another account")
+	}
+}
+
+func TestLoginExternalSanitizesNames(t *testing.T) {
+	s := newTestStorage(t)
+
+	account, err := s.LoginExternal(context.Background(), "oidc", &Claims{Subject: "1", Username: "  <b>Bob</b>  "})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := usernames.DefaultPolicy().Normalize(account.Username, false); err != nil {
+		t.Errorf("username %q breaks the policy: %v", account.Username, err)
+	}
+}
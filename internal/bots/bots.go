@@ -0,0 +1,74 @@
+// Package bots holds the handlers of bot participants, bots are matched like
+// users when humans wait too long and are flagged as bots to their peers.
+package bots
+
+import (
+	"sort"
+	"sync"
+)
+
+// Conversation is the match a bot takes part in.
+type Conversation interface {
+	// Send sends a chat message to everyone in the match.
+	Send(text string) error
+	// Peers returns the usernames of the bot's peers.
+	Peers() []string
+}
+
+type Handler interface {
+	// Name is the username the bot chats as.
+	Name() string
+	// Join is called once the bot is matched.
+	Join(conv Conversation)
+	// Message is called for every chat message of a peer.
+	Message(conv Conversation, from string, text string)
+}
+
+var (
+	mu       sync.Mutex
+	registry = map[string]func() Handler{}
+)
+
+// Register makes a bot available by name, it panics when the name is taken.
+func Register(name string, factory func() Handler) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := registry[name]; ok {
+		panic("bots: " + name + " registered twice")
+	}
+
+	registry[name] = factory
+}
+
+// New creates the bot registered under name.
+func New(name string) (Handler, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	factory, ok := registry[name]
+	if !ok {
+		return nil, false
+	}
+
+	return factory(), true
+}
+
+func Names() []string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func init() {
+	Register("echo", func() Handler { return &Echo{} })
+	Register("greeter", func() Handler { return NewGreeter(DefaultFAQ) })
+}
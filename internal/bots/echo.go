@@ -0,0 +1,16 @@
+package bots
+
+// Echo repeats every message back, handy to check a client end to end.
+type Echo struct{}
+
+func (b *Echo) Name() string {
+	return "EchoBot"
+}
+
+func (b *Echo) Join(conv Conversation) {
+	_ = conv.Send("Hi, I'm a bot and repeat whatever you say.")
+}
+
+func (b *Echo) Message(conv Conversation, from string, text string) {
+	_ = conv.Send(text)
+}
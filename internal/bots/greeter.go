@@ -0,0 +1,61 @@
+package bots
+
+import (
+	"sort"
+	"strings"
+)
+
+// DefaultFAQ answers questions about the service by keyword.
+var DefaultFAQ = map[string]string{
+	"room":   "Pick a group size next to the Match button, or join one of the topic rooms.",
+	"invite": "The Invite button gives you a single-use link to chat with someone you know.",
+	"friend": "Press Connect during a chat, if your partner does too you become friends.",
+	"mode":   "You can register for video, audio or text-only chats.",
+	"report": "Report someone through the API or the terminal client, it ends the chat too.",
+	"bot":    "Yes, I'm a bot. I keep you company until someone is free.",
+}
+
+// Greeter welcomes users while they wait for a human and answers questions
+// by keyword.
+type Greeter struct {
+	faq      map[string]string
+	keywords []string
+}
+
+func NewGreeter(faq map[string]string) *Greeter {
+	keywords := make([]string, 0, len(faq))
+	for keyword := range faq {
+		keywords = append(keywords, keyword)
+	}
+
+	sort.Strings(keywords)
+
+	return &Greeter{faq: faq, keywords: keywords}
+}
+
+func (b *Greeter) Name() string {
+	return "GreeterBot"
+}
+
+func (b *Greeter) Join(conv Conversation) {
+	greeting := "Hi"
+	if peers := conv.Peers(); len(peers) == 1 {
+		greeting += " " + peers[0]
+	}
+
+	_ = conv.Send(greeting + "! I'm a bot keeping you company until someone is free. Ask me about " +
+		strings.Join(b.keywords, ", ") + ", or press Match to look for someone again.")
+}
+
+func (b *Greeter) Message(conv Conversation, from string, text string) {
+	text = strings.ToLower(text)
+
+	for _, keyword := range b.keywords {
+		if strings.Contains(text, keyword) {
+			_ = conv.Send(b.faq[keyword])
+			return
+		}
+	}
+
+	_ = conv.Send("Sorry, I only know about " + strings.Join(b.keywords, ", ") + ".")
+}
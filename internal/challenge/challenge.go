@@ -0,0 +1,203 @@
+// Package challenge makes clients prove some effort before registering, so
+// scripts cannot flood the unpaired pool. Challenges are either a hashcash
+// proof of work or a CAPTCHA checked by an external verifier.
+package challenge
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of challenges.
+const (
+	KindProofOfWork = "pow"
+	KindCaptcha     = "captcha"
+)
+
+// Challenge is handed to the client, which answers it when registering.
+type Challenge struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// Difficulty of a proof of work is the number of leading zero bits of
+	// sha256(ID + response)
+	Difficulty int `json:"difficulty,omitempty"`
+	// Provider and SiteKey of a CAPTCHA widget
+	Provider string `json:"provider,omitempty"`
+	SiteKey  string `json:"site_key,omitempty"`
+}
+
+// Challenger issues challenges and checks the responses to them.
+type Challenger interface {
+	// Issue creates a challenge, difficulty only matters to proofs of work
+	Issue(difficulty int) (*Challenge, error)
+	Verify(ctx context.Context, challenge *Challenge, response string, ip string) (bool, error)
+}
+
+func newID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// ProofOfWork is the built-in hashcash challenge, clients find a response
+// whose hash with the challenge id has enough leading zero bits.
+type ProofOfWork struct{}
+
+func (ProofOfWork) Issue(difficulty int) (*Challenge, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Challenge{ID: id, Kind: KindProofOfWork, Difficulty: difficulty}, nil
+}
+
+func (ProofOfWork) Verify(_ context.Context, challenge *Challenge, response string, _ string) (bool, error) {
+	return len(response) <= 32 && leadingZeros(challenge.ID, response) >= challenge.Difficulty, nil
+}
+
+// Solve finds a response to a proof of work, 2^difficulty hashes on average.
+func Solve(challenge *Challenge) string {
+	for nonce := 0; ; nonce++ {
+		response := strconv.Itoa(nonce)
+		if leadingZeros(challenge.ID, response) >= challenge.Difficulty {
+			return response
+		}
+	}
+}
+
+func leadingZeros(id string, response string) int {
+	sum := sha256.Sum256([]byte(id + response))
+
+	zeros := 0
+	for _, b := range sum {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+
+	return zeros
+}
+
+// Scale sets the proof of work difficulty from the registrations of the last
+// minute, one more bit, doubling the work, each time the rate doubles past
+// Normal.
+type Scale struct {
+	Base   int
+	Max    int
+	Normal float64
+}
+
+func (s Scale) Difficulty(perMinute float64) int {
+	if s.Normal <= 0 || perMinute <= s.Normal {
+		return s.Base
+	}
+
+	return min(s.Base+int(math.Log2(perMinute/s.Normal))+1, s.Max)
+}
+
+// Verifier checks a CAPTCHA token with its provider, tests can fake it with
+// a VerifierFunc.
+type Verifier interface {
+	Verify(ctx context.Context, token string, ip string) (bool, error)
+}
+
+type VerifierFunc func(ctx context.Context, token string, ip string) (bool, error)
+
+func (f VerifierFunc) Verify(ctx context.Context, token string, ip string) (bool, error) {
+	return f(ctx, token, ip)
+}
+
+// Captcha challenges clients with the provider's widget, the response is
+// the widget's token.
+type Captcha struct {
+	Provider string
+	SiteKey  string
+	Verifier Verifier
+}
+
+func (c *Captcha) Issue(int) (*Challenge, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Challenge{ID: id, Kind: KindCaptcha, Provider: c.Provider, SiteKey: c.SiteKey}, nil
+}
+
+func (c *Captcha) Verify(ctx context.Context, _ *Challenge, response string, ip string) (bool, error) {
+	if response == "" {
+		return false, nil
+	}
+
+	return c.Verifier.Verify(ctx, response, ip)
+}
+
+// siteVerifyURLs of the providers whose widgets the register page renders.
+var siteVerifyURLs = map[string]string{
+	"hcaptcha":  "https://api.hcaptcha.com/siteverify",
+	"recaptcha": "https://www.google.com/recaptcha/api/siteverify",
+	"turnstile": "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+}
+
+// SiteVerify checks tokens with a provider's siteverify endpoint, which
+// hCaptcha, reCAPTCHA and Turnstile share.
+type SiteVerify struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+func NewSiteVerify(provider string, secret string) (*SiteVerify, error) {
+	verifyURL, ok := siteVerifyURLs[provider]
+	if !ok {
+		return nil, errors.New("unknown captcha provider " + provider)
+	}
+
+	return &SiteVerify{
+		URL:    verifyURL,
+		Secret: secret,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (v *SiteVerify) Verify(ctx context.Context, token string, ip string) (bool, error) {
+	form := url.Values{"secret": {v.Secret}, "response": {token}, "remoteip": {ip}}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Success bool `json:"success"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+
+	return result.Success, nil
+}
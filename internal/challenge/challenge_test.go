@@ -0,0 +1,117 @@
+package challenge
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProofOfWork(t *testing.T) {
+	ctx := context.Background()
+
+	issued, err := ProofOfWork{}.Issue(12)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if issued.Kind != KindProofOfWork || issued.Difficulty != 12 || issued.ID == "" {
+		t.Fatalf("issued %+v", issued)
+	}
+
+	response := Solve(issued)
+
+	if solved, err := (ProofOfWork{}).Verify(ctx, issued, response, ""); err != nil || !solved {
+		t.Errorf("Verify(Solve) = %v, %v", solved, err)
+	}
+
+	if solved, _ := (ProofOfWork{}).Verify(ctx, issued, strings.Repeat("0", 33)+response, ""); solved {
+		t.Error("accepted a response over 32 characters")
+	}
+
+	if solved, _ := (ProofOfWork{}).Verify(ctx, &Challenge{ID: issued.ID, Difficulty: 256}, response, ""); solved {
+		t.Error("accepted a response short of the difficulty")
+	}
+}
+
+func TestScale(t *testing.T) {
+	scale := Scale{Base: 16, Max: 22, Normal: 30}
+
+	for perMinute, want := range map[float64]int{
+		0:     16,
+		30:    16,
+		31:    17,
+		60:    18,
+		120:   19,
+		10000: 22,
+	} {
+		if got := scale.Difficulty(perMinute); got != want {
+			t.Errorf("Difficulty(%v) = %d, want %d", perMinute, got, want)
+		}
+	}
+}
+
+func TestCaptcha(t *testing.T) {
+	var checked []string
+
+	captcha := &Captcha{
+		Provider: "hcaptcha",
+		SiteKey:  "site",
+		Verifier: VerifierFunc(func(_ context.Context, token string, ip string) (bool, error) {
+			checked = append(checked, token+"@"+ip)
+			return token == "good", nil
+		}),
+	}
+
+	issued, err := captcha.Issue(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if issued.Kind != KindCaptcha || issued.Provider != "hcaptcha" || issued.SiteKey != "site" {
+		t.Fatalf("issued %+v", issued)
+	}
+
+	for response, want := range map[string]bool{"": false, "bad": false, "good": true} {
+		if solved, err := captcha.Verify(context.Background(), issued, response, "192.0.2.1"); err != nil || solved != want {
+			t.Errorf("Verify(%q) = %v, %v, want %v", response, solved, err, want)
+		}
+	}
+
+	// empty responses never reach the provider
+	if len(checked) != 2 || !strings.HasSuffix(checked[0], "@192.0.2.1") {
+		t.Errorf("verifier checked %v", checked)
+	}
+}
+
+func TestSiteVerify(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		success := r.FormValue("secret") == "secret" && r.FormValue("response") == "token" &&
+			r.FormValue("remoteip") == "192.0.2.1"
+
+		w.Header().Set("Content-Type", "application/json")
+		if success {
+			_, _ = w.Write([]byte(`{"success":true}`))
+		} else {
+			_, _ = w.Write([]byte(`{"success":false}`))
+		}
+	}))
+	defer server.Close()
+
+	verifier, err := NewSiteVerify("turnstile", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier.URL = server.URL
+
+	for token, want := range map[string]bool{"token": true, "forged": false} {
+		if solved, err := verifier.Verify(context.Background(), token, "192.0.2.1"); err != nil || solved != want {
+			t.Errorf("Verify(%q) = %v, %v, want %v", token, solved, err, want)
+		}
+	}
+
+	if _, err := NewSiteVerify("unknown", "secret"); err == nil {
+		t.Error("accepted an unknown provider")
+	}
+}
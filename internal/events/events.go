@@ -0,0 +1,96 @@
+// Package events records an append-only log of what happens to users and
+// matches for analytics. Events carry ids, timings and outcomes, never what
+// users say to each other.
+package events
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	"time"
+)
+
+const (
+	Registered     = "registered"
+	Queued         = "queued"
+	Matched        = "matched"
+	SessionStarted = "session_started"
+	SessionEnded   = "session_ended"
+	Reported       = "reported"
+	FeedbackGiven  = "feedback_given"
+	Disconnected   = "disconnected"
+	MessageFlagged = "message_flagged"
+)
+
+// End reasons of session_ended events.
+const (
+	ReasonSkipped      = "skipped"
+	ReasonLeft         = "left"
+	ReasonBlocked      = "blocked"
+	ReasonDisconnected = "disconnected"
+	ReasonError        = "error"
+	// ReasonEnded is used when the service ending the session gave no reason
+	ReasonEnded = "ended"
+)
+
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	UserID  string    `json:"user_id,omitempty"`
+	MatchID string    `json:"match_id,omitempty"`
+	// Data holds the details of the event type
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+// Exporter writes events to a destination, implementations must be safe for
+// concurrent use.
+type Exporter interface {
+	Export(context.Context, *Event) error
+	Close() error
+}
+
+// Log passes every event to its exporters.
+type Log struct {
+	exporters []Exporter
+	logger    *zerolog.Logger
+}
+
+func NewLog(logger *zerolog.Logger, exporters ...Exporter) *Log {
+	return &Log{
+		exporters: exporters,
+		logger:    logger,
+	}
+}
+
+// Record timestamps the event and exports it, a nil log drops it. Failing
+// exporters are logged, analytics never fail a request.
+func (l *Log) Record(ctx context.Context, event *Event) {
+	if l == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	for _, exporter := range l.exporters {
+		if err := exporter.Export(ctx, event); err != nil {
+			l.logger.Err(err).Msg("unable to export " + event.Type + " event")
+		}
+	}
+}
+
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	var firstErr error
+
+	for _, exporter := range l.exporters {
+		if err := exporter.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
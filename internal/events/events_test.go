@@ -0,0 +1,163 @@
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+// decodeLines decodes every line of NDJSON output, failing on partial or
+// interleaved lines.
+func decodeLines(t *testing.T, output []byte) []*Event {
+	t.Helper()
+
+	var decoded []*Event
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+
+		decoded = append(decoded, &event)
+	}
+
+	if len(output) > 0 && output[len(output)-1] != '\n' {
+		t.Error("output does not end with a newline")
+	}
+
+	return decoded
+}
+
+func TestNDJSONWritesOneEventPerLine(t *testing.T) {
+	var output bytes.Buffer
+
+	logger := zerolog.Nop()
+	log := NewLog(&logger, NewNDJSONExporter(&output))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			log.Record(context.Background(), &Event{
+				Type:   Queued,
+				UserID: fmt.Sprintf("user-%d", i),
+				Data:   map[string]interface{}{"note": "line\nbreak"},
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	decoded := decodeLines(t, output.Bytes())
+	if len(decoded) != 50 {
+		t.Fatalf("decoded %d events, want 50", len(decoded))
+	}
+
+	for _, event := range decoded {
+		if event.Type != Queued || event.Time.IsZero() || event.Data["note"] != "line\nbreak" {
+			t.Errorf("decoded %+v", event)
+		}
+	}
+}
+
+func TestNDJSONFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+
+	for _, eventType := range []string{Registered, Matched} {
+		exporter, err := OpenNDJSONFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := exporter.Export(context.Background(), &Event{Type: eventType}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := exporter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	output, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := decodeLines(t, output)
+	if len(decoded) != 2 || decoded[0].Type != Registered || decoded[1].Type != Matched {
+		t.Errorf("file holds %q", output)
+	}
+}
+
+func TestStreamExporter(t *testing.T) {
+	redisClient := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	ctx := context.Background()
+
+	exporter := &StreamExporter{RedisClient: redisClient, Stream: "events"}
+
+	for _, event := range []*Event{
+		{Type: Matched, MatchID: "match-1"},
+		{Type: SessionEnded, MatchID: "match-1", Data: map[string]interface{}{"reason": ReasonSkipped}},
+	} {
+		if err := exporter.Export(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var read []*Event
+
+	if err := ReadStream(ctx, redisClient, "events", "0", false, func(_ string, event *Event) error {
+		read = append(read, event)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(read) != 2 || read[0].Type != Matched || read[1].Data["reason"] != ReasonSkipped {
+		t.Errorf("read %+v", read)
+	}
+}
+
+func TestRecordSurvivesUnavailableStream(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: redisServer.Addr(), MaxRetries: -1})
+	redisServer.Close()
+
+	var output, logs bytes.Buffer
+
+	logger := zerolog.New(&logs)
+	log := NewLog(&logger, &StreamExporter{RedisClient: redisClient, Stream: "events"}, NewNDJSONExporter(&output))
+
+	log.Record(context.Background(), &Event{Type: Disconnected, UserID: "alice"})
+
+	// the other exporters still get the event
+	if decoded := decodeLines(t, output.Bytes()); len(decoded) != 1 || decoded[0].UserID != "alice" {
+		t.Errorf("NDJSON output %q", output.String())
+	}
+
+	if !strings.Contains(logs.String(), "unable to export disconnected event") {
+		t.Errorf("logged %q", logs.String())
+	}
+
+	// a service without exporters has no log
+	var none *Log
+	none.Record(context.Background(), &Event{Type: Disconnected})
+
+	if err := none.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,52 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// NDJSONExporter writes one JSON event per line.
+type NDJSONExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+	c  io.Closer
+}
+
+func NewNDJSONExporter(w io.Writer) *NDJSONExporter {
+	return &NDJSONExporter{w: w}
+}
+
+// OpenNDJSONFile appends to the file at path, creating it if needed.
+func OpenNDJSONFile(path string) (*NDJSONExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NDJSONExporter{w: file, c: file}, nil
+}
+
+func (e *NDJSONExporter) Export(ctx context.Context, event *Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, err = e.w.Write(append(line, '\n'))
+
+	return err
+}
+
+func (e *NDJSONExporter) Close() error {
+	if e.c == nil {
+		return nil
+	}
+
+	return e.c.Close()
+}
@@ -0,0 +1,84 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// StreamExporter appends events to a Redis stream, the JSON event is kept
+// in the entry's "event" field.
+type StreamExporter struct {
+	RedisClient *redis.Client
+	Stream      string
+	// MaxLen trims the stream to about this many entries, 0 keeps all
+	MaxLen int64
+}
+
+func (e *StreamExporter) Export(ctx context.Context, event *Event) error {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return e.RedisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: e.Stream,
+		MaxLen: e.MaxLen,
+		Approx: e.MaxLen > 0,
+		Values: map[string]interface{}{"type": event.Type, "event": eventJSON},
+	}).Err()
+}
+
+func (e *StreamExporter) Close() error {
+	return nil
+}
+
+// ReadStream calls fn with the events of the stream after the entry id
+// lastID, "0" for all of them. With follow it waits for new entries until
+// the context is done, otherwise it returns at the end of the stream.
+func ReadStream(ctx context.Context, redisClient *redis.Client, stream string, lastID string, follow bool,
+	fn func(id string, event *Event) error) error {
+	for {
+		args := &redis.XReadArgs{
+			Streams: []string{stream, lastID},
+			Count:   500,
+			Block:   -1,
+		}
+
+		if follow {
+			args.Block = 5 * time.Second
+		}
+
+		streams, err := redisClient.XRead(ctx, args).Result()
+		if errors.Is(err, redis.Nil) {
+			if !follow {
+				return nil
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range streams[0].Messages {
+			lastID = entry.ID
+
+			eventJSON, ok := entry.Values["event"].(string)
+			if !ok {
+				continue
+			}
+
+			var event Event
+
+			if err := json.Unmarshal([]byte(eventJSON), &event); err != nil {
+				return err
+			}
+
+			if err := fn(entry.ID, &event); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,407 @@
+// Package filter screens the text chat relayed between peers. A pipeline of
+// filters passes, masks, drops or flags each message for moderation.
+package filter
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Actions a filter takes on a message.
+const (
+	Pass = "pass"
+	Mask = "mask"
+	Drop = "drop"
+	Flag = "flag"
+)
+
+func ValidAction(action string) bool {
+	return action == Pass || action == Mask || action == Drop || action == Flag
+}
+
+// Message is a text message on its way to the sender's peers.
+type Message struct {
+	UserID string
+	// Locale is the sender's language, e.g. en, empty when unknown
+	Locale string
+	Text   string
+}
+
+// Filter checks a message and returns the action to take, filters that mask
+// rewrite the message's text.
+type Filter interface {
+	Name() string
+	Check(msg *Message) string
+}
+
+// Verdict is the action a filter took on a message.
+type Verdict struct {
+	Filter string
+	Action string
+}
+
+// Result of screening a message.
+type Result struct {
+	// Action is drop when a filter dropped the message, mask when one masked
+	// it and pass otherwise, flagged messages are delivered
+	Action string
+	Text   string
+	// Verdicts of the filters that did not pass the message
+	Verdicts []Verdict
+}
+
+// Flagged names the filters that flagged the message for moderation.
+func (r *Result) Flagged() []string {
+	var filters []string
+
+	for _, verdict := range r.Verdicts {
+		if verdict.Action == Flag {
+			filters = append(filters, verdict.Filter)
+		}
+	}
+
+	return filters
+}
+
+// Pipeline runs filters in order until one drops the message.
+type Pipeline struct {
+	Filters []Filter
+}
+
+// Screen runs the filters on a message, a nil pipeline passes everything.
+func (p *Pipeline) Screen(msg *Message) *Result {
+	result := &Result{Action: Pass, Text: msg.Text}
+
+	if p == nil {
+		return result
+	}
+
+	for _, filter := range p.Filters {
+		action := filter.Check(msg)
+		if action == Pass {
+			continue
+		}
+
+		result.Verdicts = append(result.Verdicts, Verdict{Filter: filter.Name(), Action: action})
+
+		switch action {
+		case Drop:
+			result.Action = Drop
+			return result
+		case Mask:
+			result.Action = Mask
+		}
+	}
+
+	result.Text = msg.Text
+
+	return result
+}
+
+// Clean strips control characters but newlines, and the characters that
+// reorder text, so a message shows as it was typed.
+func Clean(text string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n':
+			return r
+		case unicode.IsControl(r), r >= '\u202a' && r <= '\u202e', r >= '\u2066' && r <= '\u2069':
+			return -1
+		}
+
+		return r
+	}, text)
+}
+
+// Wordlist masks, drops or flags words from per-locale lists of profanity.
+// Messages are checked against the list of the sender's locale, or every
+// list when there is none for it.
+type Wordlist struct {
+	Action string
+	// locale -> folded word
+	lists map[string]map[string]bool
+}
+
+func NewWordlist(lists map[string][]string, action string) *Wordlist {
+	w := &Wordlist{Action: action, lists: make(map[string]map[string]bool)}
+
+	for locale, words := range lists {
+		w.lists[locale] = make(map[string]bool)
+
+		for _, word := range words {
+			w.lists[locale][fold(word)] = true
+		}
+	}
+
+	return w
+}
+
+// LoadWordlists reads the lists of a directory, one <locale>.txt file per
+// locale with a word per line, lines starting with # are comments.
+func LoadWordlists(dir string) (map[string][]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(paths) == 0 {
+		return nil, errors.New("no wordlists in " + dir)
+	}
+
+	lists := make(map[string][]string)
+
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		locale := strings.ToLower(strings.TrimSuffix(filepath.Base(path), ".txt"))
+
+		for _, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			lists[locale] = append(lists[locale], line)
+		}
+	}
+
+	return lists, nil
+}
+
+func (w *Wordlist) Name() string {
+	return "profanity"
+}
+
+func (w *Wordlist) Check(msg *Message) string {
+	lists := w.lists
+	if list, ok := w.lists[msg.Locale]; ok {
+		lists = map[string]map[string]bool{msg.Locale: list}
+	}
+
+	text := []rune(msg.Text)
+	found := false
+
+	for start := 0; start < len(text); {
+		if !wordRune(text[start]) {
+			start++
+			continue
+		}
+
+		end := start
+		for end < len(text) && wordRune(text[end]) {
+			end++
+		}
+
+		word := fold(string(text[start:end]))
+
+		for _, list := range lists {
+			if !list[word] {
+				continue
+			}
+
+			found = true
+			for i := start; i < end; i++ {
+				text[i] = '*'
+			}
+
+			break
+		}
+
+		start = end
+	}
+
+	if !found {
+		return Pass
+	}
+
+	if w.Action == Mask {
+		msg.Text = string(text)
+	}
+
+	return w.Action
+}
+
+// wordRune is part of a word, symbols standing in for letters included.
+func wordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '@' || r == '$'
+}
+
+var leet = strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s")
+
+// fold lowercases a word and undoes common letter substitutions.
+func fold(word string) string {
+	return leet.Replace(strings.ToLower(word))
+}
+
+// links are web addresses, with a scheme, a www. prefix or a common top
+// level domain.
+var links = regexp.MustCompile(`(?i)\b(?:https?://[^\s]+|www\.[^\s]+|[a-z0-9][a-z0-9-]*(?:\.[a-z0-9-]+)*\.(?:com|net|org|io|co|me|gg|ly|app|dev|xyz|info|biz|tv|to|ru|cn|de|uk|fr|nl|es|it|br|in)\b(?:/[^\s]*)?)`)
+
+// Links masks, drops or flags web addresses, except those of the Allow
+// hosts and their subdomains.
+type Links struct {
+	Action string
+	Allow  []string
+}
+
+func (l *Links) Name() string {
+	return "links"
+}
+
+func (l *Links) Check(msg *Message) string {
+	found := false
+
+	text := links.ReplaceAllStringFunc(msg.Text, func(link string) string {
+		if l.allowed(link) {
+			return link
+		}
+
+		found = true
+
+		return "[link]"
+	})
+
+	if !found {
+		return Pass
+	}
+
+	if l.Action == Mask {
+		msg.Text = text
+	}
+
+	return l.Action
+}
+
+func (l *Links) allowed(link string) bool {
+	host := strings.ToLower(link)
+	host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+
+	if i := strings.IndexAny(host, "/?#:"); i >= 0 {
+		host = host[:i]
+	}
+
+	for _, allowed := range l.Allow {
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// maxHistory bounds the messages remembered per user.
+const maxHistory = 64
+
+// Repeats catches spam, the same text sent more than Max times by a user
+// within Window.
+type Repeats struct {
+	Action string
+	Max    int
+	Window time.Duration
+
+	mu        sync.Mutex
+	history   map[string][]sent
+	lastSweep time.Time
+}
+
+type sent struct {
+	text string
+	at   time.Time
+}
+
+func NewRepeats(max int, window time.Duration, action string) *Repeats {
+	return &Repeats{
+		Action:  action,
+		Max:     max,
+		Window:  window,
+		history: make(map[string][]sent),
+	}
+}
+
+func (r *Repeats) Name() string {
+	return "spam"
+}
+
+func (r *Repeats) Check(msg *Message) string {
+	now := time.Now()
+	text := strings.Join(strings.Fields(fold(msg.Text)), " ")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// users who left are forgotten once their messages are out of the window
+	if now.Sub(r.lastSweep) > r.Window {
+		for userID, history := range r.history {
+			if history = r.recent(history, now); len(history) == 0 {
+				delete(r.history, userID)
+			} else {
+				r.history[userID] = history
+			}
+		}
+
+		r.lastSweep = now
+	}
+
+	history := r.recent(r.history[msg.UserID], now)
+
+	repeats := 0
+	for _, s := range history {
+		if s.text == text {
+			repeats++
+		}
+	}
+
+	history = append(history, sent{text: text, at: now})
+	if len(history) > maxHistory {
+		history = history[len(history)-maxHistory:]
+	}
+
+	r.history[msg.UserID] = history
+
+	if repeats < r.Max {
+		return Pass
+	}
+
+	return r.Action
+}
+
+func (r *Repeats) recent(history []sent, now time.Time) []sent {
+	for len(history) > 0 && now.Sub(history[0].at) > r.Window {
+		history = history[1:]
+	}
+
+	return history
+}
+
+// MaxLength acts on messages longer than Max characters, masking cuts them
+// to Max.
+type MaxLength struct {
+	Action string
+	Max    int
+}
+
+func (m *MaxLength) Name() string {
+	return "length"
+}
+
+func (m *MaxLength) Check(msg *Message) string {
+	text := []rune(msg.Text)
+	if len(text) <= m.Max {
+		return Pass
+	}
+
+	if m.Action == Mask {
+		msg.Text = string(text[:m.Max])
+	}
+
+	return m.Action
+}
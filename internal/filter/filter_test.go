@@ -0,0 +1,69 @@
+package filter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPipeline(t *testing.T) {
+	pipeline := &Pipeline{Filters: []Filter{
+		NewWordlist(map[string][]string{"en": {"darn"}}, Mask),
+		&Links{Action: Flag},
+		&MaxLength{Action: Drop, Max: 20},
+	}}
+
+	tests := []struct {
+		text    string
+		action  string
+		want    string
+		flagged int
+	}{
+		{"hello", Pass, "hello", 0},
+		{"d4rn it", Mask, "**** it", 0},
+		{"Scunthorpe darning", Pass, "Scunthorpe darning", 0},
+		{"see spam.com", Pass, "see spam.com", 1},
+		{"this message is far too long", Drop, "this message is far too long", 0},
+	}
+
+	for _, tt := range tests {
+		result := pipeline.Screen(&Message{UserID: "alice", Locale: "en", Text: tt.text})
+
+		if result.Action != tt.action || result.Text != tt.want || len(result.Flagged()) != tt.flagged {
+			t.Errorf("Screen(%q) = %s %q flagged %v, want %s %q flagged %d", tt.text, result.Action,
+				result.Text, result.Flagged(), tt.action, tt.want, tt.flagged)
+		}
+	}
+}
+
+func TestClean(t *testing.T) {
+	if got := Clean("a‮b⁦c\x1b[0m\nd\te"); got != "abc[0m\nde" {
+		t.Errorf("Clean = %q", got)
+	}
+}
+
+func TestLinksAllow(t *testing.T) {
+	links := &Links{Action: Mask, Allow: []string{"example.org"}}
+	msg := &Message{Text: "docs.example.org and https://example.org.evil.com/x"}
+
+	if action := links.Check(msg); action != Mask {
+		t.Errorf("action = %s, want mask", action)
+	}
+
+	if msg.Text != "docs.example.org and [link]" {
+		t.Errorf("text = %q", msg.Text)
+	}
+}
+
+func TestRepeats(t *testing.T) {
+	repeats := NewRepeats(2, time.Minute, Drop)
+
+	for i, want := range []string{Pass, Pass, Drop} {
+		if action := repeats.Check(&Message{UserID: "alice", Text: "Buy  NOW"}); action != want {
+			t.Errorf("message %d: action = %s, want %s", i, action, want)
+		}
+	}
+
+	if action := repeats.Check(&Message{UserID: "bob", Text: "buy now"}); action != Pass {
+		t.Errorf("another user's message: action = %s, want pass", action)
+	}
+}
@@ -0,0 +1,135 @@
+// Package geo tags users with where they connect from, so the matcher can
+// prefer nearby peers. Locations are coarse and never carry the address.
+package geo
+
+import (
+	"errors"
+	"github.com/oschwald/maxminddb-golang"
+	"math"
+	"net"
+	"strings"
+)
+
+// earthRadius in km
+const earthRadius = 6371
+
+// Location is where a user connects from, to about 10 km.
+type Location struct {
+	// Region is the continent and country code, e.g. EU-DE, the only part
+	// shown to peers
+	Region    string
+	Country   string
+	Latitude  float64
+	Longitude float64
+}
+
+// Resolver locates IP addresses, it returns nil for addresses it does not
+// know.
+type Resolver interface {
+	Resolve(ip string) (*Location, error)
+}
+
+// Distance is the great-circle distance between two locations in km.
+func Distance(a *Location, b *Location) float64 {
+	lat1, lat2 := radians(a.Latitude), radians(b.Latitude)
+	dLat, dLon := lat2-lat1, radians(b.Longitude-a.Longitude)
+
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dLon/2), 2)
+
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+// MaxMind resolves addresses with a local database in the MaxMind format,
+// such as GeoLite2 City.
+type MaxMind struct {
+	reader *maxminddb.Reader
+}
+
+func OpenMaxMind(path string) (*MaxMind, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MaxMind{reader: reader}, nil
+}
+
+func (m *MaxMind) Resolve(ip string) (*Location, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, errors.New("invalid ip address " + ip)
+	}
+
+	var record struct {
+		Continent struct {
+			Code string `maxminddb:"code"`
+		} `maxminddb:"continent"`
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		Location struct {
+			Latitude  float64 `maxminddb:"latitude"`
+			Longitude float64 `maxminddb:"longitude"`
+		} `maxminddb:"location"`
+	}
+
+	if err := m.reader.Lookup(addr, &record); err != nil {
+		return nil, err
+	}
+
+	if record.Country.ISOCode == "" {
+		return nil, nil
+	}
+
+	return &Location{
+		Region:    region(record.Continent.Code, record.Country.ISOCode),
+		Country:   record.Country.ISOCode,
+		Latitude:  coarse(record.Location.Latitude),
+		Longitude: coarse(record.Location.Longitude),
+	}, nil
+}
+
+func (m *MaxMind) Close() error {
+	return m.reader.Close()
+}
+
+func region(continent string, country string) string {
+	if continent == "" {
+		return country
+	}
+
+	return continent + "-" + country
+}
+
+// coarse rounds a coordinate to a tenth of a degree.
+func coarse(degrees float64) float64 {
+	return math.Round(degrees*10) / 10
+}
+
+// Fake resolves the addresses or CIDR ranges it maps, for tests and local
+// setups without a database.
+type Fake map[string]*Location
+
+func (f Fake) Resolve(ip string) (*Location, error) {
+	if location, ok := f[ip]; ok {
+		return location, nil
+	}
+
+	addr := net.ParseIP(ip)
+
+	for key, location := range f {
+		if !strings.Contains(key, "/") {
+			continue
+		}
+
+		if _, network, err := net.ParseCIDR(key); err == nil && addr != nil && network.Contains(addr) {
+			return location, nil
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,176 @@
+// Package matching decides which waiting users may be paired, and in which
+// order candidates are considered. Constraints relax the longer a user
+// waits, so nobody waits without bound while others get matched.
+package matching
+
+import (
+	"math"
+	"rvc/internal/geo"
+	"rvc/internal/models"
+	"slices"
+	"sort"
+	"time"
+)
+
+// LowReputation is the reputation below which users are matched among
+// themselves for longer.
+const LowReputation = 0.35
+
+const (
+	// SameLanguageFor is how long users are only matched with peers of their
+	// language, when both languages are known
+	SameLanguageFor = 10 * time.Second
+	// SharedTagsFor is how long users that picked tags are only matched with
+	// peers sharing one of them
+	SharedTagsFor = 20 * time.Second
+)
+
+// Candidate is a user of the unpaired pool that may be paired with a waiter.
+type Candidate struct {
+	UserID string
+	Mode   string
+	// AnyMode users accept peers of any mode once both waited long enough
+	AnyMode    bool
+	Reputation float64
+	Bot        bool
+	// Reach is one of the models' reaches, Location is nil when unknown
+	Reach    string
+	Location *geo.Location
+	// Locale is the language the user prefers, "" when unknown, Tags the
+	// interests the user picked
+	Locale string
+	Tags   []string
+	// WaitingSince is zero for users that are not looking for a match
+	WaitingSince time.Time
+}
+
+// Policy holds the constraints of a search.
+type Policy struct {
+	// Modes the candidate may be in, any mode when empty
+	Modes        []string
+	ByReputation bool
+	// RelaxModesAfter is the wait after which users that both opted in are
+	// matched with any mode, zero keeps modes strict
+	RelaxModesAfter time.Duration
+}
+
+// Eligible tells if the candidate may be paired with the waiter at now, the
+// constraints relax with the wait of the waiter. Bots chat with anyone within
+// the waiter's reach.
+func (p Policy) Eligible(waiter *Candidate, candidate *Candidate, now time.Time) bool {
+	waited := now.Sub(waiter.WaitingSince)
+
+	if !waiter.accepts(candidate) || !candidate.accepts(waiter) {
+		return false
+	}
+
+	// nearby peers first, the distance widens with the wait
+	if waiter.Reach != models.ReachAnywhere && waiter.Location != nil && candidate.Location != nil &&
+		geo.Distance(waiter.Location, candidate.Location) > DistanceBand(waited) {
+		return false
+	}
+
+	if candidate.Bot {
+		return true
+	}
+
+	if p.ByReputation {
+		band := ReputationBand(waited, waiter.Reputation < LowReputation || candidate.Reputation < LowReputation)
+		if math.Abs(waiter.Reputation-candidate.Reputation) > band {
+			return false
+		}
+	}
+
+	// each side keeps its language and tags until it waited long enough
+	if !speaksSameLanguage(waiter, candidate) &&
+		(waiter.waited(now) < SameLanguageFor || candidate.waited(now) < SameLanguageFor) {
+		return false
+	}
+
+	if !sharesTag(waiter, candidate) &&
+		(len(waiter.Tags) > 0 && waiter.waited(now) < SharedTagsFor ||
+			len(candidate.Tags) > 0 && candidate.waited(now) < SharedTagsFor) {
+		return false
+	}
+
+	if len(p.Modes) > 0 && !slices.Contains(p.Modes, candidate.Mode) {
+		return p.relaxesModes(waiter, now) && p.relaxesModes(candidate, now)
+	}
+
+	return true
+}
+
+// waited is how long the user has been waiting at now, 0 for users that are
+// not looking for a match.
+func (c *Candidate) waited(now time.Time) time.Duration {
+	if c.WaitingSince.IsZero() {
+		return 0
+	}
+
+	return now.Sub(c.WaitingSince)
+}
+
+// speaksSameLanguage tells if the users prefer the same language, users of
+// an unknown language speak any.
+func speaksSameLanguage(a *Candidate, b *Candidate) bool {
+	return a.Locale == "" || b.Locale == "" || a.Locale == b.Locale
+}
+
+func sharesTag(a *Candidate, b *Candidate) bool {
+	for _, tag := range a.Tags {
+		if slices.Contains(b.Tags, tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// relaxesModes tells if the user opted in to any mode and waited long enough
+// for it.
+func (p Policy) relaxesModes(c *Candidate, now time.Time) bool {
+	return p.RelaxModesAfter > 0 && c.AnyMode && !c.WaitingSince.IsZero() &&
+		now.Sub(c.WaitingSince) >= p.RelaxModesAfter
+}
+
+// accepts tells if the user's reach allows the other user, users of an
+// unknown location cannot restrict their country.
+func (c *Candidate) accepts(other *Candidate) bool {
+	if c.Reach != models.ReachCountry || c.Location == nil {
+		return true
+	}
+
+	return other.Location != nil && other.Location.Country == c.Location.Country
+}
+
+// ReputationBand is how far apart in reputation users are matched after
+// waiting, it widens over time and slower when one of them has a low
+// reputation.
+func ReputationBand(waited time.Duration, low bool) float64 {
+	step := 3 * time.Second
+	if low {
+		step = 10 * time.Second
+	}
+
+	return min(0.1+0.1*float64(waited/step), 1)
+}
+
+// DistanceBand is how far apart in km users are matched after waiting, it
+// doubles every 5 seconds from 500 km so it spans the globe after half a
+// minute.
+func DistanceBand(waited time.Duration) float64 {
+	return 500 * math.Pow(2, float64(waited/(5*time.Second)))
+}
+
+// Order puts the candidates waiting the longest first, users that are not
+// waiting keep their order after them.
+func Order(candidates []Candidate) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i].WaitingSince, candidates[j].WaitingSince
+		if a.IsZero() || b.IsZero() {
+			return !a.IsZero() && b.IsZero()
+		}
+
+		return a.Before(b)
+	})
+}
@@ -0,0 +1,209 @@
+package matching
+
+import (
+	"testing"
+	"time"
+
+	"rvc/internal/geo"
+	"rvc/internal/models"
+)
+
+func TestEligibleKeepsModesStrictByDefault(t *testing.T) {
+	now := time.Now()
+	policy := Policy{Modes: models.CompatibleModes(models.ModeText)}
+
+	waiter := &Candidate{UserID: "a", Mode: models.ModeText, AnyMode: true, WaitingSince: now.Add(-time.Hour)}
+	video := &Candidate{UserID: "b", Mode: models.ModeVideo, AnyMode: true, WaitingSince: now.Add(-time.Hour)}
+	text := &Candidate{UserID: "c", Mode: models.ModeText, WaitingSince: now}
+
+	if policy.Eligible(waiter, video, now) {
+		t.Error("matched a video user with a text user without relaxing modes")
+	}
+
+	if !policy.Eligible(waiter, text, now) {
+		t.Error("did not match two text users")
+	}
+}
+
+func TestEligibleRelaxesModesForBothSides(t *testing.T) {
+	now := time.Now()
+	policy := Policy{Modes: models.CompatibleModes(models.ModeText), RelaxModesAfter: 20 * time.Second}
+
+	waiter := &Candidate{UserID: "a", Mode: models.ModeText, AnyMode: true, WaitingSince: now.Add(-time.Minute)}
+
+	for name, test := range map[string]struct {
+		candidate *Candidate
+		want      bool
+	}{
+		"both waited and opted in": {
+			candidate: &Candidate{Mode: models.ModeVideo, AnyMode: true, WaitingSince: now.Add(-30 * time.Second)},
+			want:      true,
+		},
+		"candidate just arrived": {
+			candidate: &Candidate{Mode: models.ModeVideo, AnyMode: true, WaitingSince: now.Add(-time.Second)},
+		},
+		"candidate did not opt in": {
+			candidate: &Candidate{Mode: models.ModeVideo, WaitingSince: now.Add(-time.Minute)},
+		},
+		"candidate is not waiting": {
+			candidate: &Candidate{Mode: models.ModeVideo, AnyMode: true},
+		},
+	} {
+		if got := policy.Eligible(waiter, test.candidate, now); got != test.want {
+			t.Errorf("%s: Eligible = %v, want %v", name, got, test.want)
+		}
+	}
+
+	// the waiter has to opt in and wait as well
+	candidate := &Candidate{Mode: models.ModeVideo, AnyMode: true, WaitingSince: now.Add(-time.Minute)}
+
+	if policy.Eligible(&Candidate{Mode: models.ModeText, WaitingSince: now.Add(-time.Minute)}, candidate, now) {
+		t.Error("relaxed modes for a waiter that did not opt in")
+	}
+
+	if policy.Eligible(&Candidate{Mode: models.ModeText, AnyMode: true, WaitingSince: now}, candidate, now) {
+		t.Error("relaxed modes for a waiter that just arrived")
+	}
+}
+
+func TestEligibleHoldsBotsToReach(t *testing.T) {
+	now := time.Now()
+	policy := Policy{Modes: models.CompatibleModes(models.ModeVideo), ByReputation: true}
+
+	paris := &geo.Location{Country: "FR", Latitude: 48.9, Longitude: 2.4}
+	berlin := &geo.Location{Country: "DE", Latitude: 52.5, Longitude: 13.4}
+	sydney := &geo.Location{Country: "AU", Latitude: -33.9, Longitude: 151.2}
+
+	bot := func(location *geo.Location) *Candidate {
+		return &Candidate{Mode: models.ModeText, Bot: true, Reach: models.ReachAnywhere, Location: location}
+	}
+
+	for name, test := range map[string]struct {
+		waiter *Candidate
+		bot    *Candidate
+		want   bool
+	}{
+		"country reach, bot in the country": {
+			waiter: &Candidate{Reach: models.ReachCountry, Location: paris},
+			bot:    bot(&geo.Location{Country: "FR", Latitude: 45.8, Longitude: 4.8}),
+			want:   true,
+		},
+		"country reach, bot abroad": {
+			waiter: &Candidate{Reach: models.ReachCountry, Location: paris},
+			bot:    bot(berlin),
+		},
+		"country reach, bot without a location": {
+			waiter: &Candidate{Reach: models.ReachCountry, Location: paris},
+			bot:    bot(nil),
+		},
+		"nearby reach, bot far away": {
+			waiter: &Candidate{Reach: models.ReachNearby, Location: paris},
+			bot:    bot(sydney),
+		},
+		"nearby reach, bot without a location": {
+			waiter: &Candidate{Reach: models.ReachNearby, Location: paris},
+			bot:    bot(nil),
+			want:   true,
+		},
+		"anywhere": {
+			waiter: &Candidate{Reach: models.ReachAnywhere, Location: paris},
+			bot:    bot(sydney),
+			want:   true,
+		},
+	} {
+		// bots skip the mode and reputation bands
+		test.waiter.Mode = models.ModeVideo
+		test.waiter.Reputation = 0.9
+		test.waiter.WaitingSince = now
+
+		if got := policy.Eligible(test.waiter, test.bot, now); got != test.want {
+			t.Errorf("%s: Eligible = %v, want %v", name, got, test.want)
+		}
+	}
+}
+
+func TestEligiblePrefersLanguageAndTags(t *testing.T) {
+	now := time.Now()
+	policy := Policy{}
+
+	user := func(locale string, waited time.Duration, tags ...string) *Candidate {
+		return &Candidate{Mode: models.ModeVideo, Locale: locale, Tags: tags, WaitingSince: now.Add(-waited)}
+	}
+
+	for name, test := range map[string]struct {
+		waiter    *Candidate
+		candidate *Candidate
+		want      bool
+	}{
+		"same language": {
+			waiter:    user("en", 0),
+			candidate: user("en", 0),
+			want:      true,
+		},
+		"other language": {
+			waiter:    user("en", 0),
+			candidate: user("de", 0),
+		},
+		"unknown language": {
+			waiter:    user("en", 0),
+			candidate: user("", 0),
+			want:      true,
+		},
+		"other language, waiter waited": {
+			waiter:    user("en", SameLanguageFor),
+			candidate: user("de", time.Second),
+		},
+		"other language, both waited": {
+			waiter:    user("en", SameLanguageFor),
+			candidate: user("de", SameLanguageFor),
+			want:      true,
+		},
+		"other language, candidate not waiting": {
+			waiter:    user("en", time.Minute),
+			candidate: &Candidate{Mode: models.ModeVideo, Locale: "de"},
+		},
+		"shared tag": {
+			waiter:    user("en", 0, "music", "films"),
+			candidate: user("en", 0, "films"),
+			want:      true,
+		},
+		"no shared tag": {
+			waiter:    user("en", 0, "music"),
+			candidate: user("en", 0, "films"),
+		},
+		"waiter picked tags": {
+			waiter:    user("en", 0, "music"),
+			candidate: user("en", 0),
+		},
+		"candidate picked tags": {
+			waiter:    user("en", time.Minute),
+			candidate: user("en", 0, "music"),
+		},
+		"no tags": {
+			waiter:    user("en", 0),
+			candidate: user("en", 0),
+			want:      true,
+		},
+		"tags, waiter waited": {
+			waiter:    user("en", SharedTagsFor, "music"),
+			candidate: user("en", 0),
+			want:      true,
+		},
+		"tags, both waited": {
+			waiter:    user("en", SharedTagsFor, "music"),
+			candidate: user("en", SharedTagsFor, "films"),
+			want:      true,
+		},
+	} {
+		if got := policy.Eligible(test.waiter, test.candidate, now); got != test.want {
+			t.Errorf("%s: Eligible = %v, want %v", name, got, test.want)
+		}
+	}
+
+	// bots chat in any language
+	bot := &Candidate{Mode: models.ModeText, Bot: true, Locale: "de"}
+
+	if !policy.Eligible(user("en", 0, "music"), bot, now) {
+		t.Error("a bot was held to language and tags")
+	}
+}
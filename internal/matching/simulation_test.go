@@ -0,0 +1,345 @@
+package matching
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"rvc/internal/models"
+)
+
+// waiter is a simulated user looking for a match, times are offsets from the
+// start of the simulation. Users retry as soon as a search times out and
+// keep their place in the queue.
+type waiter struct {
+	id            int
+	mode          string
+	reputation    float64
+	locale        string
+	tags          []string
+	arrived       time.Duration
+	searchStarted time.Duration
+}
+
+type simulation struct {
+	arrivals  int
+	rate      float64
+	interval  time.Duration
+	timeout   time.Duration
+	textShare float64
+	lowShare  float64
+	// locales are drawn uniformly, repeat one to weigh it; tagShare of the
+	// users pick one or two of tags
+	locales  []string
+	tagShare float64
+	tags     []string
+	// random picks candidates from a random sample like the matcher used
+	// to, instead of the longest waiters first
+	random bool
+	policy func(*waiter) Policy
+}
+
+type result struct {
+	waits    []time.Duration
+	groups   map[string][]time.Duration
+	timeouts int
+
+	pairs        int
+	sameLanguage int
+	// taggedPairs have a user that picked tags, sharedTags a tag in common
+	taggedPairs int
+	sharedTags  int
+}
+
+// run replays the arrivals in virtual time, every interval each waiting
+// user makes a search attempt the way the event worker does.
+func (sim *simulation) run(rng *rand.Rand) *result {
+	res := &result{groups: make(map[string][]time.Duration)}
+
+	var waiting []*waiter
+	var now time.Duration
+
+	next := time.Duration(rng.ExpFloat64() / sim.rate * float64(time.Second))
+
+	for arrived := 0; arrived < sim.arrivals || len(waiting) > 0; now += sim.interval {
+		for ; arrived < sim.arrivals && next <= now; arrived++ {
+			waiting = append(waiting, sim.newWaiter(rng, arrived, next))
+			next += time.Duration(rng.ExpFloat64() / sim.rate * float64(time.Second))
+		}
+
+		if sim.random {
+			rng.Shuffle(len(waiting), func(i, j int) { waiting[i], waiting[j] = waiting[j], waiting[i] })
+		} else {
+			sort.SliceStable(waiting, func(i, j int) bool { return waiting[i].arrived < waiting[j].arrived })
+		}
+
+		paired := map[int]bool{}
+
+		for _, w := range waiting {
+			if paired[w.id] {
+				continue
+			}
+
+			if now-w.searchStarted >= sim.timeout {
+				res.timeouts++
+				w.searchStarted = now
+			}
+
+			candidate := sim.pick(rng, w, waiting, paired, now)
+			if candidate == nil {
+				continue
+			}
+
+			paired[w.id], paired[candidate.id] = true, true
+			res.countPair(w, candidate)
+
+			for _, u := range []*waiter{w, candidate} {
+				res.waits = append(res.waits, now-u.arrived)
+				res.groups[u.group()] = append(res.groups[u.group()], now-u.arrived)
+			}
+		}
+
+		remaining := waiting[:0]
+		for _, w := range waiting {
+			if !paired[w.id] {
+				remaining = append(remaining, w)
+			}
+		}
+		waiting = remaining
+
+		// users left without any eligible candidate would wait forever
+		if arrived == sim.arrivals && now > next+time.Hour {
+			break
+		}
+	}
+
+	return res
+}
+
+func (sim *simulation) newWaiter(rng *rand.Rand, id int, arrived time.Duration) *waiter {
+	mode := models.ModeVideo
+	if rng.Float64() < sim.textShare {
+		mode = models.ModeText
+	}
+
+	reputation := math.Max(0, math.Min(1, 0.7+rng.NormFloat64()*0.1))
+	if rng.Float64() < sim.lowShare {
+		reputation = rng.Float64() * LowReputation
+	}
+
+	w := &waiter{id: id, mode: mode, reputation: reputation, arrived: arrived, searchStarted: arrived}
+
+	if len(sim.locales) > 0 {
+		w.locale = sim.locales[rng.Intn(len(sim.locales))]
+	}
+
+	if sim.tagShare > 0 && rng.Float64() < sim.tagShare {
+		for _, i := range rng.Perm(len(sim.tags))[:1+rng.Intn(2)] {
+			w.tags = append(w.tags, sim.tags[i])
+		}
+	}
+
+	return w
+}
+
+func (res *result) countPair(a *waiter, b *waiter) {
+	res.pairs++
+
+	if a.locale == b.locale {
+		res.sameLanguage++
+	}
+
+	if len(a.tags) > 0 || len(b.tags) > 0 {
+		res.taggedPairs++
+
+		if sharesTag(a.candidate(time.Time{}), b.candidate(time.Time{})) {
+			res.sharedTags++
+		}
+	}
+}
+
+// group names the kind of user, text and low reputation users have fewer
+// candidates.
+func (w *waiter) group() string {
+	if w.reputation < LowReputation {
+		return "low reputation"
+	}
+
+	return w.mode
+}
+
+// pick returns the first eligible candidate, among the waiters ordered by
+// wait or among a random sample of 16.
+func (sim *simulation) pick(rng *rand.Rand, w *waiter, waiting []*waiter, paired map[int]bool, now time.Duration) *waiter {
+	var candidates []*waiter
+
+	for _, other := range waiting {
+		if other.id != w.id && !paired[other.id] {
+			candidates = append(candidates, other)
+		}
+	}
+
+	if sim.random {
+		rng.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+		candidates = candidates[:min(16, len(candidates))]
+	}
+
+	start := time.Unix(0, 0)
+	policy := sim.policy(w)
+
+	for _, other := range candidates {
+		if policy.Eligible(w.candidate(start), other.candidate(start), start.Add(now)) {
+			return other
+		}
+	}
+
+	return nil
+}
+
+func (w *waiter) candidate(start time.Time) *Candidate {
+	return &Candidate{
+		UserID:       fmt.Sprint(w.id),
+		Mode:         w.mode,
+		AnyMode:      true,
+		Reputation:   w.reputation,
+		Locale:       w.locale,
+		Tags:         w.tags,
+		WaitingSince: start.Add(w.arrived),
+	}
+}
+
+func percentile(waits []time.Duration, p float64) time.Duration {
+	sorted := append([]time.Duration(nil), waits...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return sorted[min(len(sorted)-1, int(p*float64(len(sorted))))]
+}
+
+// report logs the wait-time distribution of the matched users.
+func (res *result) report(t *testing.T, arrivals int) {
+	t.Logf("arrivals %d, matched %d, search timeouts %d", arrivals, len(res.waits), res.timeouts)
+	t.Logf("pairs of one language %.1f%%, tagged pairs sharing a tag %.1f%%",
+		100*float64(res.sameLanguage)/float64(res.pairs), 100*float64(res.sharedTags)/float64(res.taggedPairs))
+	t.Logf("wait p50 %v, p90 %v, p99 %v, max %v", percentile(res.waits, 0.5).Round(100*time.Millisecond),
+		percentile(res.waits, 0.9).Round(100*time.Millisecond), percentile(res.waits, 0.99).Round(100*time.Millisecond),
+		percentile(res.waits, 1).Round(100*time.Millisecond))
+
+	buckets := []time.Duration{2 * time.Second, 5 * time.Second, 10 * time.Second, 20 * time.Second,
+		30 * time.Second, time.Minute, 2 * time.Minute, 5 * time.Minute}
+	counts := make([]int, len(buckets)+1)
+
+	for _, wait := range res.waits {
+		counts[sort.Search(len(buckets), func(i int) bool { return wait <= buckets[i] })]++
+	}
+
+	for i, count := range counts {
+		label := fmt.Sprintf("> %v", buckets[len(buckets)-1])
+		if i < len(buckets) {
+			label = fmt.Sprintf("<= %v", buckets[i])
+		}
+
+		share := float64(count) / float64(len(res.waits))
+		t.Logf("%8s %6d %5.1f%% %s", label, count, 100*share, strings.Repeat("#", int(share*50)))
+	}
+}
+
+func newSimulation(arrivals int, relaxModesAfter time.Duration) *simulation {
+	return &simulation{
+		arrivals:  arrivals,
+		rate:      1,
+		interval:  2 * time.Second,
+		timeout:   30 * time.Second,
+		textShare: 0.2,
+		lowShare:  0.05,
+		locales:   []string{"en", "en", "en", "en", "en", "en", "en", "de", "de", "fr"},
+		tagShare:  0.5,
+		tags:      []string{"music", "films", "games", "sports", "books", "travel"},
+		policy: func(w *waiter) Policy {
+			return Policy{
+				Modes:           models.CompatibleModes(w.mode),
+				ByReputation:    true,
+				RelaxModesAfter: relaxModesAfter,
+			}
+		},
+	}
+}
+
+func TestSimulatedWaitsAreBounded(t *testing.T) {
+	const arrivals = 5000
+
+	for _, relaxModesAfter := range []time.Duration{0, 20 * time.Second} {
+		t.Run(fmt.Sprintf("relax modes after %v", relaxModesAfter), func(t *testing.T) {
+			res := newSimulation(arrivals, relaxModesAfter).run(rand.New(rand.NewSource(1)))
+			res.report(t, arrivals)
+
+			// a user left over when the arrivals stop has nobody to wait for
+			if len(res.waits) < arrivals-1 {
+				t.Errorf("matched %d of %d users", len(res.waits), arrivals)
+			}
+
+			if p50 := percentile(res.waits, 0.5); p50 > 5*time.Second {
+				t.Errorf("median wait %v, want at most 5s", p50)
+			}
+
+			if p99 := percentile(res.waits, 0.99); p99 > time.Minute {
+				t.Errorf("p99 wait %v, want at most a minute", p99)
+			}
+
+			if longest := percentile(res.waits, 1); longest > 3*time.Minute {
+				t.Errorf("longest wait %v, want at most 3 minutes", longest)
+			}
+		})
+	}
+}
+
+func TestSimulatedWaitsAreFair(t *testing.T) {
+	const arrivals = 5000
+
+	ordered := newSimulation(arrivals, 0)
+	res := ordered.run(rand.New(rand.NewSource(1)))
+
+	// users with fewer candidates wait longer, but not without bound
+	for group, waits := range res.groups {
+		if p90 := percentile(waits, 0.9); p90 > 90*time.Second {
+			t.Errorf("p90 wait of %s users %v, want at most 90s", group, p90)
+		}
+	}
+
+	// the longest waiters go first, so the tail is no longer than when
+	// candidates are picked at random; language and tags, which hold users
+	// apart either way, are left out to compare the order alone
+	var p99 [2]time.Duration
+
+	for i, random := range []bool{false, true} {
+		sim := newSimulation(arrivals, 0)
+		sim.random = random
+		sim.locales, sim.tagShare = nil, 0
+
+		p99[i] = percentile(sim.run(rand.New(rand.NewSource(1))).waits, 0.99)
+	}
+
+	if p99[0] > p99[1] {
+		t.Errorf("p99 wait %v, picking at random gives %v", p99[0], p99[1])
+	}
+}
+
+func TestSimulatedMatchesShareLanguageAndTags(t *testing.T) {
+	const arrivals = 5000
+
+	res := newSimulation(arrivals, 0).run(rand.New(rand.NewSource(1)))
+	res.report(t, arrivals)
+
+	// paired at random, 54% of the pairs would be of one language and about
+	// 12% of the pairs with tags would share one
+	if share := float64(res.sameLanguage) / float64(res.pairs); share < 0.75 {
+		t.Errorf("%.1f%% of pairs are of one language, want at least 75%%", 100*share)
+	}
+
+	if share := float64(res.sharedTags) / float64(res.taggedPairs); share < 0.5 {
+		t.Errorf("%.1f%% of pairs with tags share one, want at least 50%%", 100*share)
+	}
+}
@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+type Account struct {
+	AccountID string
+	Username  string
+	// PasswordHash is empty for accounts created through an identity provider
+	PasswordHash string
+	CreatedAt    time.Time
+}
@@ -0,0 +1,46 @@
+package models
+
+import "time"
+
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// Registration is what a client needs to connect once registered.
+type Registration struct {
+	UserID     string      `json:"user_id"`
+	Token      string      `json:"token"`
+	WsURL      string      `json:"ws_url"`
+	ICEServers []ICEServer `json:"ice_servers"`
+	Mode       string      `json:"mode"`
+}
+
+type Report struct {
+	ReportID string `json:"report_id"`
+	MatchID  string `json:"match_id"`
+	// Reporter and Reported are user ids, never handed out to clients
+	Reporter  string    `json:"reporter"`
+	Reported  string    `json:"reported"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// FlaggedMessage is a chat message a filter flagged for moderators.
+type FlaggedMessage struct {
+	MatchID   string    `json:"match_id"`
+	UserID    string    `json:"user_id"`
+	Text      string    `json:"text"`
+	Filters   []string  `json:"filters"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Problem is an RFC 9457 problem details error body.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"slices"
+	"time"
+)
+
+// FeedbackTags are the tags users may add to a rating.
+var FeedbackTags = []string{"great", "funny", "rude", "inappropriate", "no video", "no audio", "bad connection"}
+
+func ValidFeedbackTag(tag string) bool {
+	return slices.Contains(FeedbackTags, tag)
+}
+
+// Feedback is a rating of a peer after a match, From and To are user ids.
+type Feedback struct {
+	MatchID   string    `json:"match_id"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Rating    int       `json:"rating"`
+	Tags      []string  `json:"tags,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
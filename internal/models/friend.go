@@ -0,0 +1,7 @@
+package models
+
+type Friend struct {
+	FriendID string `json:"friend_id"`
+	Username string `json:"username"`
+	Online   bool   `json:"online"`
+}
@@ -0,0 +1,11 @@
+package models
+
+import "slices"
+
+// InterestTags are the tags users may pick when registering, users that
+// picked some are matched with peers sharing one first.
+var InterestTags = []string{"music", "films", "games", "sports", "books", "travel", "tech", "art"}
+
+func ValidInterestTag(tag string) bool {
+	return slices.Contains(InterestTags, tag)
+}
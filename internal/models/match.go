@@ -1,12 +1,90 @@
 package models
 
+import "time"
+
 type MatchRequest struct {
-	UserID1 string `json:"user_id1"`
-	UserID2 string `json:"user_id2"`
+	UserIDs []string `json:"user_ids"`
+	Size    int      `json:"size"`
+	Room    string   `json:"room,omitempty"`
+	// Direct matches pair the given users regardless of the unpaired pool
+	Direct bool `json:"direct,omitempty"`
+	// Pool restricts group rooms to users of compatible modes, empty for any
+	Pool string `json:"pool,omitempty"`
+	// Partition is the queue the request is processed from
+	Partition string `json:"partition,omitempty"`
+	// Attempts counts the times the request found its users claimed by
+	// another worker
+	Attempts int `json:"attempts,omitempty"`
 }
 
 type Match struct {
-	MatchID string `json:"match_id"`
-	UserID1 string `json:"user_id1"`
-	UserID2 string `json:"user_id2"`
+	MatchID string   `json:"match_id"`
+	UserIDs []string `json:"user_ids"`
+	Size    int      `json:"size"`
+	Room    string   `json:"room,omitempty"`
+}
+
+// MatchTicket identifies a match request, the events about its search carry
+// the ticket.
+type MatchTicket struct {
+	Ticket string `json:"ticket"`
+}
+
+// MatchSearch is a user's search for a 1:1 candidate, the event worker runs
+// it until a candidate is found, it times out or the user cancels it.
+type MatchSearch struct {
+	Ticket string `json:"ticket"`
+	UserID string `json:"user_id"`
+	// Modes the candidate may be in, any mode when empty
+	Modes        []string `json:"modes,omitempty"`
+	ByReputation bool     `json:"by_reputation,omitempty"`
+	// RelaxModesAfter is the wait after which users that both opted in are
+	// matched with any mode
+	RelaxModesAfter time.Duration `json:"relax_modes_after,omitempty"`
+	StartedAt       time.Time     `json:"started_at"`
+	// QueuedAt is when the user started waiting, constraints relax and
+	// priority grows from then on. Searches retried soon after giving up
+	// keep it.
+	QueuedAt time.Time `json:"queued_at"`
+	// Seen is set once other users were around, whether compatible or not
+	Seen bool `json:"seen,omitempty"`
+	// Partition the match found is processed in
+	Partition string `json:"partition,omitempty"`
+}
+
+// QueueStatus is pushed to users waiting for a candidate. Position is the
+// user's place among the users waiting, EstimatedWait is left out until
+// matches were made recently.
+type QueueStatus struct {
+	Ticket        string `json:"ticket"`
+	Position      int    `json:"position"`
+	Waiting       int    `json:"waiting"`
+	PoolSize      int    `json:"pool_size"`
+	EstimatedWait int    `json:"estimated_wait_seconds,omitempty"`
+}
+
+// Reasons a match request ends without a match.
+const (
+	NoMatchNoUsers      = "no_users"
+	NoMatchNoCompatible = "no_compatible_users"
+	NoMatchError        = "error"
+)
+
+// NoMatch is pushed when the search for a candidate gives up.
+type NoMatch struct {
+	Ticket string `json:"ticket"`
+	Reason string `json:"reason"`
+}
+
+// RoomFull is pushed when the topic room filled up before the user could be
+// seated.
+type RoomFull struct {
+	Room string `json:"room"`
+}
+
+// Throttled is pushed when the user goes over a rate limit, requests of the
+// action are rejected for RetryAfter seconds.
+type Throttled struct {
+	Action     string `json:"action"`
+	RetryAfter int    `json:"retry_after_seconds"`
 }
@@ -1,11 +1,43 @@
 package models
 
+import "encoding/json"
+
 type Message struct {
 	Event string    `json:"event"`
 	Data  *Exchange `json:"data"`
 }
 
+// Exchange is the roster a participant receives whenever someone joins or
+// leaves, Username and Initiator describe the only peer of a one-to-one match.
 type Exchange struct {
+	MatchID   string `json:"match_id"`
 	Username  string `json:"username"`
 	Initiator bool   `json:"initiator"`
+	PeerID    string `json:"peer_id"`
+	Peers     []Peer `json:"peers"`
+	SFU       bool   `json:"sfu,omitempty"`
+	// Mode of the only peer, clients skip media with text-only peers
+	Mode string `json:"mode,omitempty"`
+	// Bot is set when the only peer is a bot
+	Bot bool `json:"bot,omitempty"`
+	// Region of the only peer, never its address
+	Region string `json:"region,omitempty"`
+}
+
+type Peer struct {
+	PeerID    string `json:"peer_id"`
+	Username  string `json:"username"`
+	Initiator bool   `json:"initiator"`
+	Mode      string `json:"mode"`
+	Bot       bool   `json:"bot,omitempty"`
+	Region    string `json:"region,omitempty"`
+}
+
+// Event is a message as sent by a client, Data is left to the event's handler.
+// To addresses a single peer, From is filled in by the session service.
+type Event struct {
+	Event string          `json:"event"`
+	From  string          `json:"from,omitempty"`
+	To    string          `json:"to,omitempty"`
+	Data  json.RawMessage `json:"data"`
 }
@@ -0,0 +1,31 @@
+package models
+
+// Chat modes a user registers with.
+const (
+	ModeVideo = "video"
+	ModeAudio = "audio"
+	ModeText  = "text"
+)
+
+func ValidMode(mode string) bool {
+	return mode == ModeVideo || mode == ModeAudio || mode == ModeText
+}
+
+// CompatibleModes lists the modes a user can be matched with, video and audio
+// users still share audio.
+func CompatibleModes(mode string) []string {
+	if mode == ModeText {
+		return []string{ModeText}
+	}
+
+	return []string{ModeVideo, ModeAudio}
+}
+
+// ModePool names the group rooms a user of the mode is seated in.
+func ModePool(mode string) string {
+	if mode == ModeText {
+		return "text"
+	}
+
+	return "media"
+}
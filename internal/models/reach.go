@@ -0,0 +1,14 @@
+package models
+
+// Reaches a user registers with, how far away peers may be. Nearby users
+// are matched with peers close to them first, the distance widening as they
+// wait.
+const (
+	ReachNearby   = "nearby"
+	ReachCountry  = "country"
+	ReachAnywhere = "anywhere"
+)
+
+func ValidReach(reach string) bool {
+	return reach == ReachNearby || reach == ReachCountry || reach == ReachAnywhere
+}
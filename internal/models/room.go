@@ -0,0 +1,8 @@
+package models
+
+type TopicRoom struct {
+	Name      string `json:"name"`
+	Topic     string `json:"topic"`
+	Capacity  int    `json:"capacity"`
+	Occupancy int    `json:"occupancy"`
+}
@@ -1,8 +1,29 @@
 package models
 
+import "rvc/internal/geo"
+
 type User struct {
 	UserID   string
 	Username string
 	IPAddr   string
 	MatchID  string
+
+	// InvitedBy is the creator of the invite the user registered with
+	InvitedBy string
+	// Identity outlives the user, friendships are kept between identities
+	Identity string
+	// Mode is one of video, audio or text
+	Mode string
+	// AnyMode users may be matched with any mode after waiting long enough
+	AnyMode bool
+	// Reach is how far away peers may be, Location is nil when unknown
+	Reach    string
+	Location *geo.Location
+	// Locale is the language the user prefers, e.g. en, "" when unknown
+	Locale string
+	// Tags are interest tags the user picked, peers sharing one come first
+	Tags []string
+	// Bot users only join the unpaired pool when summoned for a user that
+	// waits too long
+	Bot bool
 }
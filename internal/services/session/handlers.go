@@ -2,13 +2,17 @@ package session
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog"
+	"rvc/internal/events"
+	"rvc/internal/filter"
 	"rvc/internal/models"
+	"rvc/internal/webhooks"
+	"strings"
 	"sync"
+	"time"
 )
 
 type ServerHandler interface {
@@ -20,6 +24,18 @@ type ServerHandle struct {
 	Store  Store
 	Logger *zerolog.Logger
 
+	// SFU relays media through the service when set, otherwise peers connect
+	// directly and only signaling passes through
+	SFU *SFU
+
+	// Webhooks is told about sessions ending
+	Webhooks *webhooks.Dispatcher
+	Events   *events.Log
+
+	// Filter screens text chat, FilterMetrics counts what it caught
+	Filter        *filter.Pipeline
+	FilterMetrics *FilterMetrics
+
 	Goroutines map[string]context.CancelFunc
 	mu         sync.RWMutex
 }
@@ -52,7 +68,7 @@ func (h *ServerHandle) createSession(ctx context.Context) {
 			h.Goroutines[match.MatchID] = cancel
 			h.mu.Unlock()
 
-			go session(ctx, match, h.Store, h.Logger, &wg)
+			go session(ctx, match, h, &wg)
 		}
 	}
 }
@@ -86,92 +102,90 @@ func (h *ServerHandle) deleteSession(ctx context.Context) {
 	}
 }
 
-func session(ctx context.Context, match models.Match, store Store, logger *zerolog.Logger, wg *sync.WaitGroup) {
+func session(ctx context.Context, match models.Match, h *ServerHandle, wg *sync.WaitGroup) {
 	defer wg.Done()
 
+	store, logger, hooks, eventLog := h.Store, h.Logger, h.Webhooks, h.Events
+
 	localCtx := context.Background()
 
-	User1Inc := match.UserID1 + ":incoming"
-	User1Out := match.UserID1 + ":outgoing"
-	User2Inc := match.UserID2 + ":incoming"
-	User2Out := match.UserID2 + ":outgoing"
+	RosterChannel := match.MatchID + ":roster"
 
-	user1Out := store.listenOutgoing(localCtx, User1Out)
-	user2Out := store.listenOutgoing(localCtx, User2Out)
+	listener := store.listenRoster(localCtx, match.MatchID)
 
 	defer func() {
-		if err := user1Out.Close(); err != nil {
-			logger.Err(err).Msg("failed to properly remove subscription " + User1Out)
-			return
-		}
-		if err := user2Out.Close(); err != nil {
-			logger.Err(err).Msg("failed to properly remove subscription " + User2Out)
+		if err := listener.Close(); err != nil {
+			logger.Err(err).Msg("failed to properly remove subscriptions of session " + match.MatchID)
 			return
 		}
 	}()
 
-	msg1, err := store.getExchange(localCtx, match.UserID1, true)
-	if err != nil {
-		logger.Err(err).Msg("unable to create exchange for user: " + match.UserID1)
-		return
-	}
+	room := newRoom(match.MatchID, h, listener)
+	defer room.close()
 
-	msg2, err := store.getExchange(localCtx, match.UserID2, false)
-	if err != nil {
-		logger.Err(err).Msg("unable to create exchange for user: " + match.UserID2)
+	if err := room.update(localCtx); err != nil {
+		logger.Err(err).Msg("unable to create session " + match.MatchID)
 		return
 	}
 
-	msgJSON1, err := json.Marshal(msg1)
-	if err != nil {
-		logger.Err(err).Msg("unable to marshal message")
-		return
-	}
+	logger.Info().Msg(fmt.Sprintf("created session %s for %s", match.MatchID,
+		strings.Join(match.UserIDs, " ")))
 
-	msgJSON2, err := json.Marshal(msg2)
-	if err != nil {
-		logger.Err(err).Msg("unable to marshal message")
-		return
-	}
+	startedAt := time.Now()
+	reason := events.ReasonEnded
 
-	if err := store.writeMessage(localCtx, User1Inc, msgJSON2); err != nil {
-		logger.Err(err).Msg("unable to write to user1inc")
-	}
+	eventLog.Record(localCtx, &events.Event{
+		Type:    events.SessionStarted,
+		MatchID: match.MatchID,
+		Data:    map[string]interface{}{"user_ids": match.UserIDs, "size": match.Size, "room": match.Room},
+	})
 
-	if err := store.writeMessage(localCtx, User2Inc, msgJSON1); err != nil {
-		logger.Err(err).Msg("unable to write to user2inc")
-	}
-
-	logger.Info().Msg(fmt.Sprintf("created session %s for %s %s", match.MatchID,
-		match.UserID1, match.UserID2))
+	defer func() {
+		duration := int(time.Since(startedAt).Seconds())
+
+		eventLog.Record(localCtx, &events.Event{
+			Type:    events.SessionEnded,
+			MatchID: match.MatchID,
+			Data:    map[string]interface{}{"duration_seconds": duration, "reason": reason},
+		})
+
+		if err := hooks.Publish(localCtx, webhooks.EventSessionEnded, map[string]interface{}{
+			"match_id":         match.MatchID,
+			"user_ids":         match.UserIDs,
+			"size":             match.Size,
+			"duration_seconds": duration,
+			"reason":           reason,
+		}); err != nil {
+			logger.Err(err).Msg("unable to publish webhook")
+		}
+	}()
 
-	// user 1 out -> user 2 inc
-	// user 2 out -> user 1 inc
+	// roster changes -> update room
+	// user out -> peers inc
 	for {
 		select {
 		case <-ctx.Done():
+			reason = store.takeEndReason(localCtx, match.MatchID)
+
 			logger.Info().Msg("removed session " + match.MatchID)
 			return
 
-		case msg, ok := <-user1Out.Channel():
+		case msg, ok := <-listener.Channel():
 			if !ok {
-				logger.Info().Msg("chat channel " + User1Out + " closed unexpectedly")
-				continue
-			}
+				reason = events.ReasonError
 
-			if err := store.writeMessage(localCtx, User2Inc, msg.Payload); err != nil {
-				logger.Err(err).Msg("unable to publish to user2inc")
-			}
-
-		case msg, ok := <-user2Out.Channel():
-			if !ok {
-				logger.Info().Msg("chat channel " + User2Out + " closed unexpectedly")
+				logger.Info().Msg("channels of session " + match.MatchID + " closed unexpectedly")
 				return
 			}
 
-			if err := store.writeMessage(localCtx, User1Inc, msg.Payload); err != nil {
-				logger.Err(err).Msg("unable to publish to user1inc")
+			if msg.Channel == RosterChannel {
+				if err := room.update(localCtx); err != nil {
+					logger.Err(err).Msg("unable to update roster of session " + match.MatchID)
+				}
+				continue
 			}
+
+			room.relay(localCtx, strings.TrimSuffix(msg.Channel, ":outgoing"), msg.Payload)
 		}
 	}
 }
@@ -0,0 +1,318 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"rvc/internal/events"
+	"rvc/internal/filter"
+	"rvc/internal/models"
+)
+
+// room tracks who is present in a running session, participants may join
+// and leave without the session being torn down.
+type room struct {
+	matchID  string
+	store    Store
+	logger   *zerolog.Logger
+	listener *redis.PubSub
+	sfu      *SFU
+	media    *sfuSession
+
+	filter        *filter.Pipeline
+	filterMetrics *FilterMetrics
+	events        *events.Log
+
+	// user id -> peer id
+	members   map[string]string
+	usernames map[string]string
+	modes     map[string]string
+	bots      map[string]bool
+	regions   map[string]string
+	locales   map[string]string
+}
+
+func newRoom(matchID string, h *ServerHandle, listener *redis.PubSub) *room {
+	return &room{
+		matchID:       matchID,
+		store:         h.Store,
+		logger:        h.Logger,
+		listener:      listener,
+		sfu:           h.SFU,
+		filter:        h.Filter,
+		filterMetrics: h.FilterMetrics,
+		events:        h.Events,
+		members:       make(map[string]string),
+		usernames:     make(map[string]string),
+		modes:         make(map[string]string),
+		bots:          make(map[string]bool),
+		regions:       make(map[string]string),
+		locales:       make(map[string]string),
+	}
+}
+
+// update syncs the room with the match entry and sends everyone present the
+// new roster.
+func (r *room) update(ctx context.Context) error {
+	roster, err := r.store.getRoster(ctx, r.matchID)
+	if err != nil {
+		return err
+	}
+
+	var left []string
+	joined := make(map[string]string)
+
+	for userID := range r.members {
+		if _, ok := roster[userID]; !ok {
+			left = append(left, userID)
+		}
+	}
+
+	for userID, peerID := range roster {
+		if _, ok := r.members[userID]; !ok {
+			joined[userID] = peerID
+		}
+	}
+
+	if len(left) == 0 && len(joined) == 0 {
+		return nil
+	}
+
+	for _, userID := range left {
+		if err := r.listener.Unsubscribe(ctx, userID+":outgoing"); err != nil {
+			r.logger.Err(err).Msg("failed to properly remove subscription " + userID + ":outgoing")
+		}
+
+		delete(r.members, userID)
+		delete(r.usernames, userID)
+		delete(r.modes, userID)
+		delete(r.bots, userID)
+		delete(r.regions, userID)
+		delete(r.locales, userID)
+	}
+
+	for userID, peerID := range joined {
+		username, err := r.store.getUsername(ctx, userID)
+		if err != nil {
+			r.logger.Err(err).Msg("unable to find user " + userID + " of session " + r.matchID)
+			delete(joined, userID)
+			continue
+		}
+
+		mode, err := r.store.getMode(ctx, userID)
+		if err != nil {
+			r.logger.Err(err).Msg("unable to find mode of " + userID)
+			mode = models.ModeVideo
+		}
+
+		if err := r.listener.Subscribe(ctx, userID+":outgoing"); err != nil {
+			r.logger.Err(err).Msg("unable to subscribe to " + userID + ":outgoing")
+			delete(joined, userID)
+			continue
+		}
+
+		r.members[userID] = peerID
+		r.usernames[userID] = username
+		r.modes[userID] = mode
+		r.bots[userID] = r.store.isBot(ctx, userID)
+		r.regions[userID] = r.store.getRegion(ctx, userID)
+		r.locales[userID] = r.store.getLocale(ctx, userID)
+	}
+
+	for userID := range r.members {
+		r.sendExchange(ctx, userID)
+	}
+
+	if r.sfu == nil {
+		return nil
+	}
+
+	if r.media == nil {
+		r.media = r.sfu.newSession(r.matchID, func(userID string, msg []byte) {
+			r.write(ctx, userID, msg)
+		}, r.logger)
+	}
+
+	if len(left) > 0 {
+		r.media.leave(left...)
+	}
+
+	// text-only users never negotiate media
+	for userID := range joined {
+		if r.modes[userID] == models.ModeText {
+			delete(joined, userID)
+		}
+	}
+
+	if len(joined) > 0 {
+		return r.media.join(joined)
+	}
+
+	return nil
+}
+
+func (r *room) sendExchange(ctx context.Context, userID string) {
+	exchange := &models.Exchange{
+		MatchID: r.matchID,
+		PeerID:  r.members[userID],
+		Peers:   []models.Peer{},
+		SFU:     r.sfu != nil,
+	}
+
+	for other, peerID := range r.members {
+		if other == userID {
+			continue
+		}
+
+		exchange.Peers = append(exchange.Peers, models.Peer{
+			PeerID:   peerID,
+			Username: r.usernames[other],
+			// in a mesh the lower peer id makes the offer, with the SFU
+			// everyone waits for the server's offer
+			Initiator: r.sfu == nil && exchange.PeerID < peerID,
+			Mode:      r.modes[other],
+			Bot:       r.bots[other],
+			Region:    r.regions[other],
+		})
+	}
+
+	sort.Slice(exchange.Peers, func(i, j int) bool {
+		return exchange.Peers[i].PeerID < exchange.Peers[j].PeerID
+	})
+
+	if len(exchange.Peers) == 1 {
+		exchange.Username = exchange.Peers[0].Username
+		exchange.Initiator = exchange.Peers[0].Initiator
+		exchange.Mode = exchange.Peers[0].Mode
+		exchange.Bot = exchange.Peers[0].Bot
+		exchange.Region = exchange.Peers[0].Region
+	}
+
+	msgJSON, err := json.Marshal(&models.Message{Event: "exchange", Data: exchange})
+	if err != nil {
+		r.logger.Err(err).Msg("unable to marshal message")
+		return
+	}
+
+	r.write(ctx, userID, msgJSON)
+}
+
+// relay passes a user's message on to the peer it is addressed to, or to
+// everyone else in the room.
+func (r *room) relay(ctx context.Context, userID string, payload string) {
+	peerID, ok := r.members[userID]
+	if !ok {
+		return
+	}
+
+	var event models.Event
+
+	// only events the relay understands are passed on, anything else could
+	// pose as another peer
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		r.logger.Err(err).Msg("dropped unparseable message from " + userID)
+		return
+	}
+
+	if r.media != nil && isSignaling(event.Event) {
+		if err := r.media.handle(userID, event); err != nil {
+			r.logger.Err(err).Msg("unable to handle " + event.Event + " from " + userID)
+		}
+
+		return
+	}
+
+	if event.Event == "message" && !r.screen(ctx, userID, &event) {
+		return
+	}
+
+	event.From = peerID
+
+	msgJSON, err := json.Marshal(&event)
+	if err != nil {
+		r.logger.Err(err).Msg("unable to marshal message")
+		return
+	}
+
+	if event.To == "" {
+		r.broadcast(ctx, userID, msgJSON)
+		return
+	}
+
+	for other, otherPeerID := range r.members {
+		if otherPeerID == event.To {
+			r.write(ctx, other, msgJSON)
+		}
+	}
+}
+
+// screen cleans a text message and runs it through the filters, rewriting
+// it in place, and reports whether it is still delivered.
+func (r *room) screen(ctx context.Context, userID string, event *models.Event) bool {
+	var text string
+
+	// clients only show text messages
+	if err := json.Unmarshal(event.Data, &text); err != nil {
+		return false
+	}
+
+	result := r.filter.Screen(&filter.Message{UserID: userID, Locale: r.locales[userID], Text: filter.Clean(text)})
+	r.filterMetrics.observe(result.Verdicts)
+
+	if flagged := result.Flagged(); len(flagged) > 0 {
+		if err := r.store.flagMessage(ctx, &models.FlaggedMessage{
+			MatchID:   r.matchID,
+			UserID:    userID,
+			Text:      text,
+			Filters:   flagged,
+			CreatedAt: time.Now().UTC(),
+		}); err != nil {
+			r.logger.Err(err).Msg("unable to flag message of " + userID)
+		}
+
+		r.events.Record(ctx, &events.Event{
+			Type:    events.MessageFlagged,
+			UserID:  userID,
+			MatchID: r.matchID,
+			Data:    map[string]interface{}{"filters": flagged},
+		})
+	}
+
+	if result.Action == filter.Drop {
+		return false
+	}
+
+	data, err := json.Marshal(result.Text)
+	if err != nil {
+		r.logger.Err(err).Msg("unable to marshal message")
+		return false
+	}
+
+	event.Data = data
+
+	return true
+}
+
+func (r *room) broadcast(ctx context.Context, userID string, msg interface{}) {
+	for other := range r.members {
+		if other != userID {
+			r.write(ctx, other, msg)
+		}
+	}
+}
+
+func (r *room) write(ctx context.Context, userID string, msg interface{}) {
+	if err := r.store.writeMessage(ctx, userID+":incoming", msg); err != nil {
+		r.logger.Err(err).Msg("unable to publish to " + userID + ":incoming")
+	}
+}
+
+func (r *room) close() {
+	if r.media != nil {
+		r.media.close()
+	}
+}
@@ -0,0 +1,186 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"rvc/internal/events"
+	"rvc/internal/filter"
+	"rvc/internal/models"
+)
+
+// relayStore records what the room publishes, the rest of Store is unused
+// by relay.
+type relayStore struct {
+	Store
+
+	mu       sync.Mutex
+	incoming map[string][]string
+}
+
+func (s *relayStore) writeMessage(_ context.Context, channel string, msg interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.incoming[channel] = append(s.incoming[channel], fmt.Sprintf("%s", msg))
+
+	return nil
+}
+
+func (s *relayStore) flagMessage(context.Context, *models.FlaggedMessage) error {
+	return nil
+}
+
+func newRelayRoom() (*room, *relayStore) {
+	store := &relayStore{incoming: make(map[string][]string)}
+	logger := zerolog.Nop()
+
+	r := newRoom("match-test", &ServerHandle{Store: store, Logger: &logger}, nil)
+	r.members = map[string]string{"alice": "peer-a", "bob": "peer-b", "carol": "peer-c"}
+
+	return r, store
+}
+
+func TestRelayDropsUnparseablePayloads(t *testing.T) {
+	r, store := newRelayRoom()
+
+	for _, payload := range []string{
+		`not json`,
+		// a mistyped field fails decoding, browsers would still show it as
+		// coming from carol
+		`{"event":"message","data":"hi","to":1,"from":"peer-c"}`,
+	} {
+		r.relay(context.Background(), "alice", payload)
+	}
+
+	if len(store.incoming) != 0 {
+		t.Errorf("unparseable payloads were relayed: %v", store.incoming)
+	}
+}
+
+func TestRelaySetsSender(t *testing.T) {
+	r, store := newRelayRoom()
+
+	r.relay(context.Background(), "alice", `{"event":"message","data":"hi","from":"peer-c"}`)
+
+	for _, userID := range []string{"bob", "carol"} {
+		msgs := store.incoming[userID+":incoming"]
+		if len(msgs) != 1 {
+			t.Fatalf("%s received %d messages, want 1", userID, len(msgs))
+		}
+
+		var event models.Event
+		if err := json.Unmarshal([]byte(msgs[0]), &event); err != nil {
+			t.Fatal(err)
+		}
+
+		if event.From != "peer-a" {
+			t.Errorf("%s got a message from %q, want peer-a", userID, event.From)
+		}
+	}
+
+	if msgs := store.incoming["alice:incoming"]; len(msgs) != 0 {
+		t.Errorf("alice received her own message: %v", msgs)
+	}
+}
+
+func TestRelayScreensEveryMessage(t *testing.T) {
+	r, store := newRelayRoom()
+	r.filter = &filter.Pipeline{Filters: []filter.Filter{&filter.Links{Action: filter.Mask}}}
+
+	for _, payload := range []string{
+		`{"event":"message","data":"see spam.com","to":1}`,
+		// decoding is case-insensitive, the relayed event is re-encoded from
+		// what was screened
+		`{"event":"message","data":"hello","Data":"see spam.com"}`,
+		`{"event":"message","data":"see‮ spam.com\u001b[31m"}`,
+		`{"event":"message","data":{"html":"<b>spam.com</b>"}}`,
+	} {
+		r.relay(context.Background(), "alice", payload)
+	}
+
+	msgs := store.incoming["bob:incoming"]
+
+	var texts []string
+
+	for _, msg := range msgs {
+		if strings.Contains(msg, "spam.com") || strings.ContainsAny(msg, "‮\u001b") {
+			t.Errorf("unscreened message relayed: %s", msg)
+		}
+
+		var event models.Event
+		if err := json.Unmarshal([]byte(msg), &event); err != nil {
+			t.Fatal(err)
+		}
+
+		var text string
+		if err := json.Unmarshal(event.Data, &text); err != nil {
+			t.Fatal(err)
+		}
+
+		texts = append(texts, text)
+	}
+
+	want := []string{"see [link]", "see [link][31m"}
+	if !slices.Equal(texts, want) {
+		t.Errorf("bob received %q, want %q", texts, want)
+	}
+}
+
+func TestRelayRecordsFlagsWithoutText(t *testing.T) {
+	redisClient := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	ctx := context.Background()
+
+	var output bytes.Buffer
+
+	logger := zerolog.Nop()
+
+	r, store := newRelayRoom()
+	r.filter = &filter.Pipeline{Filters: []filter.Filter{&filter.Links{Action: filter.Flag}}}
+	r.events = events.NewLog(&logger,
+		&events.StreamExporter{RedisClient: redisClient, Stream: "events"},
+		events.NewNDJSONExporter(&output))
+
+	r.relay(ctx, "alice", `{"event":"message","data":"my secret is at spam.com"}`)
+
+	if msgs := store.incoming["bob:incoming"]; len(msgs) != 1 {
+		t.Fatalf("bob received %v, want the flagged message", msgs)
+	}
+
+	var event events.Event
+	if err := json.Unmarshal(output.Bytes(), &event); err != nil {
+		t.Fatal(err)
+	}
+
+	if event.Type != events.MessageFlagged || event.UserID != "alice" || event.MatchID != "match-test" {
+		t.Errorf("recorded %+v", event)
+	}
+
+	var streamed []string
+	if err := events.ReadStream(ctx, redisClient, "events", "0", false, func(_ string, event *events.Event) error {
+		eventJSON, err := json.Marshal(event)
+		streamed = append(streamed, string(eventJSON))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(streamed) != 1 {
+		t.Fatalf("streamed %v, want the flagged event", streamed)
+	}
+
+	for _, exported := range []string{output.String(), streamed[0]} {
+		if strings.Contains(exported, "secret") || strings.Contains(exported, "spam.com") {
+			t.Errorf("the message text was exported: %s", exported)
+		}
+	}
+}
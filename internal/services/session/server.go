@@ -5,6 +5,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"net/http"
+	"rvc/internal/filter"
 	"sync"
 	"time"
 
@@ -33,6 +34,32 @@ func (p *PromMetrics) Counter(goroutines map[string]context.CancelFunc) {
 	}
 }
 
+// FilterMetrics counts the chat messages filters did not pass.
+type FilterMetrics struct {
+	filtered *prometheus.CounterVec
+}
+
+func NewFilterMetrics() *FilterMetrics {
+	return &FilterMetrics{
+		filtered: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "filtered_messages_total",
+			Help: "chat messages masked, dropped or flagged per filter and action",
+		}, []string{"filter", "action"}),
+	}
+}
+
+// observe records the verdicts on a message, it does nothing on a nil
+// FilterMetrics.
+func (m *FilterMetrics) observe(verdicts []filter.Verdict) {
+	if m == nil {
+		return
+	}
+
+	for _, verdict := range verdicts {
+		m.filtered.WithLabelValues(verdict.Filter, verdict.Action).Inc()
+	}
+}
+
 type Server struct {
 	port     string
 	handlers ServerHandler
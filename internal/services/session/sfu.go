@@ -0,0 +1,418 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+	"github.com/rs/zerolog"
+	"rvc/internal/models"
+)
+
+type SFUConfig struct {
+	PublicIP   string
+	PortMin    uint16
+	PortMax    uint16
+	ICEServers []string
+	// IncludeLoopback gathers loopback candidates, for tests and single
+	// host setups
+	IncludeLoopback bool
+}
+
+// SFU terminates every user's peer connection on the session service and
+// forwards RTP between the participants of a match.
+type SFU struct {
+	api    *webrtc.API
+	config webrtc.Configuration
+}
+
+func NewSFU(config SFUConfig) (*SFU, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+
+	if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000,
+			RTCPFeedback: []webrtc.RTCPFeedback{{Type: "nack"}, {Type: "nack", Parameter: "pli"}}},
+		PayloadType: 96,
+	}, webrtc.RTPCodecTypeVideo); err != nil {
+		return nil, err
+	}
+
+	if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+		PayloadType:        111,
+	}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, err
+	}
+
+	interceptorRegistry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+		return nil, err
+	}
+
+	settingEngine := webrtc.SettingEngine{}
+
+	if config.PortMin != 0 && config.PortMax != 0 {
+		if err := settingEngine.SetEphemeralUDPPortRange(config.PortMin, config.PortMax); err != nil {
+			return nil, err
+		}
+	}
+
+	settingEngine.SetIncludeLoopbackCandidate(config.IncludeLoopback)
+
+	if config.PublicIP != "" {
+		settingEngine.SetNAT1To1IPs([]string{config.PublicIP}, webrtc.ICECandidateTypeHost)
+	}
+
+	var iceServers []webrtc.ICEServer
+	if len(config.ICEServers) > 0 {
+		iceServers = append(iceServers, webrtc.ICEServer{URLs: config.ICEServers})
+	}
+
+	return &SFU{
+		api: webrtc.NewAPI(
+			webrtc.WithMediaEngine(mediaEngine),
+			webrtc.WithInterceptorRegistry(interceptorRegistry),
+			webrtc.WithSettingEngine(settingEngine),
+		),
+		config: webrtc.Configuration{ICEServers: iceServers},
+	}, nil
+}
+
+type sfuPeer struct {
+	userID string
+	peerID string
+	pc     *webrtc.PeerConnection
+
+	// media received from this user, written to every other participant
+	tracks map[webrtc.RTPCodecType]*webrtc.TrackLocalStaticRTP
+	// senders on this connection forwarding the media of other users
+	senders map[string][]*webrtc.RTPSender
+}
+
+type sfuSession struct {
+	sfu     *SFU
+	matchID string
+	logger  *zerolog.Logger
+	send    func(userID string, msg []byte)
+
+	mu    sync.Mutex
+	peers map[string]*sfuPeer
+}
+
+func (s *SFU) newSession(matchID string, send func(string, []byte), logger *zerolog.Logger) *sfuSession {
+	return &sfuSession{
+		sfu:     s,
+		matchID: matchID,
+		logger:  logger,
+		send:    send,
+		peers:   make(map[string]*sfuPeer),
+	}
+}
+
+// join opens a peer connection per new participant, wires the forwarded
+// tracks both ways and (re)negotiates with everyone whose media changed.
+func (sess *sfuSession) join(peerIDs map[string]string) error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	var joined []*sfuPeer
+
+	for userID, peerID := range peerIDs {
+		peer, err := sess.newPeer(userID, peerID)
+		if err != nil {
+			return err
+		}
+
+		sess.peers[userID] = peer
+		joined = append(joined, peer)
+	}
+
+	for _, newPeer := range joined {
+		for _, peer := range sess.peers {
+			if peer.userID == newPeer.userID {
+				continue
+			}
+
+			if err := sess.forward(newPeer, peer); err != nil {
+				return err
+			}
+
+			// among the new participants the other direction is wired on
+			// their own iteration
+			if _, ok := peerIDs[peer.userID]; !ok {
+				if err := sess.forward(peer, newPeer); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, peer := range sess.peers {
+		if err := sess.offer(peer); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// leave closes the participants' connections and stops forwarding their media.
+func (sess *sfuSession) leave(userIDs ...string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	for _, userID := range userIDs {
+		peer, ok := sess.peers[userID]
+		if !ok {
+			continue
+		}
+
+		if err := peer.pc.Close(); err != nil {
+			sess.logger.Err(err).Msg("unable to close peer connection of " + userID)
+		}
+
+		delete(sess.peers, userID)
+
+		for _, other := range sess.peers {
+			for _, sender := range other.senders[userID] {
+				if err := other.pc.RemoveTrack(sender); err != nil {
+					sess.logger.Err(err).Msg("unable to stop forwarding " + userID + " to " + other.userID)
+				}
+			}
+
+			delete(other.senders, userID)
+		}
+	}
+
+	for _, peer := range sess.peers {
+		if err := sess.offer(peer); err != nil {
+			sess.logger.Err(err).Msg("unable to renegotiate with " + peer.userID)
+		}
+	}
+}
+
+// forward sends the media of source to receiver.
+func (sess *sfuSession) forward(receiver *sfuPeer, source *sfuPeer) error {
+	for _, track := range source.tracks {
+		sender, err := receiver.pc.AddTrack(track)
+		if err != nil {
+			return err
+		}
+
+		receiver.senders[source.userID] = append(receiver.senders[source.userID], sender)
+
+		go sess.forwardRTCP(sender, source)
+	}
+
+	return nil
+}
+
+func (sess *sfuSession) newPeer(userID string, peerID string) (*sfuPeer, error) {
+	pc, err := sess.sfu.api.NewPeerConnection(sess.sfu.config)
+	if err != nil {
+		return nil, err
+	}
+
+	peer := &sfuPeer{
+		userID:  userID,
+		peerID:  peerID,
+		pc:      pc,
+		tracks:  make(map[webrtc.RTPCodecType]*webrtc.TrackLocalStaticRTP),
+		senders: make(map[string][]*webrtc.RTPSender),
+	}
+
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if _, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		}); err != nil {
+			_ = pc.Close()
+			return nil, err
+		}
+
+		mimeType := webrtc.MimeTypeVP8
+		if kind == webrtc.RTPCodecTypeAudio {
+			mimeType = webrtc.MimeTypeOpus
+		}
+
+		// the stream is labelled with the peer id, user ids are never shared
+		track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: mimeType},
+			kind.String(), peerID)
+		if err != nil {
+			_ = pc.Close()
+			return nil, err
+		}
+
+		peer.tracks[kind] = track
+	}
+
+	pc.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		sess.forwardRTP(peer, remote)
+	})
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+
+		sess.signal(userID, "candidate", candidate.ToJSON())
+	})
+
+	return peer, nil
+}
+
+// forwardRTP copies the media a user sends into the track every other
+// participant receives.
+func (sess *sfuSession) forwardRTP(peer *sfuPeer, remote *webrtc.TrackRemote) {
+	track, ok := peer.tracks[remote.Kind()]
+	if !ok {
+		return
+	}
+
+	buf := make([]byte, 1500)
+
+	for {
+		n, _, err := remote.Read(buf)
+		if err != nil {
+			return
+		}
+
+		if _, err := track.Write(buf[:n]); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			return
+		}
+	}
+}
+
+// forwardRTCP relays keyframe requests from receivers back to the sender.
+func (sess *sfuSession) forwardRTCP(sender *webrtc.RTPSender, source *sfuPeer) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		for _, packet := range packets {
+			if _, ok := packet.(*rtcp.PictureLossIndication); !ok {
+				continue
+			}
+
+			for _, receiver := range source.pc.GetReceivers() {
+				remote := receiver.Track()
+				if remote == nil || remote.Kind() != webrtc.RTPCodecTypeVideo {
+					continue
+				}
+
+				if err := source.pc.WriteRTCP([]rtcp.Packet{
+					&rtcp.PictureLossIndication{MediaSSRC: uint32(remote.SSRC())},
+				}); err != nil {
+					sess.logger.Err(err).Msg("unable to forward keyframe request to " + source.userID)
+				}
+			}
+		}
+	}
+}
+
+func (sess *sfuSession) offer(peer *sfuPeer) error {
+	offer, err := peer.pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+
+	if err := peer.pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+
+	sess.signal(peer.userID, "offer", offer)
+
+	return nil
+}
+
+// handle applies an offer, answer or candidate the user addressed to the server.
+func (sess *sfuSession) handle(userID string, event models.Event) error {
+	sess.mu.Lock()
+	peer, ok := sess.peers[userID]
+	sess.mu.Unlock()
+
+	if !ok {
+		return errors.New("user is not part of the session: " + userID)
+	}
+
+	switch event.Event {
+	case "offer":
+		var offer webrtc.SessionDescription
+		if err := json.Unmarshal(event.Data, &offer); err != nil {
+			return err
+		}
+
+		if err := peer.pc.SetRemoteDescription(offer); err != nil {
+			return err
+		}
+
+		answer, err := peer.pc.CreateAnswer(nil)
+		if err != nil {
+			return err
+		}
+
+		if err := peer.pc.SetLocalDescription(answer); err != nil {
+			return err
+		}
+
+		sess.signal(userID, "answer", answer)
+
+	case "answer":
+		var answer webrtc.SessionDescription
+		if err := json.Unmarshal(event.Data, &answer); err != nil {
+			return err
+		}
+
+		return peer.pc.SetRemoteDescription(answer)
+
+	case "candidate":
+		var candidate webrtc.ICECandidateInit
+		if err := json.Unmarshal(event.Data, &candidate); err != nil {
+			return err
+		}
+
+		return peer.pc.AddICECandidate(candidate)
+	}
+
+	return nil
+}
+
+func (sess *sfuSession) signal(userID string, event string, data interface{}) {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		sess.logger.Err(err).Msg("unable to marshal " + event + " for " + userID)
+		return
+	}
+
+	msgJSON, err := json.Marshal(&models.Event{Event: event, Data: dataJSON})
+	if err != nil {
+		sess.logger.Err(err).Msg("unable to marshal " + event + " for " + userID)
+		return
+	}
+
+	sess.send(userID, msgJSON)
+}
+
+func (sess *sfuSession) close() {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	for userID, peer := range sess.peers {
+		if err := peer.pc.Close(); err != nil {
+			sess.logger.Err(err).Msg("unable to close peer connection of " + userID)
+		}
+	}
+
+	sess.peers = make(map[string]*sfuPeer)
+}
+
+// isSignaling reports whether an event is addressed to the SFU rather than
+// relayed to the other participants.
+func isSignaling(event string) bool {
+	return event == "offer" || event == "answer" || event == "candidate"
+}
@@ -0,0 +1,212 @@
+package session
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/rs/zerolog"
+	"rvc/internal/models"
+)
+
+// testClient is a headless participant connecting to the SFU over loopback.
+type testClient struct {
+	t      *testing.T
+	userID string
+	sess   *sfuSession
+	pc     *webrtc.PeerConnection
+	inbox  chan []byte
+
+	mu      sync.Mutex
+	pending []webrtc.ICECandidateInit
+	remote  bool
+}
+
+func newTestClient(t *testing.T, sess *sfuSession, userID string) *testClient {
+	settingEngine := webrtc.SettingEngine{}
+	settingEngine.SetIncludeLoopbackCandidate(true)
+	settingEngine.SetInterfaceFilter(func(name string) bool { return name == "lo" })
+	settingEngine.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(settingEngine))
+
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+
+	client := &testClient{t: t, userID: userID, sess: sess, pc: pc, inbox: make(chan []byte, 64)}
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+
+		client.send("candidate", candidate.ToJSON())
+	})
+
+	go client.run()
+
+	return client
+}
+
+func (c *testClient) send(event string, data interface{}) {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		c.t.Error(err)
+		return
+	}
+
+	if err := c.sess.handle(c.userID, models.Event{Event: event, Data: dataJSON}); err != nil {
+		c.t.Error(err)
+	}
+}
+
+// run answers the SFU's offers, candidates arriving before an offer wait
+// for it.
+func (c *testClient) run() {
+	for msg := range c.inbox {
+		var event models.Event
+		if err := json.Unmarshal(msg, &event); err != nil {
+			c.t.Error(err)
+			return
+		}
+
+		switch event.Event {
+		case "offer":
+			var offer webrtc.SessionDescription
+			if err := json.Unmarshal(event.Data, &offer); err != nil {
+				c.t.Error(err)
+				return
+			}
+
+			if err := c.pc.SetRemoteDescription(offer); err != nil {
+				c.t.Error(err)
+				return
+			}
+
+			answer, err := c.pc.CreateAnswer(nil)
+			if err != nil {
+				c.t.Error(err)
+				return
+			}
+
+			if err := c.pc.SetLocalDescription(answer); err != nil {
+				c.t.Error(err)
+				return
+			}
+
+			c.send("answer", answer)
+
+			c.mu.Lock()
+			c.remote = true
+			pending := c.pending
+			c.pending = nil
+			c.mu.Unlock()
+
+			for _, candidate := range pending {
+				if err := c.pc.AddICECandidate(candidate); err != nil {
+					c.t.Error(err)
+				}
+			}
+		case "candidate":
+			var candidate webrtc.ICECandidateInit
+			if err := json.Unmarshal(event.Data, &candidate); err != nil {
+				c.t.Error(err)
+				return
+			}
+
+			c.mu.Lock()
+			if !c.remote {
+				c.pending = append(c.pending, candidate)
+				c.mu.Unlock()
+				continue
+			}
+			c.mu.Unlock()
+
+			if err := c.pc.AddICECandidate(candidate); err != nil {
+				c.t.Error(err)
+			}
+		}
+	}
+}
+
+func TestSFUForwardsPublishedTrack(t *testing.T) {
+	sfu, err := NewSFU(SFUConfig{IncludeLoopback: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := zerolog.Nop()
+	clients := make(map[string]*testClient)
+
+	sess := sfu.newSession("match-test", func(userID string, msg []byte) {
+		clients[userID].inbox <- msg
+	}, &logger)
+	defer sess.close()
+
+	publisher := newTestClient(t, sess, "publisher")
+	subscriber := newTestClient(t, sess, "subscriber")
+	clients["publisher"], clients["subscriber"] = publisher, subscriber
+
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8},
+		"video", "camera")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := publisher.pc.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan string, 1)
+
+	subscriber.pc.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if _, _, err := remote.ReadRTP(); err == nil {
+			select {
+			case received <- remote.StreamID():
+			default:
+			}
+		}
+	})
+
+	if err := sess.join(map[string]string{"publisher": "peer-a", "subscriber": "peer-b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_ = track.WriteSample(media.Sample{Data: []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a}, Duration: 20 * time.Millisecond})
+			}
+		}
+	}()
+
+	select {
+	case streamID := <-received:
+		// the stream is labelled with the publisher's peer id
+		if streamID != "peer-a" {
+			t.Errorf("stream id = %q, want peer-a", streamID)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("subscriber received no media from the publisher")
+	}
+}
@@ -3,8 +3,10 @@ package session
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/redis/go-redis/v9"
+	"rvc/internal/events"
 	"rvc/internal/models"
 	"time"
 )
@@ -15,8 +17,16 @@ type Store interface {
 	dequeueCreateSessionRequest(context.Context) (models.Match, error)
 	listenIncoming(context.Context, string) *redis.PubSub
 	listenOutgoing(context.Context, string) *redis.PubSub
-	getExchange(context.Context, string, bool) (*models.Message, error)
+	listenRoster(context.Context, string) *redis.PubSub
+	getRoster(context.Context, string) (map[string]string, error)
+	getUsername(context.Context, string) (string, error)
+	getMode(context.Context, string) (string, error)
+	isBot(context.Context, string) bool
+	getRegion(context.Context, string) string
+	getLocale(context.Context, string) string
+	takeEndReason(context.Context, string) string
 	writeMessage(context.Context, string, interface{}) error
+	flagMessage(context.Context, *models.FlaggedMessage) error
 
 	// delete session
 
@@ -50,25 +60,77 @@ func (s *Storage) listenOutgoing(ctx context.Context, channel string) *redis.Pub
 	return s.RedisClient.Subscribe(ctx, channel)
 }
 
-func (s *Storage) getExchange(ctx context.Context, user string, initiator bool) (*models.Message, error) {
-	username, err := s.RedisClient.HGet(ctx, fmt.Sprintf("user_entry:%s", user), "username").Result()
-	if err != nil {
-		return nil, err
+// listenRoster subscribes to roster changes of a match, participants'
+// outgoing channels are added to the same subscription as they join.
+func (s *Storage) listenRoster(ctx context.Context, matchID string) *redis.PubSub {
+	return s.RedisClient.Subscribe(ctx, matchID+":roster")
+}
+
+// getRoster maps the user ids of a match's participants to their peer ids.
+func (s *Storage) getRoster(ctx context.Context, matchID string) (map[string]string, error) {
+	return s.RedisClient.HGetAll(ctx, fmt.Sprintf("match_entry:%s", matchID)).Result()
+}
+
+func (s *Storage) getUsername(ctx context.Context, userID string) (string, error) {
+	return s.RedisClient.HGet(ctx, fmt.Sprintf("user_entry:%s", userID), "username").Result()
+}
+
+func (s *Storage) getMode(ctx context.Context, userID string) (string, error) {
+	mode, err := s.RedisClient.HGet(ctx, fmt.Sprintf("user_entry:%s", userID), "mode").Result()
+	if errors.Is(err, redis.Nil) || (err == nil && mode == "") {
+		return models.ModeVideo, nil
+	}
+
+	return mode, err
+}
+
+func (s *Storage) isBot(ctx context.Context, userID string) bool {
+	return s.RedisClient.HGet(ctx, fmt.Sprintf("user_entry:%s", userID), "bot").Val() == "1"
+}
+
+// getRegion returns the user's region, "" when it is unknown.
+func (s *Storage) getRegion(ctx context.Context, userID string) string {
+	return s.RedisClient.HGet(ctx, fmt.Sprintf("user_entry:%s", userID), "region").Val()
+}
+
+// getLocale returns the user's language, "" when it is unknown.
+func (s *Storage) getLocale(ctx context.Context, userID string) string {
+	return s.RedisClient.HGet(ctx, fmt.Sprintf("user_entry:%s", userID), "locale").Val()
+}
+
+// takeEndReason returns why the user service ended the match, ended when it
+// gave no reason.
+func (s *Storage) takeEndReason(ctx context.Context, matchID string) string {
+	reason, err := s.RedisClient.GetDel(ctx, fmt.Sprintf("match_end_reason:%s", matchID)).Result()
+	if err != nil || reason == "" {
+		return events.ReasonEnded
 	}
 
-	return &models.Message{
-		Event: "exchange",
-		Data: &models.Exchange{
-			Username:  username,
-			Initiator: initiator,
-		},
-	}, nil
+	return reason
 }
 
 func (s *Storage) writeMessage(ctx context.Context, channel string, msg interface{}) error {
 	return s.RedisClient.Publish(ctx, channel, msg).Err()
 }
 
+// maxFlaggedMessages is how many flagged messages are kept for moderators.
+const maxFlaggedMessages = 10000
+
+func (s *Storage) flagMessage(ctx context.Context, msg *models.FlaggedMessage) error {
+	msgJSON, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.RedisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, "flagged_messages", msgJSON)
+		pipe.LTrim(ctx, "flagged_messages", 0, maxFlaggedMessages-1)
+		return nil
+	})
+
+	return err
+}
+
 func (s *Storage) listenDeleteSession(ctx context.Context) *redis.PubSub {
 	return s.RedisClient.Subscribe(ctx, "delete_match_session")
 }
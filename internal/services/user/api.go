@@ -0,0 +1,524 @@
+package user
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"net/http"
+	"rvc/internal/challenge"
+	"rvc/internal/events"
+	"rvc/internal/models"
+	"rvc/internal/webhooks"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const maxReportReason = 500
+
+// apiRoute describes an /api/v1 endpoint, the routes are registered and the
+// OpenAPI document is generated from the same table.
+type apiRoute struct {
+	Method  string
+	Path    string
+	Summary string
+	Handler echo.HandlerFunc
+	// Auth routes require the token returned on registration
+	Auth bool
+	// RateLimit names the action the route counts against, none when empty
+	RateLimit string
+	// Request is the JSON body the route binds, nil when it takes none
+	Request interface{}
+	// Responses maps status codes to their JSON body, nil for none
+	Responses map[int]interface{}
+}
+
+type registerRequest struct {
+	// Username is 2 to 32 letters, digits, spaces and _ - . of one script,
+	// peers see it normalized
+	Username string `json:"username"`
+	Invite   string `json:"invite,omitempty"`
+	// Mode is video, audio or text, video by default
+	Mode string `json:"mode,omitempty"`
+	// Reach is nearby, country or anywhere, nearby by default
+	Reach string `json:"reach,omitempty"`
+	// AnyMode accepts peers of any mode once both waited long enough, when
+	// the service allows it
+	AnyMode bool `json:"any_mode,omitempty"`
+	// Tags are interests to be matched on first: music, films, games,
+	// sports, books, travel, tech or art
+	Tags []string `json:"tags,omitempty"`
+	// Bot registers a bot chatting in text, it requires the X-Bot-Key header
+	Bot bool `json:"bot,omitempty"`
+	// ChallengeID and ChallengeResponse answer the challenge of GET
+	// /challenge, bots need none
+	ChallengeID       string `json:"challenge_id,omitempty"`
+	ChallengeResponse string `json:"challenge_response,omitempty"`
+}
+
+type matchRequest struct {
+	Size int `json:"size,omitempty"`
+}
+
+type reportRequest struct {
+	PeerID string `json:"peer_id,omitempty"`
+	Reason string `json:"reason"`
+}
+
+type reportCreated struct {
+	ReportID string `json:"report_id"`
+}
+
+type blockRequest struct {
+	PeerID string `json:"peer_id,omitempty"`
+}
+
+type feedbackRequest struct {
+	MatchID string `json:"match_id"`
+	// PeerID is the peer rated, it may be left out after a 1:1 match
+	PeerID string   `json:"peer_id,omitempty"`
+	Rating int      `json:"rating"`
+	Tags   []string `json:"tags,omitempty"`
+}
+
+func (h *HttpServerHandle) apiRoutes() []apiRoute {
+	problem := models.Problem{}
+
+	return []apiRoute{
+		{
+			Method:    http.MethodPost,
+			Path:      "/users",
+			Summary:   "Register a user and get the details to connect with",
+			Handler:   h.apiRegister,
+			RateLimit: ActionRegister,
+			Request:   registerRequest{},
+			Responses: map[int]interface{}{201: models.Registration{}, 400: problem, 403: problem, 410: problem, 429: problem},
+		},
+		{
+			Method:    http.MethodGet,
+			Path:      "/challenge",
+			Summary:   "Get the challenge to answer when registering, no content when there is none",
+			Handler:   h.issueChallenge,
+			RateLimit: ActionChallenge,
+			Responses: map[int]interface{}{200: challenge.Challenge{}, 204: nil, 429: problem},
+		},
+		{
+			Method:    http.MethodPost,
+			Path:      "/match",
+			Summary:   "Leave the current match and look for a new one",
+			Handler:   h.apiMatch,
+			Auth:      true,
+			RateLimit: ActionMatch,
+			Request:   matchRequest{},
+			Responses: map[int]interface{}{202: models.MatchTicket{}, 400: problem, 401: problem, 403: problem, 429: problem},
+		},
+		{
+			Method:    http.MethodDelete,
+			Path:      "/match",
+			Summary:   "End the current session",
+			Handler:   h.apiEndMatch,
+			Auth:      true,
+			Responses: map[int]interface{}{204: nil, 401: problem},
+		},
+		{
+			Method:    http.MethodPost,
+			Path:      "/reports",
+			Summary:   "Report a peer of the current match",
+			Handler:   h.apiReport,
+			Auth:      true,
+			Request:   reportRequest{},
+			Responses: map[int]interface{}{201: reportCreated{}, 400: problem, 401: problem, 409: problem},
+		},
+		{
+			Method:    http.MethodPost,
+			Path:      "/blocks",
+			Summary:   "Block a peer of the current match and end the session",
+			Handler:   h.apiBlock,
+			Auth:      true,
+			Request:   blockRequest{},
+			Responses: map[int]interface{}{204: nil, 400: problem, 401: problem, 409: problem},
+		},
+		{
+			Method:    http.MethodPost,
+			Path:      "/feedback",
+			Summary:   "Rate a peer of a past match from 1 to 5",
+			Handler:   h.apiFeedback,
+			Auth:      true,
+			Request:   feedbackRequest{},
+			Responses: map[int]interface{}{204: nil, 400: problem, 401: problem, 403: problem, 409: problem},
+		},
+	}
+}
+
+// registerAPI adds the routes to the group with their rate limits and
+// authentication, and the OpenAPI document describing them.
+func (h *HttpServerHandle) registerAPI(api *echo.Group) {
+	for _, route := range h.apiRoutes() {
+		handler := route.Handler
+		if route.RateLimit != "" {
+			handler = h.rateLimit(route.RateLimit)(handler)
+		}
+		if route.Auth {
+			handler = h.apiAuth(handler)
+		}
+
+		api.Add(route.Method, route.Path, handler)
+	}
+	api.GET("/openapi.json", h.openAPI)
+}
+
+// apiAuth resolves the user from the bearer token, or from the session
+// cookie for the bundled web page.
+func (h *HttpServerHandle) apiAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var userID string
+
+		if token, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer "); ok {
+			tokenUser, err := h.Store.getTokenUser(context.Background(), token)
+			if err != nil && !errors.Is(err, redis.Nil) {
+				h.Logger.Err(err).Msg("unable to find api token")
+				return echo.NewHTTPError(http.StatusInternalServerError)
+			}
+
+			userID = tokenUser
+		} else if session, err := h.SessionStore.Get(c.Request(), "random-video-chat-session"); err == nil {
+			userID, _ = session.Values["userID"].(string)
+		}
+
+		if userID == "" || !h.Store.userExists(context.Background(), userID) {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+			return echo.NewHTTPError(http.StatusUnauthorized, "missing or invalid token")
+		}
+
+		c.Set("userID", userID)
+
+		return next(c)
+	}
+}
+
+func (h *HttpServerHandle) apiRegister(c echo.Context) error {
+	var req registerRequest
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if req.Mode == "" {
+		req.Mode = models.ModeVideo
+	}
+
+	if req.Reach == "" {
+		req.Reach = models.ReachNearby
+	}
+
+	if req.Bot {
+		key := c.Request().Header.Get("X-Bot-Key")
+		if h.BotAPIKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(h.BotAPIKey)) != 1 {
+			return echo.NewHTTPError(http.StatusForbidden, "invalid bot key")
+		}
+
+		if req.Invite != "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "bots cannot use invites")
+		}
+
+		req.Mode = models.ModeText
+	} else if err := h.checkChallenge(c, req.ChallengeID, req.ChallengeResponse); err != nil {
+		return err
+	}
+
+	userID, err := h.newUser(c, strings.TrimSpace(req.Username), req.Invite, req.Mode, req.Reach, req.Tags,
+		req.AnyMode, req.Bot)
+	if err != nil {
+		return err
+	}
+
+	token, err := h.Store.createAPIToken(context.Background(), userID)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to create api token")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	iceServer, err := h.iceServer(userID)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to issue turn credentials")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	registration := &models.Registration{
+		UserID:     userID,
+		Token:      token,
+		WsURL:      h.wsAddr(c, userID),
+		ICEServers: []models.ICEServer{},
+		Mode:       req.Mode,
+	}
+
+	if len(iceServer.URLs) > 0 {
+		registration.ICEServers = append(registration.ICEServers, *iceServer)
+	}
+
+	return c.JSON(http.StatusCreated, registration)
+}
+
+func (h *HttpServerHandle) apiMatch(c echo.Context) error {
+	var req matchRequest
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if req.Size == 0 {
+		req.Size = 2
+	}
+
+	if req.Size < 2 || req.Size > maxRoomSize {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid room size")
+	}
+
+	ticket, err := h.match(context.Background(), c.Get("userID").(string), req.Size)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusAccepted, &models.MatchTicket{Ticket: ticket})
+}
+
+func (h *HttpServerHandle) apiEndMatch(c echo.Context) error {
+	userID := c.Get("userID").(string)
+
+	if err := h.Store.cancelSearch(context.Background(), userID); err != nil {
+		h.Logger.Err(err).Msg("unable to cancel search of " + userID)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := h.Store.removeExistingMatch(context.Background(), userID, events.ReasonLeft); err != nil {
+		h.Logger.Err(err).Msg("unable to remove old match of the user")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (h *HttpServerHandle) apiReport(c echo.Context) error {
+	var req reportRequest
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" || utf8.RuneCountInString(req.Reason) > maxReportReason {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("reason must be 1 to %d characters", maxReportReason))
+	}
+
+	userID := c.Get("userID").(string)
+
+	ctx := context.Background()
+
+	peer, err := h.Store.getMatchPeer(ctx, userID, req.PeerID)
+	if errors.Is(err, errNoPeer) || errors.Is(err, redis.Nil) {
+		return echo.NewHTTPError(http.StatusConflict, "no peer to report")
+	}
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find peer of " + userID)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	report := &models.Report{
+		ReportID:  strings.ReplaceAll(uuid.New().String(), "-", ""),
+		MatchID:   peer.MatchID,
+		Reporter:  userID,
+		Reported:  peer.UserID,
+		Reason:    req.Reason,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if err := h.Store.addReport(ctx, report); err != nil {
+		h.Logger.Err(err).Msg("unable to store report")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := h.Webhooks.Publish(ctx, webhooks.EventReportCreated, report); err != nil {
+		h.Logger.Err(err).Msg("unable to publish webhook")
+	}
+
+	// the reason is left out, it is the reporter's own words
+	h.Events.Record(ctx, &events.Event{
+		Type:    events.Reported,
+		UserID:  userID,
+		MatchID: peer.MatchID,
+		Data:    map[string]interface{}{"report_id": report.ReportID, "reported": peer.UserID},
+	})
+
+	h.Logger.Info().Msg("user " + userID + " reported " + peer.UserID + " in " + peer.MatchID)
+
+	return c.JSON(http.StatusCreated, &reportCreated{ReportID: report.ReportID})
+}
+
+func (h *HttpServerHandle) apiBlock(c echo.Context) error {
+	var req blockRequest
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	userID := c.Get("userID").(string)
+
+	ctx := context.Background()
+
+	peer, err := h.Store.getMatchPeer(ctx, userID, req.PeerID)
+	if errors.Is(err, errNoPeer) || errors.Is(err, redis.Nil) {
+		return echo.NewHTTPError(http.StatusConflict, "no peer to block")
+	}
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find peer of " + userID)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	identity, err := h.Store.getIdentity(ctx, userID)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find identity of " + userID)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	peerIdentity, err := h.Store.getIdentity(ctx, peer.UserID)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find identity of " + peer.UserID)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if identity == "" || peerIdentity == "" || identity == peerIdentity {
+		return echo.NewHTTPError(http.StatusBadRequest, "unable to block this peer")
+	}
+
+	if err := h.Store.blockIdentity(ctx, identity, peerIdentity); err != nil {
+		h.Logger.Err(err).Msg("unable to block " + peer.UserID)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := h.Store.removeExistingMatch(ctx, userID, events.ReasonBlocked); err != nil {
+		h.Logger.Err(err).Msg("unable to remove old match of the user")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (h *HttpServerHandle) apiFeedback(c echo.Context) error {
+	var req feedbackRequest
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if req.Rating < 1 || req.Rating > 5 {
+		return echo.NewHTTPError(http.StatusBadRequest, "rating must be 1 to 5")
+	}
+
+	for _, tag := range req.Tags {
+		if !models.ValidFeedbackTag(tag) {
+			return echo.NewHTTPError(http.StatusBadRequest, "unknown tag "+tag)
+		}
+	}
+
+	userID := c.Get("userID").(string)
+
+	ctx := context.Background()
+
+	participants, err := h.Store.getParticipants(ctx, req.MatchID)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find participants of " + req.MatchID)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if _, ok := participants[userID]; !ok || req.MatchID == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "not a participant of the match")
+	}
+
+	var ratedID string
+
+	for participantID, p := range participants {
+		if participantID == userID {
+			continue
+		}
+
+		if p.PeerID == req.PeerID || (req.PeerID == "" && len(participants) == 2) {
+			ratedID = participantID
+		}
+	}
+
+	if ratedID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "unknown peer")
+	}
+
+	feedback := &models.Feedback{
+		MatchID:   req.MatchID,
+		From:      userID,
+		To:        ratedID,
+		Rating:    req.Rating,
+		Tags:      req.Tags,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	added, err := h.Store.addFeedback(ctx, feedback, participants[ratedID].Identity)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to store feedback")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if !added {
+		return echo.NewHTTPError(http.StatusConflict, "peer already rated")
+	}
+
+	h.Events.Record(ctx, &events.Event{
+		Type:    events.FeedbackGiven,
+		UserID:  userID,
+		MatchID: req.MatchID,
+		Data:    map[string]interface{}{"rated": ratedID, "rating": req.Rating, "tags": req.Tags},
+	})
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// problemErrorHandler answers errors on the API as problem details, other
+// routes keep the given handler.
+func problemErrorHandler(next echo.HTTPErrorHandler) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		if !strings.HasPrefix(c.Request().URL.Path, "/api/") {
+			next(err, c)
+			return
+		}
+
+		if c.Response().Committed {
+			return
+		}
+
+		problem := models.Problem{
+			Type:     "about:blank",
+			Status:   http.StatusInternalServerError,
+			Instance: c.Request().URL.Path,
+		}
+
+		var httpErr *echo.HTTPError
+		if errors.As(err, &httpErr) {
+			problem.Status = httpErr.Code
+			problem.Detail = fmt.Sprint(httpErr.Message)
+		}
+
+		problem.Title = http.StatusText(problem.Status)
+		if problem.Detail == problem.Title {
+			problem.Detail = ""
+		}
+
+		c.Response().Header().Set(echo.HeaderContentType, "application/problem+json")
+		c.Response().WriteHeader(problem.Status)
+
+		if err := c.Echo().JSONSerializer.Serialize(c, problem, ""); err != nil {
+			c.Logger().Error(err)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"rvc/internal/models"
+)
+
+// newAPIServer serves /api/v1 as the service does, with problem details on
+// errors.
+func newAPIServer(t *testing.T, limits map[string]Limit) (*httptest.Server, *HttpServerHandle) {
+	t.Helper()
+
+	s, _ := newTestHttpStorage(t)
+	logger := zerolog.Nop()
+
+	h := &HttpServerHandle{
+		SessionStore: sessions.NewCookieStore([]byte("test-session-key")),
+		Logger:       &logger,
+		Store:        s,
+		RateLimits:   limits,
+	}
+
+	e := echo.New()
+	e.HTTPErrorHandler = problemErrorHandler(e.DefaultHTTPErrorHandler)
+	h.registerAPI(e.Group("/api/v1"))
+
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	return server, h
+}
+
+// apiCall sends the body as JSON with the token and decodes the response
+// into out unless it is nil.
+func apiCall(t *testing.T, server *httptest.Server, method string, path string, token string, body interface{},
+	out interface{}) *http.Response {
+	t.Helper()
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(method, server.URL+"/api/v1"+path, bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if token != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return resp
+}
+
+// apiRegisterUser registers through the API and returns the registration.
+func apiRegisterUser(t *testing.T, server *httptest.Server, username string) *models.Registration {
+	t.Helper()
+
+	var registration models.Registration
+
+	resp := apiCall(t, server, http.MethodPost, "/users", "", map[string]string{"username": username}, &registration)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("registering %s: status %d", username, resp.StatusCode)
+	}
+
+	return &registration
+}
+
+// wantProblem checks the response is a problem+json body of the status.
+func wantProblem(t *testing.T, resp *http.Response, problem *models.Problem, status int, path string) {
+	t.Helper()
+
+	if resp.StatusCode != status {
+		t.Fatalf("%s: status %d, want %d", path, resp.StatusCode, status)
+	}
+
+	if contentType := resp.Header.Get(echo.HeaderContentType); contentType != "application/problem+json" {
+		t.Errorf("%s: content type %q", path, contentType)
+	}
+
+	if problem.Status != status || problem.Title != http.StatusText(status) || problem.Type != "about:blank" ||
+		problem.Instance != "/api/v1"+path {
+		t.Errorf("%s: problem %+v", path, problem)
+	}
+}
+
+func TestAPIAnswersProblems(t *testing.T) {
+	server, _ := newAPIServer(t, map[string]Limit{
+		ActionRegister: {PerIP: 2, Window: time.Minute},
+	})
+
+	var problem models.Problem
+
+	resp := apiCall(t, server, http.MethodPost, "/match", "", nil, &problem)
+	wantProblem(t, resp, &problem, http.StatusUnauthorized, "/match")
+	if resp.Header.Get(echo.HeaderWWWAuthenticate) != "Bearer" || problem.Detail != "missing or invalid token" {
+		t.Errorf("unauthorized: %q, %+v", resp.Header.Get(echo.HeaderWWWAuthenticate), problem)
+	}
+
+	problem = models.Problem{}
+	resp = apiCall(t, server, http.MethodPost, "/match", "forged", nil, &problem)
+	wantProblem(t, resp, &problem, http.StatusUnauthorized, "/match")
+
+	registration := apiRegisterUser(t, server, "alice")
+
+	problem = models.Problem{}
+	resp = apiCall(t, server, http.MethodPost, "/match", registration.Token, matchRequest{Size: 9}, &problem)
+	wantProblem(t, resp, &problem, http.StatusBadRequest, "/match")
+	if problem.Detail != "invalid room size" {
+		t.Errorf("bad request detail %q", problem.Detail)
+	}
+
+	problem = models.Problem{}
+	resp = apiCall(t, server, http.MethodPost, "/users", "", map[string]string{"username": ""}, &problem)
+	wantProblem(t, resp, &problem, http.StatusBadRequest, "/users")
+
+	problem = models.Problem{}
+	resp = apiCall(t, server, http.MethodPost, "/users", "", map[string]string{"username": "bob"}, &problem)
+	wantProblem(t, resp, &problem, http.StatusTooManyRequests, "/users")
+	if retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || retryAfter < 1 {
+		t.Errorf("Retry-After %q", resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestAPIReportReasonCountsCharacters(t *testing.T) {
+	server, _ := newAPIServer(t, nil)
+	registration := apiRegisterUser(t, server, "alice")
+
+	// passes validation then finds no peer to report
+	var problem models.Problem
+	resp := apiCall(t, server, http.MethodPost, "/reports", registration.Token,
+		reportRequest{Reason: strings.Repeat("é", maxReportReason)}, &problem)
+	wantProblem(t, resp, &problem, http.StatusConflict, "/reports")
+
+	problem = models.Problem{}
+	resp = apiCall(t, server, http.MethodPost, "/reports", registration.Token,
+		reportRequest{Reason: strings.Repeat("é", maxReportReason+1)}, &problem)
+	wantProblem(t, resp, &problem, http.StatusBadRequest, "/reports")
+
+	problem = models.Problem{}
+	resp = apiCall(t, server, http.MethodPost, "/reports", registration.Token, reportRequest{Reason: "  "}, &problem)
+	wantProblem(t, resp, &problem, http.StatusBadRequest, "/reports")
+}
+
+func TestAPIRegisterStoresTags(t *testing.T) {
+	server, h := newAPIServer(t, nil)
+	e := &EventStorage{RedisClient: h.Store.(*HttpStorage).RedisClient}
+
+	var problem models.Problem
+	resp := apiCall(t, server, http.MethodPost, "/users", "",
+		registerRequest{Username: "alice", Tags: []string{"music", "boring"}}, &problem)
+	wantProblem(t, resp, &problem, http.StatusBadRequest, "/users")
+
+	var registration models.Registration
+	resp = apiCall(t, server, http.MethodPost, "/users", "",
+		registerRequest{Username: "alice", Tags: []string{"music", "games", "music"}}, &registration)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("registering alice: status %d", resp.StatusCode)
+	}
+
+	candidate, err := e.loadCandidate(context.Background(), registration.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(candidate.Tags, []string{"games", "music"}) {
+		t.Errorf("matched on tags %q, want games and music", candidate.Tags)
+	}
+
+	// bob picked none, he is matched on none
+	candidate, err = e.loadCandidate(context.Background(), apiRegisterUser(t, server, "bob").UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if candidate.Tags != nil {
+		t.Errorf("matched bob on tags %q", candidate.Tags)
+	}
+}
+
+type openAPIContent map[string]struct {
+	Schema map[string]interface{} `json:"schema"`
+}
+
+type openAPIOperation struct {
+	Summary     string `json:"summary"`
+	RequestBody *struct {
+		Content openAPIContent `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]struct {
+		Content openAPIContent `json:"content"`
+	} `json:"responses"`
+	Security []interface{} `json:"security"`
+}
+
+// schemaRef is the reference the document makes to the type of v.
+func schemaRef(v interface{}) string {
+	name := reflect.TypeOf(v).Name()
+	return "#/components/schemas/" + strings.ToUpper(name[:1]) + name[1:]
+}
+
+func TestOpenAPIDocumentCoversRoutes(t *testing.T) {
+	server, h := newAPIServer(t, nil)
+
+	resp, err := http.Get(server.URL + "/api/v1/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var document struct {
+		OpenAPI    string                                 `json:"openapi"`
+		Paths      map[string]map[string]openAPIOperation `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]interface{} `json:"properties"`
+				Required   []string               `json:"required"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&document); err != nil {
+		t.Fatal(err)
+	}
+
+	if document.OpenAPI != "3.0.3" {
+		t.Errorf("openapi %q", document.OpenAPI)
+	}
+
+	for _, route := range h.apiRoutes() {
+		name := route.Method + " " + route.Path
+
+		operation, ok := document.Paths[route.Path][strings.ToLower(route.Method)]
+		if !ok {
+			t.Errorf("%s is not documented", name)
+			continue
+		}
+
+		if operation.Summary != route.Summary || (len(operation.Security) > 0) != route.Auth {
+			t.Errorf("%s: summary %q, security %v", name, operation.Summary, operation.Security)
+		}
+
+		switch {
+		case route.Request == nil && operation.RequestBody != nil:
+			t.Errorf("%s documents a request body", name)
+		case route.Request != nil && operation.RequestBody == nil:
+			t.Errorf("%s documents no request body", name)
+		case route.Request != nil:
+			if ref := operation.RequestBody.Content["application/json"].Schema["$ref"]; ref != schemaRef(route.Request) {
+				t.Errorf("%s request is %v, want %s", name, ref, schemaRef(route.Request))
+			}
+		}
+
+		if len(operation.Responses) != len(route.Responses) {
+			t.Errorf("%s documents %d responses, want %d", name, len(operation.Responses), len(route.Responses))
+		}
+
+		for status, body := range route.Responses {
+			response, ok := operation.Responses[strconv.Itoa(status)]
+			if !ok {
+				t.Errorf("%s: %d is not documented", name, status)
+				continue
+			}
+
+			if body == nil {
+				if len(response.Content) > 0 {
+					t.Errorf("%s: %d documents a body", name, status)
+				}
+				continue
+			}
+
+			contentType := "application/json"
+			if status >= 400 {
+				contentType = "application/problem+json"
+			}
+
+			if ref := response.Content[contentType].Schema["$ref"]; ref != schemaRef(body) {
+				t.Errorf("%s: %d %s is %v, want %s", name, status, contentType, ref, schemaRef(body))
+			}
+		}
+	}
+
+	register := document.Components.Schemas["RegisterRequest"]
+	if _, ok := register.Properties["any_mode"]; !ok || len(register.Required) != 1 || register.Required[0] != "username" {
+		t.Errorf("RegisterRequest schema %+v", register)
+	}
+
+	problem := document.Components.Schemas["Problem"]
+	if len(problem.Properties) != 5 || len(problem.Required) != 3 {
+		t.Errorf("Problem schema %+v", problem)
+	}
+}
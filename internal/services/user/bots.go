@@ -0,0 +1,255 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"rvc/internal/bots"
+	"rvc/internal/models"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// a user waiting on is summoned another bot after botSummonTTL, a
+	// summoned bot nobody picked returns to the bot pool after botIdle
+	botSummonTTL = 30 * time.Second
+	botIdle      = 30 * time.Second
+
+	// bots refresh their liveness every botHeartbeat, a bot that has not
+	// for botAliveTTL is no longer summoned
+	botHeartbeat = 5 * time.Second
+	botAliveTTL  = 15 * time.Second
+)
+
+// runBots connects the in-process bots and summons bots, in-process or
+// connected through the API, for users waiting longer than BotWait. It
+// returns once the in-process bots left.
+func (h *HttpServerHandle) runBots(ctx context.Context) {
+	if len(h.Bots) == 0 && h.BotAPIKey == "" {
+		return
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for _, handler := range h.Bots {
+		wg.Add(1)
+		go func(handler bots.Handler) {
+			defer wg.Done()
+
+			h.runBot(ctx, handler)
+		}(handler)
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.summonBots(ctx)
+		}
+	}
+}
+
+func (h *HttpServerHandle) summonBots(ctx context.Context) {
+	if err := h.Store.releaseIdleBots(ctx, botIdle); err != nil {
+		h.Logger.Err(err).Msg("unable to release idle bots")
+	}
+
+	waiting, err := h.Store.waitingUsers(ctx, h.BotWait)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to list waiting users")
+		return
+	}
+
+	for _, userID := range waiting {
+		botID, err := h.Store.summonBot(ctx, userID, botSummonTTL)
+		if err != nil {
+			h.Logger.Err(err).Msg("unable to summon bot for " + userID)
+			continue
+		}
+
+		if botID != "" {
+			h.Logger.Info().Msg("summoned bot " + botID + " for " + userID)
+		}
+	}
+}
+
+// runBot registers a bot user and passes the events of its matches to the
+// handler, like the websocket of a connected user.
+func (h *HttpServerHandle) runBot(ctx context.Context, handler bots.Handler) {
+	botID := "bot-" + strings.ReplaceAll(uuid.New().String(), "-", "")
+
+	if err := h.Store.addUserEntry(ctx, &models.User{
+		UserID:   botID,
+		Username: handler.Name(),
+		Mode:     models.ModeText,
+		Reach:    models.ReachAnywhere,
+		Bot:      true,
+	}); err != nil {
+		h.Logger.Err(err).Msg("unable to add bot entry")
+		return
+	}
+
+	defer func() {
+		if err := h.Store.cleanupUserEntry(context.Background(), botID); err != nil {
+			h.Logger.Err(err).Msg("unable to cleanup bot: " + botID)
+		}
+
+		if err := h.Store.removeUserEntry(context.Background(), botID); err != nil {
+			h.Logger.Err(err).Msg("unable to remove bot: " + botID)
+		}
+	}()
+
+	listenInc := h.Store.incomingMessage(ctx, botID)
+
+	defer func(pubSub *redis.PubSub) {
+		if err := pubSub.Close(); err != nil {
+			h.Logger.Err(err).Msg("unable to close redis channel properly: " + botID + ":incoming")
+		}
+	}(listenInc)
+
+	if _, err := listenInc.Receive(ctx); err != nil {
+		h.Logger.Err(err).Msg("unable to subscribe to " + botID + ":incoming")
+		return
+	}
+
+	if err := h.Store.keepBotAlive(ctx, botID, botAliveTTL); err != nil {
+		h.Logger.Err(err).Msg("unable to mark bot " + botID + " alive")
+		return
+	}
+
+	if err := h.Store.addToUnpairedPool(ctx, botID); err != nil {
+		h.Logger.Err(err).Msg("unable to add bot to bot pool")
+		return
+	}
+
+	heartbeat := time.NewTicker(botHeartbeat)
+	defer heartbeat.Stop()
+
+	h.Logger.Info().Msg("started bot " + handler.Name() + " as " + botID)
+
+	conv := &botConversation{ctx: ctx, botID: botID, store: h.Store}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			if err := h.Store.keepBotAlive(ctx, botID, botAliveTTL); err != nil {
+				h.Logger.Err(err).Msg("unable to mark bot " + botID + " alive")
+			}
+		case msg, ok := <-listenInc.Channel():
+			if !ok {
+				return
+			}
+
+			var event models.Event
+
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				continue
+			}
+
+			switch event.Event {
+			case "exchange":
+				var exchange models.Exchange
+
+				if err := json.Unmarshal(event.Data, &exchange); err != nil {
+					h.Logger.Err(err).Msg("unable to unmarshal exchange for " + botID)
+					continue
+				}
+
+				// the bot gets a new peer id with every match
+				joined := exchange.PeerID != conv.peerID && len(exchange.Peers) > 0
+				conv.peerID = exchange.PeerID
+
+				conv.peers = make(map[string]string)
+				for _, peer := range exchange.Peers {
+					conv.peers[peer.PeerID] = peer.Username
+				}
+
+				if joined {
+					handler.Join(conv)
+				}
+			case "rematch":
+				// the peer moved on, the bot waits for its next match
+				delete(conv.peers, event.From)
+			case "message":
+				from, ok := conv.peers[event.From]
+				if !ok {
+					continue
+				}
+
+				var text string
+
+				if err := json.Unmarshal(event.Data, &text); err != nil {
+					continue
+				}
+
+				handler.Message(conv, from, text)
+			}
+		}
+	}
+}
+
+// keepBotAlive refreshes the liveness of a bot connected through the API
+// until ctx is done.
+func (h *HttpServerHandle) keepBotAlive(ctx context.Context, botID string) {
+	ticker := time.NewTicker(botHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		if err := h.Store.keepBotAlive(ctx, botID, botAliveTTL); err != nil && ctx.Err() == nil {
+			h.Logger.Err(err).Msg("unable to mark bot " + botID + " alive")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// botConversation is the current match of an in-process bot.
+type botConversation struct {
+	ctx   context.Context
+	botID string
+	store HttpStore
+
+	peerID string
+	// peer id -> username
+	peers map[string]string
+}
+
+func (c *botConversation) Send(text string) error {
+	data, err := json.Marshal(text)
+	if err != nil {
+		return err
+	}
+
+	msgJSON, err := json.Marshal(&models.Event{Event: "message", Data: data})
+	if err != nil {
+		return err
+	}
+
+	return c.store.outgoingMessage(c.ctx, c.botID, msgJSON)
+}
+
+func (c *botConversation) Peers() []string {
+	peers := make([]string, 0, len(c.peers))
+	for _, username := range c.peers {
+		peers = append(peers, username)
+	}
+
+	sort.Strings(peers)
+
+	return peers
+}
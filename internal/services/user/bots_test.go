@@ -0,0 +1,93 @@
+package user
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"rvc/internal/models"
+)
+
+func newTestHttpStorage(t *testing.T) (*HttpStorage, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+
+	return &HttpStorage{RedisClient: redis.NewClient(&redis.Options{Addr: server.Addr()})}, server
+}
+
+func TestSummonBotSkipsDeadBots(t *testing.T) {
+	s, server := newTestHttpStorage(t)
+	ctx := context.Background()
+
+	for _, botID := range []string{"bot-dead", "bot-alive"} {
+		if err := s.addUserEntry(ctx, &models.User{UserID: botID, Username: "echo", Bot: true}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.keepBotAlive(ctx, botID, botAliveTTL); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.addToUnpairedPool(ctx, botID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the replica running bot-dead went away, bot-alive kept beating
+	server.FastForward(botAliveTTL - time.Second)
+	if err := s.keepBotAlive(ctx, "bot-alive", botAliveTTL); err != nil {
+		t.Fatal(err)
+	}
+	server.FastForward(2 * time.Second)
+
+	botID, err := s.summonBot(ctx, "user-1", botSummonTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if botID != "bot-alive" {
+		t.Errorf("summoned %q, want bot-alive", botID)
+	}
+
+	// nobody else is left to summon
+	if botID, err := s.summonBot(ctx, "user-2", botSummonTTL); err != nil || botID != "" {
+		t.Errorf("summoned %q, %v, want none", botID, err)
+	}
+
+	if s.userExists(ctx, "bot-dead") || s.RedisClient.SIsMember(ctx, "bot_pool", "bot-dead").Val() {
+		t.Error("the dead bot was left behind")
+	}
+}
+
+func TestReleaseIdleBotsDropsDeadBots(t *testing.T) {
+	s, server := newTestHttpStorage(t)
+	ctx := context.Background()
+
+	if err := s.addUserEntry(ctx, &models.User{UserID: "bot-1", Username: "echo", Bot: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.keepBotAlive(ctx, "bot-1", botAliveTTL); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.addToUnpairedPool(ctx, "bot-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.summonBot(ctx, "user-1", botSummonTTL); err != nil {
+		t.Fatal(err)
+	}
+
+	// nobody picked the bot, and it stopped beating meanwhile
+	server.FastForward(botAliveTTL + time.Second)
+
+	if err := s.releaseIdleBots(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.RedisClient.SIsMember(ctx, "bot_pool", "bot-1").Val() || s.userExists(ctx, "bot-1") {
+		t.Error("the dead bot went back to the bot pool")
+	}
+}
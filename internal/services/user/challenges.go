@@ -0,0 +1,82 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"net/http"
+	"rvc/internal/challenge"
+	"time"
+)
+
+// challengeTTL is how long clients have to answer a challenge.
+const challengeTTL = 5 * time.Minute
+
+// DefaultChallengeScale takes well under a second of work per registration
+// until registrations pick up.
+var DefaultChallengeScale = challenge.Scale{Base: 16, Max: 22, Normal: 30}
+
+// issueChallenge hands out the challenge to answer when registering, there
+// is no content when registration needs none.
+func (h *HttpServerHandle) issueChallenge(c echo.Context) error {
+	if h.Challenger == nil {
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	ctx := context.Background()
+
+	rate, err := h.Store.registrationRate(ctx)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find registration rate")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	issued, err := h.Challenger.Issue(h.ChallengeScale.Difficulty(float64(rate)))
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to issue challenge")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := h.Store.saveChallenge(ctx, issued, challengeTTL); err != nil {
+		h.Logger.Err(err).Msg("unable to save challenge")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, issued)
+}
+
+// checkChallenge verifies the response to a challenge issued to the client,
+// each challenge is answered once.
+func (h *HttpServerHandle) checkChallenge(c echo.Context, id string, response string) error {
+	if h.Challenger == nil {
+		return nil
+	}
+
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "challenge is required")
+	}
+
+	ctx := context.Background()
+
+	issued, err := h.Store.takeChallenge(ctx, id)
+	if errors.Is(err, redis.Nil) {
+		return echo.NewHTTPError(http.StatusForbidden, "challenge expired or already answered")
+	}
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find challenge")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	solved, err := h.Challenger.Verify(ctx, issued, response, c.RealIP())
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to verify challenge")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if !solved {
+		return echo.NewHTTPError(http.StatusForbidden, "challenge failed")
+	}
+
+	return nil
+}
@@ -0,0 +1,170 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"rvc/internal/challenge"
+)
+
+// newRegisterServer serves the challenge and registration routes of the
+// API with the challenger.
+func newRegisterServer(t *testing.T, challenger challenge.Challenger) (*httptest.Server, *miniredis.Miniredis) {
+	t.Helper()
+
+	s, redisServer := newTestHttpStorage(t)
+	logger := zerolog.Nop()
+
+	h := &HttpServerHandle{
+		SessionStore:   sessions.NewCookieStore([]byte("test-session-key")),
+		Logger:         &logger,
+		Store:          s,
+		Challenger:     challenger,
+		ChallengeScale: challenge.Scale{Base: 8, Max: 8},
+	}
+
+	e := echo.New()
+	e.GET("/api/v1/challenge", h.issueChallenge)
+	e.POST("/api/v1/users", h.apiRegister)
+
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	return server, redisServer
+}
+
+func fetchChallenge(t *testing.T, server *httptest.Server) *challenge.Challenge {
+	t.Helper()
+
+	resp, err := http.Get(server.URL + "/api/v1/challenge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var issued challenge.Challenge
+	if err := json.NewDecoder(resp.Body).Decode(&issued); err != nil {
+		t.Fatal(err)
+	}
+
+	return &issued
+}
+
+// register posts a registration answering the challenge and returns the
+// status.
+func register(t *testing.T, server *httptest.Server, challengeID string, response string) int {
+	t.Helper()
+
+	body, err := json.Marshal(map[string]string{
+		"username":           "alice",
+		"challenge_id":       challengeID,
+		"challenge_response": response,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(server.URL+"/api/v1/users", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+// unsolved finds a response that does not answer the proof of work.
+func unsolved(issued *challenge.Challenge) string {
+	for nonce := 0; ; nonce++ {
+		response := "x" + strconv.Itoa(nonce)
+		if solved, _ := (challenge.ProofOfWork{}).Verify(context.Background(), issued, response, ""); !solved {
+			return response
+		}
+	}
+}
+
+func TestRegisterRequiresProofOfWork(t *testing.T) {
+	server, redisServer := newRegisterServer(t, challenge.ProofOfWork{})
+
+	if status := register(t, server, "", ""); status != http.StatusBadRequest {
+		t.Errorf("without a challenge: status %d, want 400", status)
+	}
+
+	if status := register(t, server, "never-issued", "0"); status != http.StatusForbidden {
+		t.Errorf("unknown challenge: status %d, want 403", status)
+	}
+
+	issued := fetchChallenge(t, server)
+	if issued.Kind != challenge.KindProofOfWork || issued.Difficulty != 8 {
+		t.Fatalf("issued %+v", issued)
+	}
+
+	if status := register(t, server, issued.ID, unsolved(issued)); status != http.StatusForbidden {
+		t.Errorf("unsolved challenge: status %d, want 403", status)
+	}
+
+	// a failed answer uses the challenge up
+	if status := register(t, server, issued.ID, challenge.Solve(issued)); status != http.StatusForbidden {
+		t.Errorf("retried challenge: status %d, want 403", status)
+	}
+
+	issued = fetchChallenge(t, server)
+	response := challenge.Solve(issued)
+
+	if status := register(t, server, issued.ID, response); status != http.StatusCreated {
+		t.Errorf("solved challenge: status %d, want 201", status)
+	}
+
+	if status := register(t, server, issued.ID, response); status != http.StatusForbidden {
+		t.Errorf("replayed challenge: status %d, want 403", status)
+	}
+
+	issued = fetchChallenge(t, server)
+	redisServer.FastForward(challengeTTL + time.Second)
+
+	if status := register(t, server, issued.ID, challenge.Solve(issued)); status != http.StatusForbidden {
+		t.Errorf("expired challenge: status %d, want 403", status)
+	}
+}
+
+func TestRegisterRequiresCaptcha(t *testing.T) {
+	var ips []string
+
+	server, _ := newRegisterServer(t, &challenge.Captcha{
+		Provider: "hcaptcha",
+		SiteKey:  "site",
+		Verifier: challenge.VerifierFunc(func(_ context.Context, token string, ip string) (bool, error) {
+			ips = append(ips, ip)
+			return token == "solved", nil
+		}),
+	})
+
+	issued := fetchChallenge(t, server)
+	if issued.Kind != challenge.KindCaptcha || issued.SiteKey != "site" {
+		t.Fatalf("issued %+v", issued)
+	}
+
+	if status := register(t, server, issued.ID, "forged"); status != http.StatusForbidden {
+		t.Errorf("forged token: status %d, want 403", status)
+	}
+
+	issued = fetchChallenge(t, server)
+
+	if status := register(t, server, issued.ID, "solved"); status != http.StatusCreated {
+		t.Errorf("solved token: status %d, want 201", status)
+	}
+
+	if len(ips) != 2 || ips[1] != "127.0.0.1" {
+		t.Errorf("verified for %v, want the client address", ips)
+	}
+}
@@ -5,49 +5,339 @@ import (
 	"errors"
 	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog"
+	"rvc/internal/events"
+	"rvc/internal/models"
+	"rvc/internal/webhooks"
+	"strings"
+	"sync"
+	"time"
 )
 
 type EventServerHandler interface {
 	Match(context.Context)
+	Search(context.Context)
 }
 
 type EventServerHandle struct {
 	Store  EventStore
 	Logger *zerolog.Logger
+
+	// Webhooks is told about new matches
+	Webhooks *webhooks.Dispatcher
+	Events   *events.Log
+
+	// Partitions are the match request queues and searches served, all the
+	// partitions of a single shard when empty
+	Partitions []string
+	// Workers is the number of match and search workers, one when unset
+	Workers int
+	Metrics *MatchMetrics
 }
 
+// Match runs the workers processing the match requests of the partitions.
 func (h *EventServerHandle) Match(ctx context.Context) {
+	partitions := h.partitions()
+
+	h.runWorkers(ctx, func(localCtx context.Context) {
+		if err := h.Store.requeueDueRetries(localCtx, partitions); err != nil {
+			h.Logger.Err(err).Msg("unable to requeue due match requests")
+		}
+
+		matchRequest, err := h.Store.dequeueMatchRequest(localCtx, partitions)
+		if err != nil {
+			if !errors.Is(err, redis.Nil) {
+				h.Logger.Err(err).Msg("unable to dequeue from matchRequest queue")
+			}
+			return
+		}
+
+		if h.processMatchRequest(localCtx, matchRequest) != outcomeContended {
+			return
+		}
+
+		// another worker is matching one of the users, try again once it
+		// likely let go of them rather than spinning on the claim
+		matchRequest.Attempts++
+
+		if err := h.Store.retryMatchRequest(localCtx, matchRequest, time.Now().Add(retryDelay(matchRequest.Attempts))); err != nil {
+			h.Logger.Err(err).Msg("unable to retry match request")
+		}
+	})
+}
+
+// retryDelay is how long a request waits before its attempt-th retry.
+func retryDelay(attempt int) time.Duration {
+	return min(retryBackoff<<min(attempt-1, 8), claimTTL)
+}
+
+// runWorkers runs work in a loop on each worker until ctx is done.
+func (h *EventServerHandle) runWorkers(ctx context.Context, work func(context.Context)) {
 	localCtx := context.Background()
 
-	for {
+	var wg sync.WaitGroup
+
+	for i := 0; i < max(h.Workers, 1); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+					work(localCtx)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// partitions are the ones served, all the partitions of a single shard
+// when none are configured.
+func (h *EventServerHandle) partitions() []string {
+	if len(h.Partitions) == 0 {
+		return MatchPartitions(1)
+	}
+
+	return h.Partitions
+}
+
+// Search runs the searches for a 1:1 candidate of the partitions in the
+// background, one attempt at a time, so no request waits on them.
+func (h *EventServerHandle) Search(ctx context.Context) {
+	partitions := h.partitions()
+
+	h.runWorkers(ctx, func(localCtx context.Context) {
 		select {
 		case <-ctx.Done():
 			return
-		default:
-			matchRequest, err := h.Store.dequeueMatchRequest(localCtx)
-			if err != nil {
-				if !errors.Is(err, redis.Nil) {
-					h.Logger.Err(err).Msg("unable to dequeue from matchRequest queue")
-				}
-				continue
+		case <-time.After(searchInterval / 4):
+		}
+
+		searches, err := h.Store.dueSearches(localCtx, partitions)
+		if err != nil {
+			h.Logger.Err(err).Msg("unable to claim due searches")
+			return
+		}
+
+		for _, search := range searches {
+			h.searchAttempt(localCtx, search)
+		}
+	})
+}
+
+// searchAttempt looks for a candidate once. Until the search times out the
+// user is told where it stands and the search is scheduled again, then the
+// user is told there is no match.
+func (h *EventServerHandle) searchAttempt(ctx context.Context, search *models.MatchSearch) {
+	// cancelled by another match request or by leaving
+	if !h.Store.searchCurrent(ctx, search) {
+		return
+	}
+
+	candidateID, err := h.Store.findMatchCandidate(ctx, search)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find match candidate for " + search.UserID)
+		h.endSearch(ctx, search, models.NoMatchError)
+		return
+	}
+
+	if candidateID != "" {
+		outcome := h.processMatchRequest(ctx, &models.MatchRequest{
+			UserIDs:   []string{search.UserID, candidateID},
+			Size:      2,
+			Partition: search.Partition,
+		})
+
+		// the candidate went to another worker, keep searching
+		if outcome == outcomeMatched {
+			h.endSearch(ctx, search, "")
+			return
+		}
+	}
+
+	if time.Since(search.StartedAt) >= searchTimeout {
+		reason := models.NoMatchNoUsers
+		if search.Seen {
+			reason = models.NoMatchNoCompatible
+		}
+
+		h.endSearch(ctx, search, reason)
+
+		if err := h.Store.keepQueuedAt(ctx, search); err != nil {
+			h.Logger.Err(err).Msg("unable to keep queue place of " + search.UserID)
+		}
+		return
+	}
+
+	status, err := h.Store.queueStatus(ctx, search)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find queue status of " + search.UserID)
+	} else if err := h.Store.notifyUser(ctx, search.UserID, "queue_status", status); err != nil {
+		h.Logger.Err(err).Msg("unable to notify " + search.UserID)
+	}
+
+	if err := h.Store.scheduleSearch(ctx, search, time.Now().Add(searchInterval)); err != nil {
+		h.Logger.Err(err).Msg("unable to schedule search of " + search.UserID)
+		h.endSearch(ctx, search, models.NoMatchError)
+	}
+}
+
+// endSearch stops the search, telling the user why when there is a reason.
+func (h *EventServerHandle) endSearch(ctx context.Context, search *models.MatchSearch, reason string) {
+	if err := h.Store.endSearch(ctx, search); err != nil {
+		h.Logger.Err(err).Msg("unable to end search of " + search.UserID)
+	}
+
+	if reason == "" {
+		return
+	}
+
+	if err := h.Store.notifyUser(ctx, search.UserID, "no_match", &models.NoMatch{
+		Ticket: search.Ticket,
+		Reason: reason,
+	}); err != nil {
+		h.Logger.Err(err).Msg("unable to notify " + search.UserID)
+	}
+}
+
+// processMatchRequest seats the users of a valid request in a match or room
+// and returns the outcome.
+func (h *EventServerHandle) processMatchRequest(ctx context.Context, matchRequest *models.MatchRequest) string {
+	start := time.Now()
+
+	outcome := h.claimAndSeat(ctx, matchRequest)
+	h.Metrics.observe(matchRequest.Partition, outcome, time.Since(start))
+
+	return outcome
+}
+
+// claimAndSeat seats the users while no other worker can match them.
+func (h *EventServerHandle) claimAndSeat(ctx context.Context, matchRequest *models.MatchRequest) string {
+	claimed, err := h.Store.claimUsers(ctx, matchRequest.UserIDs)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to claim " + strings.Join(matchRequest.UserIDs, " "))
+		return outcomeError
+	}
+
+	if !claimed {
+		return outcomeContended
+	}
+
+	defer func() {
+		if err := h.Store.releaseUsers(ctx, matchRequest.UserIDs); err != nil {
+			h.Logger.Err(err).Msg("unable to release " + strings.Join(matchRequest.UserIDs, " "))
+		}
+	}()
+
+	if !h.Store.validateMatch(ctx, matchRequest) {
+		return outcomeInvalid
+	}
+
+	return h.seatUsers(ctx, matchRequest)
+}
+
+// seatUsers seats the users of a valid request in a match or room.
+func (h *EventServerHandle) seatUsers(ctx context.Context, matchRequest *models.MatchRequest) string {
+	if matchRequest.Room != "" {
+		match, created, err := h.Store.joinTopicRoom(ctx, matchRequest)
+		if errors.Is(err, errRoomFull) {
+			if err := h.Store.notifyUser(ctx, matchRequest.UserIDs[0], "room_full", &models.RoomFull{
+				Room: matchRequest.Room,
+			}); err != nil {
+				h.Logger.Err(err).Msg("unable to notify " + matchRequest.UserIDs[0])
 			}
 
-			if !h.Store.validateMatch(localCtx, matchRequest) {
-				continue
+			return outcomeInvalid
+		}
+		if err != nil {
+			h.Logger.Err(err).Msg("unable to join " + matchRequest.UserIDs[0] + " to topic room " + matchRequest.Room)
+			return outcomeError
+		}
+
+		if created {
+			if err := h.Store.enqueueCreateSessionRequest(ctx, match); err != nil {
+				h.Logger.Err(err).Msg("unable to enqueue to match queue")
 			}
 
-			match, err := h.Store.createMatchEntry(localCtx, matchRequest)
-			if err != nil {
-				h.Logger.Err(err).Msg("unable to create match model")
-				continue
+			if err := h.Webhooks.Publish(ctx, webhooks.EventMatchCreated, match); err != nil {
+				h.Logger.Err(err).Msg("unable to publish webhook")
 			}
+		} else if err := h.Store.notifyRosterChange(ctx, match.MatchID); err != nil {
+			h.Logger.Err(err).Msg("unable to notify roster change of " + match.MatchID)
+		}
 
-			if err := h.Store.enqueueCreateSessionRequest(localCtx, match); err != nil {
-				h.Logger.Err(err).Msg("unable to enqueue to match queue")
-				continue
+		h.Events.Record(ctx, &events.Event{
+			Type:    events.Matched,
+			UserID:  matchRequest.UserIDs[0],
+			MatchID: match.MatchID,
+			Data:    map[string]interface{}{"size": match.Size, "room": match.Room},
+		})
+
+		h.Logger.Info().Msg("joined " + matchRequest.UserIDs[0] + " to topic room " + matchRequest.Room)
+		return outcomeMatched
+	}
+
+	if matchRequest.Size > 2 {
+		matchID, err := h.Store.joinOpenRoom(ctx, matchRequest)
+		if err != nil {
+			h.Logger.Err(err).Msg("unable to join room")
+			return outcomeError
+		}
+
+		if matchID != "" {
+			if err := h.Store.notifyRosterChange(ctx, matchID); err != nil {
+				h.Logger.Err(err).Msg("unable to notify roster change of " + matchID)
 			}
 
-			h.Logger.Info().Msg("matched " + match.UserID1 + " " + match.UserID2)
+			h.Events.Record(ctx, &events.Event{
+				Type:    events.Matched,
+				UserID:  matchRequest.UserIDs[0],
+				MatchID: matchID,
+				Data:    map[string]interface{}{"size": matchRequest.Size},
+			})
+
+			h.Logger.Info().Msg("joined " + matchRequest.UserIDs[0] + " to room " + matchID)
+			return outcomeMatched
 		}
 	}
+
+	match, err := h.Store.createMatchEntry(ctx, matchRequest)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to create match model")
+		return outcomeError
+	}
+
+	if err := h.Store.endSearches(ctx, match.UserIDs); err != nil {
+		h.Logger.Err(err).Msg("unable to end searches of " + strings.Join(match.UserIDs, " "))
+	}
+
+	if err := h.Store.enqueueCreateSessionRequest(ctx, match); err != nil {
+		h.Logger.Err(err).Msg("unable to enqueue to match queue")
+		return outcomeError
+	}
+
+	if err := h.Webhooks.Publish(ctx, webhooks.EventMatchCreated, match); err != nil {
+		h.Logger.Err(err).Msg("unable to publish webhook")
+	}
+
+	if !matchRequest.Direct && match.Size == 2 {
+		if err := h.Store.countMatch(ctx, match.MatchID); err != nil {
+			h.Logger.Err(err).Msg("unable to count match " + match.MatchID)
+		}
+	}
+
+	h.Events.Record(ctx, &events.Event{
+		Type:    events.Matched,
+		MatchID: match.MatchID,
+		Data:    map[string]interface{}{"user_ids": match.UserIDs, "size": match.Size},
+	})
+
+	h.Logger.Info().Msg("matched " + strings.Join(match.UserIDs, " "))
+
+	return outcomeMatched
 }
@@ -3,21 +3,93 @@ package user
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
+	"math"
+	"rvc/internal/geo"
+	"rvc/internal/matching"
 	"rvc/internal/models"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
+var (
+	errRoomFull    = errors.New("room is full")
+	errUnknownRoom = errors.New("unknown room")
+)
+
+// participantsTTL is how long participants may give feedback on a match
+// after it was formed.
+const participantsTTL = time.Hour
+
+// matchRateWindow is how far back matches count towards the wait estimated
+// for waiting users.
+const matchRateWindow = 5 * time.Minute
+
+const (
+	// searchInterval is how often a search looks for a candidate, and the
+	// user is told where it stands
+	searchInterval = 2 * time.Second
+	// searchTimeout is how long a search runs before it gives up
+	searchTimeout = 30 * time.Second
+	// queuedAtTTL is how soon after giving up a new search keeps the
+	// user's place in the queue
+	queuedAtTTL = time.Minute
+	// searchBatch is how many due searches a worker claims at once
+	searchBatch = 32
+	// claimTTL bounds how long a crashed worker keeps users it claimed
+	claimTTL = 10 * time.Second
+	// retryBackoff is how long a request whose users were claimed waits
+	// before it is retried, doubling with each attempt up to claimTTL
+	retryBackoff = 250 * time.Millisecond
+	// dequeueWait is how long workers wait for a request, so they notice
+	// retries coming due and the service shutting down
+	dequeueWait = time.Second
+)
+
+// participant is kept in match_participants after the match_entry is gone,
+// so feedback can be checked and credited to the peer's identity.
+type participant struct {
+	PeerID   string `json:"peer_id"`
+	Identity string `json:"identity"`
+	JoinedAt int64  `json:"joined_at"`
+}
+
 type EventStore interface {
 	// Events: Event related operations
 
-	dequeueMatchRequest(context.Context) (*models.MatchRequest, error)
+	dequeueMatchRequest(context.Context, []string) (*models.MatchRequest, error)
+	retryMatchRequest(context.Context, *models.MatchRequest, time.Time) error
+	requeueDueRetries(context.Context, []string) error
+	claimUsers(context.Context, []string) (bool, error)
+	releaseUsers(context.Context, []string) error
 	validateMatch(context.Context, *models.MatchRequest) bool
 	createMatchEntry(context.Context, *models.MatchRequest) (*models.Match, error)
 	enqueueCreateSessionRequest(context.Context, *models.Match) error
+	countMatch(context.Context, string) error
+
+	// Search: Searches for a 1:1 candidate, an attempt every searchInterval
+
+	dueSearches(context.Context, []string) ([]*models.MatchSearch, error)
+	scheduleSearch(context.Context, *models.MatchSearch, time.Time) error
+	searchCurrent(context.Context, *models.MatchSearch) bool
+	endSearch(context.Context, *models.MatchSearch) error
+	endSearches(context.Context, []string) error
+	keepQueuedAt(context.Context, *models.MatchSearch) error
+	findMatchCandidate(context.Context, *models.MatchSearch) (string, error)
+	queueStatus(context.Context, *models.MatchSearch) (*models.QueueStatus, error)
+	notifyUser(context.Context, string, string, interface{}) error
+
+	// Rooms: Group rooms users join and leave mid-session
+
+	joinOpenRoom(context.Context, *models.MatchRequest) (string, error)
+	joinTopicRoom(context.Context, *models.MatchRequest) (*models.Match, bool, error)
+	notifyRosterChange(context.Context, string) error
 }
 
 type EventStorage struct {
@@ -26,8 +98,15 @@ type EventStorage struct {
 
 // Event
 
-func (s *EventStorage) dequeueMatchRequest(ctx context.Context) (*models.MatchRequest, error) {
-	matchRequestJSON, err := s.RedisClient.BRPop(ctx, 60*time.Second, "match_request_queue").Result()
+// dequeueMatchRequest pops a request from the queue of any of the
+// partitions.
+func (s *EventStorage) dequeueMatchRequest(ctx context.Context, partitions []string) (*models.MatchRequest, error) {
+	queues := make([]string, len(partitions))
+	for i, partition := range partitions {
+		queues[i] = "match_request_queue:" + partition
+	}
+
+	matchRequestJSON, err := s.RedisClient.BRPop(ctx, dequeueWait, queues...).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -41,50 +120,716 @@ func (s *EventStorage) dequeueMatchRequest(ctx context.Context) (*models.MatchRe
 	return &match, nil
 }
 
+// retryMatchRequest schedules the request to be put back on its partition's
+// queue at the given time.
+func (s *EventStorage) retryMatchRequest(ctx context.Context, matchRequest *models.MatchRequest, at time.Time) error {
+	matchJSON, err := json.Marshal(matchRequest)
+	if err != nil {
+		return err
+	}
+
+	return s.RedisClient.ZAdd(ctx, "match_request_retries:"+matchRequest.Partition, redis.Z{
+		Score:  float64(at.UnixMilli()),
+		Member: matchJSON,
+	}).Err()
+}
+
+// requeueDueRetries puts the retries that are due back at the head of their
+// partitions' queues, a retry is only requeued by one worker.
+func (s *EventStorage) requeueDueRetries(ctx context.Context, partitions []string) error {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	for _, partition := range partitions {
+		retries := "match_request_retries:" + partition
+
+		members, err := s.RedisClient.ZRangeByScore(ctx, retries, &redis.ZRangeBy{Min: "-inf", Max: now}).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, member := range members {
+			claimed, err := s.RedisClient.ZRem(ctx, retries, member).Result()
+			if err != nil {
+				return err
+			}
+
+			if claimed == 0 {
+				continue
+			}
+
+			if err := s.RedisClient.RPush(ctx, "match_request_queue:"+partition, member).Err(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// claimUsers keeps workers of any partition or replica from matching the
+// users at the same time, it returns false when one is already claimed.
+func (s *EventStorage) claimUsers(ctx context.Context, userIDs []string) (bool, error) {
+	sorted := slices.Clone(userIDs)
+	slices.Sort(sorted)
+
+	for i, userID := range sorted {
+		claimed, err := s.RedisClient.SetNX(ctx, fmt.Sprintf("match_claim:%s", userID), 1, claimTTL).Result()
+		if err != nil || !claimed {
+			if err := s.releaseUsers(ctx, sorted[:i]); err != nil {
+				return false, err
+			}
+
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (s *EventStorage) releaseUsers(ctx context.Context, userIDs []string) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	keys := make([]string, len(userIDs))
+	for i, userID := range userIDs {
+		keys[i] = fmt.Sprintf("match_claim:%s", userID)
+	}
+
+	return s.RedisClient.Del(ctx, keys...).Err()
+}
+
+// validateMatch tells if the users of the request can still be matched,
+// none of them may be seated elsewhere and the users of a 1:1 request must
+// all still be unpaired. Users already in the topic room they join are let
+// through, they keep their seat.
 func (s *EventStorage) validateMatch(ctx context.Context, matchRequest *models.MatchRequest) bool {
-	return s.RedisClient.SIsMember(ctx, "unpaired_pool", matchRequest.UserID1).Val() ||
-		s.RedisClient.SIsMember(ctx, "unpaired_pool", matchRequest.UserID2).Val()
+	joining := ""
+	if matchRequest.Room != "" {
+		joining = s.RedisClient.HGet(ctx, fmt.Sprintf("topic_room:%s", matchRequest.Room), "match_id").Val()
+	}
+
+	for _, userID := range matchRequest.UserIDs {
+		fields, err := s.RedisClient.HMGet(ctx, fmt.Sprintf("user_entry:%s", userID), "username", "match_id").Result()
+		if err != nil || fields[0] == nil {
+			return false
+		}
+
+		if matchID, _ := fields[1].(string); matchID != "" && (joining == "" || matchID != joining) {
+			return false
+		}
+	}
+
+	if matchRequest.Size > 2 || matchRequest.Room != "" || matchRequest.Direct {
+		return true
+	}
+
+	for _, userID := range matchRequest.UserIDs {
+		if !s.RedisClient.SIsMember(ctx, "unpaired_pool", userID).Val() {
+			return false
+		}
+	}
+
+	return true
 }
 
 func (s *EventStorage) createMatchEntry(ctx context.Context, matchRequest *models.MatchRequest) (*models.Match, error) {
+	// match ids are handed to participants, unlike user ids
 	match := models.Match{
-		MatchID: matchRequest.UserID1 + "match" + matchRequest.UserID2 + "-" +
-			strings.ReplaceAll(uuid.New().String(), "-", ""),
-		UserID1: matchRequest.UserID1,
-		UserID2: matchRequest.UserID2,
+		MatchID: "match-" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+		UserIDs: matchRequest.UserIDs,
+		Size:    matchRequest.Size,
+	}
+
+	if match.Size > 2 {
+		match.MatchID = "room-" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	}
+
+	for _, userID := range match.UserIDs {
+		if err := s.RedisClient.SRem(ctx, "unpaired_pool", userID).Err(); err != nil {
+			return nil, err
+		}
+
+		peerID := newPeerID()
+
+		if err := s.RedisClient.HSet(ctx, fmt.Sprintf("match_entry:%s", match.MatchID),
+			userID, peerID).Err(); err != nil {
+			return nil, err
+		}
+
+		if err := s.addParticipant(ctx, s.RedisClient, match.MatchID, userID, peerID); err != nil {
+			return nil, err
+		}
+
+		if err := s.RedisClient.HSet(ctx, fmt.Sprintf("user_entry:%s", userID),
+			"match_id", match.MatchID).Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.RedisClient.Set(ctx, fmt.Sprintf("match_size:%s", match.MatchID), match.Size, 0).Err(); err != nil {
+		return nil, err
+	}
+
+	if match.Size > 2 {
+		openRooms := openRoomsKey(match.Size, matchRequest.Pool)
+
+		// remembered so a freed seat is listed where the room was found
+		if err := s.RedisClient.Set(ctx, fmt.Sprintf("match_open_rooms:%s", match.MatchID), openRooms, 0).Err(); err != nil {
+			return nil, err
+		}
+
+		if match.Size > len(match.UserIDs) {
+			if err := s.RedisClient.SAdd(ctx, openRooms, match.MatchID).Err(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &match, nil
+}
+
+func (s *EventStorage) enqueueCreateSessionRequest(ctx context.Context, match *models.Match) error {
+	matchJSON, err := json.Marshal(match)
+	if err != nil {
+		return err
+	}
+
+	return s.RedisClient.LPush(ctx, "create_session_queue", matchJSON).Err()
+}
+
+// countMatch records a match made from the unpaired pool in recent_matches,
+// dropping those older than matchRateWindow.
+func (s *EventStorage) countMatch(ctx context.Context, matchID string) error {
+	now := time.Now()
+
+	if err := s.RedisClient.ZAdd(ctx, "recent_matches", redis.Z{
+		Score:  float64(now.Unix()),
+		Member: matchID,
+	}).Err(); err != nil {
+		return err
+	}
+
+	return s.RedisClient.ZRemRangeByScore(ctx, "recent_matches", "-inf",
+		strconv.FormatInt(now.Add(-matchRateWindow).Unix(), 10)).Err()
+}
+
+// Search
+
+// dueSearches claims the searches of the partitions whose next attempt is
+// due, a search is only claimed by one worker.
+func (s *EventStorage) dueSearches(ctx context.Context, partitions []string) ([]*models.MatchSearch, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	var searches []*models.MatchSearch
+
+	for _, partition := range partitions {
+		due, err := s.claimDueSearches(ctx, "match_searches:"+partition, now, searchBatch-len(searches))
+		if err != nil {
+			return nil, err
+		}
+
+		searches = append(searches, due...)
+
+		if len(searches) >= searchBatch {
+			break
+		}
+	}
+
+	// the longest waiters pick first
+	sort.Slice(searches, func(i, j int) bool {
+		return searches[i].QueuedAt.Before(searches[j].QueuedAt)
+	})
+
+	return searches, nil
+}
+
+func (s *EventStorage) claimDueSearches(ctx context.Context, key string, now string, count int) ([]*models.MatchSearch, error) {
+	members, err := s.RedisClient.ZRangeByScore(ctx, key, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   now,
+		Count: int64(count),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var searches []*models.MatchSearch
+
+	for _, member := range members {
+		claimed, err := s.RedisClient.ZRem(ctx, key, member).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		if claimed == 0 {
+			continue
+		}
+
+		var search models.MatchSearch
+
+		if err := json.Unmarshal([]byte(member), &search); err != nil {
+			return nil, err
+		}
+
+		searches = append(searches, &search)
+	}
+
+	return searches, nil
+}
+
+func (s *EventStorage) scheduleSearch(ctx context.Context, search *models.MatchSearch, at time.Time) error {
+	searchJSON, err := json.Marshal(search)
+	if err != nil {
+		return err
+	}
+
+	return s.RedisClient.ZAdd(ctx, "match_searches:"+search.Partition, redis.Z{
+		Score:  float64(at.UnixMilli()),
+		Member: searchJSON,
+	}).Err()
+}
+
+// searchCurrent tells if the search is still the user's current one, it is
+// not once the user asked for another match or left.
+func (s *EventStorage) searchCurrent(ctx context.Context, search *models.MatchSearch) bool {
+	return s.RedisClient.Get(ctx, fmt.Sprintf("match_ticket:%s", search.UserID)).Val() == search.Ticket
+}
+
+func (s *EventStorage) endSearch(ctx context.Context, search *models.MatchSearch) error {
+	if !s.searchCurrent(ctx, search) {
+		return nil
+	}
+
+	if err := s.RedisClient.ZRem(ctx, "match_waiting", search.UserID).Err(); err != nil {
+		return err
+	}
+
+	return s.RedisClient.Del(ctx, fmt.Sprintf("match_ticket:%s", search.UserID),
+		fmt.Sprintf("bot_summoned:%s", search.UserID)).Err()
+}
+
+// endSearches stops the searches of users seated in a match, whoever's
+// search found it.
+func (s *EventStorage) endSearches(ctx context.Context, userIDs []string) error {
+	members := make([]interface{}, len(userIDs))
+	keys := make([]string, 0, 2*len(userIDs))
+
+	for i, userID := range userIDs {
+		members[i] = userID
+		keys = append(keys, fmt.Sprintf("match_ticket:%s", userID), fmt.Sprintf("bot_summoned:%s", userID))
+	}
+
+	if err := s.RedisClient.ZRem(ctx, "match_waiting", members...).Err(); err != nil {
+		return err
+	}
+
+	return s.RedisClient.Del(ctx, keys...).Err()
+}
+
+// keepQueuedAt lets the user's next search within queuedAtTTL start from
+// the place in the queue of the search that gave up.
+func (s *EventStorage) keepQueuedAt(ctx context.Context, search *models.MatchSearch) error {
+	return s.RedisClient.Set(ctx, fmt.Sprintf("match_queued_at:%s", search.UserID),
+		search.QueuedAt.Unix(), queuedAtTTL).Err()
+}
+
+// findMatchCandidate picks the first eligible user of the unpaired pool,
+// the users waiting the longest come first and a sample of the others after
+// them. It returns "" when there is none yet.
+func (s *EventStorage) findMatchCandidate(ctx context.Context, search *models.MatchSearch) (string, error) {
+	waiting, err := s.RedisClient.ZRangeWithScores(ctx, "match_waiting", 0, 63).Result()
+	if err != nil {
+		return "", err
 	}
 
-	if err := s.RedisClient.SRem(ctx, "unpaired_pool", match.UserID1).Err(); err != nil {
+	// a sample rather than a single member, some may not be compatible
+	sample, err := s.RedisClient.SRandMemberN(ctx, "unpaired_pool", 16).Result()
+	if err != nil {
+		return "", err
+	}
+
+	since := make(map[string]time.Time, len(waiting))
+	userIDs := make([]string, 0, len(waiting)+len(sample))
+
+	for _, z := range waiting {
+		userID := z.Member.(string)
+		since[userID] = time.Unix(int64(z.Score), 0)
+
+		if s.RedisClient.SIsMember(ctx, "unpaired_pool", userID).Val() {
+			userIDs = append(userIDs, userID)
+		}
+	}
+
+	for _, userID := range sample {
+		if _, ok := since[userID]; !ok {
+			userIDs = append(userIDs, userID)
+		}
+	}
+
+	candidates := make([]matching.Candidate, 0, len(userIDs))
+
+	for _, userID := range userIDs {
+		if userID == search.UserID {
+			continue
+		}
+
+		candidate, err := s.loadCandidate(ctx, userID)
+		if err != nil {
+			return "", err
+		}
+
+		candidate.WaitingSince = since[userID]
+		candidates = append(candidates, *candidate)
+	}
+
+	matching.Order(candidates)
+
+	own, err := s.loadCandidate(ctx, search.UserID)
+	if err != nil {
+		return "", err
+	}
+
+	own.WaitingSince = search.QueuedAt
+
+	policy := matching.Policy{
+		Modes:           search.Modes,
+		ByReputation:    search.ByReputation,
+		RelaxModesAfter: search.RelaxModesAfter,
+	}
+	now := time.Now()
+
+	for _, candidate := range candidates {
+		search.Seen = true
+
+		if s.isBlocked(ctx, search.UserID, candidate.UserID) {
+			continue
+		}
+
+		if policy.Eligible(own, &candidate, now) {
+			return candidate.UserID, nil
+		}
+	}
+
+	return "", nil
+}
+
+// loadCandidate reads what the matching policy needs from the user's entry.
+func (s *EventStorage) loadCandidate(ctx context.Context, userID string) (*matching.Candidate, error) {
+	fields, err := s.RedisClient.HMGet(ctx, fmt.Sprintf("user_entry:%s", userID),
+		"mode", "bot", "reputation", "reach", "country", "lat", "lon", "region", "any_mode", "locale", "tags").Result()
+	if err != nil {
 		return nil, err
 	}
 
-	if err := s.RedisClient.SRem(ctx, "unpaired_pool", match.UserID2).Err(); err != nil {
+	candidate := &matching.Candidate{
+		UserID:     userID,
+		Mode:       models.ModeVideo,
+		Reputation: reputationStats{}.score(),
+	}
+
+	if mode, ok := fields[0].(string); ok && mode != "" {
+		candidate.Mode = mode
+	}
+
+	if bot, ok := fields[1].(string); ok {
+		candidate.Bot = bot == "1"
+	}
+
+	if reputation, ok := fields[2].(string); ok {
+		if score, err := strconv.ParseFloat(reputation, 64); err == nil {
+			candidate.Reputation = score
+		}
+	}
+
+	if reach, ok := fields[3].(string); ok {
+		candidate.Reach = reach
+	}
+
+	if country, ok := fields[4].(string); ok && country != "" {
+		lat, _ := fields[5].(string)
+		lon, _ := fields[6].(string)
+		region, _ := fields[7].(string)
+
+		candidate.Location = &geo.Location{Region: region, Country: country}
+		candidate.Location.Latitude, _ = strconv.ParseFloat(lat, 64)
+		candidate.Location.Longitude, _ = strconv.ParseFloat(lon, 64)
+	}
+
+	if anyMode, ok := fields[8].(string); ok {
+		candidate.AnyMode = anyMode == "1"
+	}
+
+	if locale, ok := fields[9].(string); ok {
+		candidate.Locale = locale
+	}
+
+	if tags, ok := fields[10].(string); ok && tags != "" {
+		candidate.Tags = strings.Split(tags, ",")
+	}
+
+	return candidate, nil
+}
+
+// isBlocked reports whether either user blocked the other.
+func (s *EventStorage) isBlocked(ctx context.Context, userID string, otherID string) bool {
+	identity := s.RedisClient.HGet(ctx, fmt.Sprintf("user_entry:%s", userID), "identity").Val()
+	otherIdentity := s.RedisClient.HGet(ctx, fmt.Sprintf("user_entry:%s", otherID), "identity").Val()
+
+	if identity == "" || otherIdentity == "" {
+		return false
+	}
+
+	return s.RedisClient.SIsMember(ctx, fmt.Sprintf("blocked:%s", identity), otherIdentity).Val() ||
+		s.RedisClient.SIsMember(ctx, fmt.Sprintf("blocked:%s", otherIdentity), identity).Val()
+}
+
+// queueStatus places the user among the users waiting for a candidate and
+// estimates the wait from the matches made within matchRateWindow, each of
+// them took two waiting users off the queue.
+func (s *EventStorage) queueStatus(ctx context.Context, search *models.MatchSearch) (*models.QueueStatus, error) {
+	waiting, err := s.RedisClient.ZCard(ctx, "match_waiting").Result()
+	if err != nil {
 		return nil, err
 	}
 
-	if err := s.RedisClient.HSet(ctx, fmt.Sprintf("match_entry:%s", match.MatchID),
-		"user1", match.UserID1, "user2", match.UserID2).Err(); err != nil {
+	position := waiting + 1
+
+	rank, err := s.RedisClient.ZRank(ctx, "match_waiting", search.UserID).Result()
+	if err == nil {
+		position = rank + 1
+	} else if !errors.Is(err, redis.Nil) {
 		return nil, err
 	}
 
-	if err := s.RedisClient.HSet(ctx, fmt.Sprintf("user_entry:%s", match.UserID1),
-		"match_id", match.MatchID).Err(); err != nil {
+	poolSize, err := s.RedisClient.SCard(ctx, "unpaired_pool").Result()
+	if err != nil {
 		return nil, err
 	}
 
-	if err := s.RedisClient.HSet(ctx, fmt.Sprintf("user_entry:%s", match.UserID2),
-		"match_id", match.MatchID).Err(); err != nil {
+	matches, err := s.RedisClient.ZCount(ctx, "recent_matches",
+		strconv.FormatInt(time.Now().Add(-matchRateWindow).Unix(), 10), "+inf").Result()
+	if err != nil {
 		return nil, err
 	}
 
-	return &match, nil
+	status := &models.QueueStatus{
+		Ticket:   search.Ticket,
+		Position: int(position),
+		Waiting:  int(max(waiting, position)),
+		PoolSize: int(poolSize),
+	}
+
+	if matches > 0 {
+		perSecond := 2 * float64(matches) / matchRateWindow.Seconds()
+		status.EstimatedWait = int(math.Ceil(float64(position) / perSecond))
+	}
+
+	return status, nil
 }
 
-func (s *EventStorage) enqueueCreateSessionRequest(ctx context.Context, match *models.Match) error {
-	matchJSON, err := json.Marshal(match)
+func (s *EventStorage) notifyUser(ctx context.Context, userID string, event string, data interface{}) error {
+	return publishEvent(ctx, s.RedisClient, userID, event, data)
+}
+
+// publishEvent sends an event of the service to the user's websocket.
+func publishEvent(ctx context.Context, cmd redis.Cmdable, userID string, event string, data interface{}) error {
+	dataJSON, err := json.Marshal(data)
 	if err != nil {
 		return err
 	}
 
-	return s.RedisClient.LPush(ctx, "create_session_queue", matchJSON).Err()
+	msgJSON, err := json.Marshal(&models.Event{Event: event, Data: dataJSON})
+	if err != nil {
+		return err
+	}
+
+	return cmd.Publish(ctx, userID+":incoming", msgJSON).Err()
+}
+
+// Rooms
+
+// joinOpenRoom seats the requesting user in a room of the requested size that
+// still has space, it returns an empty match id when there is none.
+func (s *EventStorage) joinOpenRoom(ctx context.Context, matchRequest *models.MatchRequest) (string, error) {
+	userID := matchRequest.UserIDs[0]
+	openRooms := openRoomsKey(matchRequest.Size, matchRequest.Pool)
+
+	for attempt := 1; attempt <= 5; attempt++ {
+		matchID, err := s.RedisClient.SRandMember(ctx, openRooms).Result()
+		if errors.Is(err, redis.Nil) {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		err = s.joinRoom(ctx, matchID, userID, openRooms)
+		if errors.Is(err, errRoomFull) || errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		return matchID, nil
+	}
+
+	return "", nil
+}
+
+func (s *EventStorage) joinRoom(ctx context.Context, matchID string, userID string, openRooms string) error {
+	matchEntry := fmt.Sprintf("match_entry:%s", matchID)
+	matchSize := fmt.Sprintf("match_size:%s", matchID)
+	peerID := newPeerID()
+
+	return s.RedisClient.Watch(ctx, func(tx *redis.Tx) error {
+		sizeStr, err := tx.Get(ctx, matchSize).Result()
+		if errors.Is(err, redis.Nil) {
+			// room was torn down since it was listed
+			if openRooms != "" {
+				tx.SRem(ctx, openRooms, matchID)
+			}
+			return errRoomFull
+		}
+		if err != nil {
+			return err
+		}
+
+		size, err := strconv.Atoi(sizeStr)
+		if err != nil {
+			return err
+		}
+
+		seated, err := tx.HLen(ctx, matchEntry).Result()
+		if err != nil {
+			return err
+		}
+
+		if int(seated) >= size {
+			if openRooms != "" {
+				tx.SRem(ctx, openRooms, matchID)
+			}
+			return errRoomFull
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, matchEntry, userID, peerID)
+			pipe.HSet(ctx, fmt.Sprintf("user_entry:%s", userID), "match_id", matchID)
+			pipe.SRem(ctx, "unpaired_pool", userID)
+
+			if int(seated)+1 >= size && openRooms != "" {
+				pipe.SRem(ctx, openRooms, matchID)
+			}
+
+			return s.addParticipant(ctx, pipe, matchID, userID, peerID)
+		})
+
+		return err
+	}, matchEntry, matchSize)
+}
+
+// joinTopicRoom seats the user in the session of a topic room, the session
+// is created with the user as its first participant when the room is empty.
+func (s *EventStorage) joinTopicRoom(ctx context.Context, matchRequest *models.MatchRequest) (*models.Match, bool, error) {
+	userID := matchRequest.UserIDs[0]
+	topicRoom := fmt.Sprintf("topic_room:%s", matchRequest.Room)
+
+	for attempt := 1; attempt <= 5; attempt++ {
+		match := &models.Match{
+			UserIDs: []string{userID},
+			Room:    matchRequest.Room,
+		}
+		var created bool
+
+		err := s.RedisClient.Watch(ctx, func(tx *redis.Tx) error {
+			room, err := tx.HGetAll(ctx, topicRoom).Result()
+			if err != nil {
+				return err
+			}
+
+			match.Size, err = strconv.Atoi(room["capacity"])
+			if err != nil {
+				return errUnknownRoom
+			}
+
+			match.MatchID = room["match_id"]
+			if match.MatchID != "" && tx.Exists(ctx, fmt.Sprintf("match_size:%s", match.MatchID)).Val() == 1 {
+				return nil
+			}
+
+			// the room is empty, open a new session for it
+			match.MatchID = "topic-" + matchRequest.Room + "-" + strings.ReplaceAll(uuid.New().String(), "-", "")
+			created = true
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.HSet(ctx, topicRoom, "match_id", match.MatchID)
+				pipe.Set(ctx, fmt.Sprintf("match_size:%s", match.MatchID), match.Size, 0)
+				pipe.Set(ctx, fmt.Sprintf("match_room:%s", match.MatchID), matchRequest.Room, 0)
+				return nil
+			})
+
+			return err
+		}, topicRoom)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		err = s.joinRoom(ctx, match.MatchID, userID, "")
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		return match, created, nil
+	}
+
+	return nil, false, errRoomFull
+}
+
+// addParticipant records the user in match_participants, users without an
+// identity are credited by user id.
+func (s *EventStorage) addParticipant(ctx context.Context, cmd redis.Cmdable, matchID string, userID string, peerID string) error {
+	identity := s.RedisClient.HGet(ctx, fmt.Sprintf("user_entry:%s", userID), "identity").Val()
+	if identity == "" {
+		identity = userID
+	}
+
+	participantJSON, err := json.Marshal(&participant{PeerID: peerID, Identity: identity, JoinedAt: time.Now().Unix()})
+	if err != nil {
+		return err
+	}
+
+	participants := fmt.Sprintf("match_participants:%s", matchID)
+
+	if err := cmd.HSet(ctx, participants, userID, participantJSON).Err(); err != nil {
+		return err
+	}
+
+	return cmd.Expire(ctx, participants, participantsTTL).Err()
+}
+
+func (s *EventStorage) notifyRosterChange(ctx context.Context, matchID string) error {
+	return s.RedisClient.Publish(ctx, matchID+":roster", "").Err()
+}
+
+// openRoomsKey lists the rooms of a size with free seats, per pool of
+// compatible modes.
+func openRoomsKey(size int, pool string) string {
+	if pool == "" {
+		return fmt.Sprintf("open_rooms:%d", size)
+	}
+
+	return fmt.Sprintf("open_rooms:%d:%s", size, pool)
+}
+
+// newPeerID identifies a participant to the others in a match, user ids are
+// never shared since they grant access to the user's connection.
+func newPeerID() string {
+	return strings.ReplaceAll(uuid.New().String(), "-", "")[:12]
 }
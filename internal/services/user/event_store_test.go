@@ -0,0 +1,196 @@
+package user
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"rvc/internal/events"
+	"rvc/internal/models"
+)
+
+// newMatchedUsers registers unpaired users and returns the event storage
+// over the same redis.
+func newMatchedUsers(t *testing.T, userIDs ...string) (*HttpStorage, *EventStorage) {
+	t.Helper()
+
+	s, _ := newTestHttpStorage(t)
+	ctx := context.Background()
+
+	for _, userID := range userIDs {
+		if err := s.addUserEntry(ctx, &models.User{UserID: userID, Username: userID}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.addToUnpairedPool(ctx, userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return s, &EventStorage{RedisClient: s.RedisClient}
+}
+
+func TestValidateMatchRequiresFreeUsers(t *testing.T) {
+	s, e := newMatchedUsers(t, "alice", "bob", "carol")
+	ctx := context.Background()
+
+	if _, err := e.createMatchEntry(ctx, &models.MatchRequest{UserIDs: []string{"alice", "bob"}, Size: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// alice is back in the pool, e.g. from a stale request, but still seated
+	if err := s.addToUnpairedPool(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, request := range map[string]*models.MatchRequest{
+		"1:1":    {UserIDs: []string{"carol", "alice"}, Size: 2},
+		"direct": {UserIDs: []string{"carol", "alice"}, Size: 2, Direct: true},
+		"room":   {UserIDs: []string{"alice"}, Size: 4},
+	} {
+		if e.validateMatch(ctx, request) {
+			t.Errorf("%s request with a seated user is valid", name)
+		}
+	}
+
+	if !e.validateMatch(ctx, &models.MatchRequest{UserIDs: []string{"carol"}, Size: 4}) {
+		t.Error("room request of a free user is invalid")
+	}
+
+	if e.validateMatch(ctx, &models.MatchRequest{UserIDs: []string{"dave"}, Size: 4}) {
+		t.Error("request of a user that left is valid")
+	}
+}
+
+func TestValidateMatchLetsUsersRejoinTheirTopicRoom(t *testing.T) {
+	s, e := newMatchedUsers(t, "alice")
+	ctx := context.Background()
+
+	if err := s.registerTopicRoom(ctx, &models.TopicRoom{Name: "music", Capacity: 8}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := e.joinTopicRoom(ctx, &models.MatchRequest{UserIDs: []string{"alice"}, Room: "music"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !e.validateMatch(ctx, &models.MatchRequest{UserIDs: []string{"alice"}, Room: "music"}) {
+		t.Error("joining the topic room the user is in is invalid")
+	}
+
+	if err := s.registerTopicRoom(ctx, &models.TopicRoom{Name: "films", Capacity: 8}); err != nil {
+		t.Fatal(err)
+	}
+
+	if e.validateMatch(ctx, &models.MatchRequest{UserIDs: []string{"alice"}, Room: "films"}) {
+		t.Error("joining another topic room while seated is valid")
+	}
+}
+
+func TestRemoveExistingMatchFreesUsers(t *testing.T) {
+	s, e := newMatchedUsers(t, "alice", "bob")
+	ctx := context.Background()
+
+	if _, err := e.createMatchEntry(ctx, &models.MatchRequest{UserIDs: []string{"alice", "bob"}, Size: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.removeExistingMatch(ctx, "alice", events.ReasonSkipped); err != nil {
+		t.Fatal(err)
+	}
+
+	if !e.validateMatch(ctx, &models.MatchRequest{UserIDs: []string{"alice", "bob"}, Size: 2}) {
+		t.Error("users of an ended match cannot be matched again")
+	}
+}
+
+func TestContendedRequestsWaitBeforeRetrying(t *testing.T) {
+	_, e := newMatchedUsers(t)
+	ctx := context.Background()
+	partitions := []string{"media-0"}
+
+	request := &models.MatchRequest{UserIDs: []string{"alice", "bob"}, Size: 2, Partition: "media-0", Attempts: 1}
+
+	if err := e.retryMatchRequest(ctx, request, time.Now().Add(retryDelay(request.Attempts))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.requeueDueRetries(ctx, partitions); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := e.RedisClient.LLen(ctx, "match_request_queue:media-0").Val(); n != 0 {
+		t.Fatalf("retried right away, %d requests queued", n)
+	}
+
+	time.Sleep(retryDelay(request.Attempts))
+
+	if err := e.requeueDueRetries(ctx, partitions); err != nil {
+		t.Fatal(err)
+	}
+
+	retried, err := e.dequeueMatchRequest(ctx, partitions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if retried.Attempts != 1 || retried.UserIDs[1] != "bob" {
+		t.Errorf("retried %+v", retried)
+	}
+
+	if e.RedisClient.ZCard(ctx, "match_request_retries:media-0").Val() != 0 {
+		t.Error("the retry was left scheduled")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempt, want := range map[int]time.Duration{
+		1:  retryBackoff,
+		2:  2 * retryBackoff,
+		3:  4 * retryBackoff,
+		50: claimTTL,
+	} {
+		if got := retryDelay(attempt); got != want {
+			t.Errorf("retryDelay(%d) = %s, want %s", attempt, got, want)
+		}
+	}
+}
+
+func TestSearchesArePartitioned(t *testing.T) {
+	s, e := newMatchedUsers(t, "alice", "bob")
+	ctx := context.Background()
+
+	for userID, partition := range map[string]string{"alice": "text-0", "bob": "media-0"} {
+		if err := s.startSearch(ctx, &models.MatchSearch{
+			Ticket:    "ticket-" + userID,
+			UserID:    userID,
+			StartedAt: time.Now().Add(-time.Second),
+			Partition: partition,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	searches, err := e.dueSearches(ctx, []string{"text-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(searches) != 1 || searches[0].UserID != "alice" {
+		t.Fatalf("text-0 served %+v, want alice's search only", searches)
+	}
+
+	// rescheduled within its partition
+	if err := e.scheduleSearch(ctx, searches[0], time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	searches, err = e.dueSearches(ctx, []string{"media-0", "text-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(searches) != 2 {
+		t.Errorf("served %d searches of both partitions, want 2", len(searches))
+	}
+}
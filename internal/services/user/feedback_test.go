@@ -0,0 +1,145 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"rvc/internal/models"
+)
+
+func TestFeedbackValidatesRatings(t *testing.T) {
+	server, h := newAPIServer(t, nil)
+	s := h.Store.(*HttpStorage)
+	e := &EventStorage{RedisClient: s.RedisClient}
+	ctx := context.Background()
+
+	alice := apiRegisterUser(t, server, "alice")
+	bob := apiRegisterUser(t, server, "bob")
+	carol := apiRegisterUser(t, server, "carol")
+
+	match, err := e.createMatchEntry(ctx, &models.MatchRequest{UserIDs: []string{alice.UserID, bob.UserID}, Size: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, test := range map[string]struct {
+		token    string
+		feedback feedbackRequest
+		status   int
+	}{
+		"rating 0":        {alice.Token, feedbackRequest{MatchID: match.MatchID, Rating: 0}, http.StatusBadRequest},
+		"rating 6":        {alice.Token, feedbackRequest{MatchID: match.MatchID, Rating: 6}, http.StatusBadRequest},
+		"unknown tag":     {alice.Token, feedbackRequest{MatchID: match.MatchID, Rating: 4, Tags: []string{"boring"}}, http.StatusBadRequest},
+		"no match":        {alice.Token, feedbackRequest{Rating: 4}, http.StatusForbidden},
+		"other match":     {alice.Token, feedbackRequest{MatchID: "match-other", Rating: 4}, http.StatusForbidden},
+		"not participant": {carol.Token, feedbackRequest{MatchID: match.MatchID, Rating: 4}, http.StatusForbidden},
+		"unknown peer":    {alice.Token, feedbackRequest{MatchID: match.MatchID, PeerID: "nobody", Rating: 4}, http.StatusBadRequest},
+	} {
+		var problem models.Problem
+
+		resp := apiCall(t, server, http.MethodPost, "/feedback", test.token, test.feedback, &problem)
+		wantProblem(t, resp, &problem, test.status, "/feedback")
+
+		if rated := s.RedisClient.HLen(ctx, "feedback:"+match.MatchID).Val(); rated != 0 {
+			t.Fatalf("%s: stored %d ratings", name, rated)
+		}
+	}
+
+	// every listed tag is accepted
+	resp := apiCall(t, server, http.MethodPost, "/feedback", alice.Token,
+		feedbackRequest{MatchID: match.MatchID, Rating: 5, Tags: models.FeedbackTags}, nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("rating bob: status %d, want 204", resp.StatusCode)
+	}
+
+	var problem models.Problem
+
+	resp = apiCall(t, server, http.MethodPost, "/feedback", alice.Token,
+		feedbackRequest{MatchID: match.MatchID, Rating: 1}, &problem)
+	wantProblem(t, resp, &problem, http.StatusConflict, "/feedback")
+
+	// bob rates alice on his own
+	resp = apiCall(t, server, http.MethodPost, "/feedback", bob.Token,
+		feedbackRequest{MatchID: match.MatchID, Rating: 3}, nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("rating alice: status %d, want 204", resp.StatusCode)
+	}
+
+	if rated := s.RedisClient.HLen(ctx, "feedback:"+match.MatchID).Val(); rated != 2 {
+		t.Errorf("stored %d ratings, want 2", rated)
+	}
+}
+
+func TestFeedbackInRoomsNamesThePeer(t *testing.T) {
+	server, h := newAPIServer(t, nil)
+	e := &EventStorage{RedisClient: h.Store.(*HttpStorage).RedisClient}
+	ctx := context.Background()
+
+	var registrations []*models.Registration
+	var userIDs []string
+
+	for i := 0; i < 3; i++ {
+		registration := apiRegisterUser(t, server, fmt.Sprintf("user%d", i))
+		registrations = append(registrations, registration)
+		userIDs = append(userIDs, registration.UserID)
+	}
+
+	match, err := e.createMatchEntry(ctx, &models.MatchRequest{UserIDs: userIDs, Size: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var problem models.Problem
+
+	resp := apiCall(t, server, http.MethodPost, "/feedback", registrations[0].Token,
+		feedbackRequest{MatchID: match.MatchID, Rating: 4}, &problem)
+	wantProblem(t, resp, &problem, http.StatusBadRequest, "/feedback")
+
+	participants, err := h.Store.getParticipants(ctx, match.MatchID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, userID := range userIDs[1:] {
+		resp := apiCall(t, server, http.MethodPost, "/feedback", registrations[0].Token,
+			feedbackRequest{MatchID: match.MatchID, PeerID: participants[userID].PeerID, Rating: 4}, nil)
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("rating %s: status %d, want 204", userID, resp.StatusCode)
+		}
+	}
+}
+
+func TestAddFeedbackCreditsOnce(t *testing.T) {
+	s, _ := newMatchedUsers(t, "alice", "bob")
+	ctx := context.Background()
+
+	feedback := &models.Feedback{MatchID: "match-1", From: "alice", To: "bob", Rating: 5}
+
+	for i, want := range []bool{true, false} {
+		added, err := s.addFeedback(ctx, feedback, "identity-bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if added != want {
+			t.Errorf("submission %d added %v, want %v", i+1, added, want)
+		}
+	}
+
+	stats := parseReputationStats(s.RedisClient.HGetAll(ctx, "reputation:identity-bob").Val())
+	if stats.RatingCount != 1 || stats.RatingSum != 5 {
+		t.Errorf("credited %+v, want a single rating of 5", stats)
+	}
+
+	if ttl := s.RedisClient.TTL(ctx, "feedback:match-1").Val(); ttl <= 0 {
+		t.Errorf("ratings of the match are kept for %s", ttl)
+	}
+
+	// the rating is the other way round, it counts on its own
+	if added, err := s.addFeedback(ctx, &models.Feedback{MatchID: "match-1", From: "bob", To: "alice", Rating: 2},
+		"identity-alice"); err != nil || !added {
+		t.Errorf("rating alice added %v, %v", added, err)
+	}
+}
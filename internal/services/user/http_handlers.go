@@ -2,19 +2,35 @@ package user
 
 import (
 	"context"
+	"errors"
 	"github.com/google/uuid"
 	"github.com/gorilla/sessions"
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
 	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog"
+	"golang.org/x/text/language"
 	"net/http"
 	"os"
+	"rvc/internal/accounts"
+	"rvc/internal/bots"
+	"rvc/internal/challenge"
+	"rvc/internal/events"
+	"rvc/internal/geo"
 	"rvc/internal/models"
+	"rvc/internal/turn"
+	"rvc/internal/usernames"
+	"rvc/internal/webhooks"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+const maxRoomSize = 8
+
 var Upgrade = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true
@@ -32,12 +48,95 @@ type HttpServerHandler interface {
 	registerUser(echo.Context) error
 	connection(echo.Context) error
 	matchUser(echo.Context) error
+
+	// Invites
+
+	createInvite(echo.Context) error
+	invitePage(echo.Context) error
+
+	// Rooms
+
+	registerTopicRooms(context.Context) error
+	listRooms(echo.Context) error
+	joinRoom(echo.Context) error
+
+	// Friends
+
+	connectPeer(echo.Context) error
+	listFriends(echo.Context) error
+	callFriend(echo.Context) error
+
+	// Accounts
+
+	accountPage(echo.Context) error
+	signup(echo.Context) error
+	login(echo.Context) error
+	logout(echo.Context) error
+	loginProvider(echo.Context) error
+	loginCallback(echo.Context) error
+
+	// Bots
+
+	runBots(context.Context)
+
+	// API
+
+	apiRoutes() []apiRoute
+	registerAPI(*echo.Group)
+	apiAuth(echo.HandlerFunc) echo.HandlerFunc
+	openAPI(echo.Context) error
+
+	// Rate limits
+
+	rateLimit(string) echo.MiddlewareFunc
+
+	// Challenges
+
+	issueChallenge(echo.Context) error
 }
 
 type HttpServerHandle struct {
 	SessionStore *sessions.CookieStore
 	Logger       *zerolog.Logger
 	Ctx          context.Context
+	TopicRooms   []models.TopicRoom
+	InviteTTL    time.Duration
+	// CrossModeMatching pairs users regardless of their chat mode
+	CrossModeMatching bool
+	// ReputationMatching prefers candidates of a similar reputation
+	ReputationMatching bool
+	// RelaxModesAfter lets users that opted in and waited this long be
+	// matched with any mode, zero keeps modes strict
+	RelaxModesAfter time.Duration
+	// MatchShards is the number of match request partitions of each pool
+	MatchShards int
+	// Geo locates users so nearby peers are preferred, nil leaves users
+	// without a location
+	Geo geo.Resolver
+	// RateLimits maps the actions to their budgets, actions missing are not
+	// limited
+	RateLimits map[string]Limit
+	// Challenger is answered before registering, none when nil. Proofs of
+	// work get harder with the registrations of the last minute.
+	Challenger     challenge.Challenger
+	ChallengeScale challenge.Scale
+
+	// Usernames is the policy names are held to, the default one when nil
+	Usernames *usernames.Policy
+
+	// Accounts is nil when the service runs with guests only
+	Accounts          accounts.Store
+	IdentityProviders map[string]accounts.IdentityProvider
+
+	// Bots run in-process, bots connecting through the API authenticate
+	// with BotAPIKey. Either is summoned for users waiting BotWait.
+	Bots      []bots.Handler
+	BotAPIKey string
+	BotWait   time.Duration
+
+	// Webhooks is told about registrations and reports
+	Webhooks *webhooks.Dispatcher
+	Events   *events.Log
 
 	Store HttpStore
 }
@@ -47,29 +146,125 @@ func (h *HttpServerHandle) checkHealth(c echo.Context) error {
 }
 
 func (h *HttpServerHandle) home(c echo.Context) error {
-	return c.Render(http.StatusOK, "register.html", nil)
+	data := map[string]string{}
+
+	if h.Accounts != nil {
+		data["Accounts"] = "1"
+
+		account, err := h.currentAccount(c)
+		if err != nil {
+			h.Logger.Err(err).Msg("unable to find account")
+		}
+
+		if account != nil {
+			data["Account"] = account.Username
+		}
+	}
+
+	return c.Render(http.StatusOK, "register.html", data)
 }
 
 func (h *HttpServerHandle) registerUser(c echo.Context) error {
-	username := c.FormValue("username")
+	mode := c.FormValue("mode")
+	if mode == "" {
+		mode = models.ModeVideo
+	}
+
+	reach := c.FormValue("reach")
+	if reach == "" {
+		reach = models.ReachNearby
+	}
+
+	if err := h.checkChallenge(c, c.FormValue("challenge_id"), c.FormValue("challenge_response")); err != nil {
+		return err
+	}
+
+	form, err := c.FormParams()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid form")
+	}
+
+	userID, err := h.newUser(c, c.FormValue("username"), c.FormValue("invite"), mode, reach, form["tags"],
+		c.FormValue("any_mode") == "on", false)
+	if err != nil {
+		return err
+	}
+
+	iceServer, err := h.iceServer(userID)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to issue turn credentials")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	var TurnUrl string
+	if len(iceServer.URLs) > 0 {
+		TurnUrl = iceServer.URLs[0]
+	}
+
+	return c.Render(http.StatusOK, "chat", map[string]string{
+		"WsAddr":   h.wsAddr(c, userID),
+		"TurnUrl":  TurnUrl,
+		"TurnUser": iceServer.Username,
+		"TurnCred": iceServer.Credential,
+		"Mode":     mode,
+	})
+}
+
+// newUser registers a user for the session cookie of the request, the user is
+// either put in the unpaired pool or waits for the creator of its invite.
+func (h *HttpServerHandle) newUser(c echo.Context, username string, invite string, mode string, reach string,
+	tags []string, anyMode bool, bot bool) (string, error) {
+	if !models.ValidMode(mode) {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "mode must be video, audio or text")
+	}
+
+	if !models.ValidReach(reach) {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "reach must be nearby, country or anywhere")
+	}
+
+	for _, tag := range tags {
+		if !models.ValidInterestTag(tag) {
+			return "", echo.NewHTTPError(http.StatusBadRequest, "unknown tag "+tag)
+		}
+	}
+
+	tags = slices.Clone(tags)
+	slices.Sort(tags)
+	tags = slices.Compact(tags)
+
+	account, err := h.currentAccount(c)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find account")
+		return "", echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if username == "" && account != nil {
+		username = account.Username
+	}
 
 	if username == "" {
-		return echo.NewHTTPError(http.StatusBadRequest)
+		return "", echo.NewHTTPError(http.StatusBadRequest, "username is required")
 	}
 
-	userID := username + "-" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	username, err = h.Usernames.Normalize(username, bot)
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	// the id ends up in keys and urls, it never carries the display name
+	userID := "user-" + strings.ReplaceAll(uuid.New().String(), "-", "")
 
 	session, err := h.SessionStore.New(c.Request(), "random-video-chat-session")
 	if err != nil {
 		h.Logger.Err(err).Msg("unable to create session")
-		return echo.NewHTTPError(http.StatusInternalServerError, "unable to create session")
+		return "", echo.NewHTTPError(http.StatusInternalServerError, "unable to create session")
 	}
 
 	session.Values["userID"] = userID
 
 	if err := session.Save(c.Request(), c.Response()); err != nil {
 		h.Logger.Err(err).Msg("unable to save session")
-		return echo.NewHTTPError(http.StatusInternalServerError, "unable to save session")
+		return "", echo.NewHTTPError(http.StatusInternalServerError, "unable to save session")
 	}
 
 	//deadline := time.Now().Add(5 * time.Second)
@@ -78,39 +273,161 @@ func (h *HttpServerHandle) registerUser(c echo.Context) error {
 
 	ctx := context.Background()
 
+	// invited users are matched with the inviter once connected, they skip
+	// the unpaired pool
+	var inviter string
+
+	if invite != "" {
+		inviter, err = h.Store.consumeInvite(ctx, invite)
+		if errors.Is(err, redis.Nil) {
+			return "", echo.NewHTTPError(http.StatusGone, "invite not found or expired")
+		}
+		if err != nil {
+			h.Logger.Err(err).Msg("unable to consume invite")
+			return "", echo.NewHTTPError(http.StatusInternalServerError)
+		}
+	}
+
+	// friendships of logged in users follow the account across devices
+	var identity string
+
+	if account != nil {
+		identity = "a-" + account.AccountID
+	} else {
+		identity, err = h.deviceIdentity(c)
+		if err != nil {
+			h.Logger.Err(err).Msg("unable to save device identity")
+			return "", echo.NewHTTPError(http.StatusInternalServerError, "unable to save session")
+		}
+	}
+
 	if err := h.Store.addUserEntry(ctx, &models.User{
-		UserID:   userID,
-		Username: username,
-		IPAddr:   c.RealIP(),
-		MatchID:  "",
+		UserID:    userID,
+		Username:  username,
+		IPAddr:    c.RealIP(),
+		MatchID:   "",
+		InvitedBy: inviter,
+		Identity:  identity,
+		Mode:      mode,
+		AnyMode:   anyMode,
+		Reach:     reach,
+		Location:  h.locate(c.RealIP()),
+		Locale:    locale(c.Request().Header.Get("Accept-Language")),
+		Tags:      tags,
+		Bot:       bot,
 	}); err != nil {
 		h.Logger.Err(err).Msg("unable to add user entry")
-		return echo.NewHTTPError(http.StatusInternalServerError)
+		return "", echo.NewHTTPError(http.StatusInternalServerError)
 	}
 
-	if err := h.Store.addToUnpairedPool(ctx, userID); err != nil {
-		h.Logger.Err(err).Msg("unable to add user to unpaired pool")
-		return echo.NewHTTPError(http.StatusInternalServerError)
+	if err := h.Store.countRegistration(ctx, userID); err != nil {
+		h.Logger.Err(err).Msg("unable to count registration of " + userID)
+	}
+
+	// bots join the bot pool now, they have until botAliveTTL to connect
+	if bot {
+		if err := h.Store.keepBotAlive(ctx, userID, botAliveTTL); err != nil {
+			h.Logger.Err(err).Msg("unable to mark bot " + userID + " alive")
+			return "", echo.NewHTTPError(http.StatusInternalServerError)
+		}
+	}
+
+	if inviter == "" {
+		if err := h.Store.addToUnpairedPool(ctx, userID); err != nil {
+			h.Logger.Err(err).Msg("unable to add user to unpaired pool")
+			return "", echo.NewHTTPError(http.StatusInternalServerError)
+		}
+	}
+
+	if err := h.Webhooks.Publish(ctx, webhooks.EventUserRegistered, map[string]interface{}{
+		"user_id":  userID,
+		"username": username,
+		"mode":     mode,
+		"bot":      bot,
+		"invited":  inviter != "",
+	}); err != nil {
+		h.Logger.Err(err).Msg("unable to publish webhook")
 	}
 
+	h.Events.Record(ctx, &events.Event{
+		Type:   events.Registered,
+		UserID: userID,
+		Data: map[string]interface{}{
+			"mode":    mode,
+			"bot":     bot,
+			"invited": inviter != "",
+			"account": account != nil,
+		},
+	})
+
 	h.Logger.Info().Msg("registered new user: " + userID)
 
-	WsAddr := "ws://" + c.Request().Host + "/connection/" + userID
+	return userID, nil
+}
+
+// locate returns the location of the address, nil when it is unknown or no
+// resolver is configured.
+func (h *HttpServerHandle) locate(ip string) *geo.Location {
+	if h.Geo == nil {
+		return nil
+	}
+
+	location, err := h.Geo.Resolve(ip)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to locate " + ip)
+		return nil
+	}
+
+	return location
+}
+
+// locale is the base language the client prefers most, e.g. en for en-GB,
+// "" when it sent none.
+func locale(acceptLanguage string) string {
+	tags, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil || len(tags) == 0 {
+		return ""
+	}
+
+	base, confidence := tags[0].Base()
+	if confidence == language.No {
+		return ""
+	}
+
+	return base.String()
+}
 
+func (h *HttpServerHandle) wsAddr(c echo.Context, userID string) string {
 	if os.Getenv("SECURE_FLAG") == "1" {
-		WsAddr = "wss://" + c.Request().Host + "/connection/" + userID
+		return "wss://" + c.Request().Host + "/connection/" + userID
 	}
 
-	TurnUrl := os.Getenv("TURN_URL")
-	TurnUser := os.Getenv("TURN_USERNAME")
-	TurnCred := os.Getenv("TURN_CRED")
+	return "ws://" + c.Request().Host + "/connection/" + userID
+}
 
-	return c.Render(http.StatusOK, "chat", map[string]string{
-		"WsAddr":   WsAddr,
-		"TurnUrl":  TurnUrl,
-		"TurnUser": TurnUser,
-		"TurnCred": TurnCred,
-	})
+// iceServer returns the TURN server the user relays through, with credentials
+// of its own when the server shares a secret with the service.
+func (h *HttpServerHandle) iceServer(userID string) (*models.ICEServer, error) {
+	iceServer := &models.ICEServer{
+		URLs:       []string{},
+		Username:   os.Getenv("TURN_USERNAME"),
+		Credential: os.Getenv("TURN_CRED"),
+	}
+
+	if turnUrl := os.Getenv("TURN_URL"); turnUrl != "" {
+		iceServer.URLs = append(iceServer.URLs, turnUrl)
+	}
+
+	if secret := os.Getenv("TURN_SECRET"); secret != "" {
+		var err error
+
+		iceServer.Username, iceServer.Credential, err = turn.Credentials(secret, userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return iceServer, nil
 }
 
 func (h *HttpServerHandle) connection(c echo.Context) error {
@@ -135,6 +452,8 @@ func (h *HttpServerHandle) connection(c echo.Context) error {
 
 	h.Logger.Info().Msg("established websocket conn " + userID)
 
+	connectedAt := time.Now()
+
 	var wg sync.WaitGroup
 
 	ctx := context.Background()
@@ -142,6 +461,17 @@ func (h *HttpServerHandle) connection(c echo.Context) error {
 	localCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// bots connected through the API are summoned while their websocket is
+	// open
+	if h.Store.isBot(ctx, userID) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			h.keepBotAlive(localCtx, userID)
+		}()
+	}
+
 	// userSource -> userTarget (outgoing for source)
 	wg.Add(1)
 	go func() {
@@ -161,6 +491,8 @@ func (h *HttpServerHandle) connection(c echo.Context) error {
 				if msgType == -1 {
 					cancel()
 
+					h.announcePresence(ctx, userID, false)
+
 					// cleanup user
 					if err := h.Store.cleanupUserEntry(ctx, userID); err != nil {
 						h.Logger.Err(err).Msg("unable to cleanup user: " + userID)
@@ -171,11 +503,22 @@ func (h *HttpServerHandle) connection(c echo.Context) error {
 						h.Logger.Err(err).Msg("unable to remove user: " + userID)
 					}
 
+					h.Events.Record(ctx, &events.Event{
+						Type:   events.Disconnected,
+						UserID: userID,
+						Data:   map[string]interface{}{"connected_seconds": int(time.Since(connectedAt).Seconds())},
+					})
+
 					h.Logger.Info().Msg("closed websocket conn " + userID)
 
 					return
 				}
 
+				// messages over the budget are dropped, the user is told
+				if h.throttle(ctx, ActionMessage, userID, c.RealIP()) > 0 {
+					continue
+				}
+
 				if err := h.Store.outgoingMessage(ctx, userID, message); err != nil {
 					h.Logger.Err(err).Msg("unable to publish to " + userID + ":outgoing")
 				}
@@ -198,6 +541,14 @@ func (h *HttpServerHandle) connection(c echo.Context) error {
 			}
 		}(listenInc)
 
+		// nothing addressed to the user may be published before this
+		if _, err := listenInc.Receive(ctx); err != nil {
+			h.Logger.Err(err).Msg("unable to subscribe to " + userID + ":incoming")
+		}
+
+		h.matchInvited(ctx, userID)
+		h.announcePresence(ctx, userID, true)
+
 		for {
 			select {
 			case <-h.Ctx.Done():
@@ -229,28 +580,718 @@ func (h *HttpServerHandle) matchUser(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "unable to find session")
 	}
 
-	userID := session.Values["userID"].(string)
+	userID, ok := session.Values["userID"].(string)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "register first")
+	}
 
 	//deadline := time.Now().Add(5 * time.Second)
 	//ctx, cancel := context.WithDeadline(context.Background(), deadline)
 	//defer cancel()
 
+	size := 2
+	if sizeParam := c.QueryParam("size"); sizeParam != "" {
+		size, err = strconv.Atoi(sizeParam)
+		if err != nil || size < 2 || size > maxRoomSize {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid room size")
+		}
+	}
+
+	ticket, err := h.match(context.Background(), userID, size)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, &models.MatchTicket{Ticket: ticket})
+}
+
+// match leaves the user's current match and requests a new one of the given
+// size. 1:1 candidates are searched by the event worker, the outcome is sent
+// over the websocket with the returned ticket.
+func (h *HttpServerHandle) match(ctx context.Context, userID string, size int) (string, error) {
+	if h.Store.isBot(ctx, userID) {
+		return "", echo.NewHTTPError(http.StatusForbidden, "bots are matched when summoned")
+	}
+
+	if err := h.Store.removeExistingMatch(ctx, userID, events.ReasonSkipped); err != nil {
+		h.Logger.Err(err).Msg("unable to remove old match of the user")
+		return "", echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	// users are only paired with compatible modes unless configured otherwise
+	var modes []string
+	var pool string
+
+	if !h.CrossModeMatching {
+		mode, err := h.Store.getMode(ctx, userID)
+		if err != nil {
+			h.Logger.Err(err).Msg("unable to find mode of " + userID)
+			return "", echo.NewHTTPError(http.StatusInternalServerError)
+		}
+
+		modes = models.CompatibleModes(mode)
+		pool = models.ModePool(mode)
+	}
+
+	h.Events.Record(ctx, &events.Event{
+		Type:   events.Queued,
+		UserID: userID,
+		Data:   map[string]interface{}{"size": size, "pool": pool},
+	})
+
+	ticket := "ticket-" + strings.ReplaceAll(uuid.New().String(), "-", "")
+
+	// group rooms are joined as they open up, no candidate is needed
+	if size > 2 {
+		if err := h.Store.cancelSearch(ctx, userID); err != nil {
+			h.Logger.Err(err).Msg("unable to cancel search of " + userID)
+			return "", echo.NewHTTPError(http.StatusInternalServerError)
+		}
+
+		if err := h.Store.removeFromUnpairedPool(ctx, userID); err != nil {
+			h.Logger.Err(err).Msg("unable to remove user from unpaired pool")
+			return "", echo.NewHTTPError(http.StatusInternalServerError)
+		}
+
+		if err := h.enqueueMatchRequest(ctx, &models.MatchRequest{
+			UserIDs: []string{userID},
+			Size:    size,
+			Pool:    pool,
+		}); err != nil {
+			h.Logger.Err(err).Msg("unable to enqueue to match request")
+			return "", echo.NewHTTPError(http.StatusInternalServerError)
+		}
+
+		return ticket, nil
+	}
+
+	if err := h.Store.startSearch(ctx, &models.MatchSearch{
+		Ticket:          ticket,
+		UserID:          userID,
+		Modes:           modes,
+		ByReputation:    h.ReputationMatching,
+		RelaxModesAfter: h.RelaxModesAfter,
+		StartedAt:       time.Now(),
+		Partition: matchPartition(&models.MatchRequest{
+			UserIDs: []string{userID},
+			Pool:    pool,
+		}, h.MatchShards),
+	}); err != nil {
+		h.Logger.Err(err).Msg("unable to start search of " + userID)
+		return "", echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return ticket, nil
+}
+
+// enqueueMatchRequest queues the request on its partition.
+func (h *HttpServerHandle) enqueueMatchRequest(ctx context.Context, matchRequest *models.MatchRequest) error {
+	matchRequest.Partition = matchPartition(matchRequest, h.MatchShards)
+
+	return h.Store.enqueueMatchRequest(ctx, matchRequest)
+}
+
+func (h *HttpServerHandle) registerTopicRooms(ctx context.Context) error {
+	for _, room := range h.TopicRooms {
+		if err := h.Store.registerTopicRoom(ctx, &room); err != nil {
+			return err
+		}
+
+		h.Logger.Info().Msg("registered topic room " + room.Name)
+	}
+
+	return nil
+}
+
+func (h *HttpServerHandle) listRooms(c echo.Context) error {
+	rooms, err := h.Store.listTopicRooms(context.Background())
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to list topic rooms")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, rooms)
+}
+
+func (h *HttpServerHandle) joinRoom(c echo.Context) error {
+	session, err := h.SessionStore.Get(c.Request(), "random-video-chat-session")
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find session")
+		return echo.NewHTTPError(http.StatusInternalServerError, "unable to find session")
+	}
+
+	userID, ok := session.Values["userID"].(string)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "register first")
+	}
+
 	ctx := context.Background()
 
-	if err := h.Store.removeExistingMatch(ctx, userID); err != nil {
+	room, err := h.Store.getTopicRoom(ctx, c.Param("name"))
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find topic room")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if room == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "unknown room")
+	}
+
+	if room.Occupancy >= room.Capacity {
+		return echo.NewHTTPError(http.StatusConflict, "room is full")
+	}
+
+	if err := h.Store.removeExistingMatch(ctx, userID, events.ReasonSkipped); err != nil {
 		h.Logger.Err(err).Msg("unable to remove old match of the user")
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
 
-	candidateID, err := h.Store.getMatchCandidate(ctx, userID)
+	if err := h.Store.removeFromUnpairedPool(ctx, userID); err != nil {
+		h.Logger.Err(err).Msg("unable to remove user from unpaired pool")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := h.enqueueMatchRequest(ctx, &models.MatchRequest{
+		UserIDs: []string{userID},
+		Size:    room.Capacity,
+		Room:    room.Name,
+	}); err != nil {
+		h.Logger.Err(err).Msg("unable to enqueue to match request")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	h.Events.Record(ctx, &events.Event{
+		Type:   events.Queued,
+		UserID: userID,
+		Data:   map[string]interface{}{"size": room.Capacity, "room": room.Name},
+	})
+
+	return c.NoContent(http.StatusOK)
+}
+
+func (h *HttpServerHandle) createInvite(c echo.Context) error {
+	session, err := h.SessionStore.Get(c.Request(), "random-video-chat-session")
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find session")
+		return echo.NewHTTPError(http.StatusInternalServerError, "unable to find session")
+	}
+
+	userID, ok := session.Values["userID"].(string)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "register first")
+	}
+
+	code := strings.ReplaceAll(uuid.New().String(), "-", "")
+
+	if err := h.Store.createInvite(context.Background(), code, userID, h.InviteTTL); err != nil {
+		h.Logger.Err(err).Msg("unable to create invite")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	InviteUrl := "http://" + c.Request().Host + "/invite/" + code
+
+	if os.Getenv("SECURE_FLAG") == "1" {
+		InviteUrl = "https://" + c.Request().Host + "/invite/" + code
+	}
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"code":       code,
+		"url":        InviteUrl,
+		"expires_in": int(h.InviteTTL.Seconds()),
+	})
+}
+
+func (h *HttpServerHandle) invitePage(c echo.Context) error {
+	code := c.Param("code")
+
+	if !h.Store.inviteExists(context.Background(), code) {
+		return echo.NewHTTPError(http.StatusNotFound, "invite not found or expired")
+	}
+
+	return c.Render(http.StatusOK, "register.html", map[string]string{
+		"Invite": code,
+	})
+}
+
+// matchInvited pairs a user who registered with an invite with its creator.
+func (h *HttpServerHandle) matchInvited(ctx context.Context, userID string) {
+	inviter, err := h.Store.takeInviter(ctx, userID)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find inviter of " + userID)
+		return
+	}
+
+	if inviter == "" {
+		return
+	}
+
+	if !h.Store.userExists(ctx, inviter) {
+		h.Logger.Info().Msg("inviter " + inviter + " left before " + userID + " connected")
+
+		if err := h.Store.addToUnpairedPool(ctx, userID); err != nil {
+			h.Logger.Err(err).Msg("unable to add user to unpaired pool")
+		}
+		return
+	}
+
+	if err := h.Store.removeExistingMatch(ctx, inviter, events.ReasonSkipped); err != nil {
+		h.Logger.Err(err).Msg("unable to remove old match of " + inviter)
+		return
+	}
+
+	if err := h.enqueueMatchRequest(ctx, &models.MatchRequest{
+		UserIDs: []string{inviter, userID},
+		Size:    2,
+		Direct:  true,
+	}); err != nil {
+		h.Logger.Err(err).Msg("unable to enqueue to match request")
+	}
+}
+
+// deviceIdentity returns the long-lived identity of the browser, friendships
+// are kept between identities since user ids change on every registration.
+func (h *HttpServerHandle) deviceIdentity(c echo.Context) (string, error) {
+	session, err := h.SessionStore.Get(c.Request(), "random-video-chat-device")
+	if err != nil {
+		// an undecodable cookie is replaced by a new identity
+		h.Logger.Err(err).Msg("unable to decode device session")
+	}
+
+	if identity, ok := session.Values["deviceID"].(string); ok && identity != "" {
+		return identity, nil
+	}
+
+	identity := "d-" + strings.ReplaceAll(uuid.New().String(), "-", "")
+
+	session.Values["deviceID"] = identity
+	session.Options.MaxAge = 365 * 24 * 60 * 60
+	session.Options.HttpOnly = true
+
+	return identity, session.Save(c.Request(), c.Response())
+}
+
+func (h *HttpServerHandle) connectPeer(c echo.Context) error {
+	session, err := h.SessionStore.Get(c.Request(), "random-video-chat-session")
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find session")
+		return echo.NewHTTPError(http.StatusInternalServerError, "unable to find session")
+	}
+
+	userID, ok := session.Values["userID"].(string)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "register first")
+	}
+
+	ctx := context.Background()
+
+	peer, err := h.Store.getMatchPeer(ctx, userID, c.FormValue("peer_id"))
+	if errors.Is(err, errNoPeer) || errors.Is(err, redis.Nil) {
+		return echo.NewHTTPError(http.StatusConflict, "no peer to connect with")
+	}
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find peer of " + userID)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	identity, err := h.Store.getIdentity(ctx, userID)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find identity of " + userID)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	peerIdentity, err := h.Store.getIdentity(ctx, peer.UserID)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find identity of " + peer.UserID)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if identity == "" || peerIdentity == "" || identity == peerIdentity {
+		return echo.NewHTTPError(http.StatusBadRequest, "unable to connect with this peer")
+	}
+
+	mutual, err := h.Store.requestConnect(ctx, peer.MatchID, userID, peer.UserID)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to store connect request")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	username, err := h.Store.getUsername(ctx, userID)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find username of " + userID)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if !mutual {
+		if err := h.Store.notifyUser(ctx, peer.UserID, "connect_request", map[string]string{
+			"peer_id":  peer.OwnPeerID,
+			"username": username,
+		}); err != nil {
+			h.Logger.Err(err).Msg("unable to notify " + peer.UserID)
+		}
+
+		return c.NoContent(http.StatusAccepted)
+	}
+
+	friendID, err := h.Store.addFriendship(ctx, identity, peerIdentity)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to add friendship")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	peerUsername, err := h.Store.getUsername(ctx, peer.UserID)
 	if err != nil {
-		return c.NoContent(http.StatusBadRequest)
+		h.Logger.Err(err).Msg("unable to find username of " + peer.UserID)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := h.Store.notifyUser(ctx, peer.UserID, "connected", &models.Friend{
+		FriendID: friendID,
+		Username: username,
+		Online:   true,
+	}); err != nil {
+		h.Logger.Err(err).Msg("unable to notify " + peer.UserID)
+	}
+
+	friend := &models.Friend{
+		FriendID: friendID,
+		Username: peerUsername,
+		Online:   true,
+	}
+
+	if err := h.Store.notifyUser(ctx, userID, "connected", friend); err != nil {
+		h.Logger.Err(err).Msg("unable to notify " + userID)
+	}
+
+	return c.JSON(http.StatusCreated, friend)
+}
+
+func (h *HttpServerHandle) listFriends(c echo.Context) error {
+	session, err := h.SessionStore.Get(c.Request(), "random-video-chat-session")
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find session")
+		return echo.NewHTTPError(http.StatusInternalServerError, "unable to find session")
+	}
+
+	userID, ok := session.Values["userID"].(string)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "register first")
+	}
+
+	ctx := context.Background()
+
+	identity, err := h.Store.getIdentity(ctx, userID)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find identity of " + userID)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	friends, err := h.Store.listFriends(ctx, identity)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to list friends")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, friends)
+}
+
+func (h *HttpServerHandle) callFriend(c echo.Context) error {
+	session, err := h.SessionStore.Get(c.Request(), "random-video-chat-session")
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find session")
+		return echo.NewHTTPError(http.StatusInternalServerError, "unable to find session")
+	}
+
+	userID, ok := session.Values["userID"].(string)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "register first")
+	}
+
+	ctx := context.Background()
+
+	identity, err := h.Store.getIdentity(ctx, userID)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find identity of " + userID)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	friendUserID, err := h.Store.getFriendUser(ctx, identity, c.Param("id"))
+	if errors.Is(err, errNoPeer) {
+		return echo.NewHTTPError(http.StatusNotFound, "unknown friend")
+	}
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find friend")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if friendUserID == "" {
+		return echo.NewHTTPError(http.StatusConflict, "friend is offline")
+	}
+
+	// a friend already chatting with someone is not pulled out of it
+	friendMatchID, err := h.Store.getMatchID(ctx, friendUserID)
+	if err != nil && !errors.Is(err, redis.Nil) {
+		h.Logger.Err(err).Msg("unable to find match of " + friendUserID)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if friendMatchID != "" {
+		return echo.NewHTTPError(http.StatusConflict, "friend is busy")
+	}
+
+	if err := h.Store.removeExistingMatch(ctx, userID, events.ReasonSkipped); err != nil {
+		h.Logger.Err(err).Msg("unable to remove old match of the user")
+		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
 
-	if err := h.Store.enqueueMatchRequest(ctx, userID, candidateID); err != nil {
+	if err := h.enqueueMatchRequest(ctx, &models.MatchRequest{
+		UserIDs: []string{userID, friendUserID},
+		Size:    2,
+		Direct:  true,
+	}); err != nil {
 		h.Logger.Err(err).Msg("unable to enqueue to match request")
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
 
 	return c.NoContent(http.StatusOK)
 }
+
+// announcePresence tells the user's friends that they came online or left.
+func (h *HttpServerHandle) announcePresence(ctx context.Context, userID string, online bool) {
+	identity, err := h.Store.getIdentity(ctx, userID)
+	if err != nil || identity == "" {
+		return
+	}
+
+	if online {
+		err = h.Store.setPresence(ctx, identity, userID)
+	} else {
+		err = h.Store.clearPresence(ctx, identity, userID)
+	}
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to update presence of " + userID)
+		return
+	}
+
+	friends, err := h.Store.listFriends(ctx, identity)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to list friends of " + userID)
+		return
+	}
+
+	username, err := h.Store.getUsername(ctx, userID)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to find username of " + userID)
+		return
+	}
+
+	for _, friend := range friends {
+		if !friend.Online {
+			continue
+		}
+
+		friendUserID, err := h.Store.getFriendUser(ctx, identity, friend.FriendID)
+		if err != nil || friendUserID == "" {
+			continue
+		}
+
+		if err := h.Store.notifyUser(ctx, friendUserID, "presence", &models.Friend{
+			FriendID: friend.FriendID,
+			Username: username,
+			Online:   online,
+		}); err != nil {
+			h.Logger.Err(err).Msg("unable to notify " + friendUserID)
+		}
+	}
+}
+
+// currentAccount returns the logged in account, or nil for guests.
+func (h *HttpServerHandle) currentAccount(c echo.Context) (*models.Account, error) {
+	if h.Accounts == nil {
+		return nil, nil
+	}
+
+	session, err := h.SessionStore.Get(c.Request(), "random-video-chat-account")
+	if err != nil {
+		// an undecodable cookie is treated as logged out
+		return nil, nil
+	}
+
+	accountID, ok := session.Values["accountID"].(string)
+	if !ok || accountID == "" {
+		return nil, nil
+	}
+
+	account, err := h.Accounts.GetAccount(context.Background(), accountID)
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+
+	return account, err
+}
+
+func (h *HttpServerHandle) saveAccountSession(c echo.Context, accountID string) error {
+	session, _ := h.SessionStore.Get(c.Request(), "random-video-chat-account")
+
+	session.Values["accountID"] = accountID
+	delete(session.Values, "state")
+	session.Options.MaxAge = 30 * 24 * 60 * 60
+	session.Options.HttpOnly = true
+
+	if accountID == "" {
+		session.Options.MaxAge = -1
+	}
+
+	return session.Save(c.Request(), c.Response())
+}
+
+func (h *HttpServerHandle) renderAccountPage(c echo.Context, status int, message string) error {
+	providers := make([]string, 0, len(h.IdentityProviders))
+	for name := range h.IdentityProviders {
+		providers = append(providers, name)
+	}
+
+	sort.Strings(providers)
+
+	return c.Render(status, "account.html", map[string]interface{}{
+		"Error":     message,
+		"Providers": providers,
+	})
+}
+
+func (h *HttpServerHandle) accountPage(c echo.Context) error {
+	if h.Accounts == nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	return h.renderAccountPage(c, http.StatusOK, "")
+}
+
+func (h *HttpServerHandle) signup(c echo.Context) error {
+	if h.Accounts == nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	name, err := h.Usernames.Normalize(c.FormValue("username"), false)
+	if err != nil {
+		return h.renderAccountPage(c, http.StatusBadRequest, err.Error())
+	}
+
+	account, err := h.Accounts.Signup(context.Background(), name, c.FormValue("password"))
+	if errors.Is(err, accounts.ErrUsernameTaken) || errors.Is(err, accounts.ErrWeakPassword) ||
+		errors.Is(err, accounts.ErrInvalidUsername) {
+		return h.renderAccountPage(c, http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to create account")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := h.saveAccountSession(c, account.AccountID); err != nil {
+		h.Logger.Err(err).Msg("unable to save session")
+		return echo.NewHTTPError(http.StatusInternalServerError, "unable to save session")
+	}
+
+	h.Logger.Info().Msg("created account " + account.AccountID)
+
+	return c.Redirect(http.StatusSeeOther, "/")
+}
+
+func (h *HttpServerHandle) login(c echo.Context) error {
+	if h.Accounts == nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	account, err := h.Accounts.Login(context.Background(), c.FormValue("username"), c.FormValue("password"))
+	if errors.Is(err, accounts.ErrInvalidCredentials) {
+		return h.renderAccountPage(c, http.StatusUnauthorized, err.Error())
+	}
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to log in")
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := h.saveAccountSession(c, account.AccountID); err != nil {
+		h.Logger.Err(err).Msg("unable to save session")
+		return echo.NewHTTPError(http.StatusInternalServerError, "unable to save session")
+	}
+
+	return c.Redirect(http.StatusSeeOther, "/")
+}
+
+func (h *HttpServerHandle) logout(c echo.Context) error {
+	if err := h.saveAccountSession(c, ""); err != nil {
+		h.Logger.Err(err).Msg("unable to save session")
+		return echo.NewHTTPError(http.StatusInternalServerError, "unable to save session")
+	}
+
+	return c.Redirect(http.StatusSeeOther, "/")
+}
+
+func (h *HttpServerHandle) loginProvider(c echo.Context) error {
+	provider, ok := h.IdentityProviders[c.Param("provider")]
+	if h.Accounts == nil || !ok {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	state := strings.ReplaceAll(uuid.New().String(), "-", "")
+
+	session, _ := h.SessionStore.Get(c.Request(), "random-video-chat-account")
+	session.Values["state"] = state
+	session.Options.HttpOnly = true
+
+	if err := session.Save(c.Request(), c.Response()); err != nil {
+		h.Logger.Err(err).Msg("unable to save session")
+		return echo.NewHTTPError(http.StatusInternalServerError, "unable to save session")
+	}
+
+	authURL, err := provider.AuthCodeURL(c.Request().Context(), state)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to reach identity provider " + provider.Name())
+		return echo.NewHTTPError(http.StatusBadGateway)
+	}
+
+	return c.Redirect(http.StatusFound, authURL)
+}
+
+func (h *HttpServerHandle) loginCallback(c echo.Context) error {
+	provider, ok := h.IdentityProviders[c.Param("provider")]
+	if h.Accounts == nil || !ok {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	session, err := h.SessionStore.Get(c.Request(), "random-video-chat-account")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "login expired")
+	}
+
+	state, _ := session.Values["state"].(string)
+	if state == "" || c.QueryParam("state") != state {
+		return echo.NewHTTPError(http.StatusBadRequest, "login expired")
+	}
+
+	if c.QueryParam("error") != "" {
+		return h.renderAccountPage(c, http.StatusUnauthorized, "login was denied by "+provider.Name())
+	}
+
+	claims, err := provider.Exchange(c.Request().Context(), c.QueryParam("code"))
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to exchange code with " + provider.Name())
+		return h.renderAccountPage(c, http.StatusBadGateway, "unable to log in with "+provider.Name())
+	}
+
+	// providers let people pick names the policy does not
+	claims.Username = h.Usernames.Sanitize(claims.Username, "user")
+
+	account, err := h.Accounts.LoginExternal(context.Background(), provider.Name(), claims)
+	if err != nil {
+		h.Logger.Err(err).Msg("unable to log in with " + provider.Name())
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := h.saveAccountSession(c, account.AccountID); err != nil {
+		h.Logger.Err(err).Msg("unable to save session")
+		return echo.NewHTTPError(http.StatusInternalServerError, "unable to save session")
+	}
+
+	return c.Redirect(http.StatusSeeOther, "/")
+}
@@ -0,0 +1,36 @@
+package user
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+)
+
+func TestHandlersRequireRegistration(t *testing.T) {
+	logger := zerolog.Nop()
+	h := &HttpServerHandle{
+		SessionStore: sessions.NewCookieStore([]byte("test-session-key")),
+		Logger:       &logger,
+	}
+
+	for name, handler := range map[string]echo.HandlerFunc{
+		"matchUser":    h.matchUser,
+		"joinRoom":     h.joinRoom,
+		"createInvite": h.createInvite,
+		"connectPeer":  h.connectPeer,
+		"listFriends":  h.listFriends,
+		"callFriend":   h.callFriend,
+	} {
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/", nil), httptest.NewRecorder())
+
+		var httpErr *echo.HTTPError
+		if err := handler(c); !errors.As(err, &httpErr) || httpErr.Code != http.StatusUnauthorized {
+			t.Errorf("%s without a session returned %v, want 401", name, err)
+		}
+	}
+}
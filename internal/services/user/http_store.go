@@ -5,8 +5,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
+	"rvc/internal/challenge"
+	"rvc/internal/events"
 	"rvc/internal/models"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,29 +23,149 @@ type HttpStore interface {
 	removeUserEntry(context.Context, string) error
 	cleanupUserEntry(context.Context, string) error
 	addToUnpairedPool(context.Context, ...string) error
-	removeExistingMatch(context.Context, string) error
-	getMatchCandidate(context.Context, string) (string, error)
-	enqueueMatchRequest(context.Context, string, string) error
+	removeFromUnpairedPool(context.Context, string) error
+	removeExistingMatch(context.Context, string, string) error
+	enqueueMatchRequest(context.Context, *models.MatchRequest) error
+	startSearch(context.Context, *models.MatchSearch) error
+	cancelSearch(context.Context, string) error
+
+	// Challenges: Single-use challenges answered when registering
+
+	saveChallenge(context.Context, *challenge.Challenge, time.Duration) error
+	takeChallenge(context.Context, string) (*challenge.Challenge, error)
+	countRegistration(context.Context, string) error
+	registrationRate(context.Context) (int64, error)
+
+	// Invites: Single-use links to chat with a specific user
+
+	createInvite(context.Context, string, string, time.Duration) error
+	inviteExists(context.Context, string) bool
+	consumeInvite(context.Context, string) (string, error)
+	takeInviter(context.Context, string) (string, error)
+	userExists(context.Context, string) bool
+
+	// Friends: Friendships between long-lived identities
+
+	getIdentity(context.Context, string) (string, error)
+	getUsername(context.Context, string) (string, error)
+	getMode(context.Context, string) (string, error)
+	setPresence(context.Context, string, string) error
+	clearPresence(context.Context, string, string) error
+	getMatchPeer(context.Context, string, string) (*matchPeer, error)
+	requestConnect(context.Context, string, string, string) (bool, error)
+	addFriendship(context.Context, string, string) (string, error)
+	listFriends(context.Context, string) ([]models.Friend, error)
+	getFriendUser(context.Context, string, string) (string, error)
+	getMatchID(context.Context, string) (string, error)
+	notifyUser(context.Context, string, string, interface{}) error
+
+	// API: Tokens authenticating API clients as a user
+
+	createAPIToken(context.Context, string) (string, error)
+	getTokenUser(context.Context, string) (string, error)
+
+	// Moderation: Reports and blocks between users
+
+	addReport(context.Context, *models.Report) error
+	blockIdentity(context.Context, string, string) error
+
+	// Feedback: Ratings of peers once a match is over
+
+	getParticipants(context.Context, string) (map[string]participant, error)
+	addFeedback(context.Context, *models.Feedback, string) (bool, error)
+
+	// Bots: Bot participants summoned for users waiting too long
+
+	isBot(context.Context, string) bool
+	keepBotAlive(context.Context, string, time.Duration) error
+	waitingUsers(context.Context, time.Duration) ([]string, error)
+	summonBot(context.Context, string, time.Duration) (string, error)
+	releaseIdleBots(context.Context, time.Duration) error
+
+	// Rooms: Topic rooms users browse and join
+
+	registerTopicRoom(context.Context, *models.TopicRoom) error
+	listTopicRooms(context.Context) ([]models.TopicRoom, error)
+	getTopicRoom(context.Context, string) (*models.TopicRoom, error)
 
 	// Chat: Needed for chat operations
 
 	outgoingMessage(context.Context, string, []byte) error
 	incomingMessage(context.Context, string) *redis.PubSub
+
+	// Rate limits: Requests counted per window across replicas
+
+	countRequest(context.Context, string, time.Duration) (int64, time.Duration, error)
 }
 
 type HttpStorage struct {
 	RedisClient *redis.Client
 }
 
+// countWindow counts a request in the key's window, starting one when there
+// is none, and returns the count with the time left in the window.
+var countWindow = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return {count, redis.call("PTTL", KEYS[1])}
+`)
+
+// clearEntryMatchID empties the match id of a user entry that still exists,
+// entries of users that left are not brought back.
+var clearEntryMatchID = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	redis.call("HSET", KEYS[1], "match_id", "")
+end
+return 0
+`)
+
 // User
 
 func (s *HttpStorage) addUserEntry(ctx context.Context, user *models.User) error {
-	return s.RedisClient.HSet(ctx, fmt.Sprintf("user_entry:%s", user.UserID),
-		"username", user.Username, "ip_addr", user.IPAddr, "match_id", user.MatchID).Err()
+	identity := user.Identity
+	if identity == "" {
+		identity = user.UserID
+	}
+
+	reputation, err := s.reputationScore(ctx, identity)
+	if err != nil {
+		return err
+	}
+
+	values := []interface{}{
+		"username", user.Username, "ip_addr", user.IPAddr, "match_id", user.MatchID,
+		"invited_by", user.InvitedBy, "identity", user.Identity, "mode", user.Mode, "bot", user.Bot,
+		"any_mode", user.AnyMode, "reputation", reputation, "reach", user.Reach, "locale", user.Locale,
+		"tags", strings.Join(user.Tags, ","),
+	}
+
+	if user.Location != nil {
+		values = append(values, "region", user.Location.Region, "country", user.Location.Country,
+			"lat", user.Location.Latitude, "lon", user.Location.Longitude)
+	}
+
+	return s.RedisClient.HSet(ctx, fmt.Sprintf("user_entry:%s", user.UserID), values...).Err()
 }
 
 func (s *HttpStorage) removeUserEntry(ctx context.Context, userID string) error {
-	return s.RedisClient.Del(ctx, fmt.Sprintf("user_entry:%s", userID)).Err()
+	if err := s.cancelSearch(ctx, userID); err != nil {
+		return err
+	}
+
+	token, err := s.RedisClient.HGet(ctx, fmt.Sprintf("user_entry:%s", userID), "api_token").Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+
+	if token != "" {
+		if err := s.RedisClient.Del(ctx, fmt.Sprintf("api_token:%s", token)).Err(); err != nil {
+			return err
+		}
+	}
+
+	return s.RedisClient.Del(ctx, fmt.Sprintf("user_entry:%s", userID), fmt.Sprintf("bot_alive:%s", userID)).Err()
 }
 
 func (s *HttpStorage) cleanupUserEntry(ctx context.Context, userID string) error {
@@ -48,15 +174,51 @@ func (s *HttpStorage) cleanupUserEntry(ctx context.Context, userID string) error
 		return err
 	}
 
+	if size := s.matchSize(ctx, matchID); size > 2 {
+		if err := s.leaveRoom(ctx, matchID, size, userID, events.ReasonDisconnected); err != nil {
+			return err
+		}
+
+		return s.RedisClient.SRem(ctx, "unpaired_pool", userID).Err()
+	}
+
 	if !s.RedisClient.SIsMember(context.Background(), "unpaired_pool", userID).Val() {
-		// publish request on delete_match_session
-		if err := s.RedisClient.Publish(context.Background(), "delete_match_session", matchID).Err(); err != nil {
+		if err := s.endSession(ctx, matchID, events.ReasonDisconnected); err != nil {
+			return err
+		}
+	}
+
+	// bots left behind are not told, they go back to the bot pool
+	users, err := s.RedisClient.HKeys(ctx, fmt.Sprintf("match_entry:%s", matchID)).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if user == userID {
+			continue
+		}
+
+		if err := s.clearMatchID(ctx, user); err != nil {
+			return err
+		}
+
+		if s.isBot(ctx, user) {
+			if err := s.addToUnpairedPool(ctx, user); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(users) > 0 {
+		if err := s.creditMatch(ctx, matchID, userID, events.ReasonDisconnected); err != nil {
 			return err
 		}
 	}
 
 	// delete match_entry
-	if err := s.RedisClient.Del(context.Background(), fmt.Sprintf("match_entry:%s", matchID)).Err(); err != nil {
+	if err := s.RedisClient.Del(context.Background(), fmt.Sprintf("match_entry:%s", matchID),
+		fmt.Sprintf("match_size:%s", matchID)).Err(); err != nil {
 		return err
 	}
 
@@ -65,12 +227,19 @@ func (s *HttpStorage) cleanupUserEntry(ctx context.Context, userID string) error
 		return err
 	}
 
-	return nil
+	return s.RedisClient.SRem(ctx, "bot_pool", userID).Err()
 }
 
+// addToUnpairedPool puts bots in the bot pool instead, they only join the
+// unpaired pool when summoned.
 func (s *HttpStorage) addToUnpairedPool(ctx context.Context, users ...string) error {
 	for _, user := range users {
-		err := s.RedisClient.SAdd(ctx, "unpaired_pool", user).Err()
+		pool := "unpaired_pool"
+		if s.isBot(ctx, user) {
+			pool = "bot_pool"
+		}
+
+		err := s.RedisClient.SAdd(ctx, pool, user).Err()
 		if err != nil {
 			return err
 		}
@@ -79,76 +248,859 @@ func (s *HttpStorage) addToUnpairedPool(ctx context.Context, users ...string) er
 	return nil
 }
 
-func (s *HttpStorage) removeExistingMatch(ctx context.Context, userID string) error {
+func (s *HttpStorage) removeFromUnpairedPool(ctx context.Context, userID string) error {
+	return s.RedisClient.SRem(ctx, "unpaired_pool", userID).Err()
+}
+
+// removeExistingMatch ends the user's match, reason is one of the events
+// package's end reasons.
+func (s *HttpStorage) removeExistingMatch(ctx context.Context, userID string, reason string) error {
 	matchID, err := s.RedisClient.HGet(ctx, fmt.Sprintf("user_entry:%s", userID), "match_id").Result()
 	if err != nil {
 		return err
 	}
 
+	if size := s.matchSize(ctx, matchID); size > 2 {
+		if err := s.leaveRoom(ctx, matchID, size, userID, reason); err != nil {
+			return err
+		}
+
+		return s.addToUnpairedPool(ctx, userID)
+	}
+
 	if matchID != "" {
-		users, err := s.RedisClient.HGetAll(ctx, fmt.Sprintf("match_entry:%s", matchID)).Result()
+		users, err := s.RedisClient.HKeys(ctx, fmt.Sprintf("match_entry:%s", matchID)).Result()
 		if err != nil && !errors.Is(err, redis.Nil) {
 			return err
 		}
 
+		if !errors.Is(err, redis.Nil) && len(users) > 0 {
+			if err := s.creditMatch(ctx, matchID, userID, reason); err != nil {
+				return err
+			}
+		}
+
 		if !errors.Is(err, redis.Nil) {
-			for _, user := range users {
-				// add user to unpaired_pool
-				if err := s.RedisClient.SAdd(ctx, "unpaired_pool", user).Err(); err != nil {
-					return err
-				}
+			// add users to unpaired_pool
+			if err := s.addToUnpairedPool(ctx, users...); err != nil {
+				return err
+			}
+
+			if err := s.clearMatchID(ctx, users...); err != nil {
+				return err
 			}
 
 			// delete match_entry
-			if err := s.RedisClient.Del(ctx, fmt.Sprintf("match_entry:%s", matchID)).Err(); err != nil {
+			if err := s.RedisClient.Del(ctx, fmt.Sprintf("match_entry:%s", matchID),
+				fmt.Sprintf("match_size:%s", matchID)).Err(); err != nil {
 				return err
 			}
 
-			// publish request on delete_match_session
-			if err := s.RedisClient.Publish(ctx, "delete_match_session", matchID).Err(); err != nil {
+			if err := s.endSession(ctx, matchID, reason); err != nil {
 				return err
 			}
 		}
 	}
 
+	// the match may have ended without the user, it is free either way
+	return s.clearMatchID(ctx, userID)
+}
+
+// clearMatchID marks the users as seated nowhere, they can be matched again.
+func (s *HttpStorage) clearMatchID(ctx context.Context, users ...string) error {
+	for _, user := range users {
+		if err := clearEntryMatchID.Run(ctx, s.RedisClient, []string{fmt.Sprintf("user_entry:%s", user)}).Err(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (s *HttpStorage) getMatchCandidate(ctx context.Context, userID string) (string, error) {
-	for attempt := 1; attempt <= 5; attempt++ {
-		setSize, err := s.RedisClient.SCard(ctx, "unpaired_pool").Result()
+// endSession publishes the request on delete_match_session, the reason is
+// kept for the session service to record.
+func (s *HttpStorage) endSession(ctx context.Context, matchID string, reason string) error {
+	if err := s.RedisClient.Set(ctx, fmt.Sprintf("match_end_reason:%s", matchID), reason, time.Minute).Err(); err != nil {
+		return err
+	}
+
+	return s.RedisClient.Publish(ctx, "delete_match_session", matchID).Err()
+}
+
+func (s *HttpStorage) enqueueMatchRequest(ctx context.Context, matchRequest *models.MatchRequest) error {
+	matchJSON, err := json.Marshal(matchRequest)
+	if err != nil {
+		return err
+	}
+
+	return s.RedisClient.LPush(ctx, "match_request_queue:"+matchRequest.Partition, matchJSON).Err()
+}
+
+// startSearch makes the search the user's current one and schedules it for
+// the event worker, a search already running is dropped by the worker. The
+// user keeps its place in the queue from the running search, or from one
+// that gave up within queuedAtTTL.
+func (s *HttpStorage) startSearch(ctx context.Context, search *models.MatchSearch) error {
+	search.QueuedAt = search.StartedAt
+
+	if since, err := s.RedisClient.ZScore(ctx, "match_waiting", search.UserID).Result(); err == nil {
+		search.QueuedAt = time.Unix(int64(since), 0)
+	} else if !errors.Is(err, redis.Nil) {
+		return err
+	} else if since, err := s.RedisClient.GetDel(ctx, fmt.Sprintf("match_queued_at:%s", search.UserID)).Int64(); err == nil {
+		search.QueuedAt = time.Unix(since, 0)
+	} else if !errors.Is(err, redis.Nil) {
+		return err
+	}
+
+	searchJSON, err := json.Marshal(search)
+	if err != nil {
+		return err
+	}
+
+	if err := s.RedisClient.Set(ctx, fmt.Sprintf("match_ticket:%s", search.UserID), search.Ticket, searchTimeout+time.Minute).Err(); err != nil {
+		return err
+	}
+
+	// waiting users get a bot summoned after a while
+	if err := s.RedisClient.ZAdd(ctx, "match_waiting", redis.Z{
+		Score:  float64(search.QueuedAt.Unix()),
+		Member: search.UserID,
+	}).Err(); err != nil {
+		return err
+	}
+
+	return s.RedisClient.ZAdd(ctx, "match_searches:"+search.Partition, redis.Z{
+		Score:  float64(search.StartedAt.UnixMilli()),
+		Member: searchJSON,
+	}).Err()
+}
+
+// cancelSearch stops the user's current search, if any.
+func (s *HttpStorage) cancelSearch(ctx context.Context, userID string) error {
+	if err := s.RedisClient.ZRem(ctx, "match_waiting", userID).Err(); err != nil {
+		return err
+	}
+
+	return s.RedisClient.Del(ctx, fmt.Sprintf("match_ticket:%s", userID),
+		fmt.Sprintf("bot_summoned:%s", userID), fmt.Sprintf("match_queued_at:%s", userID)).Err()
+}
+
+// Challenges
+
+func (s *HttpStorage) saveChallenge(ctx context.Context, issued *challenge.Challenge, ttl time.Duration) error {
+	challengeJSON, err := json.Marshal(issued)
+	if err != nil {
+		return err
+	}
+
+	return s.RedisClient.Set(ctx, fmt.Sprintf("challenge:%s", issued.ID), challengeJSON, ttl).Err()
+}
+
+// takeChallenge returns the challenge and invalidates it, it returns
+// redis.Nil once it expired or was answered.
+func (s *HttpStorage) takeChallenge(ctx context.Context, id string) (*challenge.Challenge, error) {
+	challengeJSON, err := s.RedisClient.GetDel(ctx, fmt.Sprintf("challenge:%s", id)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var issued challenge.Challenge
+
+	if err := json.Unmarshal([]byte(challengeJSON), &issued); err != nil {
+		return nil, err
+	}
+
+	return &issued, nil
+}
+
+// countRegistration records a registration in recent_registrations,
+// dropping those older than a minute.
+func (s *HttpStorage) countRegistration(ctx context.Context, userID string) error {
+	now := time.Now()
+
+	if err := s.RedisClient.ZAdd(ctx, "recent_registrations", redis.Z{
+		Score:  float64(now.Unix()),
+		Member: userID,
+	}).Err(); err != nil {
+		return err
+	}
+
+	return s.RedisClient.ZRemRangeByScore(ctx, "recent_registrations", "-inf",
+		strconv.FormatInt(now.Add(-time.Minute).Unix(), 10)).Err()
+}
+
+// registrationRate is the number of registrations of the last minute.
+func (s *HttpStorage) registrationRate(ctx context.Context) (int64, error) {
+	return s.RedisClient.ZCount(ctx, "recent_registrations",
+		strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10), "+inf").Result()
+}
+
+// Invites
+
+func (s *HttpStorage) createInvite(ctx context.Context, code string, userID string, ttl time.Duration) error {
+	return s.RedisClient.Set(ctx, fmt.Sprintf("invite:%s", code), userID, ttl).Err()
+}
+
+func (s *HttpStorage) inviteExists(ctx context.Context, code string) bool {
+	return s.RedisClient.Exists(ctx, fmt.Sprintf("invite:%s", code)).Val() == 1
+}
+
+// consumeInvite returns the creator of the invite and invalidates it.
+func (s *HttpStorage) consumeInvite(ctx context.Context, code string) (string, error) {
+	return s.RedisClient.GetDel(ctx, fmt.Sprintf("invite:%s", code)).Result()
+}
+
+// takeInviter returns who invited the user, once.
+func (s *HttpStorage) takeInviter(ctx context.Context, userID string) (string, error) {
+	inviter, err := s.RedisClient.HGet(ctx, fmt.Sprintf("user_entry:%s", userID), "invited_by").Result()
+	if err != nil || inviter == "" {
+		return "", err
+	}
+
+	if err := s.RedisClient.HSet(ctx, fmt.Sprintf("user_entry:%s", userID), "invited_by", "").Err(); err != nil {
+		return "", err
+	}
+
+	return inviter, nil
+}
+
+func (s *HttpStorage) userExists(ctx context.Context, userID string) bool {
+	return s.RedisClient.Exists(ctx, fmt.Sprintf("user_entry:%s", userID)).Val() == 1
+}
+
+// Friends
+
+var errNoPeer = errors.New("no such peer in the match")
+
+type matchPeer struct {
+	MatchID string
+	PeerID  string
+	UserID  string
+	// OwnPeerID is the requesting user's peer id in the match
+	OwnPeerID string
+}
+
+func (s *HttpStorage) getIdentity(ctx context.Context, userID string) (string, error) {
+	identity, err := s.RedisClient.HGet(ctx, fmt.Sprintf("user_entry:%s", userID), "identity").Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+
+	return identity, err
+}
+
+func (s *HttpStorage) getUsername(ctx context.Context, userID string) (string, error) {
+	return s.RedisClient.HGet(ctx, fmt.Sprintf("user_entry:%s", userID), "username").Result()
+}
+
+func (s *HttpStorage) getMode(ctx context.Context, userID string) (string, error) {
+	mode, err := s.RedisClient.HGet(ctx, fmt.Sprintf("user_entry:%s", userID), "mode").Result()
+	if errors.Is(err, redis.Nil) || (err == nil && mode == "") {
+		return models.ModeVideo, nil
+	}
+
+	return mode, err
+}
+
+// setPresence marks the identity online as the given user.
+func (s *HttpStorage) setPresence(ctx context.Context, identity string, userID string) error {
+	username, err := s.getUsername(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	return s.RedisClient.HSet(ctx, fmt.Sprintf("identity:%s", identity),
+		"username", username, "user_id", userID).Err()
+}
+
+func (s *HttpStorage) clearPresence(ctx context.Context, identity string, userID string) error {
+	current, err := s.RedisClient.HGet(ctx, fmt.Sprintf("identity:%s", identity), "user_id").Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+
+	// the identity may already be online again from another tab
+	if current != userID {
+		return nil
+	}
+
+	return s.RedisClient.HSet(ctx, fmt.Sprintf("identity:%s", identity), "user_id", "").Err()
+}
+
+// getMatchPeer finds a participant of the user's current match by peer id, or
+// the only other participant when no peer id is given.
+func (s *HttpStorage) getMatchPeer(ctx context.Context, userID string, peerID string) (*matchPeer, error) {
+	matchID, err := s.getMatchID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if matchID == "" {
+		return nil, errNoPeer
+	}
+
+	members, err := s.RedisClient.HGetAll(ctx, fmt.Sprintf("match_entry:%s", matchID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	peer := &matchPeer{MatchID: matchID, OwnPeerID: members[userID]}
+
+	for member, memberPeerID := range members {
+		if member == userID || (peerID != "" && memberPeerID != peerID) {
+			continue
+		}
+
+		if peer.UserID != "" {
+			// more than one candidate, the peer has to be named
+			return nil, errNoPeer
+		}
+
+		peer.UserID = member
+		peer.PeerID = memberPeerID
+	}
+
+	if peer.UserID == "" {
+		return nil, errNoPeer
+	}
+
+	return peer, nil
+}
+
+// requestConnect records that the user wants to keep in touch with the target
+// and reports whether the target asked for the same.
+func (s *HttpStorage) requestConnect(ctx context.Context, matchID string, userID string, target string) (bool, error) {
+	requests := fmt.Sprintf("connect_requests:%s", matchID)
+
+	if err := s.RedisClient.SAdd(ctx, requests, userID+">"+target).Err(); err != nil {
+		return false, err
+	}
+
+	if err := s.RedisClient.Expire(ctx, requests, time.Hour).Err(); err != nil {
+		return false, err
+	}
+
+	return s.RedisClient.SIsMember(ctx, requests, target+">"+userID).Result()
+}
+
+// addFriendship befriends two identities and returns the id both know the
+// friendship by, identities themselves are never shared.
+func (s *HttpStorage) addFriendship(ctx context.Context, identity1 string, identity2 string) (string, error) {
+	friendID, err := s.RedisClient.HGet(ctx, fmt.Sprintf("friends:%s", identity1), identity2).Result()
+	if err == nil {
+		return friendID, nil
+	}
+	if !errors.Is(err, redis.Nil) {
+		return "", err
+	}
+
+	friendID = strings.ReplaceAll(uuid.New().String(), "-", "")
+
+	if err := s.RedisClient.SAdd(ctx, fmt.Sprintf("friendship:%s", friendID), identity1, identity2).Err(); err != nil {
+		return "", err
+	}
+
+	if err := s.RedisClient.HSet(ctx, fmt.Sprintf("friends:%s", identity1), identity2, friendID).Err(); err != nil {
+		return "", err
+	}
+
+	if err := s.RedisClient.HSet(ctx, fmt.Sprintf("friends:%s", identity2), identity1, friendID).Err(); err != nil {
+		return "", err
+	}
+
+	return friendID, nil
+}
+
+func (s *HttpStorage) listFriends(ctx context.Context, identity string) ([]models.Friend, error) {
+	friendships, err := s.RedisClient.HGetAll(ctx, fmt.Sprintf("friends:%s", identity)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	friends := make([]models.Friend, 0, len(friendships))
+
+	for friendIdentity, friendID := range friendships {
+		entry, err := s.RedisClient.HGetAll(ctx, fmt.Sprintf("identity:%s", friendIdentity)).Result()
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 
-		if setSize < 1 { // set not large enough
-			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		friends = append(friends, models.Friend{
+			FriendID: friendID,
+			Username: entry["username"],
+			Online:   entry["user_id"] != "" && s.userExists(ctx, entry["user_id"]),
+		})
+	}
+
+	sort.Slice(friends, func(i, j int) bool {
+		return friends[i].Username < friends[j].Username
+	})
+
+	return friends, nil
+}
+
+// getFriendUser returns the user a friend is currently online as, or an empty
+// string when the friend is offline.
+func (s *HttpStorage) getFriendUser(ctx context.Context, identity string, friendID string) (string, error) {
+	identities, err := s.RedisClient.SMembers(ctx, fmt.Sprintf("friendship:%s", friendID)).Result()
+	if err != nil {
+		return "", err
+	}
+
+	var friendIdentity string
+	var isMember bool
+
+	for _, member := range identities {
+		if member == identity {
+			isMember = true
 			continue
 		}
 
-		candidate, err := s.RedisClient.SRandMemberN(ctx, "unpaired_pool", 1).Result()
+		friendIdentity = member
+	}
+
+	if !isMember || friendIdentity == "" {
+		return "", errNoPeer
+	}
+
+	userID, err := s.RedisClient.HGet(ctx, fmt.Sprintf("identity:%s", friendIdentity), "user_id").Result()
+	if errors.Is(err, redis.Nil) || (err == nil && !s.userExists(ctx, userID)) {
+		return "", nil
+	}
+
+	return userID, err
+}
+
+func (s *HttpStorage) getMatchID(ctx context.Context, userID string) (string, error) {
+	return s.RedisClient.HGet(ctx, fmt.Sprintf("user_entry:%s", userID), "match_id").Result()
+}
+
+// notifyUser sends an event straight to the user's websocket.
+func (s *HttpStorage) notifyUser(ctx context.Context, userID string, event string, data interface{}) error {
+	return publishEvent(ctx, s.RedisClient, userID, event, data)
+}
+
+// API
+
+func (s *HttpStorage) createAPIToken(ctx context.Context, userID string) (string, error) {
+	token := strings.ReplaceAll(uuid.New().String(), "-", "") + strings.ReplaceAll(uuid.New().String(), "-", "")
+
+	if err := s.RedisClient.Set(ctx, fmt.Sprintf("api_token:%s", token), userID, 0).Err(); err != nil {
+		return "", err
+	}
+
+	if err := s.RedisClient.HSet(ctx, fmt.Sprintf("user_entry:%s", userID), "api_token", token).Err(); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func (s *HttpStorage) getTokenUser(ctx context.Context, token string) (string, error) {
+	return s.RedisClient.Get(ctx, fmt.Sprintf("api_token:%s", token)).Result()
+}
+
+// Moderation
+
+func (s *HttpStorage) addReport(ctx context.Context, report *models.Report) error {
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	if err := s.RedisClient.LPush(ctx, "reports", reportJSON).Err(); err != nil {
+		return err
+	}
+
+	identity, err := s.getIdentity(ctx, report.Reported)
+	if err != nil {
+		return err
+	}
+
+	if identity == "" {
+		identity = report.Reported
+	}
+
+	if err := s.RedisClient.HIncrBy(ctx, fmt.Sprintf("reputation:%s", identity), "reports", 1).Err(); err != nil {
+		return err
+	}
+
+	return s.refreshReputation(ctx, report.Reported, identity)
+}
+
+// blockIdentity keeps the blocked identity from being matched with the
+// blocking one again.
+func (s *HttpStorage) blockIdentity(ctx context.Context, identity string, blocked string) error {
+	return s.RedisClient.SAdd(ctx, fmt.Sprintf("blocked:%s", identity), blocked).Err()
+}
+
+// Feedback
+
+func (s *HttpStorage) getParticipants(ctx context.Context, matchID string) (map[string]participant, error) {
+	entries, err := s.RedisClient.HGetAll(ctx, fmt.Sprintf("match_participants:%s", matchID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	participants := make(map[string]participant, len(entries))
+
+	for userID, participantJSON := range entries {
+		var p participant
+
+		if err := json.Unmarshal([]byte(participantJSON), &p); err != nil {
+			return nil, err
+		}
+
+		participants[userID] = p
+	}
+
+	return participants, nil
+}
+
+// addFeedback stores the rating once per rater and peer of a match and adds
+// it to the rated identity's reputation. It returns false if already rated.
+func (s *HttpStorage) addFeedback(ctx context.Context, feedback *models.Feedback, identity string) (bool, error) {
+	feedbackJSON, err := json.Marshal(feedback)
+	if err != nil {
+		return false, err
+	}
+
+	feedbackKey := fmt.Sprintf("feedback:%s", feedback.MatchID)
+
+	added, err := s.RedisClient.HSetNX(ctx, feedbackKey, feedback.From+">"+feedback.To, feedbackJSON).Result()
+	if err != nil || !added {
+		return false, err
+	}
+
+	if err := s.RedisClient.Expire(ctx, feedbackKey, 24*time.Hour).Err(); err != nil {
+		return false, err
+	}
+
+	reputation := fmt.Sprintf("reputation:%s", identity)
+
+	if err := s.RedisClient.HIncrBy(ctx, reputation, "rating_count", 1).Err(); err != nil {
+		return false, err
+	}
+
+	if err := s.RedisClient.HIncrBy(ctx, reputation, "rating_sum", int64(feedback.Rating)).Err(); err != nil {
+		return false, err
+	}
+
+	return true, s.refreshReputation(ctx, feedback.To, identity)
+}
+
+// Reputation
+
+func (s *HttpStorage) reputationScore(ctx context.Context, identity string) (float64, error) {
+	fields, err := s.RedisClient.HGetAll(ctx, fmt.Sprintf("reputation:%s", identity)).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	return parseReputationStats(fields).score(), nil
+}
+
+// refreshReputation updates the score in the entry of the user, if still
+// registered, from the stats of its identity.
+func (s *HttpStorage) refreshReputation(ctx context.Context, userID string, identity string) error {
+	if !s.userExists(ctx, userID) {
+		return nil
+	}
+
+	score, err := s.reputationScore(ctx, identity)
+	if err != nil {
+		return err
+	}
+
+	return s.RedisClient.HSet(ctx, fmt.Sprintf("user_entry:%s", userID), "reputation", score).Err()
+}
+
+// creditMatch adds the match that leaver ended to the reputation of every
+// participant: its duration, and a quick skip for the leaver if it skipped
+// early.
+func (s *HttpStorage) creditMatch(ctx context.Context, matchID string, leaver string, reason string) error {
+	participants, err := s.getParticipants(ctx, matchID)
+	if err != nil {
+		return err
+	}
+
+	for userID, p := range participants {
+		if err := s.creditParticipant(ctx, userID, p, userID == leaver, reason); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *HttpStorage) creditParticipant(ctx context.Context, userID string, p participant, leaver bool, reason string) error {
+	if p.JoinedAt == 0 {
+		return nil
+	}
+
+	duration := time.Since(time.Unix(p.JoinedAt, 0))
+	reputation := fmt.Sprintf("reputation:%s", p.Identity)
+
+	if err := s.RedisClient.HIncrBy(ctx, reputation, "sessions", 1).Err(); err != nil {
+		return err
+	}
+
+	if err := s.RedisClient.HIncrBy(ctx, reputation, "session_seconds", int64(duration.Seconds())).Err(); err != nil {
+		return err
+	}
+
+	if leaver && duration < quickSkip && (reason == events.ReasonSkipped || reason == events.ReasonLeft) {
+		if err := s.RedisClient.HIncrBy(ctx, reputation, "quick_skips", 1).Err(); err != nil {
+			return err
+		}
+	}
+
+	return s.refreshReputation(ctx, userID, p.Identity)
+}
+
+// Bots
+
+func (s *HttpStorage) isBot(ctx context.Context, userID string) bool {
+	return s.RedisClient.HGet(ctx, fmt.Sprintf("user_entry:%s", userID), "bot").Val() == "1"
+}
+
+// keepBotAlive marks the bot as alive for ttl, bots of a replica that went
+// away without cleaning up stop being summoned once it lapses.
+func (s *HttpStorage) keepBotAlive(ctx context.Context, botID string, ttl time.Duration) error {
+	return s.RedisClient.Set(ctx, fmt.Sprintf("bot_alive:%s", botID), 1, ttl).Err()
+}
+
+func (s *HttpStorage) botAlive(ctx context.Context, botID string) bool {
+	return s.RedisClient.Exists(ctx, fmt.Sprintf("bot_alive:%s", botID)).Val() == 1
+}
+
+// waitingUsers lists the users looking for a candidate for longer than wait.
+func (s *HttpStorage) waitingUsers(ctx context.Context, wait time.Duration) ([]string, error) {
+	return s.RedisClient.ZRangeByScore(ctx, "match_waiting", &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().Add(-wait).Unix(), 10),
+	}).Result()
+}
+
+// summonBot moves an idle bot to the unpaired pool for the waiting user, at
+// most once per ttl while it waits. It returns "" when no bot is summoned.
+// Dead bots popped from the pool are removed.
+func (s *HttpStorage) summonBot(ctx context.Context, userID string, ttl time.Duration) (string, error) {
+	ok, err := s.RedisClient.SetNX(ctx, fmt.Sprintf("bot_summoned:%s", userID), 1, ttl).Result()
+	if err != nil || !ok {
+		return "", err
+	}
+
+	var botID string
+
+	for {
+		botID, err = s.RedisClient.SPop(ctx, "bot_pool").Result()
+		if errors.Is(err, redis.Nil) {
+			return "", s.RedisClient.Del(ctx, fmt.Sprintf("bot_summoned:%s", userID)).Err()
+		}
 		if err != nil {
 			return "", err
 		}
 
-		if userID == candidate[0] {
-			time.Sleep(time.Duration(attempt) * 2 * time.Second)
-			continue
+		if s.botAlive(ctx, botID) {
+			break
 		}
 
-		return candidate[0], nil
+		if err := s.removeUserEntry(ctx, botID); err != nil {
+			return "", err
+		}
+	}
+
+	if err := s.RedisClient.ZAdd(ctx, "bot_summoned_at", redis.Z{
+		Score:  float64(time.Now().Unix()),
+		Member: botID,
+	}).Err(); err != nil {
+		return "", err
 	}
 
-	return "", nil
+	return botID, s.RedisClient.SAdd(ctx, "unpaired_pool", botID).Err()
 }
 
-func (s *HttpStorage) enqueueMatchRequest(ctx context.Context, userID1 string, userID2 string) error {
-	matchJSON, err := json.Marshal(&models.MatchRequest{UserID1: userID1, UserID2: userID2})
+// releaseIdleBots returns bots summoned longer than idle ago and still
+// unmatched to the bot pool.
+func (s *HttpStorage) releaseIdleBots(ctx context.Context, idle time.Duration) error {
+	bots, err := s.RedisClient.ZRangeByScore(ctx, "bot_summoned_at", &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().Add(-idle).Unix(), 10),
+	}).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, botID := range bots {
+		removed, err := s.RedisClient.SRem(ctx, "unpaired_pool", botID).Result()
+		if err != nil {
+			return err
+		}
+
+		if removed == 1 && s.botAlive(ctx, botID) {
+			if err := s.RedisClient.SAdd(ctx, "bot_pool", botID).Err(); err != nil {
+				return err
+			}
+		} else if removed == 1 {
+			if err := s.removeUserEntry(ctx, botID); err != nil {
+				return err
+			}
+		}
+
+		if err := s.RedisClient.ZRem(ctx, "bot_summoned_at", botID).Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rooms
+
+func (s *HttpStorage) matchSize(ctx context.Context, matchID string) int {
+	if matchID == "" {
+		return 0
+	}
+
+	size, err := s.RedisClient.Get(ctx, fmt.Sprintf("match_size:%s", matchID)).Int()
+	if err != nil {
+		return 0
+	}
+
+	return size
+}
+
+// leaveRoom frees the user's seat, the room is only torn down once the last
+// participant leaves.
+func (s *HttpStorage) leaveRoom(ctx context.Context, matchID string, size int, userID string, reason string) error {
+	matchEntry := fmt.Sprintf("match_entry:%s", matchID)
+
+	participants, err := s.getParticipants(ctx, matchID)
+	if err != nil {
+		return err
+	}
+
+	if p, ok := participants[userID]; ok {
+		if err := s.creditParticipant(ctx, userID, p, true, reason); err != nil {
+			return err
+		}
+	}
+
+	if err := s.RedisClient.HDel(ctx, matchEntry, userID).Err(); err != nil {
+		return err
+	}
+
+	if err := s.RedisClient.HSet(ctx, fmt.Sprintf("user_entry:%s", userID), "match_id", "").Err(); err != nil {
+		return err
+	}
+
+	remaining, err := s.RedisClient.HLen(ctx, matchEntry).Result()
 	if err != nil {
 		return err
 	}
 
-	return s.RedisClient.LPush(ctx, "match_request_queue", matchJSON).Err()
+	// topic rooms are joined by name and never listed as open rooms
+	topicRoom, err := s.RedisClient.Get(ctx, fmt.Sprintf("match_room:%s", matchID)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+
+	openRooms, err := s.RedisClient.Get(ctx, fmt.Sprintf("match_open_rooms:%s", matchID)).Result()
+	if errors.Is(err, redis.Nil) {
+		openRooms = openRoomsKey(size, "")
+	} else if err != nil {
+		return err
+	}
+
+	if remaining == 0 {
+		if err := s.RedisClient.Del(ctx, matchEntry, fmt.Sprintf("match_size:%s", matchID),
+			fmt.Sprintf("match_room:%s", matchID), fmt.Sprintf("match_open_rooms:%s", matchID)).Err(); err != nil {
+			return err
+		}
+
+		if topicRoom != "" {
+			if err := s.RedisClient.HSet(ctx, fmt.Sprintf("topic_room:%s", topicRoom), "match_id", "").Err(); err != nil {
+				return err
+			}
+		} else if err := s.RedisClient.SRem(ctx, openRooms, matchID).Err(); err != nil {
+			return err
+		}
+
+		return s.endSession(ctx, matchID, reason)
+	}
+
+	if topicRoom == "" {
+		if err := s.RedisClient.SAdd(ctx, openRooms, matchID).Err(); err != nil {
+			return err
+		}
+	}
+
+	return s.RedisClient.Publish(ctx, matchID+":roster", "").Err()
+}
+
+func (s *HttpStorage) registerTopicRoom(ctx context.Context, room *models.TopicRoom) error {
+	if err := s.RedisClient.HSet(ctx, fmt.Sprintf("topic_room:%s", room.Name),
+		"topic", room.Topic, "capacity", room.Capacity).Err(); err != nil {
+		return err
+	}
+
+	return s.RedisClient.SAdd(ctx, "topic_rooms", room.Name).Err()
+}
+
+func (s *HttpStorage) listTopicRooms(ctx context.Context) ([]models.TopicRoom, error) {
+	names, err := s.RedisClient.SMembers(ctx, "topic_rooms").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+
+	rooms := make([]models.TopicRoom, 0, len(names))
+
+	for _, name := range names {
+		room, err := s.getTopicRoom(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if room != nil {
+			rooms = append(rooms, *room)
+		}
+	}
+
+	return rooms, nil
+}
+
+// getTopicRoom returns nil when no room of that name is registered.
+func (s *HttpStorage) getTopicRoom(ctx context.Context, name string) (*models.TopicRoom, error) {
+	entry, err := s.RedisClient.HGetAll(ctx, fmt.Sprintf("topic_room:%s", name)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	capacity, err := strconv.Atoi(entry["capacity"])
+	if err != nil {
+		return nil, nil
+	}
+
+	room := &models.TopicRoom{
+		Name:     name,
+		Topic:    entry["topic"],
+		Capacity: capacity,
+	}
+
+	if matchID := entry["match_id"]; matchID != "" {
+		occupancy, err := s.RedisClient.HLen(ctx, fmt.Sprintf("match_entry:%s", matchID)).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		room.Occupancy = int(occupancy)
+	}
+
+	return room, nil
 }
 
 // Chat
@@ -160,3 +1112,14 @@ func (s *HttpStorage) outgoingMessage(ctx context.Context, userID string, messag
 func (s *HttpStorage) incomingMessage(ctx context.Context, userID string) *redis.PubSub {
 	return s.RedisClient.Subscribe(ctx, userID+":incoming")
 }
+
+// Rate limits
+
+func (s *HttpStorage) countRequest(ctx context.Context, key string, window time.Duration) (int64, time.Duration, error) {
+	result, err := countWindow.Run(ctx, s.RedisClient, []string{key}, window.Milliseconds()).Int64Slice()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return result[0], time.Duration(result[1]) * time.Millisecond, nil
+}
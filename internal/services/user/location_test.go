@@ -0,0 +1,155 @@
+package user
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"rvc/internal/geo"
+	"rvc/internal/models"
+)
+
+// places are where the test users connect from, Munich is just over 500 km
+// from Berlin and Paris about 880 km.
+var places = geo.Fake{
+	"10.0.0.1":    {Region: "EU-DE", Country: "DE", Latitude: 52.5, Longitude: 13.4},
+	"10.0.0.2":    {Region: "EU-DE", Country: "DE", Latitude: 52.4, Longitude: 13.1},
+	"10.0.1.0/24": {Region: "EU-DE", Country: "DE", Latitude: 48.1, Longitude: 11.6},
+	"10.0.2.0/24": {Region: "EU-FR", Country: "FR", Latitude: 48.9, Longitude: 2.4},
+}
+
+// newLocatedUsers registers users at the addresses the way newUser does, all
+// but berlin wait in the unpaired pool.
+func newLocatedUsers(t *testing.T, users map[string]string, reach string) (*EventStorage, map[string]bool) {
+	t.Helper()
+
+	s, _ := newTestHttpStorage(t)
+	ctx := context.Background()
+	logger := zerolog.Nop()
+	h := &HttpServerHandle{Geo: places, Logger: &logger}
+
+	located := make(map[string]bool)
+
+	for userID, ip := range users {
+		location := h.locate(ip)
+		located[userID] = location != nil
+
+		if err := s.addUserEntry(ctx, &models.User{
+			UserID:   userID,
+			Username: userID,
+			Mode:     models.ModeVideo,
+			Reach:    reach,
+			Location: location,
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if userID != "berlin" {
+			if err := s.addToUnpairedPool(ctx, userID); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	return &EventStorage{RedisClient: s.RedisClient}, located
+}
+
+// candidateAfter is the candidate found for berlin after waiting.
+func candidateAfter(t *testing.T, s *EventStorage, waited time.Duration) string {
+	t.Helper()
+
+	candidateID, err := s.findMatchCandidate(context.Background(), &models.MatchSearch{
+		UserID:   "berlin",
+		Modes:    models.CompatibleModes(models.ModeVideo),
+		QueuedAt: time.Now().Add(-waited),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return candidateID
+}
+
+func TestMatchPrefersNearbyPeers(t *testing.T) {
+	s, located := newLocatedUsers(t, map[string]string{
+		"berlin":  "10.0.0.1",
+		"potsdam": "10.0.0.2",
+		"paris":   "10.0.2.7",
+	}, models.ReachNearby)
+
+	if !located["potsdam"] || !located["paris"] {
+		t.Fatalf("located %v", located)
+	}
+
+	// paris waits longer and would come first without the distance band
+	ctx := context.Background()
+	if err := s.RedisClient.ZAdd(ctx, "match_waiting", redis.Z{
+		Score:  float64(time.Now().Add(-time.Minute).Unix()),
+		Member: "paris",
+	}).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if candidateID := candidateAfter(t, s, 0); candidateID != "potsdam" {
+		t.Errorf("matched %q, want potsdam nearby", candidateID)
+	}
+}
+
+func TestMatchWidensToAnywhere(t *testing.T) {
+	s, _ := newLocatedUsers(t, map[string]string{
+		"berlin": "10.0.0.1",
+		"paris":  "10.0.2.7",
+	}, models.ReachNearby)
+
+	if candidateID := candidateAfter(t, s, 0); candidateID != "" {
+		t.Errorf("matched %q right away, want nobody within 500 km", candidateID)
+	}
+
+	if candidateID := candidateAfter(t, s, 5*time.Second); candidateID != "paris" {
+		t.Errorf("matched %q after 5s, want paris within 1000 km", candidateID)
+	}
+}
+
+func TestMatchFallsBackWithinCountry(t *testing.T) {
+	s, _ := newLocatedUsers(t, map[string]string{
+		"berlin": "10.0.0.1",
+		"munich": "10.0.1.5",
+		"paris":  "10.0.2.7",
+	}, models.ReachCountry)
+
+	if candidateID := candidateAfter(t, s, 0); candidateID != "" {
+		t.Errorf("matched %q right away, want nobody within 500 km", candidateID)
+	}
+
+	// paris is close enough by now but in another country
+	for _, waited := range []time.Duration{5 * time.Second, time.Minute} {
+		if candidateID := candidateAfter(t, s, waited); candidateID != "munich" {
+			t.Errorf("matched %q after %v, want munich in the same country", candidateID, waited)
+		}
+	}
+
+	if err := s.RedisClient.SRem(context.Background(), "unpaired_pool", "munich").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if candidateID := candidateAfter(t, s, time.Hour); candidateID != "" {
+		t.Errorf("matched %q, want nobody outside the country", candidateID)
+	}
+}
+
+func TestMatchUnknownLocations(t *testing.T) {
+	s, located := newLocatedUsers(t, map[string]string{
+		"berlin":  "10.0.0.1",
+		"unknown": "192.0.2.1",
+	}, models.ReachNearby)
+
+	if located["unknown"] {
+		t.Fatal("located an address the resolver does not know")
+	}
+
+	if candidateID := candidateAfter(t, s, 0); candidateID != "unknown" {
+		t.Errorf("matched %q, want the user of an unknown location", candidateID)
+	}
+}
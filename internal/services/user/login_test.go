@@ -0,0 +1,197 @@
+package user
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"rvc/internal/accounts"
+	"rvc/internal/accounts/oidctest"
+)
+
+// newLoginServer serves the OIDC login routes of a user service logging in
+// through a test provider.
+func newLoginServer(t *testing.T) (*httptest.Server, *redis.Client) {
+	t.Helper()
+
+	provider := oidctest.Start("rvc", "secret")
+	t.Cleanup(provider.Close)
+
+	redisClient := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	logger := zerolog.Nop()
+
+	e := echo.New()
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	h := &HttpServerHandle{
+		SessionStore: sessions.NewCookieStore([]byte("test-session-key")),
+		Logger:       &logger,
+		Accounts:     &accounts.Storage{RedisClient: redisClient},
+		IdentityProviders: map[string]accounts.IdentityProvider{
+			"oidc": accounts.NewOIDCProvider(accounts.OIDCConfig{
+				Issuer:       provider.URL,
+				ClientID:     "rvc",
+				ClientSecret: "secret",
+				RedirectURL:  server.URL + "/login/oidc/callback",
+			}),
+		},
+	}
+
+	e.GET("/login/:provider", h.loginProvider)
+	e.GET("/login/:provider/callback", h.loginCallback)
+	e.GET("/", func(c echo.Context) error {
+		account, err := h.currentAccount(c)
+		if err != nil || account == nil {
+			return c.NoContent(http.StatusUnauthorized)
+		}
+
+		return c.String(http.StatusOK, account.Username)
+	})
+
+	return server, redisClient
+}
+
+// loginAs walks the authorization code flow, the provider logs in the
+// username without asking.
+func loginAs(t *testing.T, client *http.Client, server *httptest.Server, username string) *http.Response {
+	t.Helper()
+
+	resp, err := client.Get(server.URL + "/login/oidc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	authURL, err := resp.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = client.Get(authURL.String() + "&login_hint=" + url.QueryEscape(username))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	callback, err := resp.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = client.Get(callback.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	return resp
+}
+
+func newLoginClient(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &http.Client{Jar: jar, CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+}
+
+func whoami(t *testing.T, client *http.Client, server *httptest.Server) string {
+	t.Helper()
+
+	resp, err := client.Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+
+	name, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(name)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	server, redisClient := newLoginServer(t)
+	client := newLoginClient(t)
+
+	if resp := loginAs(t, client, server, "Alice"); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("callback returned %d, want 303", resp.StatusCode)
+	}
+
+	if name := whoami(t, client, server); name != "Alice" {
+		t.Errorf("logged in as %q, want Alice", name)
+	}
+
+	accountID := redisClient.Get(context.Background(), "account_identity:oidc:mock|alice").Val()
+	if accountID == "" {
+		t.Fatal("the subject was not linked to an account")
+	}
+
+	// logging in again from another device finds the same account
+	other := newLoginClient(t)
+	loginAs(t, other, server, "Alice")
+
+	if name := whoami(t, other, server); name != "Alice" {
+		t.Errorf("logged in again as %q, want Alice", name)
+	}
+
+	if keys := redisClient.Keys(context.Background(), "account:*").Val(); len(keys) != 1 {
+		t.Errorf("%d accounts, want 1", len(keys))
+	}
+}
+
+func TestOIDCLoginSanitizesUsername(t *testing.T) {
+	server, _ := newLoginServer(t)
+	client := newLoginClient(t)
+
+	loginAs(t, client, server, "admin")
+
+	if name := whoami(t, client, server); name == "" || name == "admin" {
+		t.Errorf("logged in as %q, want a name the policy allows", name)
+	}
+}
+
+func TestOIDCCallbackChecksState(t *testing.T) {
+	server, _ := newLoginServer(t)
+	client := newLoginClient(t)
+
+	resp, err := client.Get(server.URL + "/login/oidc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// a callback for a login the browser did not start
+	resp, err = client.Get(server.URL + "/login/oidc/callback?code=stolen&state=forged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("callback with a forged state returned %d, want 400", resp.StatusCode)
+	}
+
+	if name := whoami(t, client, server); name != "" {
+		t.Errorf("logged in as %q", name)
+	}
+}
@@ -0,0 +1,48 @@
+package user
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"time"
+)
+
+// Outcomes of a match request.
+const (
+	outcomeMatched   = "matched"
+	outcomeInvalid   = "invalid"
+	outcomeContended = "contended"
+	outcomeError     = "error"
+)
+
+// MatchMetrics counts the match requests processed per partition.
+type MatchMetrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+func NewMatchMetrics() *MatchMetrics {
+	return &MatchMetrics{
+		requests: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "user_app",
+			Name:      "match_requests_total",
+			Help:      "match requests processed per partition and outcome",
+		}, []string{"partition", "outcome"}),
+		duration: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "user_app",
+			Name:      "match_request_duration_seconds",
+			Help:      "time taken to process a match request per partition",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 12),
+		}, []string{"partition"}),
+	}
+}
+
+// observe records a processed request, it does nothing on a nil
+// MatchMetrics.
+func (m *MatchMetrics) observe(partition string, outcome string, took time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.requests.WithLabelValues(partition, outcome).Inc()
+	m.duration.WithLabelValues(partition).Observe(took.Seconds())
+}
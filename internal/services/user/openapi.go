@@ -0,0 +1,182 @@
+package user
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var pathParam = regexp.MustCompile(`:([A-Za-z0-9_]+)`)
+
+func (h *HttpServerHandle) openAPI(c echo.Context) error {
+	return c.JSON(http.StatusOK, openAPIDocument("/api/v1", h.apiRoutes()))
+}
+
+// openAPIDocument describes the routes as an OpenAPI 3 document, request and
+// response schemas are derived from the types in the route table.
+func openAPIDocument(basePath string, routes []apiRoute) map[string]interface{} {
+	schemas := map[string]interface{}{}
+	paths := map[string]map[string]interface{}{}
+
+	for _, route := range routes {
+		path := pathParam.ReplaceAllString(route.Path, "{$1}")
+
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+
+		responses := map[string]interface{}{}
+		for status, body := range route.Responses {
+			response := map[string]interface{}{"description": http.StatusText(status)}
+
+			if body != nil {
+				contentType := "application/json"
+				if status >= 400 {
+					contentType = "application/problem+json"
+				}
+
+				response["content"] = map[string]interface{}{
+					contentType: map[string]interface{}{"schema": schemaOf(reflect.TypeOf(body), schemas)},
+				}
+			}
+
+			responses[strconv.Itoa(status)] = response
+		}
+
+		operation := map[string]interface{}{
+			"summary":   route.Summary,
+			"responses": responses,
+		}
+
+		var parameters []interface{}
+		for _, match := range pathParam.FindAllStringSubmatch(route.Path, -1) {
+			parameters = append(parameters, map[string]interface{}{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+
+		if route.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": schemaOf(reflect.TypeOf(route.Request), schemas),
+					},
+				},
+			}
+		}
+
+		if route.Auth {
+			operation["security"] = []interface{}{map[string]interface{}{"bearerAuth": []string{}}}
+		}
+
+		paths[path][strings.ToLower(route.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Random Video Chat",
+			"version": "v1",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": basePath}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// schemaOf returns the JSON schema of a type, structs are added to schemas and
+// referenced by name.
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+	default:
+		return map[string]interface{}{}
+	}
+
+	name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+	ref := map[string]interface{}{"$ref": "#/components/schemas/" + name}
+
+	if _, ok := schemas[name]; ok {
+		return ref
+	}
+
+	// registered before the fields are walked so recursive types terminate
+	schemas[name] = nil
+
+	properties := map[string]interface{}{}
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		fieldName, options, _ := strings.Cut(tag, ",")
+		if fieldName == "" {
+			fieldName = field.Name
+		}
+
+		properties[fieldName] = schemaOf(field.Type, schemas)
+
+		if !strings.Contains(options, "omitempty") {
+			required = append(required, fieldName)
+		}
+	}
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+
+	schemas[name] = schema
+
+	return ref
+}
@@ -0,0 +1,44 @@
+package user
+
+import (
+	"fmt"
+	"hash/fnv"
+	"rvc/internal/models"
+)
+
+// partitionPools are the pools match requests are partitioned by, "any"
+// takes requests that are not restricted to a pool of compatible modes.
+var partitionPools = []string{"text", "media", "any"}
+
+// MatchPartitions lists the partitions of match requests for the given
+// number of shards per pool.
+func MatchPartitions(shards int) []string {
+	var partitions []string
+
+	for _, pool := range partitionPools {
+		for shard := 0; shard < max(shards, 1); shard++ {
+			partitions = append(partitions, fmt.Sprintf("%s-%d", pool, shard))
+		}
+	}
+
+	return partitions
+}
+
+// matchPartition shards the request by the room it joins, or by its first
+// user, within the pool of its mode.
+func matchPartition(matchRequest *models.MatchRequest, shards int) string {
+	pool := matchRequest.Pool
+	if pool == "" {
+		pool = "any"
+	}
+
+	key := matchRequest.Room
+	if key == "" && len(matchRequest.UserIDs) > 0 {
+		key = matchRequest.UserIDs[0]
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+
+	return fmt.Sprintf("%s-%d", pool, hash.Sum32()%uint32(max(shards, 1)))
+}
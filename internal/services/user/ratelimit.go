@@ -0,0 +1,153 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"math"
+	"net/http"
+	"rvc/internal/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rate limited actions.
+const (
+	ActionChallenge = "challenge"
+	ActionRegister  = "register"
+	ActionMatch     = "match"
+	ActionConnect   = "connect"
+	ActionMessage   = "message"
+)
+
+// Limit allows PerUser requests of each user and PerIP requests of each
+// address every Window, zero is no limit.
+type Limit struct {
+	PerUser int
+	PerIP   int
+	Window  time.Duration
+}
+
+// DefaultRateLimits are generous enough for people, a user behind a shared
+// address still has room on the address budget.
+func DefaultRateLimits() map[string]Limit {
+	return map[string]Limit{
+		ActionChallenge: {PerIP: 40, Window: time.Minute},
+		ActionRegister:  {PerIP: 20, Window: time.Minute},
+		ActionMatch:     {PerUser: 30, PerIP: 300, Window: time.Minute},
+		ActionConnect:   {PerUser: 10, PerIP: 100, Window: time.Minute},
+		ActionMessage:   {PerUser: 50, Window: time.Second},
+	}
+}
+
+// ParseLimit reads a limit written as "<per user>,<per ip>/<window>", e.g.
+// "30,300/1m".
+func ParseLimit(value string) (Limit, error) {
+	counts, window, ok := strings.Cut(value, "/")
+	if !ok {
+		return Limit{}, errors.New("rate limit " + value + " has no window")
+	}
+
+	perUser, perIP, ok := strings.Cut(counts, ",")
+	if !ok {
+		return Limit{}, errors.New("rate limit " + value + " needs a per user and a per ip count")
+	}
+
+	var limit Limit
+	var err error
+
+	if limit.PerUser, err = strconv.Atoi(perUser); err != nil {
+		return Limit{}, err
+	}
+
+	if limit.PerIP, err = strconv.Atoi(perIP); err != nil {
+		return Limit{}, err
+	}
+
+	if limit.Window, err = time.ParseDuration(window); err != nil {
+		return Limit{}, err
+	}
+
+	if limit.PerUser < 0 || limit.PerIP < 0 || limit.Window <= 0 {
+		return Limit{}, errors.New("rate limit " + value + " is out of range")
+	}
+
+	return limit, nil
+}
+
+// rateLimit rejects requests over the action's budget with a 429, the user
+// is the one apiAuth resolved, the session's or the route's id.
+func (h *HttpServerHandle) rateLimit(action string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			retryAfter := h.throttle(c.Request().Context(), action, h.requestUser(c), c.RealIP())
+			if retryAfter == 0 {
+				return next(c)
+			}
+
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+
+			return echo.NewHTTPError(http.StatusTooManyRequests, "too many "+action+" requests, retry later")
+		}
+	}
+}
+
+func (h *HttpServerHandle) requestUser(c echo.Context) string {
+	if userID, ok := c.Get("userID").(string); ok {
+		return userID
+	}
+
+	if session, err := h.SessionStore.Get(c.Request(), "random-video-chat-session"); err == nil {
+		if userID, ok := session.Values["userID"].(string); ok {
+			return userID
+		}
+	}
+
+	return c.Param("id")
+}
+
+// throttle counts the action against the user's and the address' budgets
+// and returns how long to wait when either is spent, 0 when it is allowed.
+// The user is told once per window.
+func (h *HttpServerHandle) throttle(ctx context.Context, action string, userID string, ip string) time.Duration {
+	limit, ok := h.RateLimits[action]
+	if !ok {
+		return 0
+	}
+
+	subjects := map[string]int{}
+	if userID != "" && limit.PerUser > 0 {
+		subjects["user:"+userID] = limit.PerUser
+	}
+	if ip != "" && limit.PerIP > 0 {
+		subjects["ip:"+ip] = limit.PerIP
+	}
+
+	for subject, allowed := range subjects {
+		count, ttl, err := h.Store.countRequest(ctx, fmt.Sprintf("rate_limit:%s:%s", action, subject), limit.Window)
+		if err != nil {
+			// a failing limiter does not take the service down with it
+			h.Logger.Err(err).Msg("unable to count " + action + " request of " + subject)
+			continue
+		}
+
+		if count <= int64(allowed) {
+			continue
+		}
+
+		if count == int64(allowed)+1 && userID != "" {
+			if err := h.Store.notifyUser(ctx, userID, "throttled", &models.Throttled{
+				Action:     action,
+				RetryAfter: int(math.Ceil(ttl.Seconds())),
+			}); err != nil {
+				h.Logger.Err(err).Msg("unable to notify " + userID)
+			}
+		}
+
+		return max(ttl, time.Millisecond)
+	}
+
+	return 0
+}
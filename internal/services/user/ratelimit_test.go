@@ -0,0 +1,47 @@
+package user
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestChallengeHasItsOwnBudget(t *testing.T) {
+	s, _ := newTestHttpStorage(t)
+	logger := zerolog.Nop()
+	ctx := context.Background()
+
+	h := &HttpServerHandle{
+		Store:  s,
+		Logger: &logger,
+		RateLimits: map[string]Limit{
+			ActionChallenge: {PerIP: 1, Window: time.Minute},
+			ActionRegister:  {PerIP: 1, Window: time.Minute},
+		},
+	}
+
+	limits := map[string]string{}
+	for _, route := range h.apiRoutes() {
+		limits[route.Method+" "+route.Path] = route.RateLimit
+	}
+
+	if limits["GET /challenge"] != ActionChallenge || limits["POST /users"] != ActionRegister {
+		t.Errorf("challenge is limited as %q and registration as %q",
+			limits["GET /challenge"], limits["POST /users"])
+	}
+
+	// registering takes a challenge then the registration, once each
+	if h.throttle(ctx, ActionChallenge, "", "192.0.2.1") != 0 || h.throttle(ctx, ActionRegister, "", "192.0.2.1") != 0 {
+		t.Fatal("fetching a challenge used up the registration budget")
+	}
+
+	if h.throttle(ctx, ActionChallenge, "", "192.0.2.1") == 0 {
+		t.Error("a second challenge was allowed over the budget")
+	}
+
+	if h.throttle(ctx, ActionRegister, "", "192.0.2.2") != 0 {
+		t.Error("another address was throttled")
+	}
+}
@@ -0,0 +1,52 @@
+package user
+
+import (
+	"strconv"
+	"time"
+)
+
+// skipping a match sooner than quickSkip counts against the skipper
+const quickSkip = 10 * time.Second
+
+// reputationStats are the inputs of a reputation, kept per identity in
+// reputation:<identity>.
+type reputationStats struct {
+	RatingCount    int
+	RatingSum      int
+	Reports        int
+	QuickSkips     int
+	Sessions       int
+	SessionSeconds int
+}
+
+func parseReputationStats(fields map[string]string) reputationStats {
+	value := func(field string) int {
+		n, _ := strconv.Atoi(fields[field])
+		return n
+	}
+
+	return reputationStats{
+		RatingCount:    value("rating_count"),
+		RatingSum:      value("rating_sum"),
+		Reports:        value("reports"),
+		QuickSkips:     value("quick_skips"),
+		Sessions:       value("sessions"),
+		SessionSeconds: value("session_seconds"),
+	}
+}
+
+// score weighs the inputs into a reputation between 0 and 1. Each input is
+// smoothed towards a neutral prior worth five matches, new users start at
+// about 0.7 and no single match moves them far.
+func (r reputationStats) score() float64 {
+	const prior = 5
+
+	rating := (float64(r.RatingSum) + 3.5*prior) / float64(r.RatingCount+prior)
+	skipRate := float64(r.QuickSkips) / float64(r.Sessions+prior)
+	reportRate := float64(r.Reports) / float64(r.Sessions+prior)
+	avgDuration := float64(r.SessionSeconds+120*prior) / float64(r.Sessions+prior)
+
+	score := 0.5*(rating-1)/4 + 0.2*min(avgDuration/300, 1) + 0.3*(1-skipRate) - reportRate
+
+	return max(0, min(score, 1))
+}
@@ -0,0 +1,155 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"rvc/internal/events"
+	"rvc/internal/matching"
+	"rvc/internal/models"
+)
+
+func TestReputationScore(t *testing.T) {
+	neutral := reputationStats{}.score()
+	if neutral < 0.65 || neutral > 0.75 {
+		t.Errorf("new users score %.3f, want about 0.7", neutral)
+	}
+
+	for name, test := range map[string]struct {
+		stats  reputationStats
+		higher bool
+	}{
+		"top ratings":   {reputationStats{RatingCount: 10, RatingSum: 50, Sessions: 10, SessionSeconds: 1200}, true},
+		"long sessions": {reputationStats{Sessions: 10, SessionSeconds: 6000}, true},
+		"low ratings":   {reputationStats{RatingCount: 10, RatingSum: 10, Sessions: 10, SessionSeconds: 1200}, false},
+		"quick skips":   {reputationStats{QuickSkips: 10, Sessions: 10, SessionSeconds: 1200}, false},
+		"reports":       {reputationStats{Reports: 3, Sessions: 10, SessionSeconds: 1200}, false},
+	} {
+		if score := test.stats.score(); (score > neutral) != test.higher {
+			t.Errorf("%s score %.3f against %.3f for new users", name, score, neutral)
+		}
+	}
+
+	// a single match moves a new user little
+	if score := (reputationStats{RatingCount: 1, RatingSum: 1, Sessions: 1}).score(); neutral-score > 0.1 {
+		t.Errorf("one bad rating drops a new user to %.3f", score)
+	}
+
+	for _, stats := range []reputationStats{
+		{Reports: 100, QuickSkips: 100, Sessions: 100},
+		{RatingCount: 100, RatingSum: 500, Sessions: 100, SessionSeconds: 100000},
+	} {
+		if score := stats.score(); score < 0 || score > 1 {
+			t.Errorf("%+v score %.3f out of 0 to 1", stats, score)
+		}
+	}
+}
+
+// rate has the raters give the user the rating, each in a match of its own.
+func rate(t *testing.T, s *HttpStorage, userID string, rating int, raters int) {
+	t.Helper()
+
+	for i := 0; i < raters; i++ {
+		if _, err := s.addFeedback(context.Background(), &models.Feedback{
+			MatchID: fmt.Sprintf("match-%s-%d-%d", userID, rating, i),
+			From:    fmt.Sprintf("rater-%d", i),
+			To:      userID,
+			Rating:  rating,
+		}, userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRatingsSetTheReputationBand(t *testing.T) {
+	s, e := newMatchedUsers(t, "alice", "bob", "carol")
+	ctx := context.Background()
+
+	rate(t, s, "alice", 1, 20)
+	rate(t, s, "carol", 5, 3)
+
+	candidates := map[string]*matching.Candidate{}
+	for _, userID := range []string{"alice", "bob", "carol"} {
+		candidate, err := e.loadCandidate(ctx, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		candidates[userID] = candidate
+	}
+
+	alice, bob, carol := candidates["alice"].Reputation, candidates["bob"].Reputation, candidates["carol"].Reputation
+	if alice >= bob || bob >= carol {
+		t.Fatalf("reputations alice %.3f, bob %.3f, carol %.3f", alice, bob, carol)
+	}
+
+	policy := matching.Policy{ByReputation: true}
+	now := time.Now()
+
+	for _, candidate := range candidates {
+		candidate.WaitingSince = now
+	}
+
+	if !policy.Eligible(candidates["bob"], candidates["carol"], now) {
+		t.Error("bob and carol are apart right away")
+	}
+
+	if policy.Eligible(candidates["bob"], candidates["alice"], now) {
+		t.Error("alice's ratings did not keep her apart from bob")
+	}
+
+	// the band widens with the wait
+	if !policy.Eligible(candidates["bob"], candidates["alice"], now.Add(time.Minute)) {
+		t.Error("alice and bob are apart after a minute")
+	}
+}
+
+func TestQuickSkipsLowerTheSkipper(t *testing.T) {
+	s, e := newMatchedUsers(t, "alice", "bob")
+	ctx := context.Background()
+
+	match, err := e.createMatchEntry(ctx, &models.MatchRequest{UserIDs: []string{"alice", "bob"}, Size: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the match started 5 seconds ago, alice skips it
+	participants, err := s.getParticipants(ctx, match.MatchID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for userID, p := range participants {
+		p.JoinedAt = time.Now().Add(-5 * time.Second).Unix()
+
+		participantJSON, err := json.Marshal(&p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.RedisClient.HSet(ctx, "match_participants:"+match.MatchID, userID, participantJSON).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.creditMatch(ctx, match.MatchID, "alice", events.ReasonSkipped); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := parseReputationStats(s.RedisClient.HGetAll(ctx, "reputation:alice").Val())
+	bob := parseReputationStats(s.RedisClient.HGetAll(ctx, "reputation:bob").Val())
+
+	if alice.QuickSkips != 1 || alice.Sessions != 1 || bob.QuickSkips != 0 || bob.Sessions != 1 {
+		t.Errorf("credited alice %+v, bob %+v", alice, bob)
+	}
+
+	aliceScore, _ := s.RedisClient.HGet(ctx, "user_entry:alice", "reputation").Float64()
+	bobScore, _ := s.RedisClient.HGet(ctx, "user_entry:bob", "reputation").Float64()
+
+	if aliceScore >= bobScore {
+		t.Errorf("skipper alice scores %.3f, bob %.3f", aliceScore, bobScore)
+	}
+}
@@ -0,0 +1,34 @@
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"rvc/internal/models"
+)
+
+// LoadTopicRooms reads the topic rooms to register from a JSON file.
+func LoadTopicRooms(path string) ([]models.TopicRoom, error) {
+	roomsJSON, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rooms []models.TopicRoom
+
+	if err := json.Unmarshal(roomsJSON, &rooms); err != nil {
+		return nil, err
+	}
+
+	for _, room := range rooms {
+		if room.Name == "" {
+			return nil, fmt.Errorf("topic room without a name in %s", path)
+		}
+
+		if room.Capacity < 3 || room.Capacity > maxRoomSize {
+			return nil, fmt.Errorf("capacity of topic room %s must be between 3 and %d", room.Name, maxRoomSize)
+		}
+	}
+
+	return rooms, nil
+}
@@ -0,0 +1,171 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"rvc/internal/models"
+)
+
+// newSearchHandle returns the event handle over the storage, and a function
+// returning the next event sent to the user.
+func newSearchHandle(t *testing.T, e *EventStorage, userID string) (*EventServerHandle, func() *models.Event) {
+	t.Helper()
+
+	logger := zerolog.Nop()
+	h := &EventServerHandle{Store: e, Logger: &logger}
+
+	ctx := context.Background()
+	pubsub := e.RedisClient.Subscribe(ctx, userID+":incoming")
+	t.Cleanup(func() { _ = pubsub.Close() })
+
+	if _, err := pubsub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	next := func() *models.Event {
+		t.Helper()
+
+		ctx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+
+		msg, err := pubsub.ReceiveMessage(ctx)
+		if err != nil {
+			t.Fatalf("%s was sent nothing: %v", userID, err)
+		}
+
+		var event models.Event
+		if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+			t.Fatal(err)
+		}
+
+		return &event
+	}
+
+	return h, next
+}
+
+// startSearchAt starts a search of the user for peers of the modes.
+func startSearchAt(t *testing.T, s *HttpStorage, userID string, startedAt time.Time, modes ...string) *models.MatchSearch {
+	t.Helper()
+
+	search := &models.MatchSearch{
+		Ticket:    "ticket-" + userID,
+		UserID:    userID,
+		Modes:     modes,
+		StartedAt: startedAt,
+		Partition: "media-0",
+	}
+
+	if err := s.startSearch(context.Background(), search); err != nil {
+		t.Fatal(err)
+	}
+
+	return search
+}
+
+func TestSearchSendsQueueStatus(t *testing.T) {
+	s, e := newMatchedUsers(t, "alice", "bob", "carol")
+	ctx := context.Background()
+
+	// bob and carol wait for text peers, alice is third in line
+	startSearchAt(t, s, "bob", time.Now().Add(-20*time.Second), models.ModeText)
+	startSearchAt(t, s, "carol", time.Now().Add(-10*time.Second), models.ModeText)
+	search := startSearchAt(t, s, "alice", time.Now(), models.ModeAudio)
+
+	h, next := newSearchHandle(t, e, "alice")
+
+	h.searchAttempt(ctx, search)
+
+	event := next()
+	if event.Event != "queue_status" {
+		t.Fatalf("sent %s, want queue_status", event.Event)
+	}
+
+	var status models.QueueStatus
+	if err := json.Unmarshal(event.Data, &status); err != nil {
+		t.Fatal(err)
+	}
+
+	want := models.QueueStatus{Ticket: "ticket-alice", Position: 3, Waiting: 3, PoolSize: 3}
+	if status != want {
+		t.Errorf("status %+v, want %+v", status, want)
+	}
+
+	// 30 matches in 5 minutes make a match of two every 5 seconds
+	for i := 0; i < 30; i++ {
+		if err := e.countMatch(ctx, fmt.Sprintf("match-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h.searchAttempt(ctx, search)
+
+	if err := json.Unmarshal(next().Data, &status); err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Position != 3 || status.EstimatedWait != 15 {
+		t.Errorf("status %+v, want position 3 and a 15s wait", status)
+	}
+
+	if !e.searchCurrent(ctx, search) {
+		t.Error("the search ended before it timed out")
+	}
+}
+
+func TestSearchEndsWithNoMatchReason(t *testing.T) {
+	page, err := os.ReadFile("../../../web/chat.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, users := range map[string][]string{
+		models.NoMatchNoUsers:      {"alice"},
+		models.NoMatchNoCompatible: {"alice", "bob"},
+	} {
+		// the page explains each reason
+		if !strings.Contains(string(page), name+": '") {
+			t.Errorf("chat.html does not explain %s", name)
+		}
+
+		s, e := newMatchedUsers(t, users...)
+		ctx := context.Background()
+
+		// bob, when around, is in another mode
+		search := startSearchAt(t, s, "alice", time.Now().Add(-searchTimeout), models.ModeText)
+
+		h, next := newSearchHandle(t, e, "alice")
+
+		h.searchAttempt(ctx, search)
+
+		event := next()
+		if event.Event != "no_match" {
+			t.Fatalf("%s: sent %s, want no_match", name, event.Event)
+		}
+
+		var noMatch models.NoMatch
+		if err := json.Unmarshal(event.Data, &noMatch); err != nil {
+			t.Fatal(err)
+		}
+
+		if noMatch.Reason != name || noMatch.Ticket != "ticket-alice" {
+			t.Errorf("no match %+v, want %s", noMatch, name)
+		}
+
+		if e.searchCurrent(ctx, search) || s.RedisClient.ZScore(ctx, "match_waiting", "alice").Err() == nil {
+			t.Errorf("%s: the search was left running", name)
+		}
+
+		// the next search keeps alice's place
+		if s.RedisClient.Exists(ctx, "match_queued_at:alice").Val() != 1 {
+			t.Errorf("%s: the place in the queue was dropped", name)
+		}
+	}
+}
@@ -31,6 +31,10 @@ func (svc *Server) Run(ctx context.Context) error {
 	var wg sync.WaitGroup
 	errChan := make(chan error, 1)
 
+	if err := svc.httpHandlers.registerTopicRooms(ctx); err != nil {
+		return err
+	}
+
 	// user
 	wg.Add(1)
 	go func() {
@@ -39,15 +43,33 @@ func (svc *Server) Run(ctx context.Context) error {
 		svc.engine.Use(echoprometheus.NewMiddleware("user_app"))
 		svc.engine.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 			AllowOrigins: []string{"*"},
-			AllowMethods: []string{http.MethodGet, http.MethodPost},
+			AllowMethods: []string{http.MethodGet, http.MethodPost, http.MethodDelete},
 		}))
 
 		svc.engine.GET("/health", svc.httpHandlers.checkHealth)
 		svc.engine.GET("/metrics", echoprometheus.NewHandler())
 		svc.engine.GET("/", svc.httpHandlers.home)
-		svc.engine.POST("/register", svc.httpHandlers.registerUser)
-		svc.engine.GET("/connection/:id", svc.httpHandlers.connection)
-		svc.engine.GET("/match", svc.httpHandlers.matchUser)
+		svc.engine.POST("/register", svc.httpHandlers.registerUser, svc.httpHandlers.rateLimit(ActionRegister))
+		svc.engine.GET("/register/challenge", svc.httpHandlers.issueChallenge, svc.httpHandlers.rateLimit(ActionChallenge))
+		svc.engine.GET("/connection/:id", svc.httpHandlers.connection, svc.httpHandlers.rateLimit(ActionConnect))
+		svc.engine.GET("/match", svc.httpHandlers.matchUser, svc.httpHandlers.rateLimit(ActionMatch))
+		svc.engine.POST("/invite", svc.httpHandlers.createInvite)
+		svc.engine.GET("/invite/:code", svc.httpHandlers.invitePage)
+		svc.engine.GET("/rooms", svc.httpHandlers.listRooms)
+		svc.engine.POST("/rooms/:name/join", svc.httpHandlers.joinRoom, svc.httpHandlers.rateLimit(ActionMatch))
+		svc.engine.POST("/connect", svc.httpHandlers.connectPeer)
+		svc.engine.GET("/friends", svc.httpHandlers.listFriends)
+		svc.engine.POST("/friends/:id/chat", svc.httpHandlers.callFriend)
+		svc.engine.GET("/account", svc.httpHandlers.accountPage)
+		svc.engine.POST("/signup", svc.httpHandlers.signup)
+		svc.engine.POST("/login", svc.httpHandlers.login)
+		svc.engine.POST("/logout", svc.httpHandlers.logout)
+		svc.engine.GET("/login/:provider", svc.httpHandlers.loginProvider)
+		svc.engine.GET("/login/:provider/callback", svc.httpHandlers.loginCallback)
+
+		svc.engine.HTTPErrorHandler = problemErrorHandler(svc.engine.DefaultHTTPErrorHandler)
+
+		svc.httpHandlers.registerAPI(svc.engine.Group("/api/v1"))
 
 		if err := svc.engine.Start(svc.port); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			errChan <- err
@@ -62,5 +84,27 @@ func (svc *Server) Run(ctx context.Context) error {
 		svc.eventHandlers.Match(ctx)
 	}()
 
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		svc.eventHandlers.Search(ctx)
+	}()
+
+	// bots
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		svc.httpHandlers.runBots(ctx)
+	}()
+
+	// Run returns once the workers and bots stopped after ctx is done and
+	// the engine was shut down
+	go func() {
+		wg.Wait()
+		close(errChan)
+	}()
+
 	return <-errChan
 }
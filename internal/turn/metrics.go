@@ -0,0 +1,81 @@
+package turn
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// allocationMetrics exports one series per live allocation, series of an
+// allocation disappear with it.
+type allocationMetrics struct {
+	mu     sync.RWMutex
+	relays map[string]*relayConn
+
+	allocations   *prometheus.Desc
+	bytesReceived *prometheus.Desc
+	bytesSent     *prometheus.Desc
+	packetsDrop   *prometheus.Desc
+}
+
+func newAllocationMetrics() *allocationMetrics {
+	labels := []string{"relay", "user"}
+
+	return &allocationMetrics{
+		relays: make(map[string]*relayConn),
+		allocations: prometheus.NewDesc("turn_allocations",
+			"number of allocations currently open on the embedded turn server", nil, nil),
+		bytesReceived: prometheus.NewDesc("turn_allocation_received_bytes_total",
+			"bytes received from peers on an allocation", labels, nil),
+		bytesSent: prometheus.NewDesc("turn_allocation_sent_bytes_total",
+			"bytes relayed to peers on an allocation", labels, nil),
+		packetsDrop: prometheus.NewDesc("turn_allocation_dropped_packets_total",
+			"packets dropped on an allocation for exceeding the bandwidth quota", labels, nil),
+	}
+}
+
+func (m *allocationMetrics) add(relay *relayConn) {
+	m.mu.Lock()
+	m.relays[relay.relayAddr] = relay
+	m.mu.Unlock()
+}
+
+func (m *allocationMetrics) remove(relayAddr string) {
+	m.mu.Lock()
+	delete(m.relays, relayAddr)
+	m.mu.Unlock()
+}
+
+func (m *allocationMetrics) assignUser(relayAddr string, userID string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if relay, ok := m.relays[relayAddr]; ok {
+		relay.userID.Store(userID)
+	}
+}
+
+func (m *allocationMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.allocations
+	ch <- m.bytesReceived
+	ch <- m.bytesSent
+	ch <- m.packetsDrop
+}
+
+func (m *allocationMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(m.allocations, prometheus.GaugeValue, float64(len(m.relays)))
+
+	for relayAddr, relay := range m.relays {
+		userID, _ := relay.userID.Load().(string)
+
+		ch <- prometheus.MustNewConstMetric(m.bytesReceived, prometheus.CounterValue,
+			float64(relay.bytesReceived.Load()), relayAddr, userID)
+		ch <- prometheus.MustNewConstMetric(m.bytesSent, prometheus.CounterValue,
+			float64(relay.bytesSent.Load()), relayAddr, userID)
+		ch <- prometheus.MustNewConstMetric(m.packetsDrop, prometheus.CounterValue,
+			float64(relay.packetsDrop.Load()), relayAddr, userID)
+	}
+}
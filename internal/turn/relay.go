@@ -0,0 +1,108 @@
+package turn
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	pionturn "github.com/pion/turn/v4"
+	"golang.org/x/time/rate"
+)
+
+// relayBurst is the least burst of an allocation's limiter in bytes, the
+// largest UDP datagram, so a limit under the packet size still lets packets
+// through at the limit instead of dropping every one.
+const relayBurst = 64 << 10
+
+// relayAddressGenerator hands out relay sockets from the configured port range
+// wrapped so every allocation is metered and held to its bandwidth quota.
+type relayAddressGenerator struct {
+	pionturn.RelayAddressGeneratorPortRange
+
+	// bandwidthLimit is in bytes per second
+	bandwidthLimit int
+	metrics        *allocationMetrics
+}
+
+func (g *relayAddressGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	conn, relayAddr, err := g.RelayAddressGeneratorPortRange.AllocatePacketConn(network, requestedPort)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	relay := &relayConn{
+		PacketConn: conn,
+		relayAddr:  relayAddr.String(),
+		metrics:    g.metrics,
+	}
+
+	if g.bandwidthLimit > 0 {
+		relay.limiter = rate.NewLimiter(rate.Limit(g.bandwidthLimit), max(g.bandwidthLimit, relayBurst))
+	}
+
+	g.metrics.add(relay)
+
+	return relay, relayAddr, nil
+}
+
+type relayConn struct {
+	net.PacketConn
+
+	relayAddr string
+	limiter   *rate.Limiter
+	metrics   *allocationMetrics
+
+	userID        atomic.Value
+	bytesReceived atomic.Uint64
+	bytesSent     atomic.Uint64
+	packetsDrop   atomic.Uint64
+}
+
+// ReadFrom reads traffic from peers, packets over the quota are dropped.
+func (c *relayConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+
+		if !c.allow(n) {
+			continue
+		}
+
+		c.bytesReceived.Add(uint64(n))
+
+		return n, addr, nil
+	}
+}
+
+// WriteTo relays client traffic to peers, packets over the quota are dropped.
+func (c *relayConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !c.allow(len(p)) {
+		return len(p), nil
+	}
+
+	n, err := c.PacketConn.WriteTo(p, addr)
+	c.bytesSent.Add(uint64(n))
+
+	return n, err
+}
+
+func (c *relayConn) Close() error {
+	c.metrics.remove(c.relayAddr)
+
+	return c.PacketConn.Close()
+}
+
+func (c *relayConn) allow(n int) bool {
+	if c.limiter == nil {
+		return true
+	}
+
+	if !c.limiter.AllowN(time.Now(), n) {
+		c.packetsDrop.Add(1)
+		return false
+	}
+
+	return true
+}
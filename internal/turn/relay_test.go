@@ -0,0 +1,224 @@
+package turn
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	pionturn "github.com/pion/turn/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// newRelay allocates a relay on the loopback limited to bandwidthLimit bytes
+// per second.
+func newRelay(t *testing.T, bandwidthLimit int, metrics *allocationMetrics) *relayConn {
+	t.Helper()
+
+	generator := &relayAddressGenerator{
+		RelayAddressGeneratorPortRange: pionturn.RelayAddressGeneratorPortRange{
+			RelayAddress: net.ParseIP("127.0.0.1"),
+			Address:      "127.0.0.1",
+			MinPort:      40000,
+			MaxPort:      49999,
+		},
+		bandwidthLimit: bandwidthLimit,
+		metrics:        metrics,
+	}
+
+	if err := generator.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, _, err := generator.AllocatePacketConn("udp4", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn.(*relayConn)
+}
+
+func newPeer(t *testing.T) net.PacketConn {
+	t.Helper()
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = peer.Close() })
+
+	return peer
+}
+
+func TestRelayDropsPacketsOverQuota(t *testing.T) {
+	// a limit under the packet size
+	relay := newRelay(t, 1000, newAllocationMetrics())
+	peer := newPeer(t)
+
+	packet := make([]byte, 1200)
+	for i := 0; i < 100; i++ {
+		if n, err := relay.WriteTo(packet, peer.LocalAddr()); err != nil || n != len(packet) {
+			t.Fatalf("WriteTo = %d, %v", n, err)
+		}
+	}
+
+	_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := peer.ReadFrom(make([]byte, 1500)); err != nil {
+		t.Fatalf("no packet was relayed: %v", err)
+	}
+
+	sent, dropped := int(relay.bytesSent.Load()), int(relay.packetsDrop.Load())
+
+	// the burst passes, the rest is dropped
+	if sent < relayBurst-len(packet) || sent > relayBurst+len(packet) {
+		t.Errorf("sent %d bytes, want about the %d byte burst", sent, relayBurst)
+	}
+
+	if sent/len(packet)+dropped != 100 {
+		t.Errorf("sent %d bytes and dropped %d packets of 100", sent, dropped)
+	}
+}
+
+func TestRelayWithoutLimit(t *testing.T) {
+	relay := newRelay(t, 0, newAllocationMetrics())
+	peer := newPeer(t)
+
+	packet := make([]byte, 1200)
+	for i := 0; i < 100; i++ {
+		if _, err := relay.WriteTo(packet, peer.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if relay.bytesSent.Load() != 100*1200 || relay.packetsDrop.Load() != 0 {
+		t.Errorf("sent %d bytes, dropped %d packets", relay.bytesSent.Load(), relay.packetsDrop.Load())
+	}
+}
+
+func TestQuotaCapsAllocationsPerUser(t *testing.T) {
+	logger := zerolog.Nop()
+	s := &Server{
+		config:      Config{MaxAllocations: 2},
+		logger:      &logger,
+		metrics:     newAllocationMetrics(),
+		allocations: make(map[string]int),
+	}
+
+	relayAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}
+
+	for i := 0; i < 2; i++ {
+		if !s.quotaHandler("1700000000:alice", "", nil) {
+			t.Fatalf("allocation %d refused", i+1)
+		}
+
+		s.onAllocationCreated(nil, nil, "", "1700000000:alice", "", relayAddr, 0)
+	}
+
+	if s.quotaHandler("1800000000:alice", "", nil) {
+		t.Error("a third allocation was allowed")
+	}
+
+	if !s.quotaHandler("1700000000:bob", "", nil) {
+		t.Error("another user was refused")
+	}
+
+	s.onAllocationDeleted(nil, nil, "", "1700000000:alice", "")
+
+	if !s.quotaHandler("1700000000:alice", "", nil) {
+		t.Error("refused after an allocation was deleted")
+	}
+
+	s.onAllocationDeleted(nil, nil, "", "1700000000:alice", "")
+
+	if len(s.allocations) != 0 {
+		t.Errorf("allocations left %v", s.allocations)
+	}
+}
+
+// gather returns the values of the metric by user label.
+func gather(t *testing.T, registry *prometheus.Registry, name string) map[string]float64 {
+	t.Helper()
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			var userID string
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "user" {
+					userID = label.GetValue()
+				}
+			}
+
+			values[userID] = metric.GetCounter().GetValue() + metric.GetGauge().GetValue()
+		}
+	}
+
+	return values
+}
+
+func TestAllocationMetrics(t *testing.T) {
+	metrics := newAllocationMetrics()
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(metrics)
+
+	logger := zerolog.Nop()
+	s := &Server{logger: &logger, metrics: metrics, allocations: make(map[string]int)}
+
+	relay := newRelay(t, 1000, metrics)
+	other := newRelay(t, 0, metrics)
+	peer := newPeer(t)
+
+	relayAddr, _ := net.ResolveUDPAddr("udp4", relay.relayAddr)
+	s.onAllocationCreated(nil, nil, "", "1700000000:alice", "", relayAddr, 0)
+
+	if _, err := relay.WriteTo(make([]byte, 100), peer.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := relay.WriteTo(make([]byte, relayBurst), peer.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := peer.WriteTo(make([]byte, 300), relayAddr); err != nil {
+		t.Fatal(err)
+	}
+	_ = relay.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := relay.ReadFrom(make([]byte, 1500)); err != nil {
+		t.Fatal(err)
+	}
+
+	if allocations := gather(t, registry, "turn_allocations"); allocations[""] != 2 {
+		t.Errorf("allocations %v, want 2", allocations)
+	}
+
+	for name, want := range map[string]float64{
+		"turn_allocation_sent_bytes_total":      100,
+		"turn_allocation_received_bytes_total":  300,
+		"turn_allocation_dropped_packets_total": 1,
+	} {
+		if got := gather(t, registry, name); got["alice"] != want || got[""] != 0 {
+			t.Errorf("%s = %v, want %v for alice", name, got, want)
+		}
+	}
+
+	_ = relay.Close()
+	_ = other.Close()
+
+	if allocations := gather(t, registry, "turn_allocations"); allocations[""] != 0 {
+		t.Errorf("allocations %v after closing, want 0", allocations)
+	}
+
+	if sent := gather(t, registry, "turn_allocation_sent_bytes_total"); len(sent) != 0 {
+		t.Errorf("series of closed allocations left: %v", sent)
+	}
+}
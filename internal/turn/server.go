@@ -0,0 +1,185 @@
+package turn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/logging"
+	pionturn "github.com/pion/turn/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+const credentialTTL = 24 * time.Hour
+
+type Config struct {
+	ListenAddr string
+	PublicIP   string
+	Realm      string
+	Secret     string
+
+	RelayPortMin uint16
+	RelayPortMax uint16
+
+	// BandwidthLimit is the relay budget of a single allocation in bytes per
+	// second, 0 disables the limit.
+	BandwidthLimit int
+	// MaxAllocations is the number of concurrent allocations per user, 0
+	// disables the quota.
+	MaxAllocations int
+
+	// Authorize reports whether the user behind a credential still exists.
+	Authorize func(userID string) bool
+}
+
+type Server struct {
+	config  Config
+	logger  *zerolog.Logger
+	metrics *allocationMetrics
+
+	mu          sync.Mutex
+	allocations map[string]int
+}
+
+func NewServer(config Config, logger *zerolog.Logger) (*Server, error) {
+	if config.Secret == "" {
+		return nil, errors.New("turn secret is required for the embedded server")
+	}
+
+	if net.ParseIP(config.PublicIP) == nil {
+		return nil, errors.New("invalid turn public ip: " + config.PublicIP)
+	}
+
+	if config.RelayPortMin == 0 || config.RelayPortMax < config.RelayPortMin {
+		return nil, errors.New("invalid turn relay port range")
+	}
+
+	metrics := newAllocationMetrics()
+	if err := prometheus.Register(metrics); err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		config:      config,
+		logger:      logger,
+		metrics:     metrics,
+		allocations: make(map[string]int),
+	}, nil
+}
+
+// Credentials issues the ephemeral TURN REST credentials for a user, these
+// are what the embedded server authenticates against.
+func Credentials(secret string, userID string) (string, string, error) {
+	return pionturn.GenerateLongTermTURNRESTCredentials(secret, userID, credentialTTL)
+}
+
+func (s *Server) Run(ctx context.Context) error {
+	udpListener, err := net.ListenPacket("udp4", s.config.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	server, err := pionturn.NewServer(pionturn.ServerConfig{
+		Realm:         s.config.Realm,
+		LoggerFactory: loggerFactory,
+		AuthHandler:   s.authHandler(loggerFactory.NewLogger("turn")),
+		QuotaHandler:  s.quotaHandler,
+		EventHandler: pionturn.EventHandler{
+			OnAllocationCreated: s.onAllocationCreated,
+			OnAllocationDeleted: s.onAllocationDeleted,
+		},
+		PacketConnConfigs: []pionturn.PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &relayAddressGenerator{
+					RelayAddressGeneratorPortRange: pionturn.RelayAddressGeneratorPortRange{
+						RelayAddress: net.ParseIP(s.config.PublicIP),
+						Address:      "0.0.0.0",
+						MinPort:      s.config.RelayPortMin,
+						MaxPort:      s.config.RelayPortMax,
+					},
+					bandwidthLimit: s.config.BandwidthLimit,
+					metrics:        s.metrics,
+				},
+			},
+		},
+	})
+	if err != nil {
+		_ = udpListener.Close()
+		return err
+	}
+
+	s.logger.Info().Msg("started embedded turn server on " + s.config.ListenAddr)
+
+	<-ctx.Done()
+
+	return server.Close()
+}
+
+func (s *Server) authHandler(logger logging.LeveledLogger) pionturn.AuthHandler {
+	restAuth := pionturn.LongTermTURNRESTAuthHandler(s.config.Secret, logger)
+
+	return func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+		key, ok := restAuth(username, realm, srcAddr)
+		if !ok {
+			return nil, false
+		}
+
+		if s.config.Authorize != nil && !s.config.Authorize(userFromUsername(username)) {
+			s.logger.Info().Msg("rejected turn credential of unknown user " + username)
+			return nil, false
+		}
+
+		return key, true
+	}
+}
+
+func (s *Server) quotaHandler(username, _ string, _ net.Addr) bool {
+	if s.config.MaxAllocations == 0 {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.allocations[userFromUsername(username)] < s.config.MaxAllocations
+}
+
+func (s *Server) onAllocationCreated(_, _ net.Addr, _, username, _ string, relayAddr net.Addr, _ int) {
+	userID := userFromUsername(username)
+
+	s.mu.Lock()
+	s.allocations[userID]++
+	s.mu.Unlock()
+
+	s.metrics.assignUser(relayAddr.String(), userID)
+}
+
+func (s *Server) onAllocationDeleted(_, _ net.Addr, _, username, _ string) {
+	userID := userFromUsername(username)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.allocations[userID] <= 1 {
+		delete(s.allocations, userID)
+		return
+	}
+
+	s.allocations[userID]--
+}
+
+// userFromUsername strips the expiry prefix of a TURN REST username.
+func userFromUsername(username string) string {
+	if _, userID, ok := strings.Cut(username, ":"); ok {
+		return userID
+	}
+
+	return username
+}
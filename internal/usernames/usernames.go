@@ -0,0 +1,272 @@
+// Package usernames holds the names users chat as to a policy. Names are
+// shown to peers, so they are normalized, limited to letters, digits and a
+// few separators, and kept from impersonating staff or bots through
+// lookalike characters.
+package usernames
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	ErrCharacters = errors.New("username may only hold letters, digits, spaces and _ - . and must start with a letter or digit")
+	ErrScripts    = errors.New("username mixes letters of different scripts")
+	ErrReserved   = errors.New("username is reserved")
+	ErrProfane    = errors.New("username is not allowed")
+)
+
+// DefaultReserved are names that could pass for the service, its staff or
+// the system messages of the chat page.
+var DefaultReserved = []string{
+	"admin", "administrator", "moderator", "mod", "staff", "support", "official", "root", "system",
+	"server", "rvc", "bot", "you", "null", "undefined",
+}
+
+// DefaultProfanity are words no name may hold even when the service loads no
+// wordlists, the wordlists add to them.
+var DefaultProfanity = []string{
+	"fuck", "fucker", "motherfucker", "shit", "cunt", "bitch", "asshole", "pussy", "whore", "slut",
+	"wanker", "twat", "faggot", "nigger", "nigga", "retard", "rapist",
+}
+
+// Policy is what names users may chat as. Reserved names and Profanity are
+// matched on skeletons, so lookalikes and digits standing in for letters
+// are caught too.
+type Policy struct {
+	MinLength int
+	MaxLength int
+	// Reserved names also cover them followed by digits, Bots are reserved
+	// for bots
+	Reserved []string
+	Bots     []string
+	// Profanity is rejected as a word of a name, or as the whole name once
+	// separators are dropped, so names merely containing it pass
+	Profanity []string
+}
+
+func DefaultPolicy() *Policy {
+	return &Policy{MinLength: 2, MaxLength: 32, Reserved: DefaultReserved, Profanity: DefaultProfanity}
+}
+
+var defaultPolicy = DefaultPolicy()
+
+// Normalize returns the name as it is shown to peers, or why the policy
+// rejects it. A nil policy is the default one.
+func (p *Policy) Normalize(name string, bot bool) (string, error) {
+	if p == nil {
+		p = defaultPolicy
+	}
+
+	if !utf8.ValidString(name) {
+		return "", ErrCharacters
+	}
+
+	// compatibility forms, such as full width letters, become the plain
+	// ones and runs of spaces become one
+	name = strings.Join(strings.Fields(norm.NFKC.String(name)), " ")
+
+	if length := utf8.RuneCountInString(name); length < p.MinLength || length > p.MaxLength {
+		return "", fmt.Errorf("username must be %d to %d characters", p.MinLength, p.MaxLength)
+	}
+
+	for i, r := range name {
+		first := i == 0
+
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+		case !first && (unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Mc, r)):
+		case !first && (r == ' ' || r == '_' || r == '-' || r == '.'):
+		default:
+			return "", ErrCharacters
+		}
+	}
+
+	if !singleScript(name) {
+		return "", ErrScripts
+	}
+
+	skeleton := Skeleton(name)
+	bare := Skeleton(strings.TrimRightFunc(name, func(r rune) bool {
+		return unicode.IsDigit(r) || r == ' ' || r == '_' || r == '-' || r == '.'
+	}))
+
+	reserved := p.Reserved
+	if !bot {
+		reserved = append(slices.Clip(reserved), p.Bots...)
+	}
+
+	for _, name := range reserved {
+		if name = Skeleton(name); name == skeleton || name == bare {
+			return "", ErrReserved
+		}
+	}
+
+	nameWords := words(name)
+
+	for _, word := range p.Profanity {
+		if word = Skeleton(word); word != "" && (word == skeleton || slices.Contains(nameWords, word)) {
+			return "", ErrProfane
+		}
+	}
+
+	return name, nil
+}
+
+// Sanitize turns a name from elsewhere, such as an identity provider, into
+// one the policy accepts, fallback when nothing of it is left.
+func (p *Policy) Sanitize(name string, fallback string) string {
+	if p == nil {
+		p = defaultPolicy
+	}
+
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.M, r) || r == '_' || r == '-' || r == '.' {
+			return r
+		}
+
+		return ' '
+	}, norm.NFKC.String(name))
+
+	name = strings.TrimLeftFunc(strings.Join(strings.Fields(name), " "), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	if length := utf8.RuneCountInString(name); length > p.MaxLength {
+		name = strings.TrimSpace(string([]rune(name)[:p.MaxLength]))
+	}
+
+	normalized, err := p.Normalize(name, false)
+	if err != nil {
+		return fallback
+	}
+
+	return normalized
+}
+
+// words returns the skeletons of the words of a name, split at separators
+// and where a capital letter follows a lowercase one, e.g. Big and Word in
+// BigWord.
+func words(name string) []string {
+	var words []string
+	var word []rune
+
+	flush := func() {
+		if len(word) > 0 {
+			words = append(words, Skeleton(string(word)))
+			word = word[:0]
+		}
+	}
+
+	var previous rune
+
+	for _, r := range name {
+		switch {
+		case r == ' ' || r == '_' || r == '-' || r == '.':
+			flush()
+		case unicode.IsUpper(r) && unicode.IsLower(previous):
+			flush()
+			word = append(word, r)
+		default:
+			word = append(word, r)
+		}
+
+		previous = r
+	}
+
+	flush()
+
+	return words
+}
+
+// combined are scripts written together, after the highly restrictive level
+// of Unicode's UTS #39.
+var combined = [][]string{
+	{"Latin", "Han", "Hiragana", "Katakana"},
+	{"Latin", "Han", "Bopomofo"},
+	{"Latin", "Han", "Hangul"},
+}
+
+// singleScript reports whether the letters of a name belong to one script,
+// or to scripts written together, which keeps lookalikes of another script
+// out of a name, e.g. a Cyrillic а in admin.
+func singleScript(name string) bool {
+	used := make(map[string]bool)
+
+	for _, r := range name {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+
+		for script, table := range unicode.Scripts {
+			if script != "Common" && script != "Inherited" && unicode.Is(table, r) {
+				used[script] = true
+				break
+			}
+		}
+	}
+
+	if len(used) <= 1 {
+		return true
+	}
+
+	for _, scripts := range combined {
+		all := true
+		for script := range used {
+			all = all && slices.Contains(scripts, script)
+		}
+
+		if all {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lookalikes map characters to the Latin ones they pass for, i, l and 1 are
+// all i and o and 0 are o.
+var lookalikes = map[rune]string{
+	'а': "a", 'в': "b", 'е': "e", 'ё': "e", 'к': "k", 'м': "m", 'н': "h", 'о': "o", 'р': "p", 'с': "c",
+	'т': "t", 'у': "y", 'х': "x", 'ѕ': "s", 'і': "i", 'ї': "i", 'ј': "j", 'ԁ': "d", 'ԛ': "q", 'ԝ': "w",
+	'ӏ': "i", 'ɡ': "g", 'ı': "i", 'α': "a", 'β': "b", 'ε': "e", 'η': "n", 'ι': "i", 'κ': "k", 'ν': "v",
+	'ο': "o", 'ρ': "p", 'τ': "t", 'υ': "u", 'χ': "x", 'γ': "y", 'ω': "w", 'l': "i", '0': "o", '1': "i",
+	'3': "e", '4': "a", '5': "s", '7': "t", '8': "b", '|': "i",
+}
+
+// Skeleton reduces a name to what it looks like, lowercased, without
+// accents or separators and with lookalikes replaced, so names that pass
+// for each other share a skeleton.
+func Skeleton(name string) string {
+	stripMarks := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+
+	name, _, err := transform.String(stripMarks, strings.ToLower(norm.NFKC.String(name)))
+	if err != nil {
+		return ""
+	}
+
+	var skeleton strings.Builder
+
+	for _, r := range name {
+		if r == ' ' || r == '_' || r == '-' || r == '.' {
+			continue
+		}
+
+		if lookalike, ok := lookalikes[r]; ok {
+			skeleton.WriteString(lookalike)
+			continue
+		}
+
+		skeleton.WriteRune(r)
+	}
+
+	// rn passes for m and vv for w
+	return strings.NewReplacer("rn", "m", "vv", "w").Replace(skeleton.String())
+}
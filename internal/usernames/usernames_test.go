@@ -0,0 +1,65 @@
+package usernames
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	for name, want := range map[string]string{
+		"  alice   smith ": "alice smith",
+		"ａｌｉｃｅ":            "alice",
+		"Zoë":              "Zoë",
+		"李小龙":              "李小龙",
+	} {
+		got, err := DefaultPolicy().Normalize(name, false)
+		if err != nil || got != want {
+			t.Errorf("Normalize(%q) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+
+	for name, want := range map[string]error{
+		"_alice":  ErrCharacters,
+		"al<i>ce": ErrCharacters,
+		"аdmin":   ErrScripts,
+		"Admin42": ErrReserved,
+		"ad.m1n":  ErrReserved,
+	} {
+		if _, err := DefaultPolicy().Normalize(name, false); !errors.Is(err, want) {
+			t.Errorf("Normalize(%q) = %v, want %v", name, err, want)
+		}
+	}
+}
+
+func TestNormalizeMatchesProfanityByWord(t *testing.T) {
+	policy := DefaultPolicy()
+	policy.Profanity = []string{"ass", "cunt"}
+
+	// the words only appear inside other words
+	for _, name := range []string{"Cassandra", "Scunthorpe", "classic bass", "Grassy_Knoll", "passes4you"} {
+		if _, err := policy.Normalize(name, false); err != nil {
+			t.Errorf("Normalize(%q) = %v, want it allowed", name, err)
+		}
+	}
+
+	for _, name := range []string{"ass", "big ass", "Big_A55", "BigAss", "c.u.n.t", "C U N T", "kick-ass"} {
+		if _, err := policy.Normalize(name, false); !errors.Is(err, ErrProfane) {
+			t.Errorf("Normalize(%q) = %v, want ErrProfane", name, err)
+		}
+	}
+}
+
+func TestDefaultPolicyRejectsProfanity(t *testing.T) {
+	// without wordlists
+	for _, name := range []string{"fuck", "Shit Head", "b1tch_99", "MotherFucker"} {
+		if _, err := DefaultPolicy().Normalize(name, false); !errors.Is(err, ErrProfane) {
+			t.Errorf("Normalize(%q) = %v, want ErrProfane", name, err)
+		}
+	}
+
+	for _, name := range []string{"Dick Grayson", "Sussex", "Matsushita", "Twatt"} {
+		if _, err := DefaultPolicy().Normalize(name, false); err != nil {
+			t.Errorf("Normalize(%q) = %v, want it allowed", name, err)
+		}
+	}
+}
@@ -0,0 +1,435 @@
+// Package webhooks delivers lifecycle events to configured HTTP endpoints.
+// Deliveries go through a Redis queue so any replica may send them, failed
+// ones are retried with backoff and end in a dead-letter list. A delivery
+// being sent is kept in the sending dispatcher's processing list until it
+// is acknowledged, those of a dispatcher that went away are requeued.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EventUserRegistered = "user.registered"
+	EventMatchCreated   = "match.created"
+	EventSessionEnded   = "session.ended"
+	EventReportCreated  = "report.created"
+)
+
+const (
+	queueKey       = "webhook_queue"
+	retryKey       = "webhook_retry"
+	deadLetterKey  = "webhook_dead_letter"
+	dispatchersKey = "webhook_dispatchers"
+
+	maxBackoff = 10 * time.Minute
+
+	// dispatchers renew their lease every leaseInterval, the deliveries of
+	// one whose lease lapsed for leaseTTL are requeued
+	leaseInterval = 10 * time.Second
+	leaseTTL      = 30 * time.Second
+)
+
+// Event is the JSON body posted to endpoints.
+type Event struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// delivery is an event on its way to a single endpoint.
+type delivery struct {
+	Endpoint  string `json:"endpoint"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error,omitempty"`
+	Event     Event  `json:"event"`
+}
+
+type Config struct {
+	Endpoints []string
+	// Secret signs every delivery, see Sign
+	Secret string
+	// MaxAttempts before a delivery is dead-lettered, 8 by default
+	MaxAttempts int
+	// Timeout of a single attempt, 10s by default
+	Timeout time.Duration
+	// Workers send deliveries concurrently, 4 by default
+	Workers int
+}
+
+type Dispatcher struct {
+	config      Config
+	redisClient *redis.Client
+	httpClient  *http.Client
+	logger      *zerolog.Logger
+
+	// id names the dispatcher's lease and processing list
+	id string
+	// wait is how long workers block on an empty queue, they notice the
+	// context is done in between
+	wait time.Duration
+}
+
+func NewDispatcher(redisClient *redis.Client, config Config, logger *zerolog.Logger) *Dispatcher {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 8
+	}
+
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	if config.Workers <= 0 {
+		config.Workers = 4
+	}
+
+	return &Dispatcher{
+		config:      config,
+		redisClient: redisClient,
+		httpClient:  &http.Client{Timeout: config.Timeout},
+		logger:      logger,
+		id:          strings.ReplaceAll(uuid.New().String(), "-", ""),
+		wait:        5 * time.Second,
+	}
+}
+
+func processingKey(id string) string {
+	return "webhook_processing:" + id
+}
+
+func leaseKey(id string) string {
+	return "webhook_dispatcher:" + id
+}
+
+// Publish queues the event for every endpoint. A nil dispatcher or one
+// without endpoints drops it.
+func (d *Dispatcher) Publish(ctx context.Context, eventType string, data interface{}) error {
+	if d == nil || len(d.config.Endpoints) == 0 {
+		return nil
+	}
+
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	event := Event{
+		ID:        strings.ReplaceAll(uuid.New().String(), "-", ""),
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		Data:      dataJSON,
+	}
+
+	for _, endpoint := range d.config.Endpoints {
+		deliveryJSON, err := json.Marshal(&delivery{Endpoint: endpoint, Event: event})
+		if err != nil {
+			return err
+		}
+
+		if err := d.redisClient.LPush(ctx, queueKey, deliveryJSON).Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Run sends queued deliveries on a pool of workers and requeues retries as
+// they come due, until the context is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	if len(d.config.Endpoints) == 0 {
+		return
+	}
+
+	if err := d.renewLease(ctx); err != nil {
+		d.logger.Err(err).Msg("unable to take webhook dispatcher lease")
+	}
+
+	d.recoverDeliveries(ctx)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		d.requeueRetries(ctx)
+	}()
+
+	for i := 0; i < d.config.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			d.work(ctx)
+		}()
+	}
+
+	wg.Wait()
+
+	d.release()
+}
+
+// work moves deliveries from the queue to the processing list and sends
+// them, until the context is done.
+func (d *Dispatcher) work(ctx context.Context) {
+	processing := processingKey(d.id)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			deliveryJSON, err := d.redisClient.BLMove(ctx, queueKey, processing, "RIGHT", "LEFT", d.wait).Result()
+			if err != nil {
+				if !errors.Is(err, redis.Nil) && ctx.Err() == nil {
+					d.logger.Err(err).Msg("unable to dequeue from webhook queue")
+					time.Sleep(time.Second)
+				}
+				continue
+			}
+
+			d.deliver(ctx, deliveryJSON)
+		}
+	}
+}
+
+// deliver sends a delivery from the processing list, and acknowledges it
+// once it is sent, scheduled for a retry or dead-lettered.
+func (d *Dispatcher) deliver(ctx context.Context, deliveryJSON string) {
+	var del delivery
+
+	if err := json.Unmarshal([]byte(deliveryJSON), &del); err != nil {
+		d.logger.Err(err).Msg("unable to unmarshal webhook delivery")
+		d.ack(context.Background(), deliveryJSON, nil)
+		return
+	}
+
+	err := d.send(ctx, &del)
+	if err == nil {
+		d.ack(context.Background(), deliveryJSON, nil)
+		return
+	}
+
+	del.Attempts++
+	del.LastError = err.Error()
+
+	retryJSON, jsonErr := json.Marshal(&del)
+	if jsonErr != nil {
+		d.logger.Err(jsonErr).Msg("unable to marshal webhook delivery")
+		return
+	}
+
+	// a fresh context, the delivery must not be lost on shutdown
+	ctx = context.Background()
+
+	if del.Attempts >= d.config.MaxAttempts {
+		d.logger.Err(err).Msg("dead-lettering webhook " + del.Event.ID + " to " + del.Endpoint)
+
+		d.ack(ctx, deliveryJSON, func(pipe redis.Pipeliner) {
+			pipe.LPush(ctx, deadLetterKey, retryJSON)
+		})
+		return
+	}
+
+	due := time.Now().Add(backoff(del.Attempts))
+
+	d.ack(ctx, deliveryJSON, func(pipe redis.Pipeliner) {
+		pipe.ZAdd(ctx, retryKey, redis.Z{
+			Score:  float64(due.Unix()),
+			Member: retryJSON,
+		})
+	})
+}
+
+// ack removes a delivery from the processing list together with what then
+// becomes of it, a delivery left there is sent again.
+func (d *Dispatcher) ack(ctx context.Context, deliveryJSON string, then func(redis.Pipeliner)) {
+	if _, err := d.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if then != nil {
+			then(pipe)
+		}
+		pipe.LRem(ctx, processingKey(d.id), 1, deliveryJSON)
+		return nil
+	}); err != nil {
+		d.logger.Err(err).Msg("unable to acknowledge webhook delivery")
+	}
+}
+
+func (d *Dispatcher) send(ctx context.Context, del *delivery) error {
+	body, err := json.Marshal(&del.Event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, del.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-ID", del.Event.ID)
+	req.Header.Set("X-Webhook-Event", del.Event.Type)
+
+	if d.config.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(d.config.Secret, time.Now(), body))
+	}
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint responded %s", resp.Status)
+	}
+
+	return nil
+}
+
+// requeueRetries moves retries that came due back to the queue, the ZRem
+// makes sure only one replica moves each of them. It renews the lease
+// and recovers the deliveries of dispatchers that went away meanwhile.
+func (d *Dispatcher) requeueRetries(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	renewedAt := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if time.Since(renewedAt) >= leaseInterval {
+				if err := d.renewLease(ctx); err != nil && ctx.Err() == nil {
+					d.logger.Err(err).Msg("unable to renew webhook dispatcher lease")
+				}
+
+				d.recoverDeliveries(ctx)
+				renewedAt = time.Now()
+			}
+
+			due, err := d.redisClient.ZRangeByScore(ctx, retryKey, &redis.ZRangeBy{
+				Min:   "-inf",
+				Max:   strconv.FormatInt(time.Now().Unix(), 10),
+				Count: 100,
+			}).Result()
+			if err != nil {
+				if ctx.Err() == nil {
+					d.logger.Err(err).Msg("unable to list due webhook retries")
+				}
+				continue
+			}
+
+			for _, deliveryJSON := range due {
+				removed, err := d.redisClient.ZRem(ctx, retryKey, deliveryJSON).Result()
+				if err != nil || removed == 0 {
+					continue
+				}
+
+				if err := d.redisClient.LPush(ctx, queueKey, deliveryJSON).Err(); err != nil {
+					d.logger.Err(err).Msg("unable to requeue webhook retry")
+				}
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) renewLease(ctx context.Context) error {
+	_, err := d.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, dispatchersKey, d.id)
+		pipe.Set(ctx, leaseKey(d.id), 1, leaseTTL)
+		return nil
+	})
+
+	return err
+}
+
+// recoverDeliveries requeues the deliveries dispatchers were sending when
+// they went away, they are sent again. LMOVE moves each of them once when
+// replicas recover at the same time.
+func (d *Dispatcher) recoverDeliveries(ctx context.Context) {
+	ids, err := d.redisClient.SMembers(ctx, dispatchersKey).Result()
+	if err != nil {
+		if ctx.Err() == nil {
+			d.logger.Err(err).Msg("unable to list webhook dispatchers")
+		}
+		return
+	}
+
+	for _, id := range ids {
+		if id == d.id || d.redisClient.Exists(ctx, leaseKey(id)).Val() == 1 {
+			continue
+		}
+
+		if err := d.requeueProcessing(ctx, id); err != nil {
+			d.logger.Err(err).Msg("unable to recover webhook deliveries of dispatcher " + id)
+			continue
+		}
+
+		if err := d.redisClient.SRem(ctx, dispatchersKey, id).Err(); err != nil {
+			d.logger.Err(err).Msg("unable to remove webhook dispatcher " + id)
+		}
+	}
+}
+
+// requeueProcessing moves the deliveries of a dispatcher's processing list
+// back to the front of the queue, oldest first.
+func (d *Dispatcher) requeueProcessing(ctx context.Context, id string) error {
+	for {
+		err := d.redisClient.LMove(ctx, processingKey(id), queueKey, "LEFT", "RIGHT").Err()
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// release gives up the lease once the workers stopped, deliveries still in
+// the processing list go back to the queue.
+func (d *Dispatcher) release() {
+	ctx := context.Background()
+
+	if err := d.requeueProcessing(ctx, d.id); err != nil {
+		d.logger.Err(err).Msg("unable to requeue webhook deliveries")
+		return
+	}
+
+	if _, err := d.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, leaseKey(d.id))
+		pipe.SRem(ctx, dispatchersKey, d.id)
+		return nil
+	}); err != nil {
+		d.logger.Err(err).Msg("unable to release webhook dispatcher lease")
+	}
+}
+
+// backoff doubles from 2s with every attempt, up to maxBackoff.
+func backoff(attempts int) time.Duration {
+	wait := 2 * time.Second
+	for i := 1; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+
+	return min(wait, maxBackoff)
+}
@@ -0,0 +1,326 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+// receiver is an endpoint recording the deliveries it receives, fail
+// decides the response to each attempt.
+type receiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	received []*http.Request
+	bodies   [][]byte
+	times    []time.Time
+	fail     func(attempt int) bool
+}
+
+func newReceiver(t *testing.T, fail func(attempt int) bool) *receiver {
+	r := &receiver{fail: fail}
+
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+
+		r.mu.Lock()
+		r.received = append(r.received, req)
+		r.bodies = append(r.bodies, body)
+		r.times = append(r.times, time.Now())
+		attempt := len(r.received)
+		r.mu.Unlock()
+
+		if r.fail != nil && r.fail(attempt) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(r.Close)
+
+	return r
+}
+
+func (r *receiver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.received)
+}
+
+// waitFor polls until cond holds.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for " + what)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// runDispatcher runs a dispatcher until the test ends.
+func runDispatcher(t *testing.T, redisClient *redis.Client, config Config) *Dispatcher {
+	logger := zerolog.Nop()
+	d := NewDispatcher(redisClient, config, &logger)
+	d.wait = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		d.Run(ctx)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return d
+}
+
+func newTestRedis(t *testing.T) *redis.Client {
+	return redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+}
+
+func TestSignature(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+	header := Sign("secret", time.Now(), body)
+
+	if err := Verify("secret", header, body, time.Minute); err != nil {
+		t.Errorf("Verify = %v", err)
+	}
+
+	for name, err := range map[string]error{
+		"tampered body": Verify("secret", header, []byte(`{"id":"2"}`), time.Minute),
+		"wrong secret":  Verify("other", header, body, time.Minute),
+		"replayed":      Verify("secret", Sign("secret", time.Now().Add(-time.Hour), body), body, time.Minute),
+		"malformed":     Verify("secret", "v1=abc", body, time.Minute),
+	} {
+		if !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("%s: err = %v, want ErrInvalidSignature", name, err)
+		}
+	}
+}
+
+func TestDispatcherSignsDeliveries(t *testing.T) {
+	endpoint := newReceiver(t, nil)
+	redisClient := newTestRedis(t)
+
+	d := runDispatcher(t, redisClient, Config{Endpoints: []string{endpoint.URL}, Secret: "secret"})
+
+	if err := d.Publish(context.Background(), EventMatchCreated, map[string]string{"match_id": "m1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 5*time.Second, "the delivery", func() bool { return endpoint.count() == 1 })
+
+	endpoint.mu.Lock()
+	req, body := endpoint.received[0], endpoint.bodies[0]
+	endpoint.mu.Unlock()
+
+	if err := Verify("secret", req.Header.Get(SignatureHeader), body, time.Minute); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+
+	var event Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatal(err)
+	}
+
+	if event.Type != EventMatchCreated || string(event.Data) != `{"match_id":"m1"}` ||
+		req.Header.Get("X-Webhook-ID") != event.ID || req.Header.Get("X-Webhook-Event") != EventMatchCreated {
+		t.Errorf("received %s %s with headers %v", event.Type, event.Data, req.Header)
+	}
+
+	// acknowledged deliveries leave the processing list
+	waitFor(t, time.Second, "the acknowledgement", func() bool {
+		return redisClient.LLen(context.Background(), processingKey(d.id)).Val() == 0
+	})
+}
+
+func TestBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  2 * time.Second,
+		2:  4 * time.Second,
+		3:  8 * time.Second,
+		20: maxBackoff,
+	} {
+		if got := backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestDispatcherRetriesWithBackoff(t *testing.T) {
+	endpoint := newReceiver(t, func(attempt int) bool { return attempt == 1 })
+	redisClient := newTestRedis(t)
+
+	d := runDispatcher(t, redisClient, Config{Endpoints: []string{endpoint.URL}})
+
+	if err := d.Publish(context.Background(), EventUserRegistered, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the retry is due 2s after the failure, retries are checked every second
+	waitFor(t, 5*time.Second, "the retry", func() bool { return endpoint.count() == 2 })
+
+	endpoint.mu.Lock()
+	wait := endpoint.times[1].Sub(endpoint.times[0])
+	ids := []string{endpoint.received[0].Header.Get("X-Webhook-ID"), endpoint.received[1].Header.Get("X-Webhook-ID")}
+	endpoint.mu.Unlock()
+
+	if wait < time.Second {
+		t.Errorf("retried after %s, want the backoff of %s", wait, backoff(1))
+	}
+
+	if ids[0] != ids[1] {
+		t.Errorf("retry carries id %s, want %s", ids[1], ids[0])
+	}
+
+	ctx := context.Background()
+	waitFor(t, time.Second, "the acknowledgement", func() bool {
+		return redisClient.LLen(ctx, processingKey(d.id)).Val() == 0
+	})
+
+	if n := redisClient.ZCard(ctx, retryKey).Val() + redisClient.LLen(ctx, deadLetterKey).Val(); n != 0 {
+		t.Errorf("%d deliveries left after the retry succeeded", n)
+	}
+}
+
+func TestDispatcherDeadLetters(t *testing.T) {
+	endpoint := newReceiver(t, func(int) bool { return true })
+	redisClient := newTestRedis(t)
+	ctx := context.Background()
+
+	d := runDispatcher(t, redisClient, Config{Endpoints: []string{endpoint.URL}, MaxAttempts: 1})
+
+	if err := d.Publish(ctx, EventReportCreated, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 5*time.Second, "the dead letter", func() bool { return redisClient.LLen(ctx, deadLetterKey).Val() == 1 })
+
+	var del delivery
+	if err := json.Unmarshal([]byte(redisClient.LIndex(ctx, deadLetterKey, 0).Val()), &del); err != nil {
+		t.Fatal(err)
+	}
+
+	if del.Attempts != 1 || del.LastError == "" || del.Endpoint != endpoint.URL {
+		t.Errorf("dead letter = %+v", del)
+	}
+
+	if redisClient.LLen(ctx, processingKey(d.id)).Val() != 0 || redisClient.ZCard(ctx, retryKey).Val() != 0 {
+		t.Error("the dead-lettered delivery was left behind")
+	}
+}
+
+func TestDispatcherRecoversDeliveries(t *testing.T) {
+	endpoint := newReceiver(t, nil)
+	redisClient := newTestRedis(t)
+	ctx := context.Background()
+
+	// a dispatcher went away while sending, its lease is gone
+	deliveryJSON, err := json.Marshal(&delivery{Endpoint: endpoint.URL, Event: Event{ID: "lost", Type: EventSessionEnded}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redisClient.SAdd(ctx, dispatchersKey, "gone")
+	redisClient.LPush(ctx, processingKey("gone"), deliveryJSON)
+
+	runDispatcher(t, redisClient, Config{Endpoints: []string{endpoint.URL}})
+
+	waitFor(t, 5*time.Second, "the recovered delivery", func() bool { return endpoint.count() == 1 })
+
+	endpoint.mu.Lock()
+	id := endpoint.received[0].Header.Get("X-Webhook-ID")
+	endpoint.mu.Unlock()
+
+	if id != "lost" {
+		t.Errorf("received %s, want the lost delivery", id)
+	}
+
+	if redisClient.SIsMember(ctx, dispatchersKey, "gone").Val() || redisClient.Exists(ctx, processingKey("gone")).Val() != 0 {
+		t.Error("the dispatcher that went away was left behind")
+	}
+}
+
+func TestDispatcherKeepsLiveDispatchersDeliveries(t *testing.T) {
+	redisClient := newTestRedis(t)
+	ctx := context.Background()
+
+	// another replica is sending this one right now
+	redisClient.SAdd(ctx, dispatchersKey, "alive")
+	redisClient.Set(ctx, leaseKey("alive"), 1, leaseTTL)
+	redisClient.LPush(ctx, processingKey("alive"), `{"endpoint":"http://example.invalid"}`)
+
+	logger := zerolog.Nop()
+	NewDispatcher(redisClient, Config{Endpoints: []string{"http://example.invalid"}}, &logger).recoverDeliveries(ctx)
+
+	if redisClient.LLen(ctx, processingKey("alive")).Val() != 1 || redisClient.LLen(ctx, queueKey).Val() != 0 {
+		t.Error("requeued the delivery of a live dispatcher")
+	}
+}
+
+func TestDispatcherSendsConcurrently(t *testing.T) {
+	const workers = 4
+
+	// every request waits until all workers are sending at once
+	var arrived sync.WaitGroup
+	arrived.Add(workers)
+
+	var count int
+	var mu sync.Mutex
+
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		count++
+		first := count <= workers
+		mu.Unlock()
+
+		if first {
+			arrived.Done()
+			arrived.Wait()
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer endpoint.Close()
+
+	redisClient := newTestRedis(t)
+
+	d := runDispatcher(t, redisClient, Config{Endpoints: []string{endpoint.URL}, Workers: workers, Timeout: 3 * time.Second})
+
+	for i := 0; i < workers; i++ {
+		if err := d.Publish(context.Background(), EventUserRegistered, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, 2*time.Second, "concurrent deliveries", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return count == workers && redisClient.ZCard(context.Background(), retryKey).Val() == 0 &&
+			redisClient.LLen(context.Background(), processingKey(d.id)).Val() == 0
+	})
+}
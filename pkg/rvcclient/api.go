@@ -0,0 +1,207 @@
+package rvcclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// Registration is returned by the service on registration.
+type Registration struct {
+	UserID     string      `json:"user_id"`
+	Token      string      `json:"token"`
+	WsURL      string      `json:"ws_url"`
+	ICEServers []ICEServer `json:"ice_servers"`
+	Mode       string      `json:"mode"`
+}
+
+// APIError is a problem details error returned by the API.
+type APIError struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// RetryAfter is how long to wait after a 429, the request is over a
+	// rate limit of the service
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *APIError) Error() string {
+	if e.Detail != "" {
+		return fmt.Sprintf("rvc: %d %s: %s", e.Status, e.Title, e.Detail)
+	}
+
+	return fmt.Sprintf("rvc: %d %s", e.Status, e.Title)
+}
+
+// Register registers a new user, an invite code pairs the user with the
+// invite's creator.
+func (c *Client) Register(ctx context.Context, invite string) (*Registration, error) {
+	var registration Registration
+
+	body := map[string]interface{}{
+		"username": c.config.Username,
+		"invite":   invite,
+		"mode":     c.config.Mode,
+		"reach":    c.config.Reach,
+		"any_mode": c.config.AnyMode,
+		"tags":     c.config.Tags,
+		"bot":      c.config.BotKey != "",
+	}
+
+	// bots are let in by their key
+	if c.config.BotKey == "" {
+		id, response, err := c.answerChallenge(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		body["challenge_id"] = id
+		body["challenge_response"] = response
+	}
+
+	if err := c.call(ctx, http.MethodPost, "/users", "", body, &registration); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.registration = &registration
+	c.mu.Unlock()
+
+	return &registration, nil
+}
+
+// answerChallenge gets the registration challenge and answers it, proofs
+// of work are solved here and CAPTCHAs by the SolveCaptcha callback.
+func (c *Client) answerChallenge(ctx context.Context) (string, string, error) {
+	var challenge *Challenge
+
+	if err := c.call(ctx, http.MethodGet, "/challenge", "", nil, &challenge); err != nil {
+		return "", "", err
+	}
+
+	// the service asks for none
+	if challenge == nil {
+		return "", "", nil
+	}
+
+	if challenge.Kind == ChallengeProofOfWork {
+		return challenge.ID, solveProofOfWork(challenge), nil
+	}
+
+	if challenge.Kind == ChallengeCaptcha && c.config.SolveCaptcha != nil {
+		response, err := c.config.SolveCaptcha(ctx, challenge)
+		return challenge.ID, response, err
+	}
+
+	return "", "", errors.New("rvc: unable to answer " + challenge.Kind + " challenge")
+}
+
+// RequestMatch asks for a new match of the given size, 2 for 1:1 and up to 8
+// for group rooms, and returns its ticket at once. The match arrives as an
+// exchange event, meanwhile queue_status events and, if no candidate is
+// found, a no_match event carry the ticket.
+func (c *Client) RequestMatch(ctx context.Context, size int) (string, error) {
+	var ticket struct {
+		Ticket string `json:"ticket"`
+	}
+
+	if err := c.call(ctx, http.MethodPost, "/match", c.token(), map[string]int{"size": size}, &ticket); err != nil {
+		return "", err
+	}
+
+	return ticket.Ticket, nil
+}
+
+// EndMatch leaves the current match.
+func (c *Client) EndMatch(ctx context.Context) error {
+	return c.call(ctx, http.MethodDelete, "/match", c.token(), nil, nil)
+}
+
+// Report reports a peer of the current match, the peer id may be empty in a
+// 1:1 match.
+func (c *Client) Report(ctx context.Context, peerID string, reason string) error {
+	return c.call(ctx, http.MethodPost, "/reports", c.token(), map[string]string{
+		"peer_id": peerID,
+		"reason":  reason,
+	}, nil)
+}
+
+// Feedback rates a peer of a past match from 1 to 5, the peer id may be
+// empty after a 1:1 match. Tags are among "great", "funny", "rude",
+// "inappropriate", "no video", "no audio" and "bad connection".
+func (c *Client) Feedback(ctx context.Context, matchID string, peerID string, rating int, tags ...string) error {
+	return c.call(ctx, http.MethodPost, "/feedback", c.token(), map[string]interface{}{
+		"match_id": matchID,
+		"peer_id":  peerID,
+		"rating":   rating,
+		"tags":     tags,
+	}, nil)
+}
+
+// Block blocks a peer of the current match and ends the match.
+func (c *Client) Block(ctx context.Context, peerID string) error {
+	return c.call(ctx, http.MethodPost, "/blocks", c.token(), map[string]string{
+		"peer_id": peerID,
+	}, nil)
+}
+
+func (c *Client) call(ctx context.Context, method string, path string, token string, body interface{}, result interface{}) error {
+	var reqBody bytes.Buffer
+
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.config.BaseURL+"/api/v1"+path, &reqBody)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	if c.config.BotKey != "" {
+		req.Header.Set("X-Bot-Key", c.config.BotKey)
+	}
+
+	resp, err := c.config.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		apiErr := &APIError{Status: resp.StatusCode, Title: http.StatusText(resp.StatusCode)}
+		_ = json.NewDecoder(resp.Body).Decode(apiErr)
+
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			apiErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+
+		return apiErr
+	}
+
+	if result == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,44 @@
+package rvcclient
+
+import (
+	"crypto/sha256"
+	"math/bits"
+	"strconv"
+)
+
+// Kinds of registration challenges.
+const (
+	ChallengeProofOfWork = "pow"
+	ChallengeCaptcha     = "captcha"
+)
+
+// Challenge is answered when registering, unless the service asks for none.
+type Challenge struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// Difficulty of a proof of work is the number of leading zero bits of
+	// sha256(ID + response)
+	Difficulty int `json:"difficulty,omitempty"`
+	// Provider and SiteKey of a CAPTCHA widget, e.g. hcaptcha
+	Provider string `json:"provider,omitempty"`
+	SiteKey  string `json:"site_key,omitempty"`
+}
+
+func solveProofOfWork(challenge *Challenge) string {
+	for nonce := 0; ; nonce++ {
+		response := strconv.Itoa(nonce)
+		sum := sha256.Sum256([]byte(challenge.ID + response))
+
+		zeros := 0
+		for _, b := range sum {
+			zeros += bits.LeadingZeros8(b)
+			if b != 0 {
+				break
+			}
+		}
+
+		if zeros >= challenge.Difficulty {
+			return response
+		}
+	}
+}
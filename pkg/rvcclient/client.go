@@ -0,0 +1,324 @@
+// Package rvcclient is a client for the random video chat service, for bots
+// and native clients.
+//
+// A client registers a user, connects its websocket and receives the events
+// of its matches either on a channel or through a callback:
+//
+//	client := rvcclient.New(rvcclient.Config{BaseURL: "http://localhost:8080", Username: "guest"})
+//	if err := client.Connect(ctx); err != nil {
+//		...
+//	}
+//	defer client.Close()
+//
+//	for event := range client.Events() {
+//		...
+//	}
+package rvcclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var ErrNotConnected = errors.New("rvc: not connected")
+
+// Chat modes, users are matched with compatible modes only unless the service
+// allows cross-mode matching.
+const (
+	ModeVideo = "video"
+	ModeAudio = "audio"
+	ModeText  = "text"
+)
+
+// Reaches, how far away peers may be. Nearby peers are preferred by default.
+const (
+	ReachNearby   = "nearby"
+	ReachCountry  = "country"
+	ReachAnywhere = "anywhere"
+)
+
+type Config struct {
+	// BaseURL of the user service, e.g. https://chat.example.com
+	BaseURL  string
+	Username string
+	// Mode is one of the Mode constants, video by default
+	Mode string
+	// Reach is one of the Reach constants, nearby by default
+	Reach string
+	// AnyMode accepts peers of any mode once both waited long enough, when
+	// the service allows it
+	AnyMode bool
+	// Tags are interests to be matched on first, such as music or films
+	Tags []string
+	// BotKey registers the client as a bot with the service's BOT_API_KEY.
+	// Bots chat in text and are matched with users who wait too long.
+	BotKey string
+	// SolveCaptcha answers a CAPTCHA challenge of the service with the
+	// provider's token, proofs of work are solved by the client.
+	SolveCaptcha func(context.Context, *Challenge) (string, error)
+
+	HTTPClient *http.Client
+	Dialer     *websocket.Dialer
+
+	// Handler receives every event when set, Events is not used then. It is
+	// called from the client's read loop and should not block.
+	Handler func(Event)
+
+	// Reconnect registers and connects again when the websocket drops, the
+	// service forgets users once their websocket closes.
+	Reconnect bool
+	// MaxBackoff caps the wait between reconnection attempts, 30s by default.
+	MaxBackoff time.Duration
+}
+
+type Client struct {
+	config Config
+	events chan Event
+
+	mu           sync.Mutex
+	writeMu      sync.Mutex
+	registration *Registration
+	conn         *websocket.Conn
+	closed       bool
+	done         chan struct{}
+}
+
+func New(config Config) *Client {
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	if config.Dialer == nil {
+		config.Dialer = websocket.DefaultDialer
+	}
+
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = 30 * time.Second
+	}
+
+	return &Client{
+		config: config,
+		events: make(chan Event, 64),
+		done:   make(chan struct{}),
+	}
+}
+
+// Events delivers received events when no Handler is configured, it is closed
+// once the client is closed or gives up reconnecting.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+func (c *Client) token() string {
+	if registration := c.Registration(); registration != nil {
+		return registration.Token
+	}
+
+	return ""
+}
+
+// Registration returns the current registration, nil before Connect.
+func (c *Client) Registration() *Registration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.registration
+}
+
+// Connect registers the user unless Register was called already, and opens
+// the websocket.
+func (c *Client) Connect(ctx context.Context) error {
+	if c.Registration() == nil {
+		if _, err := c.Register(ctx, ""); err != nil {
+			return err
+		}
+	}
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	go c.readLoop(conn)
+
+	return nil
+}
+
+func (c *Client) dial(ctx context.Context) (*websocket.Conn, error) {
+	conn, _, err := c.config.Dialer.DialContext(ctx, c.Registration().WsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		_ = conn.Close()
+		return nil, ErrNotConnected
+	}
+
+	c.conn = conn
+
+	return conn, nil
+}
+
+func (c *Client) readLoop(conn *websocket.Conn) {
+	for {
+		_, payload, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		var event Event
+		if err := json.Unmarshal(payload, &event); err != nil {
+			continue
+		}
+
+		c.emit(event)
+	}
+
+	if c.config.Reconnect && c.reconnect() {
+		return
+	}
+
+	_ = c.Close()
+
+	// the read loop is the only sender
+	if c.config.Handler == nil {
+		close(c.events)
+	}
+}
+
+// reconnect registers again with backoff until it succeeds or the client is
+// closed.
+func (c *Client) reconnect() bool {
+	backoff := time.Second
+
+	for {
+		select {
+		case <-c.done:
+			return false
+		case <-time.After(backoff):
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		registration, err := c.Register(ctx, "")
+		if err == nil {
+			var conn *websocket.Conn
+
+			conn, err = c.dial(ctx)
+			if err == nil {
+				cancel()
+
+				data, _ := json.Marshal(registration)
+				c.emit(Event{Event: EventReconnected, Data: data})
+
+				go c.readLoop(conn)
+
+				return true
+			}
+		}
+		cancel()
+
+		if errors.Is(err, ErrNotConnected) {
+			return false
+		}
+
+		backoff *= 2
+		if backoff > c.config.MaxBackoff {
+			backoff = c.config.MaxBackoff
+		}
+	}
+}
+
+func (c *Client) emit(event Event) {
+	if c.config.Handler != nil {
+		c.config.Handler(event)
+		return
+	}
+
+	select {
+	case c.events <- event:
+	case <-c.done:
+	}
+}
+
+// Send sends an event to the peer with the given peer id, or to everyone in
+// the match when to is empty.
+func (c *Client) Send(event string, to string, data interface{}) error {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	msg, err := json.Marshal(&Event{Event: event, To: to, Data: dataJSON})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+// SendMessage sends a chat message to everyone in the match.
+func (c *Client) SendMessage(text string) error {
+	return c.Send(EventMessage, "", text)
+}
+
+func (c *Client) SendOffer(to string, offer SessionDescription) error {
+	return c.Send(EventOffer, to, offer)
+}
+
+func (c *Client) SendAnswer(to string, answer SessionDescription) error {
+	return c.Send(EventAnswer, to, answer)
+}
+
+func (c *Client) SendCandidate(to string, candidate ICECandidate) error {
+	return c.Send(EventCandidate, to, candidate)
+}
+
+// Match tells the peers the user is leaving and requests a new match, like
+// the Match button of the web page. It returns the request's ticket.
+func (c *Client) Match(ctx context.Context, size int) (string, error) {
+	if err := c.Send(EventRematch, "", nil); err != nil && !errors.Is(err, ErrNotConnected) {
+		return "", err
+	}
+
+	return c.RequestMatch(ctx, size)
+}
+
+// Close closes the websocket, the service then removes the user.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	c.closed = true
+	close(c.done)
+
+	if c.conn == nil {
+		return nil
+	}
+
+	return c.conn.Close()
+}
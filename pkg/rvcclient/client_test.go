@@ -0,0 +1,420 @@
+package rvcclient_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"rvc/pkg/rvcclient"
+)
+
+// fakeService speaks the API of the user service: it asks for a proof of
+// work, matches users two by two and relays their events.
+type fakeService struct {
+	*httptest.Server
+	difficulty int
+
+	mu         sync.Mutex
+	issued     int
+	challenges map[string]bool
+	users      map[string]*fakeUser
+	rematches  []string
+	waiting    *fakeUser
+}
+
+type fakeUser struct {
+	id       string
+	token    string
+	username string
+	peerID   string
+
+	writeMu sync.Mutex
+	conn    *websocket.Conn
+	partner *fakeUser
+}
+
+func (u *fakeUser) send(event rvcclient.Event) {
+	u.writeMu.Lock()
+	defer u.writeMu.Unlock()
+
+	_ = u.conn.WriteJSON(event)
+}
+
+func newFakeService(t *testing.T, difficulty int) *fakeService {
+	s := &fakeService{
+		difficulty: difficulty,
+		challenges: make(map[string]bool),
+		users:      make(map[string]*fakeUser),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/challenge", s.challenge)
+	mux.HandleFunc("POST /api/v1/users", s.register)
+	mux.HandleFunc("POST /api/v1/match", s.match)
+	mux.HandleFunc("GET /connection/{userID}", s.connect)
+
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func problem(w http.ResponseWriter, status int, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":   "about:blank",
+		"title":  http.StatusText(status),
+		"status": status,
+		"detail": detail,
+	})
+}
+
+func (s *fakeService) challenge(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	s.issued++
+	id := fmt.Sprintf("challenge-%d", s.issued)
+	s.challenges[id] = true
+	s.mu.Unlock()
+
+	_ = json.NewEncoder(w).Encode(&rvcclient.Challenge{ID: id, Kind: rvcclient.ChallengeProofOfWork, Difficulty: s.difficulty})
+}
+
+func (s *fakeService) register(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Username          string `json:"username"`
+		ChallengeID       string `json:"challenge_id"`
+		ChallengeResponse string `json:"challenge_response"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		problem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.challenges[body.ChallengeID] {
+		problem(w, http.StatusBadRequest, "challenge required")
+		return
+	}
+	delete(s.challenges, body.ChallengeID)
+
+	sum := sha256.Sum256([]byte(body.ChallengeID + body.ChallengeResponse))
+	zeros := 0
+	for _, b := range sum {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+
+	if zeros < s.difficulty {
+		problem(w, http.StatusForbidden, "challenge failed")
+		return
+	}
+
+	n := len(s.users)
+	user := &fakeUser{
+		id:       fmt.Sprintf("user-%d", n),
+		token:    fmt.Sprintf("token-%d", n),
+		username: body.Username,
+		peerID:   fmt.Sprintf("peer-%d", n),
+	}
+	s.users[user.token] = user
+
+	_ = json.NewEncoder(w).Encode(&rvcclient.Registration{
+		UserID: user.id,
+		Token:  user.token,
+		WsURL:  "ws" + strings.TrimPrefix(s.URL, "http") + "/connection/" + user.id,
+	})
+}
+
+func (s *fakeService) user(r *http.Request) *fakeUser {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.users[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+}
+
+func (s *fakeService) match(w http.ResponseWriter, r *http.Request) {
+	user := s.user(r)
+	if user == nil {
+		problem(w, http.StatusUnauthorized, "missing or invalid token")
+		return
+	}
+
+	s.mu.Lock()
+	waiting := s.waiting
+	paired := waiting != nil && waiting != user
+	if paired {
+		s.waiting = nil
+		user.partner, waiting.partner = waiting, user
+	} else {
+		s.waiting = user
+	}
+	s.mu.Unlock()
+
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]string{"ticket": "ticket-" + user.id})
+
+	if paired {
+		for _, u := range []*fakeUser{user, waiting} {
+			data, _ := json.Marshal(&rvcclient.Exchange{
+				MatchID:   "match-1",
+				Username:  u.partner.username,
+				Initiator: u == user,
+				PeerID:    u.partner.peerID,
+			})
+			u.send(rvcclient.Event{Event: rvcclient.EventExchange, Data: data})
+		}
+	}
+}
+
+func (s *fakeService) connect(w http.ResponseWriter, r *http.Request) {
+	var user *fakeUser
+
+	s.mu.Lock()
+	for _, u := range s.users {
+		if u.id == r.PathValue("userID") {
+			user = u
+		}
+	}
+	s.mu.Unlock()
+
+	if user == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	user.conn = conn
+	s.mu.Unlock()
+
+	for {
+		var event rvcclient.Event
+		if err := conn.ReadJSON(&event); err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if event.Event == rvcclient.EventRematch {
+			s.rematches = append(s.rematches, user.id)
+		}
+		partner := user.partner
+		s.mu.Unlock()
+
+		if partner != nil {
+			event.From = user.peerID
+			partner.send(event)
+		}
+	}
+}
+
+// next waits for the next event of a type, skipping others.
+func next(t *testing.T, client *rvcclient.Client, eventType string) rvcclient.Event {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+
+	for {
+		select {
+		case event, ok := <-client.Events():
+			if !ok {
+				t.Fatalf("events closed while waiting for %s", eventType)
+			}
+
+			if event.Event == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", eventType)
+		}
+	}
+}
+
+func TestConnectMatchAndSend(t *testing.T) {
+	service := newFakeService(t, 8)
+	ctx := context.Background()
+
+	alice := rvcclient.New(rvcclient.Config{BaseURL: service.URL, Username: "alice"})
+	bob := rvcclient.New(rvcclient.Config{BaseURL: service.URL, Username: "bob"})
+
+	for _, client := range []*rvcclient.Client{alice, bob} {
+		if err := client.Connect(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+	}
+
+	if _, err := alice.Match(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	ticket, err := bob.Match(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ticket != "ticket-"+bob.Registration().UserID {
+		t.Errorf("ticket = %q", ticket)
+	}
+
+	exchange, err := next(t, alice, rvcclient.EventExchange).Exchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exchange.Username != "bob" || exchange.Initiator {
+		t.Errorf("alice's exchange = %+v, want bob answering", exchange)
+	}
+
+	exchange, err = next(t, bob, rvcclient.EventExchange).Exchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exchange.Username != "alice" || !exchange.Initiator {
+		t.Errorf("bob's exchange = %+v, want alice offered to", exchange)
+	}
+
+	if err := alice.SendMessage("hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	event := next(t, bob, rvcclient.EventMessage)
+
+	text, err := event.Message()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if text != "hello" || event.From != exchange.PeerID {
+		t.Errorf("bob received %q from %q, want hello from %q", text, event.From, exchange.PeerID)
+	}
+
+	// Match leaves the previous match over the websocket first, bob's events
+	// are relayed in order so his rematch was seen once his reply arrives
+	if err := bob.SendMessage("hi"); err != nil {
+		t.Fatal(err)
+	}
+
+	next(t, alice, rvcclient.EventMessage)
+
+	service.mu.Lock()
+	rematches := len(service.rematches)
+	service.mu.Unlock()
+
+	if rematches != 2 {
+		t.Errorf("%d rematch events, want 2", rematches)
+	}
+}
+
+func TestRegisterAnswersCaptcha(t *testing.T) {
+	var answered string
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/challenge", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(&rvcclient.Challenge{ID: "c1", Kind: rvcclient.ChallengeCaptcha,
+			Provider: "hcaptcha", SiteKey: "site"})
+	})
+	mux.HandleFunc("POST /api/v1/users", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		answered, _ = body["challenge_response"].(string)
+		_ = json.NewEncoder(w).Encode(&rvcclient.Registration{UserID: "user-0"})
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := rvcclient.New(rvcclient.Config{BaseURL: server.URL, Username: "alice"})
+	if _, err := client.Register(context.Background(), ""); err == nil {
+		t.Error("registered without a way to solve the CAPTCHA")
+	}
+
+	client = rvcclient.New(rvcclient.Config{
+		BaseURL:  server.URL,
+		Username: "alice",
+		SolveCaptcha: func(_ context.Context, challenge *rvcclient.Challenge) (string, error) {
+			return "token-for-" + challenge.SiteKey, nil
+		},
+	})
+
+	if _, err := client.Register(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if answered != "token-for-site" {
+		t.Errorf("challenge response = %q, want token-for-site", answered)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		problem(w, http.StatusTooManyRequests, "slow down")
+	}))
+	defer server.Close()
+
+	client := rvcclient.New(rvcclient.Config{BaseURL: server.URL, Username: "alice"})
+
+	_, err := client.RequestMatch(context.Background(), 2)
+
+	var apiErr *rvcclient.APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want an APIError", err)
+	}
+
+	if apiErr.Status != http.StatusTooManyRequests || apiErr.Detail != "slow down" || apiErr.RetryAfter != 7*time.Second {
+		t.Errorf("APIError = %+v", apiErr)
+	}
+
+	if err := client.SendMessage("hello"); !errors.Is(err, rvcclient.ErrNotConnected) {
+		t.Errorf("Send before Connect: err = %v, want ErrNotConnected", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	service := newFakeService(t, 4)
+
+	client := rvcclient.New(rvcclient.Config{BaseURL: service.URL, Username: "alice", Reconnect: true})
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	first := client.Registration()
+
+	service.mu.Lock()
+	conn := service.users[first.Token].conn
+	service.mu.Unlock()
+
+	// the service forgets users whose websocket drops
+	_ = conn.Close()
+
+	registration, err := next(t, client, rvcclient.EventReconnected).Registration()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if registration.UserID == first.UserID || client.Registration().UserID != registration.UserID {
+		t.Errorf("reconnected as %s after %s", registration.UserID, first.UserID)
+	}
+}
@@ -0,0 +1,206 @@
+package rvcclient
+
+import "encoding/json"
+
+// Events sent by the service, and by peers through it.
+const (
+	EventExchange  = "exchange"
+	EventOffer     = "offer"
+	EventAnswer    = "answer"
+	EventCandidate = "candidate"
+	EventMessage   = "message"
+	EventRematch   = "rematch"
+
+	// EventQueueStatus is sent every few seconds while the service looks
+	// for a candidate, EventNoMatch once it gives up.
+	EventQueueStatus = "queue_status"
+	EventNoMatch     = "no_match"
+
+	// EventRoomFull is sent when a topic room filled up before the user
+	// could be seated.
+	EventRoomFull = "room_full"
+
+	// EventThrottled is sent when the user goes over a rate limit, messages
+	// sent meanwhile are dropped.
+	EventThrottled = "throttled"
+
+	// EventReconnected is emitted by the client once it registered and
+	// connected again after the websocket dropped, Data holds the new
+	// Registration.
+	EventReconnected = "reconnected"
+)
+
+// Event is a message received on, or sent over, the websocket.
+type Event struct {
+	Event string `json:"event"`
+	// From is the peer id of the sender, empty for events of the service
+	From string `json:"from,omitempty"`
+	// To addresses a single peer, empty for everyone in the match
+	To   string          `json:"to,omitempty"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Exchange describes the match the user is in, it is sent whenever the
+// participants change.
+type Exchange struct {
+	// MatchID identifies the match, e.g. to give feedback once it is over
+	MatchID string `json:"match_id"`
+	// Username and Initiator describe the only peer of a 1:1 match
+	Username  string `json:"username"`
+	Initiator bool   `json:"initiator"`
+	PeerID    string `json:"peer_id"`
+	Peers     []Peer `json:"peers"`
+	// SFU is set when media is negotiated with the service instead of peers
+	SFU bool `json:"sfu,omitempty"`
+	// Mode of the only peer of a 1:1 match
+	Mode string `json:"mode,omitempty"`
+	// Bot is set when the only peer of a 1:1 match is a bot
+	Bot bool `json:"bot,omitempty"`
+	// Region of the only peer of a 1:1 match, e.g. EU-DE, empty when unknown
+	Region string `json:"region,omitempty"`
+}
+
+type Peer struct {
+	PeerID   string `json:"peer_id"`
+	Username string `json:"username"`
+	// Initiator is set when the user is to make the offer to this peer
+	Initiator bool `json:"initiator"`
+	// Mode is video, audio or text, no media is negotiated with text peers
+	Mode string `json:"mode"`
+	// Bot is set for bot participants, they only chat in text
+	Bot bool `json:"bot,omitempty"`
+	// Region is the continent and country of the peer, e.g. EU-DE
+	Region string `json:"region,omitempty"`
+}
+
+// QueueStatus tells where the user stands while waiting for a candidate.
+type QueueStatus struct {
+	// Ticket is the one returned by RequestMatch
+	Ticket string `json:"ticket"`
+	// Position is the user's place among the Waiting users
+	Position int `json:"position"`
+	Waiting  int `json:"waiting"`
+	// PoolSize counts the users that can be picked as candidates
+	PoolSize int `json:"pool_size"`
+	// EstimatedWait is in seconds, zero when no matches were made recently
+	EstimatedWait int `json:"estimated_wait_seconds,omitempty"`
+}
+
+// Reasons of a NoMatch.
+const (
+	NoMatchNoUsers      = "no_users"
+	NoMatchNoCompatible = "no_compatible_users"
+	NoMatchError        = "error"
+)
+
+// NoMatch ends a match request that found no candidate.
+type NoMatch struct {
+	Ticket string `json:"ticket"`
+	Reason string `json:"reason"`
+}
+
+// Throttled tells which action went over its rate limit and when it is
+// allowed again.
+type Throttled struct {
+	// Action is register, match, connect or message
+	Action     string `json:"action"`
+	RetryAfter int    `json:"retry_after_seconds"`
+}
+
+// SessionDescription mirrors RTCSessionDescriptionInit.
+type SessionDescription struct {
+	Type string `json:"type"`
+	SDP  string `json:"sdp"`
+}
+
+// RoomFull names the topic room the user could not join.
+type RoomFull struct {
+	Room string `json:"room"`
+}
+
+// ICECandidate mirrors RTCIceCandidateInit.
+type ICECandidate struct {
+	Candidate        string  `json:"candidate"`
+	SDPMid           *string `json:"sdpMid,omitempty"`
+	SDPMLineIndex    *uint16 `json:"sdpMLineIndex,omitempty"`
+	UsernameFragment *string `json:"usernameFragment,omitempty"`
+}
+
+func (e Event) Exchange() (*Exchange, error) {
+	var exchange Exchange
+	if err := json.Unmarshal(e.Data, &exchange); err != nil {
+		return nil, err
+	}
+
+	return &exchange, nil
+}
+
+func (e Event) Message() (string, error) {
+	var message string
+	err := json.Unmarshal(e.Data, &message)
+
+	return message, err
+}
+
+func (e Event) SessionDescription() (*SessionDescription, error) {
+	var description SessionDescription
+	if err := json.Unmarshal(e.Data, &description); err != nil {
+		return nil, err
+	}
+
+	return &description, nil
+}
+
+func (e Event) Candidate() (*ICECandidate, error) {
+	var candidate ICECandidate
+	if err := json.Unmarshal(e.Data, &candidate); err != nil {
+		return nil, err
+	}
+
+	return &candidate, nil
+}
+
+func (e Event) RoomFull() (*RoomFull, error) {
+	var roomFull RoomFull
+	if err := json.Unmarshal(e.Data, &roomFull); err != nil {
+		return nil, err
+	}
+
+	return &roomFull, nil
+}
+
+func (e Event) Registration() (*Registration, error) {
+	var registration Registration
+	if err := json.Unmarshal(e.Data, &registration); err != nil {
+		return nil, err
+	}
+
+	return &registration, nil
+}
+
+func (e Event) QueueStatus() (*QueueStatus, error) {
+	var status QueueStatus
+	if err := json.Unmarshal(e.Data, &status); err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+func (e Event) NoMatch() (*NoMatch, error) {
+	var noMatch NoMatch
+	if err := json.Unmarshal(e.Data, &noMatch); err != nil {
+		return nil, err
+	}
+
+	return &noMatch, nil
+}
+
+func (e Event) Throttled() (*Throttled, error) {
+	var throttled Throttled
+	if err := json.Unmarshal(e.Data, &throttled); err != nil {
+		return nil, err
+	}
+
+	return &throttled, nil
+}